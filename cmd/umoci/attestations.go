@@ -0,0 +1,103 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var attestationsCommand = cli.Command{
+	Name:  "attestations",
+	Usage: "lists or strips the attestation manifests of an image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to operate on (if not specified, defaults to "latest").
+
+Attestation manifests (such as the SBOM and provenance attestations generated
+by BuildKit) are image index entries with the "vnd.docker.reference.type"
+annotation set to "attestation-manifest". By default, the digest of each
+attestation manifest and the digest of the manifest it refers to are printed.
+
+If --strip is specified, the attestation manifests are removed from the image
+index. Their blobs are not removed until the layout is garbage-collected with
+umoci-gc(1).`,
+
+	// attestations modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "strip",
+			Usage: "remove the attestation manifests from the image",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: attestations,
+}
+
+func attestations(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	if !ctx.Bool("strip") {
+		descriptorPaths, err := engineExt.ListAttestations(context.Background(), tagName)
+		if err != nil {
+			return errors.Wrap(err, "list attestations")
+		}
+		for _, descriptorPath := range descriptorPaths {
+			descriptor := descriptorPath.Descriptor()
+			fmt.Printf("%s\t%s\n", descriptor.Digest, descriptor.Annotations[casext.AnnotationReferenceDigest])
+		}
+		return nil
+	}
+
+	removed, err := engineExt.StripAttestations(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "strip attestations")
+	}
+	for _, descriptor := range removed {
+		log.Infof("removed attestation manifest: %s", descriptor.Digest)
+	}
+	if len(removed) == 0 {
+		log.Infof("no attestation manifests found: %s", tagName)
+	}
+	return nil
+}
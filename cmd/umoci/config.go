@@ -18,15 +18,22 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/mutate"
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	igen "github.com/opencontainers/umoci/oci/config/generate"
+	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
@@ -34,7 +41,7 @@ import (
 
 // FIXME: We should also implement a raw mode that just does modifications of
 //        JSON blobs (allowing this all to be used outside of our build setup).
-var configCommand = uxHistory(uxTag(cli.Command{
+var configCommand = uxRemap(uxHistory(uxTag(cli.Command{
 	Name:  "config",
 	Usage: "modifies the image configuration of an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>]
@@ -59,6 +66,19 @@ image.`,
 		if _, ok := ctx.App.Metadata["--image-tag"]; !ok {
 			return errors.Errorf("missing mandatory argument: --image")
 		}
+		// The unpack options only affect the previewed runtime config.
+		if !ctx.Bool("runtime-preview") {
+			for _, flag := range []string{"rootless", "uid-map", "gid-map", "runtime-profile"} {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--%s can only be used with --runtime-preview", flag)
+				}
+			}
+		}
+		profile, ok := runtimeProfiles[ctx.String("runtime-profile")]
+		if !ok {
+			return errors.Errorf("invalid --runtime-profile: %s", ctx.String("runtime-profile"))
+		}
+		ctx.App.Metadata["--runtime-profile"] = profile
 		return nil
 	},
 
@@ -90,10 +110,35 @@ image.`,
 		cli.StringFlag{Name: "os"},
 		cli.StringSliceFlag{Name: "manifest.annotation"},
 		cli.StringSliceFlag{Name: "clear"},
+		cli.StringFlag{
+			Name:  "config-json",
+			Usage: "path to a (partial) JSON image config object to merge into the config",
+		},
+		cli.BoolFlag{
+			Name:  "runtime-preview",
+			Usage: "print the runtime config.json that umoci-unpack(1) would generate, rather than modifying the image",
+		},
+		cli.StringFlag{
+			Name:  "runtime-profile",
+			Usage: "with --runtime-preview, runtime the previewed config.json is tailored to (runc, crun, kata)",
+			Value: "runc",
+		},
+		cli.BoolFlag{
+			Name:  "print-labels",
+			Usage: "print the labels of the image configuration (one name=value pair per line), rather than modifying the image",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "with --print-labels, print the labels as a JSON object",
+		},
+		cli.BoolFlag{
+			Name:  "collapse-empty-history",
+			Usage: "collapse consecutive empty-layer history entries into a single entry",
+		},
 	},
 
 	Action: config,
-}))
+})))
 
 func toImage(config ispec.ImageConfig, meta mutate.Meta) ispec.Image {
 	created := meta.Created
@@ -119,6 +164,29 @@ func fromImage(image ispec.Image) (ispec.ImageConfig, mutate.Meta) {
 	}
 }
 
+// printLabels writes the given labels to w, either as a JSON object or as
+// name=value lines sorted by name.
+func printLabels(w io.Writer, labels map[string]string, asJSON bool) error {
+	if asJSON {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		return errors.Wrap(json.NewEncoder(w).Encode(labels), "encoding labels")
+	}
+
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s=%s\n", name, labels[name]); err != nil {
+			return errors.Wrap(err, "write labels")
+		}
+	}
+	return nil
+}
+
 // parseKV splits a given string (of the form name=value) into (name,
 // value). An error is returned if there is no "=" in the line or if the
 // name is empty.
@@ -216,6 +284,20 @@ func config(ctx *cli.Context) error {
 		}
 	}
 
+	// --config-json is applied before the individual --config.* flags, so that
+	// the flags can be used to override values from the document.
+	if ctx.IsSet("config-json") {
+		configJSON, err := os.Open(ctx.String("config-json"))
+		if err != nil {
+			return errors.Wrap(err, "open --config-json")
+		}
+		defer configJSON.Close()
+
+		if err := g.MergeConfigJSON(configJSON); err != nil {
+			return errors.Wrap(err, "invalid --config-json")
+		}
+	}
+
 	if ctx.IsSet("created") {
 		// How do we handle other formats?
 		created, err := time.Parse(igen.ISO8601, ctx.String("created"))
@@ -288,6 +370,23 @@ func config(ctx *cli.Context) error {
 		}
 	}
 
+	// With --runtime-preview we only show what the (possibly modified) image
+	// configuration would look like once unpacked (with the same mapping
+	// options and runtime profile as umoci-unpack(1)).
+	if ctx.Bool("runtime-preview") {
+		var meta umoci.Meta
+		if err := umoci.ParseIdmapOptions(&meta, ctx); err != nil {
+			return err
+		}
+		profile := ctx.App.Metadata["--runtime-profile"].(layer.RuntimeProfile)
+		return layer.PreviewRuntimeJSON(os.Stdout, g.Image(), &meta.MapOptions, profile)
+	}
+
+	// Similarly, --print-labels only shows the (possibly modified) labels.
+	if ctx.Bool("print-labels") {
+		return printLabels(os.Stdout, g.Image().Config.Labels, ctx.Bool("json"))
+	}
+
 	var history *ispec.History
 	if !ctx.Bool("no-history") {
 		created := time.Now()
@@ -321,18 +420,19 @@ func config(ctx *cli.Context) error {
 	if err := mutator.Set(context.Background(), newConfig, newMeta, annotations, history); err != nil {
 		return errors.Wrap(err, "set modified configuration")
 	}
+	if ctx.Bool("collapse-empty-history") {
+		if err := mutator.CollapseEmptyHistory(context.Background(), true); err != nil {
+			return errors.Wrap(err, "collapse empty history")
+		}
+	}
 
-	newDescriptorPath, err := mutator.Commit(context.Background())
+	newDescriptorPath, err := mutator.CommitReference(context.Background(), tagName)
 	if err != nil {
 		return errors.Wrap(err, "commit mutated image")
 	}
 
 	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
 
-	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
-		return errors.Wrap(err, "add new tag")
-	}
-
 	log.Infof("created new tag for image manifest: %s", tagName)
 	return nil
 }
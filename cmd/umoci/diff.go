@@ -0,0 +1,163 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var diffCommand = uxRemap(cli.Command{
+	Name:  "diff",
+	Usage: "displays the differences between two images",
+	ArgsUsage: `--image <image-path>[:<tag>] --image <image-path>[:<tag>]
+
+Where each "<image-path>" is the path to an OCI image, and "<tag>" is the name
+of the tagged image to compare. The first --image is the old image and the
+second is the new image. The two images may be in different layouts.
+
+By default only the layers of the two images are compared (by digest). If
+--files is specified, the root filesystems of both images are assembled in a
+temporary directory and the paths which were added, modified or deleted are
+listed as well.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// diff reads manifest information from two images, so it has no
+	// Category (which would add the usual single --image flag).
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "image",
+			Usage: "OCI image URI of the form 'path[:tag]' (must be given twice)",
+		},
+		cli.BoolFlag{
+			Name:  "files",
+			Usage: "also compare the root filesystems of the images",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the diff as a JSON encoded blob",
+		},
+	},
+
+	Action: diff,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		images := ctx.StringSlice("image")
+		if len(images) != 2 {
+			return errors.Errorf("invalid --image: must be specified exactly twice")
+		}
+		for idx, name := range []string{"old", "new"} {
+			path, tag, err := parseImage(images[idx])
+			if err != nil {
+				return errors.Wrap(err, "invalid --image")
+			}
+			tag, err = resolveImageTag(ctx, tag)
+			if err != nil {
+				return errors.Wrap(err, "invalid --image")
+			}
+			ctx.App.Metadata["--image-"+name+"-path"] = path
+			ctx.App.Metadata["--image-"+name+"-tag"] = tag
+		}
+		return nil
+	},
+})
+
+// resolveManifest resolves the given tag to a single manifest descriptor.
+func resolveManifest(engineExt casext.Engine, tagName string) (ispec.Descriptor, error) {
+	manifestDescriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(manifestDescriptorPaths) == 0 {
+		return ispec.Descriptor{}, errors.Errorf("tag not found: %s", tagName)
+	}
+	if len(manifestDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return ispec.Descriptor{}, errors.Errorf("tag is ambiguous: %s", tagName)
+	}
+	return manifestDescriptorPaths[0].Descriptor(), nil
+}
+
+func diff(ctx *cli.Context) error {
+	var meta umoci.Meta
+	meta.Version = umoci.MetaVersion
+
+	// Parse and set up the mapping options.
+	if err := umoci.ParseIdmapOptions(&meta, ctx); err != nil {
+		return err
+	}
+
+	var (
+		engines     []casext.Engine
+		descriptors []ispec.Descriptor
+	)
+	for _, name := range []string{"old", "new"} {
+		imagePath := ctx.App.Metadata["--image-"+name+"-path"].(string)
+		tagName := ctx.App.Metadata["--image-"+name+"-tag"].(string)
+
+		// Get a reference to the CAS.
+		engine, err := openImage(imagePath)
+		if err != nil {
+			return errors.Wrapf(err, "open %s CAS", name)
+		}
+		engineExt := casext.NewEngine(engine)
+		defer engine.Close()
+
+		descriptor, err := resolveManifest(engineExt, tagName)
+		if err != nil {
+			return errors.Wrapf(err, "%s image", name)
+		}
+		engines = append(engines, engineExt)
+		descriptors = append(descriptors, descriptor)
+	}
+
+	imageDiff, err := umoci.Diff(context.Background(), engines[0], descriptors[0], engines[1], descriptors[1], &umoci.DiffOptions{
+		Files:         ctx.Bool("files"),
+		UnpackOptions: layer.UnpackOptions{MapOptions: meta.MapOptions},
+	})
+	if err != nil {
+		return errors.Wrap(err, "diff")
+	}
+
+	// Output the diff.
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(imageDiff); err != nil {
+			return errors.Wrap(err, "encoding diff")
+		}
+	} else {
+		if err := imageDiff.Format(os.Stdout); err != nil {
+			return errors.Wrap(err, "format diff")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var fsckCommand = cli.Command{
+	Name:  "fsck",
+	Usage: "checks the integrity of every blob in an OCI image",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+This command will check every blob in the provided OCI image (not just those
+reachable from a particular tag). Blobs with invalid names or contents that do
+not match their digest, and descriptors which reference blobs that do not
+exist, are reported as errors. Blobs which are not reachable from any
+reference are reported as orphans (and can be removed with umoci-gc(1)).`,
+
+	// fsck reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "quick",
+			Usage: "only check that blobs exist, without verifying their contents",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		return nil
+	},
+
+	Action: fsck,
+}
+
+func fsck(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	report, err := engineExt.Fsck(context.Background(), casext.FsckOptions{
+		Quick: ctx.Bool("quick"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "fsck")
+	}
+
+	for _, blob := range report.Misnamed {
+		fmt.Printf("misnamed blob: %s\n", blob)
+	}
+	for _, blob := range report.Corrupt {
+		if blob.Actual != "" {
+			fmt.Printf("corrupt blob: %s (contents are %s)\n", blob.Digest, blob.Actual)
+		} else {
+			fmt.Printf("corrupt blob: %s\n", blob.Digest)
+		}
+	}
+	for _, ref := range report.Dangling {
+		parent := "index.json"
+		if ref.Parent != "" {
+			parent = ref.Parent.String()
+		}
+		fmt.Printf("missing blob: %s (referenced by %s)\n", ref.Descriptor.Digest, parent)
+	}
+	for _, blob := range report.Orphans {
+		fmt.Printf("orphaned blob: %s\n", blob)
+	}
+
+	if !report.Clean() {
+		return errors.Errorf("image failed integrity check")
+	}
+	return nil
+}
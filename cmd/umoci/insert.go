@@ -34,7 +34,7 @@ import (
 	"github.com/urfave/cli"
 )
 
-var insertCommand = uxRemap(uxHistory(uxTag(cli.Command{
+var insertCommand = uxExclude(uxLayerAnnotation(uxRemap(uxHistory(uxTag(cli.Command{
 	Name:  "insert",
 	Usage: "insert content into an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] [--opaque] <source> <target>
@@ -77,6 +77,10 @@ Some examples:
 			Name:  "opaque",
 			Usage: "mask any previous entries in the target directory",
 		},
+		cli.StringFlag{
+			Name:  "timestamp-reference",
+			Usage: "use the modification time of the given file as the timestamp of every entry in the new layer",
+		},
 	},
 
 	Before: func(ctx *cli.Context) error {
@@ -107,7 +111,7 @@ Some examples:
 		ctx.App.Metadata["--target-path"] = targetPath
 		return nil
 	},
-})))
+})))))
 
 func insert(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -156,7 +160,16 @@ func insert(ctx *cli.Context) error {
 		return err
 	}
 
-	packOptions := layer.RepackOptions{MapOptions: meta.MapOptions}
+	packOptions := layer.RepackOptions{
+		MapOptions:         meta.MapOptions,
+		TimestampReference: ctx.String("timestamp-reference"),
+	}
+	if val, ok := ctx.App.Metadata["--layer.annotation"]; ok {
+		packOptions.LayerAnnotations = val.(map[string]string)
+	}
+	if val, ok := ctx.App.Metadata["--exclude"]; ok {
+		packOptions.Excludes = val.([]string)
+	}
 	reader := layer.GenerateInsertLayer(sourcePath, targetPath, ctx.IsSet("opaque"), &packOptions)
 	defer reader.Close()
 
@@ -190,20 +203,16 @@ func insert(ctx *cli.Context) error {
 
 	// TODO: We should add a flag to allow for a new layer to be made
 	//       non-distributable.
-	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, reader, history, mutate.GzipCompressor); err != nil {
+	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, reader, history, mutate.GzipCompressorWithBudget(packOptions.MemoryBudgetBytes), packOptions.LayerAnnotations); err != nil {
 		return errors.Wrap(err, "add diff layer")
 	}
 
-	newDescriptorPath, err := mutator.Commit(context.Background())
+	newDescriptorPath, err := mutator.CommitReference(context.Background(), tagName)
 	if err != nil {
 		return errors.Wrap(err, "commit mutated image")
 	}
 
 	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
-
-	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
-		return errors.Wrap(err, "add new tag")
-	}
 	log.Infof("updated tag for image manifest: %s", tagName)
 	return nil
 }
@@ -24,6 +24,7 @@ import (
 	"github.com/apex/log"
 	logcli "github.com/apex/log/handlers/cli"
 	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -61,6 +62,15 @@ func Main(args []string) error {
 			Usage: "set the log level (debug, info, [warn], error, fatal)",
 			Value: "warn",
 		},
+		cli.StringFlag{
+			Name:  "default-tag",
+			Usage: "tag to use when --image doesn't specify one",
+			Value: casext.DefaultReferenceName,
+		},
+		cli.StringSliceFlag{
+			Name:  "alias",
+			Usage: "alias of the form <name>=<tag>, so that --image <path>:<name> refers to <tag> (can be specified multiple times)",
+		},
 		cli.StringFlag{
 			Name:   "cpu-profile",
 			Usage:  "profile umoci during execution and output it to a file",
@@ -108,14 +118,20 @@ func Main(args []string) error {
 		unpackCommand,
 		repackCommand,
 		gcCommand,
+		fsckCommand,
 		initCommand,
 		newCommand,
 		tagAddCommand,
 		tagRemoveCommand,
 		tagListCommand,
 		statCommand,
+		diffCommand,
+		attestationsCommand,
+		saveMetadataCommand,
+		mtreeCommand,
 		rawSubcommand,
 		insertCommand,
+		repairConfigCommand,
 	}
 
 	app.Metadata = map[string]interface{}{}
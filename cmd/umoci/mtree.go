@@ -0,0 +1,124 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var mtreeCommand = uxRemap(cli.Command{
+	Name:  "mtree",
+	Usage: "generates an mtree manifest of the root filesystem of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--out <file>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image (if not specified, defaults to "latest") and "<file>" is the path
+the manifest is written to (if not specified, it is written to stdout).
+
+The root filesystem of the image is assembled in a temporary directory, and a
+go-mtree manifest of it (containing the same keywords as the manifest stored in
+bundles by umoci-unpack(1)) is generated. The manifest can be used to later
+verify that a deployed root filesystem has not drifted from the image.
+
+If "<tag>" refers to a multi-platform image index, the root filesystem for the
+platform given by --platform (or the host platform if not specified) is used.`,
+
+	// mtree reads manifest information and layers.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "out",
+			Usage: "path to write the mtree manifest to (default: stdout)",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform (os/arch[/variant]) of the manifest to use from a multi-platform image",
+		},
+	},
+
+	Action: generateMtree,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.IsSet("out") && ctx.String("out") == "" {
+			return errors.Errorf("invalid --out: path is empty")
+		}
+		if ctx.IsSet("platform") {
+			platform, err := casext.ParsePlatform(ctx.String("platform"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+			ctx.App.Metadata["--platform"] = &platform
+		}
+		return nil
+	},
+})
+
+func generateMtree(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	var platform *ispec.Platform
+	if val, ok := ctx.App.Metadata["--platform"]; ok {
+		platform = val.(*ispec.Platform)
+	}
+
+	var meta umoci.Meta
+	meta.Version = umoci.MetaVersion
+
+	// Parse and set up the mapping options.
+	if err := umoci.ParseIdmapOptions(&meta, ctx); err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	var out io.Writer = os.Stdout
+	if path := ctx.String("out"); path != "" {
+		fh, err := os.Create(path)
+		if err != nil {
+			return errors.Wrap(err, "create mtree")
+		}
+		defer func() {
+			if err := fh.Close(); err != nil && Err == nil {
+				Err = errors.Wrap(err, "close mtree")
+			}
+		}()
+		out = fh
+	}
+
+	unpackOptions := layer.UnpackOptions{MapOptions: meta.MapOptions}
+	return umoci.GenerateImageManifest(engineExt, fromName, platform, out, unpackOptions)
+}
@@ -155,21 +155,17 @@ func rawAddLayer(ctx *cli.Context) error {
 
 	// TODO: We should add a flag to allow for a new layer to be made
 	//       non-distributable.
-	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, newLayer, history, mutate.GzipCompressor); err != nil {
+	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, newLayer, history, mutate.GzipCompressor, nil); err != nil {
 		return errors.Wrap(err, "add diff layer")
 	}
 
-	newDescriptorPath, err := mutator.Commit(context.Background())
+	newDescriptorPath, err := mutator.CommitReference(context.Background(), tagName)
 	if err != nil {
 		return errors.Wrap(err, "commit mutated image")
 	}
 
 	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
 
-	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
-		return errors.Wrap(err, "add new tag")
-	}
-
 	log.Infof("created new tag for image manifest: %s", tagName)
 	return nil
 }
@@ -0,0 +1,139 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var rawLayerCommand = cli.Command{
+	Name:  "layer",
+	Usage: "export a single layer blob of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] --index <index> [--out <file>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image (if not specified, defaults to "latest"), "<index>" is the index
+of the layer to export (starting at 0 for the base layer) and "<file>" is the
+path the layer is written to (if not specified, it is written to stdout).
+
+The layer blob is written as it is stored in the image (usually compressed),
+unless --decompress is given in which case the uncompressed tar archive is
+written instead.
+
+If "<tag>" refers to a multi-platform image index, the layer of the manifest
+for the platform given by --platform (or the host platform if not specified)
+is used.`,
+
+	// layer reads manifest information and layers.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "index",
+			Usage: "index of the layer to export (starting at 0 for the base layer)",
+			Value: -1,
+		},
+		cli.StringFlag{
+			Name:  "out",
+			Usage: "path to write the layer to (default: stdout)",
+		},
+		cli.BoolFlag{
+			Name:  "decompress",
+			Usage: "write the uncompressed tar archive rather than the blob as stored",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform (os/arch[/variant]) of the manifest to use from a multi-platform image",
+		},
+	},
+
+	Action: rawLayer,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("index") {
+			return errors.Errorf("missing mandatory argument: --index")
+		}
+		if ctx.Int("index") < 0 {
+			return errors.Errorf("invalid --index: must not be negative")
+		}
+		if ctx.IsSet("out") && ctx.String("out") == "" {
+			return errors.Errorf("invalid --out: path is empty")
+		}
+		if ctx.IsSet("platform") {
+			platform, err := casext.ParsePlatform(ctx.String("platform"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+			ctx.App.Metadata["--platform"] = &platform
+		}
+		return nil
+	},
+}
+
+func rawLayer(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	var platform *ispec.Platform
+	if val, ok := ctx.App.Metadata["--platform"]; ok {
+		platform = val.(*ispec.Platform)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	var out io.Writer = os.Stdout
+	if path := ctx.String("out"); path != "" {
+		fh, err := os.Create(path)
+		if err != nil {
+			return errors.Wrap(err, "create layer file")
+		}
+		defer func() {
+			if err := fh.Close(); err != nil && Err == nil {
+				Err = errors.Wrap(err, "close layer file")
+			}
+		}()
+		out = fh
+	}
+
+	desc, err := umoci.ExportLayer(engineExt, fromName, platform, ctx.Int("index"), ctx.Bool("decompress"), out)
+	if err != nil {
+		return errors.Wrap(err, "export layer")
+	}
+	log.WithFields(log.Fields{
+		"digest":    desc.Digest,
+		"mediatype": desc.MediaType,
+	}).Infof("exported layer %d", ctx.Int("index"))
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rawRemoveLayerCommand = uxTag(cli.Command{
+	Name:  "remove-layer",
+	Usage: "remove a layer from an image",
+	ArgsUsage: `--image <image-path>[:<tag>] <index>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to modify (if not specified, defaults to "latest") and "<index>"
+is the index of the layer to remove (starting at 0 for the base layer).
+
+The DiffID and history entry of the layer are removed from the image
+configuration. Unless --force is given, the layer is only removed if no later
+layer depends on it (by whiting out, overwriting or hardlinking to its
+contents) and the layer does not contain any whiteouts itself.`,
+
+	// remove-layer modifies an image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "remove the layer even if later layers depend on it",
+		},
+	},
+
+	Action: rawRemoveLayer,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <index>")
+		}
+		index, err := strconv.Atoi(ctx.Args().First())
+		if err != nil || index < 0 {
+			return errors.Errorf("invalid layer index: %q", ctx.Args().First())
+		}
+		ctx.App.Metadata["index"] = index
+		return nil
+	},
+})
+
+func rawRemoveLayer(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	index := ctx.App.Metadata["index"].(int)
+
+	// Overide the from tag by default, otherwise use the one specified.
+	tagName := fromName
+	if overrideTagName, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = overrideTagName.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+	if err := mutator.RemoveLayer(context.Background(), index, ctx.Bool("force")); err != nil {
+		return errors.Wrap(err, "remove layer")
+	}
+
+	newDescriptorPath, err := mutator.CommitReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
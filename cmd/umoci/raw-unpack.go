@@ -21,9 +21,9 @@ import (
 	"fmt"
 
 	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/pkg/errors"
@@ -38,7 +38,18 @@ var rawUnpackCommand = uxRemap(cli.Command{
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
 tagged image to unpack (if not specified, defaults to "latest") and "<rootfs>"
-is the destination to unpack the image to.`,
+is the destination to unpack the image to.
+
+If --diff-id is specified, only the layers with the given DiffIDs are
+extracted, so "<rootfs>" only contains the changes made by those layers rather
+than the full root filesystem of the image.
+
+If --whiteout-markers is specified, whiteouts do not remove anything from
+"<rootfs>". Instead, a "<name>.umoci-whiteout" marker file is written next to
+each whited-out path (or a ".umoci-whiteout" file inside directories which
+were made opaque), so that it is possible to see what each layer intended to
+delete. The resulting "<rootfs>" is not the root filesystem of the image, and
+should only be used for inspection.`,
 
 	// unpack reads manifest information.
 	Category: "image",
@@ -48,6 +59,14 @@ is the destination to unpack the image to.`,
 			Name:  "keep-dirlinks",
 			Usage: "don't clobber underlying symlinks to directories",
 		},
+		cli.StringSliceFlag{
+			Name:  "diff-id",
+			Usage: "only extract the layer with the given DiffID (can be specified multiple times)",
+		},
+		cli.BoolFlag{
+			Name:  "whiteout-markers",
+			Usage: "write marker files for whiteouts instead of removing paths (for inspection only)",
+		},
 	},
 
 	Action: rawUnpack,
@@ -60,6 +79,15 @@ is the destination to unpack the image to.`,
 			return errors.Errorf("rootfs path cannot be empty")
 		}
 		ctx.App.Metadata["rootfs"] = ctx.Args().First()
+		var diffIDs []digest.Digest
+		for _, value := range ctx.StringSlice("diff-id") {
+			diffID, err := digest.Parse(value)
+			if err != nil {
+				return errors.Wrap(err, "invalid --diff-id")
+			}
+			diffIDs = append(diffIDs, diffID)
+		}
+		ctx.App.Metadata["--diff-id"] = diffIDs
 		return nil
 	},
 })
@@ -81,10 +109,14 @@ func rawUnpack(ctx *cli.Context) error {
 	}
 
 	unpackOptions.KeepDirlinks = ctx.Bool("keep-dirlinks")
+	if ctx.Bool("whiteout-markers") {
+		unpackOptions.WhiteoutMode = layer.MarkerWhiteout
+	}
 	unpackOptions.MapOptions = meta.MapOptions
+	unpackOptions.OnlyDiffIDs = ctx.App.Metadata["--diff-id"].([]digest.Digest)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImage(imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
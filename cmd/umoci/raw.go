@@ -35,6 +35,8 @@ should be sufficient for most use-cases.`,
 	Subcommands: []cli.Command{
 		rawAddLayerCommand,
 		rawConfigCommand,
+		rawLayerCommand,
+		rawRemoveLayerCommand,
 		rawUnpackCommand,
 	},
 }
@@ -19,6 +19,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"time"
 
 	"github.com/apex/log"
@@ -28,13 +29,14 @@ import (
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	igen "github.com/opencontainers/umoci/oci/config/generate"
+	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/opencontainers/umoci/pkg/mtreefilter"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
 )
 
-var repackCommand = uxHistory(cli.Command{
+var repackCommand = uxExclude(uxLayerAnnotation(uxHistory(cli.Command{
 	Name:  "repack",
 	Usage: "repacks an OCI runtime bundle into a reference",
 	ArgsUsage: `--image <image-path>[:<new-tag>] <bundle>
@@ -74,6 +76,49 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			Name:  "refresh-bundle",
 			Usage: "update the bundle metadata to reflect the packed rootfs",
 		},
+		cli.BoolFlag{
+			Name:  "metadata-only",
+			Usage: "only allow metadata changes (such as modes and ownership) in the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "fail-on-no-change",
+			Usage: "fail (without modifying the image) if the bundle has no changes",
+		},
+		cli.StringFlag{
+			Name:  "base-image-name",
+			Usage: "record the unpacked image as the base image of the new image, with the given name",
+		},
+		cli.StringFlag{
+			Name:  "timestamp-reference",
+			Usage: "use the modification time of the given file as the timestamp of every entry in the new layer",
+		},
+		cli.StringFlag{
+			Name:  "compression",
+			Usage: "compression used for the new layer (gzip, zstd or none)",
+			Value: "gzip",
+		},
+		cli.StringFlag{
+			Name:  "zstd-dictionary",
+			Usage: "compress the new layer with zstd using the dictionary in the given file",
+		},
+		cli.StringFlag{
+			Name:  "entry-order",
+			Usage: "order of the entries in the new layer (lexical or extension)",
+			Value: "lexical",
+		},
+		cli.Int64Flag{
+			Name:  "chunk-size",
+			Usage: "split the new layer into blobs of at most this many bytes (0 disables chunking)",
+		},
+		cli.StringFlag{
+			Name:  "change-detection",
+			Usage: "which changes to a file cause it to be included in the new layer (digest, metadata or content)",
+			Value: "digest",
+		},
+		cli.IntFlag{
+			Name:  "max-layers",
+			Usage: "squash the oldest layers if the image would have more than this many layers (0 disables the limit)",
+		},
 	},
 
 	Action: repack,
@@ -86,9 +131,37 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			return errors.Errorf("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		switch compression := ctx.String("compression"); compression {
+		case "gzip":
+			ctx.App.Metadata["--compression"] = layer.GzipCompression
+		case "zstd":
+			ctx.App.Metadata["--compression"] = layer.ZstdCompression
+		case "none":
+			ctx.App.Metadata["--compression"] = layer.NoCompression
+		default:
+			return errors.Errorf("unknown --compression: %s", compression)
+		}
+		switch order := ctx.String("entry-order"); order {
+		case "lexical":
+			ctx.App.Metadata["--entry-order"] = layer.LexicalOrdering
+		case "extension":
+			ctx.App.Metadata["--entry-order"] = layer.ExtensionOrdering
+		default:
+			return errors.Errorf("unknown --entry-order: %s", order)
+		}
+		switch mode := ctx.String("change-detection"); mode {
+		case "digest":
+			ctx.App.Metadata["--change-detection"] = layer.DigestChangeDetection
+		case "metadata":
+			ctx.App.Metadata["--change-detection"] = layer.MetadataChangeDetection
+		case "content":
+			ctx.App.Metadata["--change-detection"] = layer.ContentChangeDetection
+		default:
+			return errors.Errorf("unknown --change-detection: %s", mode)
+		}
 		return nil
 	},
-})
+})))
 
 func repack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -176,5 +249,37 @@ func repack(ctx *cli.Context) error {
 		mtreefilter.MaskFilter(maskedPaths),
 	}
 
-	return umoci.Repack(engineExt, tagName, bundlePath, meta, history, filters, ctx.Bool("refresh-bundle"), mutator)
+	var packOptions layer.RepackOptions
+	if val, ok := ctx.App.Metadata["--layer.annotation"]; ok {
+		packOptions.LayerAnnotations = val.(map[string]string)
+	}
+	if val, ok := ctx.App.Metadata["--exclude"]; ok {
+		packOptions.Excludes = val.([]string)
+	}
+	packOptions.MetadataOnly = ctx.Bool("metadata-only")
+	packOptions.FailOnNoChange = ctx.Bool("fail-on-no-change")
+	packOptions.BaseImageName = ctx.String("base-image-name")
+	packOptions.TimestampReference = ctx.String("timestamp-reference")
+	packOptions.Compression = ctx.App.Metadata["--compression"].(layer.Compression)
+	packOptions.CompressionOrdering = ctx.App.Metadata["--entry-order"].(layer.EntryOrdering)
+	packOptions.ChangeDetection = ctx.App.Metadata["--change-detection"].(layer.ChangeDetection)
+	if dictPath := ctx.String("zstd-dictionary"); dictPath != "" {
+		dict, err := ioutil.ReadFile(dictPath)
+		if err != nil {
+			return errors.Wrap(err, "read zstd dictionary")
+		}
+		packOptions.ZstdDictionary = dict
+	}
+	if chunkSize := ctx.Int64("chunk-size"); chunkSize < 0 {
+		return errors.Errorf("--chunk-size must not be negative: %d", chunkSize)
+	} else {
+		packOptions.FixedChunkBytes = chunkSize
+	}
+	if maxLayers := ctx.Int("max-layers"); maxLayers < 0 {
+		return errors.Errorf("--max-layers must not be negative: %d", maxLayers)
+	} else {
+		packOptions.MaxLayers = maxLayers
+	}
+
+	return umoci.Repack(engineExt, tagName, bundlePath, meta, history, filters, ctx.Bool("refresh-bundle"), mutator, &packOptions)
 }
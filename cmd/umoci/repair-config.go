@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var repairConfigCommand = uxTag(cli.Command{
+	Name:  "repair-config",
+	Usage: "recompute the diff_ids of an image configuration from its layers",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to repair (if not specified, defaults to "latest").
+
+Every layer of the image is decompressed to compute its DiffID, and the
+rootfs.diff_ids of the image configuration are replaced with the computed
+values. A warning is printed if the image history does not match the layers.
+
+With --history, the diff_ids are left alone and instead the empty_layer flags
+of the image history are corrected so that the non-empty history entries
+match the layers of the image.`,
+
+	// repair-config modifies an image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "history",
+			Usage: "correct the empty_layer flags of the history instead of the diff_ids",
+		},
+	},
+
+	Action: repairConfig,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+})
+
+func repairConfig(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Overide the from tag by default, otherwise use the one specified.
+	tagName := fromName
+	if overrideTagName, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = overrideTagName.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+	if ctx.Bool("history") {
+		changed, err := mutator.RepairEmptyLayers(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "repair history")
+		}
+		if changed == 0 && tagName == fromName {
+			log.Infof("image history is already correct")
+			return nil
+		}
+	} else {
+		changed, err := mutator.RepairDiffIDs(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "repair diffids")
+		}
+		if changed == 0 && tagName == fromName {
+			log.Infof("image diffids are already correct")
+			return nil
+		}
+	}
+
+	newDescriptorPath, err := mutator.CommitReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
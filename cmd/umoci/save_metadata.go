@@ -0,0 +1,97 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var saveMetadataCommand = cli.Command{
+	Name:  "save-metadata",
+	Usage: "saves the manifest and configuration of an image to a directory",
+	ArgsUsage: `--image <image-path>[:<tag>] --out-dir <directory>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image (if not specified, defaults to "latest") and "<directory>" is the
+directory the metadata is written to.
+
+The manifest and image configuration are written (byte-for-byte, so that their
+digests match the image) to "manifest.json" and "config.json", and an image
+index containing only the index entry of "<tag>" is written to "index.json".
+No layers are extracted.
+
+If "<tag>" refers to a multi-platform image index, the metadata for the
+platform given by --platform (or the host platform if not specified) is saved.`,
+
+	// save-metadata reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "out-dir",
+			Usage: "directory to write the metadata to",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform (os/arch[/variant]) of the manifest to save from a multi-platform image",
+		},
+	},
+
+	Action: saveMetadata,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("out-dir") == "" {
+			return errors.Errorf("missing mandatory argument: --out-dir")
+		}
+		if ctx.IsSet("platform") {
+			platform, err := casext.ParsePlatform(ctx.String("platform"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+			ctx.App.Metadata["--platform"] = &platform
+		}
+		return nil
+	},
+}
+
+func saveMetadata(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	var platform *ispec.Platform
+	if val, ok := ctx.App.Metadata["--platform"]; ok {
+		platform = val.(*ispec.Platform)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	return umoci.SaveMetadata(engineExt, fromName, platform, ctx.String("out-dir"))
+}
@@ -24,7 +24,6 @@ import (
 
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -68,7 +67,7 @@ func stat(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImage(imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
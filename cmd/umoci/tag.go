@@ -18,7 +18,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 
 	"github.com/apex/log"
 	"github.com/opencontainers/umoci/oci/cas/dir"
@@ -39,6 +41,13 @@ the tag and "<new-tag>" is the new name of the tag.`,
 	// tag modifies an image layout.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "annotation to add to the index entry of the new tag (name=value)",
+		},
+	},
+
 	Action: tagAdd,
 
 	Before: func(ctx *cli.Context) error {
@@ -52,6 +61,17 @@ the tag and "<new-tag>" is the new name of the tag.`,
 			return errors.Errorf("new tag is an invalid reference")
 		}
 		ctx.App.Metadata["new-tag"] = ctx.Args().First()
+		if ctx.IsSet("annotation") {
+			annotations := map[string]string{}
+			for _, annotation := range ctx.StringSlice("annotation") {
+				name, value, err := parseKV(annotation)
+				if err != nil {
+					return errors.Wrap(err, "invalid --annotation")
+				}
+				annotations[name] = value
+			}
+			ctx.App.Metadata["--annotation"] = annotations
+		}
 		return nil
 	},
 }
@@ -83,8 +103,13 @@ func tagAdd(ctx *cli.Context) error {
 	}
 	descriptor := descriptorPaths[0].Descriptor()
 
+	var annotations map[string]string
+	if val, ok := ctx.App.Metadata["--annotation"]; ok {
+		annotations = val.(map[string]string)
+	}
+
 	// Add it.
-	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+	if err := engineExt.UpdateReferenceWithAnnotations(context.Background(), tagName, descriptor, annotations); err != nil {
 		return errors.Wrap(err, "put reference")
 	}
 
@@ -145,7 +170,11 @@ var tagListCommand = cli.Command{
 Where "<image-path>" is the path to the OCI layout.
 
 Gives the full list of tags in an OCI layout, with each tag name on a single
-line. See umoci-stat(1) to get more information about each tagged image.`,
+line. See umoci-stat(1) to get more information about each tagged image.
+
+If --json is specified, the list of tags is output as a JSON array, with each
+entry also including the descriptor of the tag and the descriptors (including
+the platform) of the manifests it resolves to.`,
 
 	// tag modifies an image layout.
 	Category: "layout",
@@ -157,6 +186,13 @@ line. See umoci-stat(1) to get more information about each tagged image.`,
 		return nil
 	},
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the tags and their resolved descriptors as a JSON encoded blob",
+		},
+	},
+
 	Action: tagList,
 }
 
@@ -171,6 +207,20 @@ func tagList(ctx *cli.Context) error {
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
+	if ctx.Bool("json") {
+		refs, err := engineExt.ListResolvedReferences(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "list references")
+		}
+		if refs == nil {
+			refs = []casext.ResolvedReference{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(refs); err != nil {
+			return errors.Wrap(err, "encoding references")
+		}
+		return nil
+	}
+
 	names, err := engineExt.ListReferences(context.Background())
 	if err != nil {
 		return errors.Wrap(err, "list references")
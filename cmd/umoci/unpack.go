@@ -18,8 +18,13 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/pkg/errors"
@@ -35,6 +40,10 @@ Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
 tagged image to unpack (if not specified, defaults to "latest") and "<bundle>"
 is the destination to unpack the image to.
 
+If "<tag>" refers to a multi-platform image index, the manifest for the
+platform given by --platform (or the host platform if not specified) is
+unpacked.
+
 It should be noted that this is not the same as oci-create-runtime-bundle,
 because this command also will create an mtree specification to allow for layer
 creation with umoci-repack(1).`,
@@ -47,6 +56,66 @@ creation with umoci-repack(1).`,
 			Name:  "keep-dirlinks",
 			Usage: "don't clobber underlying symlinks to directories",
 		},
+		cli.BoolFlag{
+			Name:  "dir-times-last",
+			Usage: "restore directory timestamps after all of their contents have been extracted",
+		},
+		cli.StringFlag{
+			Name:  "implicit-dir-mode",
+			Usage: "octal mode of parent directories which are created without an entry in the layer",
+		},
+		cli.StringFlag{
+			Name:  "rootless-no-devices",
+			Usage: "how to handle device nodes which cannot be created in rootless mode (skip, empty, error)",
+			Value: "skip",
+		},
+		cli.StringFlag{
+			Name:  "fifos",
+			Usage: "how to handle fifos in the image (create, record)",
+			Value: "create",
+		},
+		cli.StringFlag{
+			Name:  "sockets",
+			Usage: "how to handle sockets in the image (skip, record)",
+			Value: "skip",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform (os/arch[/variant]) of the manifest to unpack from a multi-platform image",
+		},
+		cli.StringFlag{
+			Name:  "layer-cache",
+			Usage: "directory of a layer cache to share extracted layers between unpacks",
+		},
+		cli.StringFlag{
+			Name:  "ownership-report",
+			Usage: "write a JSON report of the intended and actual owner of every extracted path to the given file",
+		},
+		cli.StringSliceFlag{
+			Name:  "zstd-dictionary",
+			Usage: "zstd dictionary file used to decompress layers compressed with a dictionary (can be specified multiple times)",
+		},
+		cli.BoolFlag{
+			Name:  "check-history",
+			Usage: "fail if the image's non-empty history entries don't match its layers",
+		},
+		cli.BoolFlag{
+			Name:  "no-runtime-config",
+			Usage: "only extract the rootfs, without generating config.json or umoci bundle metadata",
+		},
+		cli.BoolFlag{
+			Name:  "network-placeholders",
+			Usage: "create empty /etc/resolv.conf and /etc/hosts files in the rootfs if they don't exist",
+		},
+		cli.StringFlag{
+			Name:  "runtime-profile",
+			Usage: "runtime the generated config.json is tailored to (runc, crun, kata)",
+			Value: "runc",
+		},
+		cli.BoolFlag{
+			Name:  "check-space",
+			Usage: "fail before extracting if the bundle's filesystem is too small for the image's layers",
+		},
 	},
 
 	Action: unpack,
@@ -59,10 +128,73 @@ creation with umoci-repack(1).`,
 			return errors.Errorf("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		if ctx.IsSet("platform") {
+			platform, err := casext.ParsePlatform(ctx.String("platform"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+			ctx.App.Metadata["--platform"] = &platform
+		}
+		if ctx.IsSet("implicit-dir-mode") {
+			mode, err := strconv.ParseUint(ctx.String("implicit-dir-mode"), 8, 32)
+			if err != nil || mode == 0 || os.FileMode(mode)&^os.ModePerm != 0 {
+				return errors.Errorf("invalid --implicit-dir-mode: %s", ctx.String("implicit-dir-mode"))
+			}
+			ctx.App.Metadata["--implicit-dir-mode"] = os.FileMode(mode)
+		}
+		mode, ok := rootlessDeviceModes[ctx.String("rootless-no-devices")]
+		if !ok {
+			return errors.Errorf("invalid --rootless-no-devices: %s", ctx.String("rootless-no-devices"))
+		}
+		ctx.App.Metadata["--rootless-no-devices"] = mode
+		fifoMode, ok := fifoModes[ctx.String("fifos")]
+		if !ok {
+			return errors.Errorf("invalid --fifos: %s", ctx.String("fifos"))
+		}
+		ctx.App.Metadata["--fifos"] = fifoMode
+		socketMode, ok := socketModes[ctx.String("sockets")]
+		if !ok {
+			return errors.Errorf("invalid --sockets: %s", ctx.String("sockets"))
+		}
+		ctx.App.Metadata["--sockets"] = socketMode
+		profile, ok := runtimeProfiles[ctx.String("runtime-profile")]
+		if !ok {
+			return errors.Errorf("invalid --runtime-profile: %s", ctx.String("runtime-profile"))
+		}
+		ctx.App.Metadata["--runtime-profile"] = profile
 		return nil
 	},
 })
 
+// rootlessDeviceModes maps the values of --rootless-no-devices to the
+// corresponding layer.RootlessDeviceMode.
+var rootlessDeviceModes = map[string]layer.RootlessDeviceMode{
+	"skip":  layer.SkipRootlessDevices,
+	"empty": layer.EmptyFileRootlessDevices,
+	"error": layer.RejectRootlessDevices,
+}
+
+// fifoModes maps the values of --fifos to the corresponding layer.FifoMode.
+var fifoModes = map[string]layer.FifoMode{
+	"create": layer.CreateFifos,
+	"record": layer.RecordFifos,
+}
+
+// socketModes maps the values of --sockets to the corresponding
+// layer.SocketMode.
+var socketModes = map[string]layer.SocketMode{
+	"skip":   layer.SkipSockets,
+	"record": layer.RecordSockets,
+}
+
+// runtimeProfiles maps the values of --runtime-profile to the corresponding
+// layer.RuntimeProfile.
+var runtimeProfiles = map[string]layer.RuntimeProfile{
+	"runc": layer.RuncRuntimeProfile,
+	"crun": layer.CrunRuntimeProfile,
+	"kata": layer.KataRuntimeProfile,
+}
+
 func unpack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	fromName := ctx.App.Metadata["--image-tag"].(string)
@@ -78,15 +210,65 @@ func unpack(ctx *cli.Context) error {
 		return err
 	}
 
+	var platform *ispec.Platform
+	if val, ok := ctx.App.Metadata["--platform"]; ok {
+		platform = val.(*ispec.Platform)
+	}
+
 	unpackOptions.KeepDirlinks = ctx.Bool("keep-dirlinks")
+	unpackOptions.DirectoryTimesLast = ctx.Bool("dir-times-last")
+	unpackOptions.CheckFreeSpace = ctx.Bool("check-space")
+	unpackOptions.CheckHistory = ctx.Bool("check-history")
+	unpackOptions.NoRuntimeConfig = ctx.Bool("no-runtime-config")
+	unpackOptions.NetworkPlaceholders = ctx.Bool("network-placeholders")
+	if val, ok := ctx.App.Metadata["--implicit-dir-mode"]; ok {
+		unpackOptions.ImplicitDirectoryMode = val.(os.FileMode)
+	}
+	unpackOptions.RootlessDeviceMode = ctx.App.Metadata["--rootless-no-devices"].(layer.RootlessDeviceMode)
+	unpackOptions.FifoMode = ctx.App.Metadata["--fifos"].(layer.FifoMode)
+	unpackOptions.SocketMode = ctx.App.Metadata["--sockets"].(layer.SocketMode)
+	unpackOptions.RuntimeProfile = ctx.App.Metadata["--runtime-profile"].(layer.RuntimeProfile)
 	unpackOptions.MapOptions = meta.MapOptions
+	if cacheDir := ctx.String("layer-cache"); cacheDir != "" {
+		cache, err := layer.NewLayerCache(cacheDir)
+		if err != nil {
+			return errors.Wrap(err, "open layer cache")
+		}
+		unpackOptions.LayerCache = cache
+	}
+	for _, dictPath := range ctx.StringSlice("zstd-dictionary") {
+		dict, err := ioutil.ReadFile(dictPath)
+		if err != nil {
+			return errors.Wrap(err, "read zstd dictionary")
+		}
+		unpackOptions.ZstdDictionaries = append(unpackOptions.ZstdDictionaries, dict)
+	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImage(imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
-	return umoci.Unpack(engineExt, fromName, bundlePath, unpackOptions)
+
+	reportPath := ctx.String("ownership-report")
+	if reportPath != "" {
+		unpackOptions.OwnershipReport = new(layer.OwnershipReport)
+	}
+	if err := umoci.UnpackPlatform(engineExt, fromName, platform, bundlePath, unpackOptions); err != nil {
+		return err
+	}
+	if reportPath != "" {
+		fh, err := os.Create(reportPath)
+		if err != nil {
+			return errors.Wrap(err, "create ownership report")
+		}
+		defer fh.Close()
+		if err := json.NewEncoder(fh).Encode(unpackOptions.OwnershipReport.Entries()); err != nil {
+			return errors.Wrap(err, "write ownership report")
+		}
+		return fh.Close()
+	}
+	return nil
 }
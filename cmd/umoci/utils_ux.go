@@ -19,9 +19,16 @@ package main
 
 import (
 	"fmt"
+	"net/url"
+	"os"
 	"strings"
 
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/cas/httpdir"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/pkg/mtreefilter"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -121,6 +128,99 @@ func uxTag(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// parseImage parses and verifies an image URI of the form "path[:tag]",
+// returning the path and tag (which is empty if not specified, see
+// resolveImageTag). The path may also be an HTTP(S) URL, in which case only
+// the last component of the URL path can have a tag (or digest) suffix, so
+// that the port or credentials of the URL are never mistaken for one.
+//
+// An image URI of the form "path@digest" refers to the manifest (or index)
+// with the given digest, in which case the returned tag is a digest reference
+// (see casext.DigestReference).
+func parseImage(image string) (string, string, error) {
+	dir, suffix := image, ""
+	if httpdir.IsURL(image) {
+		u, err := url.Parse(image)
+		if err != nil {
+			return "", "", errors.Wrap(err, "invalid image URL")
+		}
+		name := u.Path[strings.LastIndex(u.Path, "/")+1:]
+		if sep := strings.IndexAny(name, "@:"); sep != -1 {
+			suffix = name[sep:]
+			u.Path, u.RawPath = strings.TrimSuffix(u.Path, suffix), ""
+			dir = u.String()
+		}
+	} else if at := strings.LastIndex(image, "@"); at != -1 && at > strings.LastIndex(image, "/") {
+		dir, suffix = image[:at], image[at:]
+	} else if sep := strings.Index(image, ":"); sep != -1 {
+		dir, suffix = image[:sep], image[sep:]
+	}
+
+	// Verify directory value.
+	if dir == "" {
+		return "", "", fmt.Errorf("path is empty")
+	}
+	switch {
+	case suffix == "":
+		return dir, "", nil
+	case suffix[0] == '@':
+		blobDigest, err := digest.Parse(suffix[1:])
+		if err != nil {
+			return "", "", errors.Wrap(err, "invalid digest")
+		}
+		return dir, casext.DigestReference(blobDigest), nil
+	}
+
+	// Verify tag value.
+	tag := suffix[1:]
+	if !casext.IsValidReferenceName(tag) {
+		return "", "", fmt.Errorf("tag contains invalid characters: '%s'", tag)
+	}
+	if tag == "" {
+		return "", "", fmt.Errorf("tag is empty")
+	}
+	return dir, tag, nil
+}
+
+// imageNameResolver returns the casext.NameResolver configured by the global
+// --default-tag and --alias flags.
+func imageNameResolver(ctx *cli.Context) (casext.NameResolver, error) {
+	aliases := map[string]string{}
+	for _, alias := range ctx.GlobalStringSlice("alias") {
+		parts := strings.SplitN(alias, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid --alias %q: must be of the form <name>=<tag>", alias)
+		}
+		aliases[parts[0]] = parts[1]
+	}
+	defaultTag := casext.DefaultReferenceName
+	if ctx.GlobalIsSet("default-tag") {
+		defaultTag = ctx.GlobalString("default-tag")
+	}
+	return casext.AliasNameResolver(aliases, casext.DefaultNameResolver(defaultTag)), nil
+}
+
+// resolveImageTag resolves the tag returned by parseImage (which is empty if
+// the image URI didn't specify a tag) using the global --default-tag and
+// --alias flags.
+func resolveImageTag(ctx *cli.Context, tag string) (string, error) {
+	resolver, err := imageNameResolver(ctx)
+	if err != nil {
+		return "", err
+	}
+	return casext.ResolveName(resolver, tag)
+}
+
+// openImage opens the image at the given path, which is either a local image
+// layout or the HTTP(S) URL of a (read-only) image layout served by a web
+// server.
+func openImage(path string) (cas.Engine, error) {
+	if httpdir.IsURL(path) {
+		return httpdir.Open(path)
+	}
+	return dir.Open(path)
+}
+
 // uxImage adds an --image flag to the given cli.Command as well as adding
 // relevant validation logic to the .Before of the command. The values (image,
 // tag) will be stored in ctx.Metadata["--image-path"] and
@@ -129,36 +229,20 @@ func uxTag(cmd cli.Command) cli.Command {
 func uxImage(cmd cli.Command) cli.Command {
 	cmd.Flags = append(cmd.Flags, cli.StringFlag{
 		Name:  "image",
-		Usage: "OCI image URI of the form 'path[:tag]'",
+		Usage: "OCI image URI of the form 'path[:tag]' or 'path@digest'",
 	})
 
 	oldBefore := cmd.Before
 	cmd.Before = func(ctx *cli.Context) error {
 		// Verify and parse --image.
 		if ctx.IsSet("image") {
-			image := ctx.String("image")
-
-			var dir, tag string
-			sep := strings.Index(image, ":")
-			if sep == -1 {
-				dir = image
-				tag = "latest"
-			} else {
-				dir = image[:sep]
-				tag = image[sep+1:]
+			dir, tag, err := parseImage(ctx.String("image"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --image")
 			}
-
-			// Verify directory value.
-			if dir == "" {
-				return errors.Wrap(fmt.Errorf("path is empty"), "invalid --image")
-			}
-
-			// Verify tag value.
-			if !casext.IsValidReferenceName(tag) {
-				return errors.Wrap(fmt.Errorf("tag contains invalid characters: '%s'", tag), "invalid --image")
-			}
-			if tag == "" {
-				return errors.Wrap(fmt.Errorf("tag is empty"), "invalid --image")
+			tag, err = resolveImageTag(ctx, tag)
+			if err != nil {
+				return errors.Wrap(err, "invalid --image")
 			}
 
 			ctx.App.Metadata["--image-path"] = dir
@@ -209,6 +293,92 @@ func uxLayout(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// uxLayerAnnotation adds a --layer.annotation flag to the given cli.Command as
+// well as adding relevant validation logic to the .Before of the command. The
+// parsed annotations will be stored in ctx.App.Metadata["--layer.annotation"]
+// as a map[string]string (or nil if --layer.annotation was not specified).
+func uxLayerAnnotation(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringSliceFlag{
+		Name:  "layer.annotation",
+		Usage: "annotation to add to the new layer's descriptor (name=value)",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.IsSet("layer.annotation") {
+			annotations := map[string]string{}
+			for _, annotation := range ctx.StringSlice("layer.annotation") {
+				name, value, err := parseKV(annotation)
+				if err != nil {
+					return errors.Wrap(err, "invalid --layer.annotation")
+				}
+				annotations[name] = value
+			}
+			ctx.App.Metadata["--layer.annotation"] = annotations
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxExclude adds --exclude and --exclude-file flags to the given cli.Command
+// as well as adding relevant validation logic to the .Before of the command.
+// The combined list of patterns (with those from --exclude-file first) will be
+// stored in ctx.App.Metadata["--exclude"] as a []string (or nil if neither
+// flag was specified).
+func uxExclude(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: ".dockerignore-style pattern of paths to omit from the new layer",
+		},
+		cli.StringFlag{
+			Name:  "exclude-file",
+			Usage: "path to a .dockerignore-style file of paths to omit from the new layer",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		var patterns []string
+		if ctx.IsSet("exclude-file") {
+			fh, err := os.Open(ctx.String("exclude-file"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --exclude-file")
+			}
+			defer fh.Close()
+
+			filePatterns, err := mtreefilter.ParseExcludeFile(fh)
+			if err != nil {
+				return errors.Wrap(err, "invalid --exclude-file")
+			}
+			patterns = append(patterns, filePatterns...)
+		}
+		patterns = append(patterns, ctx.StringSlice("exclude")...)
+		if len(patterns) > 0 {
+			// Catch invalid patterns before doing any work.
+			if _, err := mtreefilter.ExcludeFilter(patterns); err != nil {
+				return errors.Wrap(err, "invalid --exclude")
+			}
+			ctx.App.Metadata["--exclude"] = patterns
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
 func uxRemap(cmd cli.Command) cli.Command {
 	cmd.Flags = append(cmd.Flags, []cli.Flag{
 		cli.StringSliceFlag{
@@ -0,0 +1,95 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DeduplicateLayers recompresses the layers of every image (including every
+// manifest of an image index) referenced by the given reference names with
+// the given compressor, and updates the references to point to the rewritten
+// images. Layers with the same contents are thus stored as a single blob,
+// even if they were originally compressed differently (such as when images
+// were imported from different sources). The original layer blobs (including
+// the chunks of chunked layers) are then removed if they are no longer
+// referenced. No other blobs are removed, so the replaced manifests and any
+// unrelated unreferenced blobs are left for GC.
+func DeduplicateLayers(ctx context.Context, engineExt casext.Engine, refnames []string, compressor mutate.Compressor) error {
+	replaced := map[digest.Digest]struct{}{}
+	for _, refname := range refnames {
+		descriptorPaths, err := engineExt.ResolveReference(ctx, refname)
+		if err != nil {
+			return errors.Wrapf(err, "resolve %s", refname)
+		}
+		if len(descriptorPaths) == 0 {
+			return errors.Errorf("reference not found: %s", refname)
+		}
+
+		// Each commit rewrites the path to the root of the reference, so we
+		// need to re-resolve the reference after every manifest (the order of
+		// the resolved paths is unaffected by the rewrite).
+		for idx := range descriptorPaths {
+			descriptorPaths, err := engineExt.ResolveReference(ctx, refname)
+			if err != nil {
+				return errors.Wrapf(err, "resolve %s", refname)
+			}
+			descriptorPath := descriptorPaths[idx]
+			if descriptorPath.Descriptor().MediaType != ispec.MediaTypeImageManifest {
+				continue
+			}
+
+			mutator, err := mutate.New(engineExt, descriptorPath)
+			if err != nil {
+				return errors.Wrapf(err, "create mutator for %s", descriptorPath.Descriptor().Digest)
+			}
+			manifest, err := mutator.Manifest(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "get manifest %s", descriptorPath.Descriptor().Digest)
+			}
+			for _, layerDescriptor := range manifest.Layers {
+				if err := engineExt.Walk(ctx, layerDescriptor, func(descriptorPath casext.DescriptorPath) error {
+					replaced[descriptorPath.Descriptor().Digest] = struct{}{}
+					return nil
+				}); err != nil {
+					return errors.Wrapf(err, "walk layer %s", layerDescriptor.Digest)
+				}
+			}
+			if err := mutator.RecompressLayers(ctx, compressor); err != nil {
+				return errors.Wrapf(err, "recompress %s", descriptorPath.Descriptor().Digest)
+			}
+			newDescriptorPath, err := mutator.CommitReference(ctx, refname)
+			if err != nil {
+				return errors.Wrapf(err, "commit %s", refname)
+			}
+			log.Infof("recompressed image manifest: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+		}
+	}
+	// Layers which were already compressed with the compressor are still
+	// referenced, and so are not removed.
+	return errors.Wrap(engineExt.GC(ctx, func(ctx context.Context, digest digest.Digest) (bool, error) {
+		_, ok := replaced[digest]
+		return ok, nil
+	}), "garbage collect")
+}
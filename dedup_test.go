@@ -0,0 +1,144 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestDeduplicateLayers(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestDeduplicateLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+	defer engineExt.Close()
+
+	var layerBuf bytes.Buffer
+	tw := tar.NewWriter(&layerBuf)
+	contents := []byte("shared layer contents")
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Import the same layer into two images, compressed differently.
+	original := map[string]ispec.Descriptor{}
+	for tagName, compressor := range map[string]mutate.Compressor{
+		"gzip": mutate.GzipCompressor,
+		"zstd": mutate.ZstdCompressor,
+	} {
+		if err := NewImage(engineExt, tagName); err != nil {
+			t.Fatalf("unexpected error creating image: %+v", err)
+		}
+		descriptorPaths, err := engineExt.ResolveReference(ctx, tagName)
+		if err != nil || len(descriptorPaths) != 1 {
+			t.Fatalf("unexpected error resolving %s: %+v", tagName, err)
+		}
+		mutator, err := mutate.New(engineExt, descriptorPaths[0])
+		if err != nil {
+			t.Fatalf("unexpected error creating mutator: %+v", err)
+		}
+		desc, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, bytes.NewReader(layerBuf.Bytes()), nil, compressor, nil)
+		if err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+		if _, err := mutator.CommitReference(ctx, tagName); err != nil {
+			t.Fatalf("unexpected error committing image: %+v", err)
+		}
+		original[tagName] = desc
+	}
+	if original["gzip"].Digest == original["zstd"].Digest {
+		t.Fatalf("differently compressed layers have the same digest")
+	}
+
+	// Unrelated unreferenced blobs must not be removed.
+	unrelated, _, err := engineExt.PutBlob(ctx, bytes.NewReader([]byte("unrelated blob")))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+
+	if err := DeduplicateLayers(ctx, engineExt, []string{"gzip", "zstd"}, mutate.GzipCompressor); err != nil {
+		t.Fatalf("unexpected error deduplicating layers: %+v", err)
+	}
+
+	// Both images must now share a single gzip layer blob, which must be the
+	// only layer left in the store.
+	expected := map[digest.Digest]struct{}{}
+	var layerDesc ispec.Descriptor
+	for _, tagName := range []string{"gzip", "zstd"} {
+		descriptorPaths, err := engineExt.ResolveReference(ctx, tagName)
+		if err != nil || len(descriptorPaths) != 1 {
+			t.Fatalf("unexpected error resolving %s: %+v", tagName, err)
+		}
+		manifest := getManifest(t, engineExt, tagName)
+		if len(manifest.Layers) != 1 {
+			t.Fatalf("unexpected number of layers in %s: %d", tagName, len(manifest.Layers))
+		}
+		if layerDesc.Digest == "" {
+			layerDesc = manifest.Layers[0]
+		} else if manifest.Layers[0].Digest != layerDesc.Digest {
+			t.Errorf("images do not share a layer blob: %s != %s", manifest.Layers[0].Digest, layerDesc.Digest)
+		}
+		expected[descriptorPaths[0].Descriptor().Digest] = struct{}{}
+		expected[manifest.Config.Digest] = struct{}{}
+		expected[manifest.Layers[0].Digest] = struct{}{}
+	}
+	if layerDesc.MediaType != ispec.MediaTypeImageLayerGzip {
+		t.Errorf("unexpected layer media-type: %s", layerDesc.MediaType)
+	}
+
+	expected[unrelated] = struct{}{}
+	for blob := range expected {
+		if _, err := engineExt.GetBlob(ctx, blob); err != nil {
+			t.Errorf("expected blob %s to be in store: %+v", blob, err)
+		}
+	}
+	if _, err := engineExt.GetBlob(ctx, original["zstd"].Digest); !errors.Is(err, cas.ErrBlobNotExist) {
+		t.Errorf("original zstd layer blob was not removed: %+v", err)
+	}
+}
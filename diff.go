@@ -0,0 +1,251 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// FileChangeType is the kind of change made to a path between two images.
+type FileChangeType string
+
+const (
+	// FileAdded indicates the path only exists in the new image.
+	FileAdded FileChangeType = "added"
+
+	// FileModified indicates the path exists in both images, but its
+	// contents or metadata differ.
+	FileModified FileChangeType = "modified"
+
+	// FileDeleted indicates the path only exists in the old image.
+	FileDeleted FileChangeType = "deleted"
+)
+
+// FileChange describes a single changed path between two images.
+type FileChange struct {
+	// Path is the absolute path (within the root filesystem) that changed.
+	Path string `json:"path"`
+
+	// Type is the kind of change made to Path.
+	Type FileChangeType `json:"type"`
+}
+
+// ImageDiff describes the differences between two images. The layers of the
+// two images are compared by digest: the longest shared prefix of layers is
+// listed in CommonLayers, while the remaining layers of each image are listed
+// in RemovedLayers and AddedLayers.
+type ImageDiff struct {
+	// CommonLayers are the leading layers shared by both images.
+	CommonLayers []ispec.Descriptor `json:"common_layers"`
+
+	// RemovedLayers are the layers of the old image after CommonLayers.
+	RemovedLayers []ispec.Descriptor `json:"removed_layers"`
+
+	// AddedLayers are the layers of the new image after CommonLayers.
+	AddedLayers []ispec.Descriptor `json:"added_layers"`
+
+	// Files is the list of paths which differ between the root filesystems
+	// of the two images, sorted by path. It is only filled if
+	// DiffOptions.Files was set.
+	Files []FileChange `json:"files,omitempty"`
+}
+
+// DiffOptions controls how Diff compares two images.
+type DiffOptions struct {
+	// Files enables the file-level diff. This requires both root filesystems
+	// to be assembled in a temporary directory, and so is far more expensive
+	// than only comparing layers.
+	Files bool
+
+	// UnpackOptions are the options used to assemble the root filesystems
+	// for the file-level diff.
+	UnpackOptions layer.UnpackOptions
+}
+
+// Format formats an ImageDiff using the default formatting, and writes the
+// result to the given writer.
+func (d ImageDiff) Format(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "LAYER\tSTATUS\tSIZE\n")
+	for _, group := range []struct {
+		status string
+		layers []ispec.Descriptor
+	}{
+		{"common", d.CommonLayers},
+		{"removed", d.RemovedLayers},
+		{"added", d.AddedLayers},
+	} {
+		for _, descriptor := range group.layers {
+			fmt.Fprintf(tw, "%s\t%s\t%d\n", descriptor.Digest, group.status, descriptor.Size)
+		}
+	}
+	if d.Files != nil {
+		fmt.Fprintf(tw, "\nPATH\tSTATUS\n")
+		for _, change := range d.Files {
+			fmt.Fprintf(tw, "%s\t%s\n", change.Path, change.Type)
+		}
+	}
+	return tw.Flush()
+}
+
+// readManifest returns the manifest referenced by the given descriptor.
+func readManifest(ctx context.Context, engineExt casext.Engine, descriptor ispec.Descriptor) (ispec.Manifest, error) {
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Manifest{}, errors.Errorf("descriptor does not point to %s: %s", ispec.MediaTypeImageManifest, descriptor.MediaType)
+	}
+	blob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "get manifest")
+	}
+	defer blob.Close()
+
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Manifest{}, errors.Errorf("[internal error] unknown manifest blob type: %s", blob.Descriptor.MediaType)
+	}
+	return manifest, nil
+}
+
+// Diff computes the differences between the old and new images, given by
+// their manifest descriptors. The two images may be stored in different
+// engines. Only the layer lists are compared unless opt.Files is set, in
+// which case both root filesystems are assembled to compute a file-level diff
+// as well (opt may be nil).
+func Diff(ctx context.Context, oldEngine casext.Engine, oldDescriptor ispec.Descriptor, newEngine casext.Engine, newDescriptor ispec.Descriptor, opt *DiffOptions) (ImageDiff, error) {
+	var diffOptions DiffOptions
+	if opt != nil {
+		diffOptions = *opt
+	}
+
+	oldManifest, err := readManifest(ctx, oldEngine, oldDescriptor)
+	if err != nil {
+		return ImageDiff{}, errors.Wrap(err, "diff: old image")
+	}
+	newManifest, err := readManifest(ctx, newEngine, newDescriptor)
+	if err != nil {
+		return ImageDiff{}, errors.Wrap(err, "diff: new image")
+	}
+
+	var diff ImageDiff
+	common := 0
+	for common < len(oldManifest.Layers) && common < len(newManifest.Layers) &&
+		oldManifest.Layers[common].Digest == newManifest.Layers[common].Digest {
+		common++
+	}
+	diff.CommonLayers = newManifest.Layers[:common]
+	diff.RemovedLayers = oldManifest.Layers[common:]
+	diff.AddedLayers = newManifest.Layers[common:]
+
+	if diffOptions.Files {
+		files, err := diffFiles(ctx, oldEngine, oldManifest, newEngine, newManifest, diffOptions.UnpackOptions)
+		if err != nil {
+			return ImageDiff{}, errors.Wrap(err, "diff: files")
+		}
+		diff.Files = files
+	}
+	return diff, nil
+}
+
+// diffFiles assembles the root filesystems of both manifests in a temporary
+// directory and returns the list of paths which differ between them.
+func diffFiles(ctx context.Context, oldEngine casext.Engine, oldManifest ispec.Manifest, newEngine casext.Engine, newManifest ispec.Manifest, unpackOptions layer.UnpackOptions) ([]FileChange, error) {
+	fsEval := fseval.Default
+	if unpackOptions.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	// The root filesystems are removed once we're done, which would fail if
+	// any of their paths were made immutable.
+	unpackOptions.NoApplyFileFlags = true
+
+	tmpDir, err := ioutil.TempDir("", "umoci-diff")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temporary directory")
+	}
+	defer func() {
+		if err := fsEval.RemoveAll(tmpDir); err != nil {
+			log.Warnf("diff: failed to remove temporary directory %s: %v", tmpDir, err)
+		}
+	}()
+
+	oldRootfs := filepath.Join(tmpDir, "old")
+	newRootfs := filepath.Join(tmpDir, "new")
+	for _, rootfs := range []struct {
+		path      string
+		engineExt casext.Engine
+		manifest  ispec.Manifest
+	}{
+		{oldRootfs, oldEngine, oldManifest},
+		{newRootfs, newEngine, newManifest},
+	} {
+		if err := os.Mkdir(rootfs.path, 0755); err != nil {
+			return nil, errors.Wrap(err, "create rootfs")
+		}
+		if err := layer.UnpackRootfs(ctx, rootfs.engineExt, rootfs.path, rootfs.manifest, &unpackOptions); err != nil {
+			return nil, errors.Wrap(err, "unpack rootfs")
+		}
+	}
+
+	dh, err := mtree.Walk(oldRootfs, nil, MtreeKeywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate mtree of old rootfs")
+	}
+	deltas, err := mtree.Check(newRootfs, dh, MtreeKeywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "compare rootfs")
+	}
+
+	files := []FileChange{}
+	for _, delta := range deltas {
+		var changeType FileChangeType
+		switch delta.Type() {
+		case mtree.Extra:
+			changeType = FileAdded
+		case mtree.Modified:
+			changeType = FileModified
+		case mtree.Missing:
+			changeType = FileDeleted
+		default:
+			continue
+		}
+		files = append(files, FileChange{
+			Path: filepath.Join("/", delta.Path()),
+			Type: changeType,
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
@@ -0,0 +1,116 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"golang.org/x/net/context"
+)
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestDiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+
+	// Build "a" with two files, and "b" on top of it with one file changed.
+	for name, contents := range map[string]string{"unchanged": "same", "changed": "before"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repackBundle(t, engineExt, "a", bundle, nil); err != nil {
+		t.Fatalf("unexpected error repacking a: %+v", err)
+	}
+	bundleA := filepath.Join(dir, "bundle-a")
+	if err := Unpack(engineExt, "a", bundleA, layer.UnpackOptions{MapOptions: testMapOptions()}); err != nil {
+		t.Fatalf("unexpected error unpacking a: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundleA, layer.RootfsName, "changed"), []byte("after"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackBundle(t, engineExt, "b", bundleA, nil); err != nil {
+		t.Fatalf("unexpected error repacking b: %+v", err)
+	}
+
+	resolve := func(name string) casext.DescriptorPath {
+		descriptorPath, err := resolvePlatform(engineExt, name, nil)
+		if err != nil {
+			t.Fatalf("unexpected error resolving %s: %+v", name, err)
+		}
+		return descriptorPath
+	}
+	descA, descB := resolve("a").Descriptor(), resolve("b").Descriptor()
+	manifestA, manifestB := getManifest(t, engineExt, "a"), getManifest(t, engineExt, "b")
+
+	diff, err := Diff(ctx, engineExt, descA, engineExt, descB, &DiffOptions{
+		Files:         true,
+		UnpackOptions: layer.UnpackOptions{MapOptions: testMapOptions()},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error computing diff: %+v", err)
+	}
+
+	if !reflect.DeepEqual(diff.CommonLayers, manifestA.Layers) {
+		t.Errorf("unexpected common layers: expected %v, got %v", manifestA.Layers, diff.CommonLayers)
+	}
+	if len(diff.RemovedLayers) != 0 {
+		t.Errorf("unexpected removed layers: %v", diff.RemovedLayers)
+	}
+	if !reflect.DeepEqual(diff.AddedLayers, manifestB.Layers[len(manifestA.Layers):]) {
+		t.Errorf("unexpected added layers: expected %v, got %v", manifestB.Layers[len(manifestA.Layers):], diff.AddedLayers)
+	}
+	expectedFiles := []FileChange{{Path: "/changed", Type: FileModified}}
+	if !reflect.DeepEqual(diff.Files, expectedFiles) {
+		t.Errorf("unexpected file diff: expected %v, got %v", expectedFiles, diff.Files)
+	}
+
+	var buf bytes.Buffer
+	if err := diff.Format(&buf); err != nil {
+		t.Fatalf("unexpected error formatting diff: %+v", err)
+	}
+	if !strings.Contains(buf.String(), "/changed") {
+		t.Errorf("formatted diff does not list changed file:\n%s", buf.String())
+	}
+
+	// The reverse diff has the new layer removed, and no file-level diff
+	// unless requested.
+	diff, err = Diff(ctx, engineExt, descB, engineExt, descA, nil)
+	if err != nil {
+		t.Fatalf("unexpected error computing reverse diff: %+v", err)
+	}
+	if len(diff.RemovedLayers) != 1 || len(diff.AddedLayers) != 0 || diff.Files != nil {
+		t.Errorf("unexpected reverse diff: %+v", diff)
+	}
+}
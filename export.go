@@ -0,0 +1,87 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"io"
+	"io/ioutil"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ExportLayer writes the blob of the layer at position index (starting at 0
+// for the base layer) of the image referenced by fromName to w. If decompress
+// is set, the uncompressed tar archive is written instead of the blob as it is
+// stored in the image. If fromName refers to a multi-platform image index, the
+// manifest for the given platform (or the host platform if platform is nil) is
+// used. Chunked layers are reassembled (see layer.OpenLayer). The descriptor
+// of the layer blob is returned, and the blob is verified against it as it is
+// written.
+func ExportLayer(engineExt casext.Engine, fromName string, platform *ispec.Platform, index int, decompress bool, w io.Writer) (_ ispec.Descriptor, Err error) {
+	ctx := context.Background()
+
+	fromDescriptorPath, err := resolvePlatform(engineExt, fromName, platform)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	manifest, err := readManifest(ctx, engineExt, fromDescriptorPath.Descriptor())
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	if index < 0 || index >= len(manifest.Layers) {
+		return ispec.Descriptor{}, errors.Errorf("layer index %d out of range: image has %d layers", index, len(manifest.Layers))
+	}
+	blob, desc, err := layer.OpenLayer(ctx, engineExt, manifest.Layers[index])
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "layer %d", index)
+	}
+	defer func() {
+		// Closing the blob verifies its digest, so the error matters.
+		if err := blob.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "verify layer blob")
+		}
+	}()
+
+	if !layer.IsLayerMediaType(desc.MediaType) {
+		return ispec.Descriptor{}, errors.Wrapf(layer.ErrUnsupportedMediaType, "layer %d: blob is not a layer: %s", index, desc.MediaType)
+	}
+
+	var reader io.Reader = blob
+	if decompress {
+		decompressed, err := layer.DecompressLayer(blob, desc)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "decompress layer")
+		}
+		defer decompressed.Close()
+		reader = decompressed
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "export layer")
+	}
+	// Make sure the entire blob is read (and thus verified), even if the
+	// decompressor stopped before the end of the blob.
+	if _, err := io.Copy(ioutil.Discard, blob); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "read trailing layer data")
+	}
+	return desc, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+func TestExportLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestExportLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	contents := []byte("hello world\n")
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "hello"), contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackBundle(t, engineExt, "new", bundle, nil); err != nil {
+		t.Fatalf("unexpected error repacking bundle: %+v", err)
+	}
+	manifest := getManifest(t, engineExt, "new")
+	index := len(manifest.Layers) - 1
+
+	// The blob as stored must match the manifest descriptor.
+	var blob bytes.Buffer
+	desc, err := ExportLayer(engineExt, "new", nil, index, false, &blob)
+	if err != nil {
+		t.Fatalf("unexpected error exporting layer: %+v", err)
+	}
+	if desc.Digest != manifest.Layers[index].Digest {
+		t.Errorf("unexpected descriptor returned: expected %s got %s", manifest.Layers[index].Digest, desc.Digest)
+	}
+	if got := digest.FromBytes(blob.Bytes()); got != desc.Digest {
+		t.Errorf("exported blob digest mismatch: expected %s got %s", desc.Digest, got)
+	}
+	if int64(blob.Len()) != desc.Size {
+		t.Errorf("exported blob size mismatch: expected %d got %d", desc.Size, blob.Len())
+	}
+
+	// The decompressed layer must be a tar archive containing the new file.
+	var archive bytes.Buffer
+	if _, err := ExportLayer(engineExt, "new", nil, index, true, &archive); err != nil {
+		t.Fatalf("unexpected error exporting decompressed layer: %+v", err)
+	}
+	found := false
+	tr := tar.NewReader(&archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error reading exported layer: %+v", err)
+		}
+		if filepath.Clean(hdr.Name) == "hello" {
+			got, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, contents) {
+				t.Errorf("unexpected contents of hello: %q", got)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("exported layer does not contain hello")
+	}
+
+	for _, badIndex := range []int{-1, len(manifest.Layers)} {
+		if _, err := ExportLayer(engineExt, "new", nil, badIndex, false, ioutil.Discard); err == nil {
+			t.Errorf("expected error exporting out-of-range layer %d", badIndex)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/system"
+	"golang.org/x/net/context"
+)
+
+// setInodeFlags sets the immutable and append-only inode flags of the given
+// path to the given value, preserving any other flags.
+func setInodeFlags(path string, flags uint32) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	oldFlags, err := system.GetInodeFlags(fh)
+	if err != nil {
+		return err
+	}
+	return system.SetInodeFlags(fh, (oldFlags&^(system.InodeImmutable|system.InodeAppend))|flags)
+}
+
+// TestFileFlagsTemporaryRootfs makes sure that the operations which unpack
+// an image into a temporary directory can still remove it if the image
+// contains immutable or append-only paths.
+func TestFileFlagsTemporaryRootfs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("inode flags can only be set by root")
+	}
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestFileFlagsTemporaryRootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := os.Mkdir(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "log"), []byte("log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setInodeFlags(filepath.Join(rootfs, "etc"), system.InodeImmutable); err != nil {
+		t.Skipf("filesystem does not support inode flags: %v", err)
+	}
+	if err := setInodeFlags(filepath.Join(rootfs, "log"), system.InodeAppend); err != nil {
+		t.Fatal(err)
+	}
+	err = repackBundle(t, engineExt, "flags", bundle, nil)
+	for _, path := range []string{"etc", "log"} {
+		if err := setInodeFlags(filepath.Join(rootfs, path), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err != nil {
+		t.Fatalf("unexpected error repacking bundle: %+v", err)
+	}
+
+	// Use our own temporary directory, so we can check nothing was leaked.
+	tmpDir := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldTmpDir, hadTmpDir := os.LookupEnv("TMPDIR")
+	os.Setenv("TMPDIR", tmpDir)
+	defer func() {
+		if hadTmpDir {
+			os.Setenv("TMPDIR", oldTmpDir)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+	}()
+
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	if err := GenerateImageManifest(engineExt, "flags", nil, ioutil.Discard, unpackOptions); err != nil {
+		t.Fatalf("unexpected error generating mtree: %+v", err)
+	}
+	_, err = Diff(ctx, engineExt, getManifestDescriptor(t, engineExt, "latest"), engineExt, getManifestDescriptor(t, engineExt, "flags"), &DiffOptions{
+		Files:         true,
+		UnpackOptions: unpackOptions,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error diffing images: %+v", err)
+	}
+	if leaked, err := ioutil.ReadDir(tmpDir); err != nil || len(leaked) != 0 {
+		t.Errorf("temporary rootfs was not removed: %v %v", leaked, err)
+	}
+
+	// The network placeholders must be created before /etc is made immutable.
+	fileFlags := map[string]string{}
+	unpackOptions.FileFlags = fileFlags
+	unpackOptions.NetworkPlaceholders = true
+	bundleFlags := filepath.Join(dir, "bundle-flags")
+	err = Unpack(engineExt, "flags", bundleFlags, unpackOptions)
+	defer layer.ClearFileFlags(filepath.Join(bundleFlags, layer.RootfsName), fileFlags)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	for _, path := range layer.NetworkPlaceholderPaths {
+		if _, err := os.Lstat(filepath.Join(bundleFlags, layer.RootfsName, path)); err != nil {
+			t.Errorf("missing network placeholder %s: %v", path, err)
+		}
+	}
+	fh, err := os.Open(filepath.Join(bundleFlags, layer.RootfsName, "etc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if flags, err := system.GetInodeFlags(fh); err != nil || flags&system.InodeImmutable == 0 {
+		t.Errorf("inode flags were not applied to /etc: %#x %v", flags, err)
+	}
+}
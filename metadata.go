@@ -0,0 +1,148 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// The names of the files written by SaveMetadata.
+const (
+	// MetadataManifestName is the name of the file containing the manifest.
+	MetadataManifestName = "manifest.json"
+
+	// MetadataConfigName is the name of the file containing the image
+	// configuration.
+	MetadataConfigName = "config.json"
+
+	// MetadataIndexName is the name of the file containing an image index
+	// with just the top-level index entry of the reference.
+	MetadataIndexName = "index.json"
+)
+
+// readBlobBytes returns the verified contents of the given blob.
+func readBlobBytes(ctx context.Context, engineExt casext.Engine, descriptor ispec.Descriptor) ([]byte, error) {
+	reader, err := engineExt.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get blob %s", descriptor.Digest)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	return data, errors.Wrapf(err, "read blob %s", descriptor.Digest)
+}
+
+// SaveMetadata writes the manifest and image configuration of the image
+// referenced by fromName to outDir (as MetadataManifestName and
+// MetadataConfigName), without extracting any layers. The files contain the
+// exact bytes of the blobs, so their digests match the descriptors in the
+// image. An image index containing only the top-level index entry of fromName
+// is written to MetadataIndexName. If fromName refers to a multi-platform
+// image index, the manifest for the given platform (or the host platform if
+// platform is nil) is saved.
+func SaveMetadata(engineExt casext.Engine, fromName string, platform *ispec.Platform, outDir string) error {
+	ctx := context.Background()
+
+	fromDescriptorPath, err := resolvePlatform(engineExt, fromName, platform)
+	if err != nil {
+		return err
+	}
+	manifestDescriptor := fromDescriptorPath.Descriptor()
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType)
+	}
+
+	manifestData, err := readBlobBytes(ctx, engineExt, manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "read manifest")
+	}
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return errors.Wrap(err, "parse manifest")
+	}
+	configData, err := readBlobBytes(ctx, engineExt, manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "read config")
+	}
+	indexData, err := json.Marshal(ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.Descriptor{fromDescriptorPath.Root()},
+	})
+	if err != nil {
+		return errors.Wrap(err, "encode index")
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return errors.Wrap(err, "create output directory")
+	}
+	for name, data := range map[string][]byte{
+		MetadataManifestName: manifestData,
+		MetadataConfigName:   configData,
+		MetadataIndexName:    indexData,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(outDir, name), data, 0644); err != nil {
+			return errors.Wrapf(err, "write %s", name)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"manifest": manifestDescriptor.Digest,
+		"config":   manifest.Config.Digest,
+	}).Infof("saved metadata of %s to %s", fromName, outDir)
+	return nil
+}
+
+// Labels returns the labels in the image configuration of the image
+// referenced by fromName (which may be nil if the image has no labels). If
+// fromName refers to a multi-platform image index, the labels of the manifest
+// for the given platform (or the host platform if platform is nil) are
+// returned.
+func Labels(engineExt casext.Engine, fromName string, platform *ispec.Platform) (map[string]string, error) {
+	ctx := context.Background()
+
+	fromDescriptorPath, err := resolvePlatform(engineExt, fromName, platform)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readManifest(ctx, engineExt, fromDescriptorPath.Descriptor())
+	if err != nil {
+		return nil, err
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return nil, errors.Errorf("config blob is not an image config: %s", configBlob.Descriptor.MediaType)
+	}
+	return config.Config.Labels, nil
+}
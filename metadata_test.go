@@ -0,0 +1,168 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"golang.org/x/net/context"
+)
+
+func TestSaveMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestSaveMetadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	other := "linux/umoci-test-arch"
+	engineExt := setupMultiPlatformImage(t, dir, other, casext.PlatformString(casext.HostPlatform()))
+	defer engineExt.Close()
+
+	platform, err := casext.ParsePlatform(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outDir := filepath.Join(dir, "meta")
+	if err := SaveMetadata(engineExt, "multi", &platform, outDir); err != nil {
+		t.Fatalf("unexpected error saving metadata: %+v", err)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), "multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths = casext.FilterPlatform(descriptorPaths, platform)
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of manifests for %s: %d", other, len(descriptorPaths))
+	}
+	expectedManifest := descriptorPaths[0].Descriptor()
+
+	manifestData, err := ioutil.ReadFile(filepath.Join(outDir, MetadataManifestName))
+	if err != nil {
+		t.Fatalf("unexpected error reading manifest: %+v", err)
+	}
+	if got := digest.FromBytes(manifestData); got != expectedManifest.Digest {
+		t.Errorf("saved manifest has wrong digest: expected %s got %s", expectedManifest.Digest, got)
+	}
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	configData, err := ioutil.ReadFile(filepath.Join(outDir, MetadataConfigName))
+	if err != nil {
+		t.Fatalf("unexpected error reading config: %+v", err)
+	}
+	if got := digest.FromBytes(configData); got != manifest.Config.Digest {
+		t.Errorf("saved config has wrong digest: expected %s got %s", manifest.Config.Digest, got)
+	}
+
+	indexData, err := ioutil.ReadFile(filepath.Join(outDir, MetadataIndexName))
+	if err != nil {
+		t.Fatalf("unexpected error reading index: %+v", err)
+	}
+	var index ispec.Index
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("unexpected number of index entries: %d", len(index.Manifests))
+	}
+	if entry := index.Manifests[0]; entry.Digest != descriptorPaths[0].Root().Digest || entry.Annotations[ispec.AnnotationRefName] != "multi" {
+		t.Errorf("unexpected index entry: %+v", entry)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestLabels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+	if err := NewImage(engineExt, "labels"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new image has no labels.
+	labels, err := Labels(engineExt, "labels", nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading labels: %+v", err)
+	}
+	if len(labels) != 0 {
+		t.Errorf("unexpected labels in new image: %v", labels)
+	}
+
+	expected := map[string]string{
+		"org.opencontainers.image.version": "1.2.3",
+		"maintainer":                       "Jane Doe <jane@example.com>",
+		"empty":                            "",
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Labels = expected
+	if err := mutator.Set(ctx, config, meta, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.CommitReference(ctx, "labels"); err != nil {
+		t.Fatal(err)
+	}
+
+	labels, err = Labels(engineExt, "labels", nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading labels: %+v", err)
+	}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("unexpected labels: expected %v got %v", expected, labels)
+	}
+
+	if _, err := Labels(engineExt, "missing", nil); err == nil {
+		t.Errorf("expected reading labels of a missing tag to fail")
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// GenerateImageManifest assembles the root filesystem of the image referenced
+// by fromName in a temporary directory, and writes an mtree manifest of it
+// (using MtreeKeywords) to w. The manifest is identical to the one generated
+// by Unpack for a bundle of the same image, and so can be used to later verify
+// that a deployed root filesystem has not drifted from the image. If fromName
+// refers to a multi-platform image index, the manifest for the given platform
+// (or the host platform if platform is nil) is used.
+func GenerateImageManifest(engineExt casext.Engine, fromName string, platform *ispec.Platform, w io.Writer, unpackOptions layer.UnpackOptions) error {
+	ctx := context.Background()
+
+	fromDescriptorPath, err := resolvePlatform(engineExt, fromName, platform)
+	if err != nil {
+		return err
+	}
+	manifest, err := readManifest(ctx, engineExt, fromDescriptorPath.Descriptor())
+	if err != nil {
+		return err
+	}
+
+	fsEval := fseval.Default
+	if unpackOptions.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	// The rootfs is removed once we're done, which would fail if any of its
+	// paths were made immutable. The mtree keywords don't include the inode
+	// flags, so the manifest is unaffected.
+	unpackOptions.NoApplyFileFlags = true
+
+	tmpDir, err := ioutil.TempDir("", "umoci-mtree")
+	if err != nil {
+		return errors.Wrap(err, "create temporary directory")
+	}
+	defer func() {
+		if err := fsEval.RemoveAll(tmpDir); err != nil {
+			log.Warnf("mtree: failed to remove temporary directory %s: %v", tmpDir, err)
+		}
+	}()
+
+	rootfs := filepath.Join(tmpDir, layer.RootfsName)
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return errors.Wrap(err, "create rootfs")
+	}
+	log.Info("unpacking rootfs ...")
+	if err := layer.UnpackRootfs(ctx, engineExt, rootfs, manifest, &unpackOptions); err != nil {
+		return errors.Wrap(err, "unpack rootfs")
+	}
+	log.Info("... done")
+
+	log.WithFields(log.Fields{
+		"keywords": MtreeKeywords,
+	}).Debugf("umoci: generating mtree manifest")
+
+	log.Info("computing filesystem manifest ...")
+	dh, err := mtree.Walk(rootfs, nil, MtreeKeywords, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "generate mtree spec")
+	}
+	log.Info("... done")
+
+	if _, err := dh.WriteTo(w); err != nil {
+		return errors.Wrap(err, "write mtree")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/vbatts/go-mtree"
+)
+
+func TestGenerateImageManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateImageManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	contents := []byte("hello world\n")
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := os.Mkdir(filepath.Join(rootfs, "etc"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "hello"), contents, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackBundle(t, engineExt, "new", bundle, nil); err != nil {
+		t.Fatalf("unexpected error repacking bundle: %+v", err)
+	}
+
+	var buf bytes.Buffer
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	if err := GenerateImageManifest(engineExt, "new", nil, &buf, unpackOptions); err != nil {
+		t.Fatalf("unexpected error generating mtree: %+v", err)
+	}
+
+	dh, err := mtree.ParseSpec(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error parsing generated mtree: %+v", err)
+	}
+	entries := map[string]map[string]string{}
+	for _, entry := range dh.Entries {
+		if entry.Type != mtree.RelativeType && entry.Type != mtree.FullType {
+			continue
+		}
+		path, err := entry.Path()
+		if err != nil {
+			t.Fatalf("unexpected error getting entry path: %+v", err)
+		}
+		keys := map[string]string{}
+		for _, kv := range entry.AllKeys() {
+			keys[string(kv.Keyword())] = kv.Value()
+		}
+		entries[path] = keys
+	}
+
+	for _, test := range []struct {
+		path     string
+		expected map[string]string
+	}{
+		{"etc", map[string]string{"type": "dir", "mode": "0750"}},
+		{"etc/hello", map[string]string{
+			"type":         "file",
+			"mode":         "0640",
+			"size":         "12",
+			"sha256digest": digest.FromBytes(contents).Encoded(),
+		}},
+	} {
+		keys, ok := entries[test.path]
+		if !ok {
+			t.Errorf("mtree is missing an entry for %s: %v", test.path, entries)
+			continue
+		}
+		for keyword, value := range test.expected {
+			if got := keys[keyword]; got != value {
+				t.Errorf("mtree entry %s has unexpected %s: expected %q got %q", test.path, keyword, value, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// putChunked stores the layer blob read from r (which has the given
+// media-type) as a sequence of chunkSize-byte blobs, and then stores a
+// layer.ChunkedLayer blob referencing them. The digest and size of the
+// ChunkedLayer blob are returned.
+func (m *Mutator) putChunked(ctx context.Context, r io.Reader, mediaType string, chunkSize int64) (digest.Digest, int64, error) {
+	chunked := layer.ChunkedLayer{
+		MediaType: mediaType,
+	}
+
+	digester := cas.BlobAlgorithm.Digester()
+	br := bufio.NewReader(io.TeeReader(r, digester.Hash()))
+	for {
+		// Don't create an empty trailing chunk.
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", -1, errors.Wrap(err, "read layer")
+		}
+		chunkDigest, size, err := m.engine.PutBlob(ctx, io.LimitReader(br, chunkSize))
+		if err != nil {
+			return "", -1, errors.Wrapf(err, "put layer chunk %d", len(chunked.Chunks))
+		}
+		chunked.Chunks = append(chunked.Chunks, ispec.Descriptor{
+			MediaType: layer.MediaTypeLayerChunk,
+			Digest:    chunkDigest,
+			Size:      size,
+		})
+		chunked.Size += size
+	}
+	chunked.Digest = digester.Digest()
+
+	return m.engine.PutBlobJSON(ctx, chunked)
+}
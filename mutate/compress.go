@@ -4,23 +4,19 @@ import (
 	"io"
 	"io/ioutil"
 	"runtime"
+	"time"
 
 	zstd "github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/membudget"
 	"github.com/pkg/errors"
 )
 
 // Compressor is an interface which users can use to implement different
-// compression types.
-type Compressor interface {
-	// Compress sets up the streaming compressor for this compression type.
-	Compress(io.Reader) (io.ReadCloser, error)
-
-	// MediaTypeSuffix returns the suffix to be added to the layer to
-	// indicate what compression type is used, e.g. "gzip", or "" for no
-	// compression.
-	MediaTypeSuffix() string
-}
+// compression types. It is the same interface as layer.Compressor, so custom
+// compressors can be used with both packages.
+type Compressor = layer.Compressor
 
 type noopCompressor struct{}
 
@@ -38,14 +34,51 @@ var NoopCompressor Compressor = noopCompressor{}
 // GzipCompressor provides gzip compression.
 var GzipCompressor Compressor = gzipCompressor{}
 
-type gzipCompressor struct{}
+// gzipCompressCost is the approximate memory usage of a parallel gzip writer.
+// Each in-flight block has an input and output buffer, as well as its own
+// flate compressor (which uses roughly 1MiB of state).
+var gzipCompressCost = membudget.Cost{PerBlockOverhead: 1 << 20, BuffersPerBlock: 2}
+
+// GzipCompressorWithBudget returns a Compressor which provides gzip
+// compression, where the parallel compression is throttled such that the
+// in-flight buffers use approximately no more than budget bytes. If budget is
+// zero, this is equivalent to GzipCompressor.
+func GzipCompressorWithBudget(budget int64) Compressor {
+	if budget <= 0 {
+		return GzipCompressor
+	}
+	blockSize, blocks := membudget.Split(budget, gzipCompressCost, 2*runtime.NumCPU())
+	return gzipCompressor{blockSize: blockSize, blocks: blocks}
+}
+
+// gzipHeaderOS is the OS byte written in the header of gzip layers. RFC 1952
+// defines 255 as "unknown", which avoids leaking details of the host that
+// generated the layer into its digest.
+const gzipHeaderOS = 255
+
+type gzipCompressor struct {
+	// blockSize and blocks are the pgzip concurrency settings. If they are
+	// zero, the defaults are used.
+	blockSize, blocks int
+}
 
 func (gz gzipCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
 	pipeReader, pipeWriter := io.Pipe()
 
+	blockSize, blocks := gz.blockSize, gz.blocks
+	if blockSize == 0 || blocks == 0 {
+		blockSize, blocks = 256<<10, 2*runtime.NumCPU()
+	}
+
 	gzw := gzip.NewWriter(pipeWriter)
-	if err := gzw.SetConcurrency(256<<10, 2*runtime.NumCPU()); err != nil {
-		return nil, errors.Wrapf(err, "set concurrency level to %v blocks", 2*runtime.NumCPU())
+	// Make sure the header is reproducible, so that compressing the same
+	// archive always results in the same blob digest. Note that pgzip encodes
+	// the zero time.Time as a (non-zero) truncated timestamp, so we explicitly
+	// use the epoch which is encoded as "no timestamp available".
+	gzw.Header.ModTime = time.Unix(0, 0)
+	gzw.Header.OS = gzipHeaderOS
+	if err := gzw.SetConcurrency(blockSize, blocks); err != nil {
+		return nil, errors.Wrapf(err, "set concurrency level to %v blocks", blocks)
 	}
 	go func() {
 		if _, err := io.Copy(gzw, reader); err != nil {
@@ -72,14 +105,30 @@ func (gz gzipCompressor) MediaTypeSuffix() string {
 // ZstdCompressor provides zstd compression.
 var ZstdCompressor Compressor = zstdCompressor{}
 
-type zstdCompressor struct{}
+// ZstdCompressorWithDict returns a Compressor which provides zstd compression
+// using the given zstd dictionary (in the format produced by "zstd --train").
+// Sharing a dictionary between similar layers can significantly improve the
+// compression ratio, but the resulting layers can only be decompressed by
+// providing the same dictionary.
+func ZstdCompressorWithDict(dict []byte) Compressor {
+	return zstdCompressor{dict: dict}
+}
+
+type zstdCompressor struct {
+	// dict is the zstd dictionary used for compression, if non-nil.
+	dict []byte
+}
 
 func (zs zstdCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	var opts []zstd.EOption
+	if zs.dict != nil {
+		opts = append(opts, zstd.WithEncoderDict(zs.dict))
+	}
 
 	pipeReader, pipeWriter := io.Pipe()
-	zenc, err := zstd.NewWriter(pipeWriter)
+	zenc, err := zstd.NewWriter(pipeWriter, opts...)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "create zstd writer")
 	}
 	go func() {
 		if _, err := io.Copy(zenc, reader); err != nil {
@@ -8,6 +8,7 @@ import (
 
 	zstd "github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -66,3 +67,55 @@ func TestZstdCompressor(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(content.String(), fact)
 }
+
+func TestGzipCompressorWithBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	// Use an input much larger than the budget, to make sure that throttling
+	// doesn't stop us from making progress.
+	const budget = 4 << 20
+	input := bytes.Repeat([]byte(fact), (16<<20)/len(fact))
+
+	c := GzipCompressorWithBudget(budget)
+	assert.Equal(c.MediaTypeSuffix(), "gzip")
+
+	gz, ok := c.(gzipCompressor)
+	assert.True(ok)
+	assert.True(gz.blocks >= 1)
+	assert.True(gzipCompressCost.Usage(gz.blockSize, gz.blocks) <= budget,
+		"usage %d exceeds budget %d", gzipCompressCost.Usage(gz.blockSize, gz.blocks), budget)
+
+	r, err := c.Compress(bytes.NewReader(input))
+	assert.NoError(err)
+
+	r, err = gzip.NewReader(r)
+	assert.NoError(err)
+
+	content, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.True(bytes.Equal(content, input))
+}
+
+func TestGzipCompressorReproducible(t *testing.T) {
+	assert := assert.New(t)
+
+	input := bytes.Repeat([]byte(fact), (1<<20)/len(fact))
+	compress := func(c Compressor) []byte {
+		r, err := c.Compress(bytes.NewReader(input))
+		assert.NoError(err)
+		output, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		return output
+	}
+
+	for _, c := range []Compressor{GzipCompressor, GzipCompressorWithBudget(4 << 20)} {
+		first, second := compress(c), compress(c)
+		assert.True(bytes.Equal(first, second), "compressing the same data twice gave different output")
+		assert.Equal(digest.FromBytes(first), digest.FromBytes(second))
+
+		// The header must have no mtime and a fixed OS byte.
+		assert.True(len(first) > 10)
+		assert.Equal([]byte{0, 0, 0, 0}, first[4:8], "gzip header mtime must be zero")
+		assert.Equal(byte(gzipHeaderOS), first[9])
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// collapsedCreatedBySeparator separates the CreatedBy values of history
+// entries merged by CollapseEmptyHistory.
+const collapsedCreatedBySeparator = "; "
+
+// collapseEmptyHistory returns a copy of history where every run of
+// consecutive empty-layer entries has been replaced by a single entry. See
+// CollapseEmptyHistory for more details.
+func collapseEmptyHistory(history []ispec.History, mergeCreatedBy bool) []ispec.History {
+	var (
+		collapsed []ispec.History
+		run       []ispec.History
+	)
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		entry := run[len(run)-1]
+		if mergeCreatedBy {
+			var createdBy []string
+			for _, h := range run {
+				if h.CreatedBy == "" || (len(createdBy) > 0 && createdBy[len(createdBy)-1] == h.CreatedBy) {
+					continue
+				}
+				createdBy = append(createdBy, h.CreatedBy)
+			}
+			entry.CreatedBy = strings.Join(createdBy, collapsedCreatedBySeparator)
+		}
+		collapsed = append(collapsed, entry)
+		run = nil
+	}
+	for _, h := range history {
+		if h.EmptyLayer {
+			run = append(run, h)
+			continue
+		}
+		flush()
+		collapsed = append(collapsed, h)
+	}
+	flush()
+	return collapsed
+}
+
+// CollapseEmptyHistory replaces every run of consecutive empty-layer history
+// entries (such as those produced by many configuration-only changes) with a
+// single empty-layer entry. Entries which correspond to layers are left
+// untouched, so the correspondence between non-empty history entries and the
+// layers of the image is preserved. The collapsed entry is the last entry of
+// each run, except that if mergeCreatedBy is set its CreatedBy is the
+// CreatedBy of every entry in the run (ignoring empty and repeated values)
+// separated by "; ".
+func (m *Mutator) CollapseEmptyHistory(ctx context.Context, mergeCreatedBy bool) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	m.config.History = collapseEmptyHistory(m.config.History, mergeCreatedBy)
+	return nil
+}
+
+// PruneEmptyHistory removes every empty-layer history entry, leaving only the
+// entries which correspond to layers of the image.
+func (m *Mutator) PruneEmptyHistory(ctx context.Context) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	var pruned []ispec.History
+	for _, h := range m.config.History {
+		if !h.EmptyLayer {
+			pruned = append(pruned, h)
+		}
+	}
+	m.config.History = pruned
+	return nil
+}
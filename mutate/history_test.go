@@ -0,0 +1,126 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"golang.org/x/net/context"
+)
+
+// setupEmptyHistory creates an image with two layers, with several
+// empty-layer history entries between and after them.
+func setupEmptyHistory(t *testing.T, dir string) (casext.Engine, *Mutator) {
+	engineExt, mutator := setupLayers(t, dir,
+		[]layerFile{{"base", "base"}},
+		[]layerFile{{"app", "app"}},
+	)
+
+	empty := func(hour int, createdBy string) ispec.History {
+		created := time.Date(2020, 1, 1, hour, 0, 0, 0, time.UTC)
+		return ispec.History{Created: &created, CreatedBy: createdBy, EmptyLayer: true}
+	}
+	history := mutator.config.History
+	mutator.config.History = []ispec.History{
+		history[0],
+		empty(1, "config/0"),
+		empty(2, "config/1"),
+		empty(3, "config/1"),
+		empty(4, ""),
+		empty(5, "config/2"),
+		history[1],
+		empty(6, "config/3"),
+		empty(7, "config/4"),
+	}
+	return engineExt, mutator
+}
+
+func TestMutateCollapseEmptyHistory(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		merge     bool
+		createdBy []string
+	}{
+		{"Merge", true, []string{"layer/0", "config/0; config/1; config/2", "layer/1", "config/3; config/4"}},
+		{"NoMerge", false, []string{"layer/0", "config/2", "layer/1", "config/4"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestMutateCollapseEmptyHistory")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			engineExt, mutator := setupEmptyHistory(t, dir)
+			defer engineExt.Close()
+
+			before := mutator.config.History
+			if err := mutator.CollapseEmptyHistory(context.Background(), test.merge); err != nil {
+				t.Fatalf("unexpected error collapsing history: %+v", err)
+			}
+			history := mutator.config.History
+
+			var createdBy []string
+			for _, h := range history {
+				createdBy = append(createdBy, h.CreatedBy)
+			}
+			if !reflect.DeepEqual(createdBy, test.createdBy) {
+				t.Fatalf("unexpected collapsed history: expected %q got %q", test.createdBy, createdBy)
+			}
+
+			// Layer-backed history entries must be untouched.
+			if !reflect.DeepEqual(history[0], before[0]) || !reflect.DeepEqual(history[2], before[6]) {
+				t.Errorf("layer history entries were modified: %+v", history)
+			}
+			for idx, emptyLayer := range []bool{false, true, false, true} {
+				if history[idx].EmptyLayer != emptyLayer {
+					t.Errorf("history entry %d: expected empty_layer=%v", idx, emptyLayer)
+				}
+			}
+			// The collapsed entry takes the metadata of the last entry.
+			if !reflect.DeepEqual(history[1].Created, before[5].Created) {
+				t.Errorf("collapsed entry has unexpected created time: %v", history[1].Created)
+			}
+		})
+	}
+}
+
+func TestMutatePruneEmptyHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutatePruneEmptyHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, mutator := setupEmptyHistory(t, dir)
+	defer engineExt.Close()
+
+	if err := mutator.PruneEmptyHistory(context.Background()); err != nil {
+		t.Fatalf("unexpected error pruning history: %+v", err)
+	}
+	history := mutator.config.History
+	if len(history) != 2 || history[0].CreatedBy != "layer/0" || history[1].CreatedBy != "layer/1" {
+		t.Errorf("unexpected pruned history: %+v", history)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"bytes"
+	"io"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// MediaTypeFormat is a family of image media-types which an image can be
+// converted to with ConvertMediaTypes.
+type MediaTypeFormat int
+
+const (
+	// OCIMediaTypes are the OCI image-spec media-types.
+	OCIMediaTypes MediaTypeFormat = iota
+
+	// DockerMediaTypes are the Docker image manifest (version 2, schema 2)
+	// media-types.
+	DockerMediaTypes
+)
+
+// String returns the name of the media-type format.
+func (f MediaTypeFormat) String() string {
+	switch f {
+	case OCIMediaTypes:
+		return "oci"
+	case DockerMediaTypes:
+		return "docker"
+	}
+	return "unknown"
+}
+
+// gzipMagic is the header which every gzip stream starts with.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// mediaTypeEquivalent describes a media-type which has an equivalent in both
+// formats. magic (if non-nil) is the header every blob of the media-type must
+// start with.
+type mediaTypeEquivalent struct {
+	oci, docker string
+	magic       []byte
+}
+
+var (
+	manifestEquivalent = mediaTypeEquivalent{oci: ispec.MediaTypeImageManifest, docker: mediatype.DockerMediaTypeManifest}
+	configEquivalent   = mediaTypeEquivalent{oci: ispec.MediaTypeImageConfig, docker: mediatype.DockerMediaTypeImageConfig}
+
+	// Only gzip layers can be converted, since Docker has no (standard)
+	// media-type for uncompressed or zstd layers.
+	layerEquivalents = []mediaTypeEquivalent{
+		{oci: ispec.MediaTypeImageLayerGzip, docker: mediatype.DockerMediaTypeLayerGzip, magic: gzipMagic},
+		{oci: ispec.MediaTypeImageLayerNonDistributableGzip, docker: mediatype.DockerMediaTypeForeignLayerGzip, magic: gzipMagic},
+	}
+)
+
+// convert returns the media-type in the given format.
+func (e mediaTypeEquivalent) convert(format MediaTypeFormat) string {
+	if format == DockerMediaTypes {
+		return e.docker
+	}
+	return e.oci
+}
+
+// isDockerManifest returns whether the given manifest media-type is the
+// Docker manifest media-type.
+func isDockerManifest(mediaType string) bool {
+	return mediaType == mediatype.DockerMediaTypeManifest
+}
+
+// ConvertMediaTypes rewrites the media-types of the manifest, configuration
+// and layers of the image to their equivalents in the given format, without
+// modifying the blobs themselves (so the layers keep the same digests). Each
+// layer blob is checked to ensure its compression matches the new
+// media-type. Layers which have no equivalent in the target format (such as
+// zstd layers when converting to DockerMediaTypes) cause an error, in which
+// case the image is not modified. Converting an image which is already in the
+// given format is a no-op.
+//
+// Note that images using DockerMediaTypes cannot be unpacked by umoci, and so
+// conversion to DockerMediaTypes should be the final step before pushing an
+// image to a registry which only accepts Docker images.
+func (m *Mutator) ConvertMediaTypes(ctx context.Context, format MediaTypeFormat) error {
+	if format != OCIMediaTypes && format != DockerMediaTypes {
+		return errors.Errorf("convert media-types: unknown format %d", format)
+	}
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	// Only modify the manifest once every layer has been checked.
+	newLayers := make([]ispec.Descriptor, len(m.manifest.Layers))
+	for idx, desc := range m.manifest.Layers {
+		equivalent, ok := findLayerEquivalent(desc.MediaType)
+		if !ok {
+			return errors.Errorf("convert media-types: layer %d (%s) has media-type with no %s equivalent: %s", idx, desc.Digest, format, desc.MediaType)
+		}
+		if err := m.checkMagic(ctx, desc, equivalent.magic); err != nil {
+			return errors.Wrapf(err, "convert media-types: layer %d (%s)", idx, desc.Digest)
+		}
+		newLayers[idx] = desc
+		newLayers[idx].MediaType = equivalent.convert(format)
+	}
+	if mt := m.manifest.Config.MediaType; mt != configEquivalent.oci && mt != configEquivalent.docker {
+		return errors.Errorf("convert media-types: config has unknown media-type: %s", mt)
+	}
+
+	m.manifest.Layers = newLayers
+	m.manifest.Config.MediaType = configEquivalent.convert(format)
+	m.mediaType = manifestEquivalent.convert(format)
+	return nil
+}
+
+// findLayerEquivalent returns the layer media-type equivalence which contains
+// the given media-type (in either format).
+func findLayerEquivalent(mediaType string) (mediaTypeEquivalent, bool) {
+	for _, equivalent := range layerEquivalents {
+		if mediaType == equivalent.oci || mediaType == equivalent.docker {
+			return equivalent, true
+		}
+	}
+	return mediaTypeEquivalent{}, false
+}
+
+// checkMagic ensures that the blob referenced by the descriptor starts with
+// the given magic bytes.
+func (m *Mutator) checkMagic(ctx context.Context, desc ispec.Descriptor, magic []byte) error {
+	if magic == nil {
+		return nil
+	}
+	blob, err := m.engine.GetBlob(ctx, desc.Digest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer blob.Close()
+
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(blob, header); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return errors.Wrap(err, "read blob header")
+	}
+	if !bytes.Equal(header, magic) {
+		return errors.Errorf("blob compression does not match media-type %s", desc.MediaType)
+	}
+	return nil
+}
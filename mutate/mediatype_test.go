@@ -0,0 +1,175 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"golang.org/x/net/context"
+)
+
+func TestMutateConvertMediaTypes(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestMutateConvertMediaTypes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, mutator := setupLayers(t, dir,
+		[]layerFile{{"etc/", ""}, {"etc/base", "base"}},
+		[]layerFile{{"etc/app", "app"}},
+	)
+	defer engineExt.Close()
+
+	origManifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.ConvertMediaTypes(ctx, DockerMediaTypes); err != nil {
+		t.Fatalf("unexpected error converting to docker media-types: %+v", err)
+	}
+	newPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+	if mt := newPath.Descriptor().MediaType; mt != mediatype.DockerMediaTypeManifest {
+		t.Errorf("unexpected manifest descriptor media-type: %s", mt)
+	}
+
+	// The manifest blob must include its media-type.
+	reader, err := engineExt.GetBlob(ctx, newPath.Descriptor().Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rawManifest struct {
+		MediaType string `json:"mediaType"`
+	}
+	err = json.NewDecoder(reader).Decode(&rawManifest)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rawManifest.MediaType != mediatype.DockerMediaTypeManifest {
+		t.Errorf("unexpected mediaType in manifest blob: %q", rawManifest.MediaType)
+	}
+
+	// The layer blobs must be untouched.
+	blob, err := engineExt.FromDescriptor(ctx, newPath.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dockerManifest, ok := blob.Data.(ispec.Manifest)
+	blob.Close()
+	if !ok {
+		t.Fatalf("docker manifest blob was not parsed: %T", blob.Data)
+	}
+	if mt := dockerManifest.Config.MediaType; mt != mediatype.DockerMediaTypeImageConfig {
+		t.Errorf("unexpected config media-type: %s", mt)
+	}
+	if len(dockerManifest.Layers) != len(origManifest.Layers) {
+		t.Fatalf("converted manifest has %d layers, expected %d", len(dockerManifest.Layers), len(origManifest.Layers))
+	}
+	for idx, desc := range dockerManifest.Layers {
+		if desc.MediaType != mediatype.DockerMediaTypeLayerGzip {
+			t.Errorf("unexpected media-type of layer %d: %s", idx, desc.MediaType)
+		}
+		if desc.Digest != origManifest.Layers[idx].Digest || desc.Size != origManifest.Layers[idx].Size {
+			t.Errorf("layer %d blob changed: %s -> %s", idx, origManifest.Layers[idx].Digest, desc.Digest)
+		}
+	}
+
+	// Converting back must produce the original media-types.
+	mutator, err = New(engineExt, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.ConvertMediaTypes(ctx, OCIMediaTypes); err != nil {
+		t.Fatalf("unexpected error converting to oci media-types: %+v", err)
+	}
+	ociPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+	if mt := ociPath.Descriptor().MediaType; mt != ispec.MediaTypeImageManifest {
+		t.Errorf("unexpected manifest descriptor media-type: %s", mt)
+	}
+	ociManifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ociManifest.Config.MediaType != ispec.MediaTypeImageConfig {
+		t.Errorf("unexpected config media-type: %s", ociManifest.Config.MediaType)
+	}
+	for idx, desc := range ociManifest.Layers {
+		if desc.MediaType != origManifest.Layers[idx].MediaType || desc.Digest != origManifest.Layers[idx].Digest {
+			t.Errorf("layer %d not restored: %v", idx, desc)
+		}
+	}
+}
+
+func TestMutateConvertMediaTypesInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestMutateConvertMediaTypesInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The layer in this image claims to be gzip-compressed, but isn't.
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.ConvertMediaTypes(ctx, DockerMediaTypes); err == nil {
+		t.Errorf("expected converting an incorrectly compressed layer to fail")
+	}
+
+	// Layers without a docker equivalent cannot be converted.
+	if err := os.Mkdir(filepath.Join(dir, "zstd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	engineExt, mutator := setupLayers(t, filepath.Join(dir, "zstd"), []layerFile{{"etc/app", "app"}})
+	defer engineExt.Close()
+	if err := mutator.RecompressLayers(ctx, ZstdCompressor); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.ConvertMediaTypes(ctx, DockerMediaTypes); err == nil {
+		t.Errorf("expected converting a zstd layer to fail")
+	}
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Layers[0].MediaType != ispec.MediaTypeImageLayer+"+zstd" || manifest.Config.MediaType != ispec.MediaTypeImageConfig {
+		t.Errorf("failed conversion modified the manifest: %v", manifest)
+	}
+}
@@ -23,6 +23,7 @@
 package mutate
 
 import (
+	"encoding/json"
 	"io"
 	"reflect"
 	"time"
@@ -32,6 +33,7 @@ import (
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -52,7 +54,21 @@ func timePtr(t time.Time) *time.Time               { return &t }
 // Mutator is a wrapper around a cas.Engine instance, and is used to mutate a
 // given image (described by a manifest) in a high-level fashion. It handles
 // creating all necessary blobs and modfying other blobs. In order for changes
-// to be committed you must call .Commit().
+// to be committed you must call .Commit() (or .CommitReference()).
+//
+// All changes made through a Mutator are batched in memory until they are
+// committed. While new layer blobs are written to the engine by .Add(), they
+// are not referenced by anything until the new manifest is committed, so an
+// operation which is interrupted before being committed leaves the original
+// image intact (the unreferenced blobs will be removed by a garbage
+// collection).
+//
+// Layer blobs are only ever written or replaced by methods which explicitly
+// operate on layers (such as .Add(), .RemoveLayer(), .RecompressLayers() and
+// .SquashLayers()). Changes to the configuration, metadata or annotations of
+// an image never touch its layers, so the committed manifest references the
+// original layer blobs verbatim (allowing them to be shared with other
+// images).
 //
 // TODO: Implement manifest list support.
 type Mutator struct {
@@ -60,6 +76,10 @@ type Mutator struct {
 	engine casext.Engine
 	source casext.DescriptorPath
 
+	// mediaType is the media-type of the manifest, which can be changed by
+	// ConvertMediaTypes.
+	mediaType string
+
 	// Cached values of the configuration and manifest.
 	manifest *ispec.Manifest
 	config   *ispec.Image
@@ -129,16 +149,18 @@ func (m *Mutator) cache(ctx context.Context) error {
 }
 
 // New creates a new Mutator for the given descriptor (which _must_ have a
-// MediaType of ispec.MediaTypeImageManifest.
+// MediaType of ispec.MediaTypeImageManifest, or be a Docker manifest).
 func New(engine cas.Engine, src casext.DescriptorPath) (*Mutator, error) {
 	// We currently only support changing a given manifest through a walk.
-	if mt := src.Descriptor().MediaType; mt != ispec.MediaTypeImageManifest {
+	mt := src.Descriptor().MediaType
+	if mt != ispec.MediaTypeImageManifest && !isDockerManifest(mt) {
 		return nil, errors.Errorf("unsupported source type: %s", mt)
 	}
 
 	return &Mutator{
-		engine: casext.NewEngine(engine),
-		source: src,
+		engine:    casext.NewEngine(engine),
+		source:    src,
+		mediaType: mt,
 	}, nil
 }
 
@@ -227,10 +249,47 @@ func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta,
 	return nil
 }
 
-// add adds the given layer to the CAS, and mutates the configuration to
-// include the diffID. The returned string is the digest of the *compressed*
-// layer (which is compressed by us).
-func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.History, compressor Compressor) (digest.Digest, int64, error) {
+// SetAnnotations sets the annotations of the image manifest, without
+// modifying the configuration or history. As with Set, the result of
+// Annotations should be used as the source for any modifications.
+func (m *Mutator) SetAnnotations(ctx context.Context, annotations map[string]string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	m.manifest.Annotations = annotations
+	return nil
+}
+
+// MutateImage calls fn with a copy of the full (cached) image configuration,
+// allowing arbitrary fields to be modified. The changes are only applied if fn
+// returns nil, in which case they will be included in the next Commit.
+func (m *Mutator) MutateImage(ctx context.Context, fn func(*ispec.Image) error) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	// Do a deep copy so that a failing fn cannot leave partial changes behind
+	// (the maps and slices in ispec.Image would otherwise be shared).
+	raw, err := json.Marshal(m.config)
+	if err != nil {
+		return errors.Wrap(err, "copy image config")
+	}
+	var config ispec.Image
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return errors.Wrap(err, "copy image config")
+	}
+
+	if err := fn(&config); err != nil {
+		return err
+	}
+	m.config = &config
+	return nil
+}
+
+// add adds the given layer to the CAS (using put to store the compressed
+// layer), and mutates the configuration to include the diffID. The returned
+// digest and size are those returned by put.
+func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.History, compressor Compressor, put func(io.Reader) (digest.Digest, int64, error)) (digest.Digest, int64, error) {
 	if err := m.cache(ctx); err != nil {
 		return "", -1, errors.Wrap(err, "getting cache failed")
 	}
@@ -244,7 +303,7 @@ func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.Hist
 	}
 	defer compressed.Close()
 
-	layerDigest, layerSize, err := m.engine.PutBlob(ctx, compressed)
+	layerDigest, layerSize, err := put(compressed)
 	if err != nil {
 		return "", -1, errors.Wrap(err, "put layer blob")
 	}
@@ -271,29 +330,72 @@ func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.Hist
 // provided reader. The stream must not be compressed, as it is used to
 // generate the DiffIDs for the image metatadata. The provided history entry is
 // appended to the image's history and should correspond to what operations
-// were made to the configuration.
-func (m *Mutator) Add(ctx context.Context, mediaType string, r io.Reader, history *ispec.History, compressor Compressor) (ispec.Descriptor, error) {
+// were made to the configuration. The provided annotations (if any) are
+// attached to the new layer's descriptor in the manifest -- they do not affect
+// the layer blob itself.
+//
+// The layer is compressed and streamed directly into the engine's PutBlob
+// (with the DiffID computed from the uncompressed side of the stream), so the
+// layer is never buffered in full by the Mutator.
+func (m *Mutator) Add(ctx context.Context, mediaType string, r io.Reader, history *ispec.History, compressor Compressor, annotations map[string]string) (ispec.Descriptor, error) {
+	return m.addLayer(ctx, mediaType, r, history, compressor, annotations, 0)
+}
+
+// AddChunked is like Add, except that the compressed layer is stored as a
+// sequence of blobs of chunkSize bytes (the last chunk may be smaller). The
+// chunks are referenced by a layer.ChunkedLayer blob, which is used as the
+// layer's descriptor in the manifest (with a media-type of
+// layer.MediaTypeChunkedLayer). The layer is reassembled from its chunks when
+// it is read by umoci.
+func (m *Mutator) AddChunked(ctx context.Context, mediaType string, r io.Reader, history *ispec.History, compressor Compressor, annotations map[string]string, chunkSize int64) (ispec.Descriptor, error) {
+	if chunkSize <= 0 {
+		return ispec.Descriptor{}, errors.Errorf("invalid layer chunk size %d", chunkSize)
+	}
+	return m.addLayer(ctx, mediaType, r, history, compressor, annotations, chunkSize)
+}
+
+// addLayer implements Add and AddChunked. If chunkSize is zero, the layer is
+// stored as a single blob.
+func (m *Mutator) addLayer(ctx context.Context, mediaType string, r io.Reader, history *ispec.History, compressor Compressor, annotations map[string]string, chunkSize int64) (ispec.Descriptor, error) {
 	desc := ispec.Descriptor{}
 	if err := m.cache(ctx); err != nil {
 		return desc, errors.Wrap(err, "getting cache failed")
 	}
 
-	digest, size, err := m.add(ctx, r, history, compressor)
-	if err != nil {
-		return desc, errors.Wrap(err, "add layer")
-	}
-
 	compressedMediaType := mediaType
 	if compressor.MediaTypeSuffix() != "" {
 		compressedMediaType = compressedMediaType + "+" + compressor.MediaTypeSuffix()
 	}
 
+	layerMediaType := compressedMediaType
+	put := func(r io.Reader) (digest.Digest, int64, error) {
+		return m.engine.PutBlob(ctx, r)
+	}
+	if chunkSize > 0 {
+		layerMediaType = layer.MediaTypeChunkedLayer
+		put = func(r io.Reader) (digest.Digest, int64, error) {
+			return m.putChunked(ctx, r, compressedMediaType, chunkSize)
+		}
+	}
+
+	digest, size, err := m.add(ctx, r, history, compressor, put)
+	if err != nil {
+		return desc, errors.Wrap(err, "add layer")
+	}
+
 	// Append to layers.
 	desc = ispec.Descriptor{
-		MediaType: compressedMediaType,
+		MediaType: layerMediaType,
 		Digest:    digest,
 		Size:      size,
 	}
+	if len(annotations) > 0 {
+		// Make a copy so that callers can't modify the manifest.
+		desc.Annotations = map[string]string{}
+		for k, v := range annotations {
+			desc.Annotations[k] = v
+		}
+	}
 	m.manifest.Layers = append(m.manifest.Layers, desc)
 	return desc, nil
 }
@@ -319,8 +421,16 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 		Size:      configSize,
 	}
 
-	// Now commit the manifest.
-	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, m.manifest)
+	// Now commit the manifest. Docker manifests must include their
+	// media-type, which ispec.Manifest doesn't have a field for.
+	var manifestBlob interface{} = m.manifest
+	if isDockerManifest(m.mediaType) {
+		manifestBlob = struct {
+			MediaType string `json:"mediaType"`
+			*ispec.Manifest
+		}{m.mediaType, m.manifest}
+	}
+	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, manifestBlob)
 	if err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated manifest blob")
 	}
@@ -336,6 +446,7 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 
 	// Replace the end of the path.
 	end := &newPath.Walk[pathLength-1]
+	end.MediaType = m.mediaType
 	end.Digest = manifestDigest
 	end.Size = manifestSize
 
@@ -376,3 +487,20 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 
 	return newPath, nil
 }
+
+// CommitReference is like Commit, except that it also updates the given
+// reference to point to the new root of the descriptor path. All of the blobs
+// are written before the reference is updated, and the reference is updated
+// with a single PutIndex (which replaces the index atomically for the dir
+// engine), so a failure at any point will leave the reference pointing to
+// either the original or the fully mutated image.
+func (m *Mutator) CommitReference(ctx context.Context, refname string) (casext.DescriptorPath, error) {
+	newPath, err := m.Commit(ctx)
+	if err != nil {
+		return casext.DescriptorPath{}, err
+	}
+	if err := m.engine.UpdateReference(ctx, refname, newPath.Root()); err != nil {
+		return casext.DescriptorPath{}, errors.Wrapf(err, "update reference %s", refname)
+	}
+	return newPath, nil
+}
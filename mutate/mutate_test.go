@@ -34,6 +34,7 @@ import (
 	"github.com/opencontainers/umoci/oci/cas"
 	casdir "github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
 	"golang.org/x/net/context"
 )
 
@@ -217,7 +218,7 @@ func TestMutateAdd(t *testing.T) {
 	// Add a new layer.
 	newLayerDesc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, buffer, &ispec.History{
 		Comment: "new layer",
-	}, GzipCompressor)
+	}, GzipCompressor, nil)
 	if err != nil {
 		t.Fatalf("unexpected error adding layer: %+v", err)
 	}
@@ -563,3 +564,255 @@ func TestMutatePath(t *testing.T) {
 		}
 	}
 }
+
+// failIndexEngine is a cas.Engine which fails every PutIndex, simulating a
+// crash while committing a reference.
+type failIndexEngine struct {
+	cas.Engine
+}
+
+func (e failIndexEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	return fmt.Errorf("simulated crash")
+}
+
+func TestMutateCommitReferenceAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateCommitReferenceAtomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	if err := engineExt.UpdateReference(context.Background(), "latest", fromDescriptor); err != nil {
+		t.Fatal(err)
+	}
+	origIndex, err := engine.GetIndex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutateImage := func(engine cas.Engine) *Mutator {
+		mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer := bytes.NewBufferString("contents")
+		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, buffer, nil, GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+		if err := mutator.Set(context.Background(), ispec.ImageConfig{
+			User: "changed:user",
+			Env:  []string{"FOO=bar"},
+		}, Meta{}, nil, nil); err != nil {
+			t.Fatalf("unexpected error setting config: %+v", err)
+		}
+		return mutator
+	}
+
+	checkOriginal := func() {
+		index, err := engine.GetIndex(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(index, origIndex) {
+			t.Errorf("index was modified before commit: expected %+v, got %+v", origIndex, index)
+		}
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), "latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descriptorPaths) != 1 || descriptorPaths[0].Descriptor().Digest != fromDescriptor.Digest {
+			t.Errorf("reference was modified before commit: %+v", descriptorPaths)
+		}
+	}
+
+	// Simulate a crash before the changes are committed.
+	_ = mutateImage(engine)
+	checkOriginal()
+
+	// Simulate a crash while the reference is being updated.
+	if _, err := mutateImage(failIndexEngine{engine}).CommitReference(context.Background(), "latest"); err == nil {
+		t.Errorf("expected CommitReference to fail")
+	}
+	checkOriginal()
+
+	// A successful commit updates everything at once.
+	newPath, err := mutateImage(engine).CommitReference(context.Background(), "latest")
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 || descriptorPaths[0].Descriptor().Digest != newPath.Descriptor().Digest {
+		t.Fatalf("reference was not updated: %+v", descriptorPaths)
+	}
+
+	mutator, err := New(engine, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	if len(mutator.manifest.Layers) != 2 || len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Errorf("layer was not added: %d layers, %d diffids", len(mutator.manifest.Layers), len(mutator.config.RootFS.DiffIDs))
+	}
+	if mutator.config.Config.User != "changed:user" || !reflect.DeepEqual(mutator.config.Config.Env, []string{"FOO=bar"}) {
+		t.Errorf("config was not updated: %+v", mutator.config.Config)
+	}
+}
+
+func TestMutateAddPredictedDiffID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddPredictedDiffID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "bin", "app"), []byte("#!/bin/sh\necho app\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	timestamp := filepath.Join(dir, "timestamp")
+	if err := ioutil.WriteFile(timestamp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opt := &layer.RepackOptions{TimestampReference: timestamp}
+
+	predicted, err := layer.InsertLayerDiffID(src, "/opt/app", false, opt)
+	if err != nil {
+		t.Fatalf("unexpected error predicting diffid: %+v", err)
+	}
+
+	engineExt, mutator := setupLayers(t, dir)
+	defer engineExt.Close()
+
+	// The DiffID doesn't depend on the compression of the layer.
+	for idx, compressor := range []Compressor{GzipCompressor, ZstdCompressor, NoopCompressor} {
+		reader := layer.GenerateInsertLayer(src, "/opt/app", false, opt)
+		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, reader, &ispec.History{}, compressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+		reader.Close()
+		if diffID := mutator.config.RootFS.DiffIDs[idx]; diffID != predicted {
+			t.Errorf("predicted diffid doesn't match packed layer (%s): expected %s got %s", compressor.MediaTypeSuffix(), predicted, diffID)
+		}
+	}
+
+	// Changing the contents must change the predicted DiffID.
+	if err := ioutil.WriteFile(filepath.Join(src, "bin", "app"), []byte("#!/bin/sh\necho changed\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := layer.InsertLayerDiffID(src, "/opt/app", false, opt)
+	if err != nil {
+		t.Fatalf("unexpected error predicting diffid: %+v", err)
+	}
+	if changed == predicted {
+		t.Errorf("predicted diffid didn't change with the contents: %s", changed)
+	}
+}
+
+// Config-only mutations must never rewrite (or recompress) the layer blobs of
+// an image, otherwise layers can no longer be shared with other images.
+func TestMutateConfigPreservesLayers(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestMutateConfigPreservesLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldManifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldBlobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.Set(ctx, ispec.ImageConfig{
+		User:       "changed:user",
+		Env:        []string{"FOO=bar"},
+		Entrypoint: []string{"/bin/sh"},
+	}, Meta{
+		Author:       "Someone Else",
+		Architecture: "arm64",
+		OS:           "linux",
+	}, map[string]string{
+		"org.opencontainers.image.title": "changed",
+	}, &ispec.History{
+		CreatedBy:  "umoci config",
+		EmptyLayer: true,
+	}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	if err := mutator.MutateImage(ctx, func(image *ispec.Image) error {
+		image.Config.Labels = map[string]string{"label": "value"}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error mutating image: %+v", err)
+	}
+
+	newPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if newPath.Descriptor().Digest == fromDescriptor.Digest {
+		t.Fatalf("config-only mutation did not change manifest")
+	}
+
+	newBlob, err := engineExt.FromDescriptor(ctx, newPath.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newBlob.Close()
+	newManifest := newBlob.Data.(ispec.Manifest)
+
+	if newManifest.Config.Digest == oldManifest.Config.Digest {
+		t.Errorf("config-only mutation did not change config blob")
+	}
+	if len(newManifest.Layers) != len(oldManifest.Layers) {
+		t.Fatalf("config-only mutation changed number of layers: expected %d got %d", len(oldManifest.Layers), len(newManifest.Layers))
+	}
+	for idx, oldDesc := range oldManifest.Layers {
+		if newDesc := newManifest.Layers[idx]; !reflect.DeepEqual(oldDesc, newDesc) {
+			t.Errorf("config-only mutation changed layer %d descriptor: expected %#v got %#v", idx, oldDesc, newDesc)
+		}
+	}
+
+	// Only the new config and manifest blobs should have been written.
+	newBlobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := map[digest.Digest]struct{}{}
+	for _, blob := range newBlobs {
+		written[blob] = struct{}{}
+	}
+	for _, blob := range oldBlobs {
+		delete(written, blob)
+	}
+	delete(written, newManifest.Config.Digest)
+	delete(written, newPath.Descriptor().Digest)
+	if len(written) != 0 {
+		t.Errorf("config-only mutation wrote unexpected blobs: %v", written)
+	}
+}
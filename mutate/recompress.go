@@ -0,0 +1,125 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io"
+	"strings"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// RecompressLayers replaces every layer of the image with the same layer
+// compressed using the given compressor. The DiffID of each layer is verified
+// while it is recompressed. Since compression with a given compressor is
+// deterministic, recompressing the layers of several images with the same
+// compressor means that layers with identical contents are stored as the same
+// blob (regardless of how they were compressed originally), and the original
+// blobs can then be removed by a garbage collection.
+//
+// The layer media-types are updated to match the compressor, and any
+// ZstdDictionaryAnnotation is removed (other descriptor annotations are kept).
+// Docker gzip layers recompressed with a different compressor are given the
+// equivalent OCI media-type, since Docker has no media-type for them.
+func (m *Mutator) RecompressLayers(ctx context.Context, compressor Compressor) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if len(m.manifest.Layers) != len(m.config.RootFS.DiffIDs) {
+		return errors.Errorf("image has %d layers but %d diffids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+
+	// Only modify the manifest once every layer has been recompressed.
+	newLayers := make([]ispec.Descriptor, len(m.manifest.Layers))
+	for idx, desc := range m.manifest.Layers {
+		newDesc, err := m.recompressLayer(ctx, idx, desc, compressor)
+		if err != nil {
+			return errors.Wrapf(err, "recompress layer %d", idx)
+		}
+		if newDesc.Digest != desc.Digest {
+			log.Debugf("mutate: recompressed layer %s -> %s", desc.Digest, newDesc.Digest)
+		}
+		newLayers[idx] = newDesc
+	}
+	m.manifest.Layers = newLayers
+	return nil
+}
+
+// recompressLayer recompresses the given layer (at index idx in the image),
+// returning the descriptor of the new layer blob.
+func (m *Mutator) recompressLayer(ctx context.Context, idx int, desc ispec.Descriptor, compressor Compressor) (ispec.Descriptor, error) {
+	reader, blobDesc, err := m.layerReader(ctx, desc)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer reader.Close()
+
+	diffidDigester := cas.BlobAlgorithm.Digester()
+	compressed, err := compressor.Compress(io.TeeReader(reader, diffidDigester.Hash()))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "couldn't create compression for blob")
+	}
+	defer compressed.Close()
+
+	layerDigest, layerSize, err := m.engine.PutBlob(ctx, compressed)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put layer blob")
+	}
+	if diffID := diffidDigester.Digest(); diffID != m.config.RootFS.DiffIDs[idx] {
+		return ispec.Descriptor{}, errors.Wrapf(layer.ErrDiffIDMismatch, "expected %s got %s", m.config.RootFS.DiffIDs[idx], diffID)
+	}
+
+	// Strip the old compression suffix (if any) from the media-type. Docker
+	// layer media-types don't use suffixes, so they are first mapped to their
+	// OCI equivalent (and mapped back if the compression is unchanged). The
+	// recompressed layer is never chunked.
+	mediaType := blobDesc.MediaType
+	if equivalent, ok := findLayerEquivalent(mediaType); ok {
+		mediaType = equivalent.oci
+	}
+	if sep := strings.Index(mediaType, "+"); sep != -1 {
+		mediaType = mediaType[:sep]
+	}
+	if compressor.MediaTypeSuffix() != "" {
+		mediaType = mediaType + "+" + compressor.MediaTypeSuffix()
+	}
+	if equivalent, ok := findLayerEquivalent(mediaType); ok && equivalent.docker == blobDesc.MediaType {
+		mediaType = blobDesc.MediaType
+	}
+
+	newDesc := ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+	for k, v := range desc.Annotations {
+		if k == layer.ZstdDictionaryAnnotation {
+			continue
+		}
+		if newDesc.Annotations == nil {
+			newDesc.Annotations = map[string]string{}
+		}
+		newDesc.Annotations[k] = v
+	}
+	return newDesc, nil
+}
@@ -0,0 +1,123 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestMutateRecompressLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRecompressLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, mutator := setupLayers(t, dir,
+		[]layerFile{{"etc/", ""}, {"etc/base", "base"}},
+		[]layerFile{{"etc/app", "app"}},
+	)
+	defer engineExt.Close()
+
+	if err := mutator.RecompressLayers(context.Background(), ZstdCompressor); err != nil {
+		t.Fatalf("unexpected error recompressing layers: %+v", err)
+	}
+	zstdManifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zstdLayers []ispec.Descriptor
+	for _, desc := range zstdManifest.Layers {
+		if desc.MediaType != ispec.MediaTypeImageLayer+"+zstd" {
+			t.Errorf("unexpected media-type of recompressed layer: %s", desc.MediaType)
+		}
+		zstdLayers = append(zstdLayers, desc)
+	}
+
+	// Recompressing the recompressed layers must be reproducible.
+	if err := mutator.RecompressLayers(context.Background(), ZstdCompressor); err != nil {
+		t.Fatalf("unexpected error recompressing layers again: %+v", err)
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, desc := range manifest.Layers {
+		if desc.Digest != zstdLayers[idx].Digest {
+			t.Errorf("recompressing layer %d is not reproducible: %s != %s", idx, desc.Digest, zstdLayers[idx].Digest)
+		}
+	}
+
+	// A corrupt DiffID must be detected.
+	mutator.config.RootFS.DiffIDs[1] = digest.FromString("bad diffid")
+	if err := mutator.RecompressLayers(context.Background(), GzipCompressor); !errors.Is(err, layer.ErrDiffIDMismatch) {
+		t.Errorf("expected recompressing with a bad diffid to fail with ErrDiffIDMismatch: %+v", err)
+	}
+}
+
+func TestMutateRecompressDockerLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRecompressDockerLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, mutator := setupLayers(t, dir,
+		[]layerFile{{"etc/", ""}, {"etc/base", "base"}},
+	)
+	defer engineExt.Close()
+
+	for _, test := range []struct {
+		compressor Compressor
+		expected   string
+	}{
+		{ZstdCompressor, ispec.MediaTypeImageLayer + "+zstd"},
+		{NoopCompressor, ispec.MediaTypeImageLayer},
+		{GzipCompressor, mediatype.DockerMediaTypeLayerGzip},
+	} {
+		// Reset the layers to Docker gzip layers.
+		if err := mutator.RecompressLayers(context.Background(), GzipCompressor); err != nil {
+			t.Fatalf("unexpected error recompressing layers with gzip: %+v", err)
+		}
+		if err := mutator.ConvertMediaTypes(context.Background(), DockerMediaTypes); err != nil {
+			t.Fatalf("unexpected error converting to docker media-types: %+v", err)
+		}
+
+		if err := mutator.RecompressLayers(context.Background(), test.compressor); err != nil {
+			t.Fatalf("unexpected error recompressing docker layers with %s: %+v", test.compressor.MediaTypeSuffix(), err)
+		}
+		manifest, err := mutator.Manifest(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, desc := range manifest.Layers {
+			if desc.MediaType != test.expected {
+				t.Errorf("unexpected media-type of recompressed docker layer: expected %s got %s", test.expected, desc.MediaType)
+			}
+		}
+	}
+}
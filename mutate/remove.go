@@ -0,0 +1,257 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	zstd "github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Whiteout prefixes, as defined by the OCI image specification.
+const (
+	whPrefix = ".wh."
+	whOpaque = whPrefix + whPrefix + ".opq"
+)
+
+// ErrLayerDependency is returned by RemoveLayer if a later layer in the image
+// depends on the layer being removed.
+var ErrLayerDependency = errors.New("layer has dependent layers")
+
+// layerEntry is the relevant information about an entry in a layer archive.
+type layerEntry struct {
+	// Path is the cleaned absolute path of the entry (or of the whited-out
+	// path for whiteouts).
+	Path string
+
+	// IsDir is whether the entry is a directory.
+	IsDir bool
+
+	// Whiteout and Opaque are set for regular and opaque whiteouts.
+	Whiteout, Opaque bool
+
+	// Linkname is the cleaned absolute target of hardlinks.
+	Linkname string
+}
+
+// layerReader returns a reader for the uncompressed contents of the given
+// layer, as well as the descriptor of the layer blob (which differs from desc
+// for chunked layers, see layer.OpenLayer). The blob is verified against the
+// descriptor as it is read.
+func (m *Mutator) layerReader(ctx context.Context, desc ispec.Descriptor) (io.ReadCloser, ispec.Descriptor, error) {
+	blob, desc, err := layer.OpenLayer(ctx, m.engine, desc)
+	if err != nil {
+		return nil, ispec.Descriptor{}, err
+	}
+
+	// Docker layer media-types have no compression suffix, so use their OCI
+	// equivalent to pick the decompressor.
+	mediaType := desc.MediaType
+	if equivalent, ok := findLayerEquivalent(mediaType); ok {
+		mediaType = equivalent.oci
+	}
+
+	var decompressed io.ReadCloser
+	switch decompress := layer.GetDecompressor(mediaType); {
+	case decompress != nil:
+		decompressed, err = decompress(blob)
+		if err != nil {
+			blob.Close()
+			return nil, ispec.Descriptor{}, errors.Wrapf(err, "decompress %s layer", desc.MediaType)
+		}
+	case strings.HasSuffix(mediaType, "+gzip"):
+		decompressed, err = gzip.NewReader(blob)
+		if err != nil {
+			blob.Close()
+			return nil, ispec.Descriptor{}, errors.Wrap(err, "create gzip reader")
+		}
+	case strings.HasSuffix(mediaType, "+zstd"):
+		zr, err := zstd.NewReader(blob)
+		if err != nil {
+			blob.Close()
+			return nil, ispec.Descriptor{}, errors.Wrap(err, "create zstd reader")
+		}
+		decompressed = zr.IOReadCloser()
+	default:
+		return blob, desc, nil
+	}
+	return layerReadCloser{Reader: decompressed, closers: []io.Closer{decompressed, blob}}, desc, nil
+}
+
+// layerReadCloser is an io.ReadCloser which closes every one of its closers
+// (the decompressor and the underlying blob) when closed.
+type layerReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r layerReadCloser) Close() error {
+	var err error
+	for _, closer := range r.closers {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// layerEntries returns the list of entries in the given layer blob.
+func (m *Mutator) layerEntries(ctx context.Context, desc ispec.Descriptor) ([]layerEntry, error) {
+	reader, _, err := m.layerReader(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var entries []layerEntry
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read next entry")
+		}
+
+		entry := layerEntry{
+			Path:  path.Clean("/" + hdr.Name),
+			IsDir: hdr.Typeflag == tar.TypeDir,
+		}
+		dir, file := path.Split(entry.Path)
+		switch {
+		case file == whOpaque:
+			entry.Path = path.Clean(dir)
+			entry.Opaque = true
+		case strings.HasPrefix(file, whPrefix):
+			entry.Path = path.Join(dir, strings.TrimPrefix(file, whPrefix))
+			entry.Whiteout = true
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			entry.Linkname = path.Clean("/" + hdr.Linkname)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// isWithin returns whether the path is the same as (or is inside) dir.
+func isWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// checkLayerDependencies returns an error (wrapping ErrLayerDependency) if any
+// of the layers after index reference the contents of the layer at index, or
+// if the layer at index contains whiteouts (since removing it would resurrect
+// the paths it deleted). Directories present in both layers are not
+// considered to be references, since every layer usually contains entries for
+// the parent directories of its contents.
+func (m *Mutator) checkLayerDependencies(ctx context.Context, index int) error {
+	removed, err := m.layerEntries(ctx, m.manifest.Layers[index])
+	if err != nil {
+		return errors.Wrapf(err, "read layer %d", index)
+	}
+	paths := map[string]bool{}
+	for _, entry := range removed {
+		if entry.Whiteout || entry.Opaque {
+			return errors.Wrapf(ErrLayerDependency, "layer %d contains a whiteout for %s", index, entry.Path)
+		}
+		paths[entry.Path] = entry.IsDir
+	}
+
+	for idx := index + 1; idx < len(m.manifest.Layers); idx++ {
+		entries, err := m.layerEntries(ctx, m.manifest.Layers[idx])
+		if err != nil {
+			return errors.Wrapf(err, "read layer %d", idx)
+		}
+		for _, entry := range entries {
+			if entry.Whiteout || entry.Opaque {
+				// Opaque whiteouts only remove the contents of the directory.
+				for removedPath := range paths {
+					if isWithin(removedPath, entry.Path) && !(entry.Opaque && removedPath == entry.Path) {
+						return errors.Wrapf(ErrLayerDependency, "layer %d whites out %s from layer %d", idx, removedPath, index)
+					}
+				}
+				continue
+			}
+			if isDir, ok := paths[entry.Path]; ok && !(isDir && entry.IsDir) {
+				return errors.Wrapf(ErrLayerDependency, "layer %d overwrites %s from layer %d", idx, entry.Path, index)
+			}
+			if isDir, ok := paths[entry.Linkname]; ok && !isDir {
+				return errors.Wrapf(ErrLayerDependency, "layer %d hardlinks to %s from layer %d", idx, entry.Linkname, index)
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveLayer removes the layer at the given index (where 0 is the base layer)
+// from the image, along with its DiffID and the corresponding history entry.
+// Unless force is set, the layer is only removed if no later layer depends on
+// it -- that is, no later layer contains whiteouts of, overwrites of or
+// hardlinks to the contents of the layer -- and the layer doesn't contain any
+// whiteouts itself. Otherwise an error wrapping ErrLayerDependency is
+// returned.
+func (m *Mutator) RemoveLayer(ctx context.Context, index int, force bool) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if index < 0 || index >= len(m.manifest.Layers) {
+		return errors.Errorf("remove layer: index %d out of range (image has %d layers)", index, len(m.manifest.Layers))
+	}
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("remove layer: config has %d diff_ids but manifest has %d layers", len(m.config.RootFS.DiffIDs), len(m.manifest.Layers))
+	}
+	if !force {
+		if err := m.checkLayerDependencies(ctx, index); err != nil {
+			return errors.Wrap(err, "remove layer")
+		}
+	}
+
+	// Find the history entry of the layer, which is the index-th entry that
+	// isn't an empty layer.
+	historyIdx, layerIdx := -1, 0
+	for idx, history := range m.config.History {
+		if history.EmptyLayer {
+			continue
+		}
+		if layerIdx == index {
+			historyIdx = idx
+			break
+		}
+		layerIdx++
+	}
+	if historyIdx >= 0 {
+		m.config.History = append(m.config.History[:historyIdx:historyIdx], m.config.History[historyIdx+1:]...)
+	} else {
+		log.Warnf("remove layer: no history entry found for layer %d", index)
+	}
+
+	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs[:index:index], m.config.RootFS.DiffIDs[index+1:]...)
+	m.manifest.Layers = append(m.manifest.Layers[:index:index], m.manifest.Layers[index+1:]...)
+	return nil
+}
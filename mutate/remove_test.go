@@ -0,0 +1,230 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	casdir "github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// layerFile is a single entry in a test layer. If contents is empty, the
+// entry is a directory (or a whiteout if the name has the whiteout prefix).
+type layerFile struct {
+	name, contents string
+}
+
+// setupLayers creates an image with one layer (with a history entry) for each
+// of the given lists of entries, and returns a Mutator for it.
+func setupLayers(t *testing.T, dir string, layers ...[]layerFile) (casext.Engine, *Mutator) {
+	image := filepath.Join(dir, "image")
+	if err := casdir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := casdir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Image{
+		RootFS: ispec.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, files := range layers {
+		history := &ispec.History{CreatedBy: fmt.Sprintf("layer/%d", idx)}
+		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, layerTar(t, files), history, GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer %d: %+v", idx, err)
+		}
+	}
+	return engineExt, mutator
+}
+
+// layerTar returns an (uncompressed) layer archive containing the given
+// entries.
+func layerTar(t *testing.T, files []layerFile) *bytes.Buffer {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, file := range files {
+		hdr := &tar.Header{Name: file.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file.contents))}
+		if file.contents == "" && !strings.HasPrefix(filepath.Base(file.name), whPrefix) {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(file.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+func TestMutateRemoveLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRemoveLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, mutator := setupLayers(t, dir,
+		[]layerFile{{"etc/", ""}, {"etc/base", "base"}},
+		[]layerFile{{"var/", ""}, {"var/cache/", ""}, {"var/cache/blob", "cache"}},
+		[]layerFile{{"etc/", ""}, {"etc/app", "app"}, {"var/", ""}},
+	)
+	defer engineExt.Close()
+
+	if err := mutator.RemoveLayer(context.Background(), 3, false); err == nil {
+		t.Errorf("expected error removing out-of-range layer")
+	}
+	if err := mutator.RemoveLayer(context.Background(), 1, false); err != nil {
+		t.Fatalf("unexpected error removing independent layer: %+v", err)
+	}
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 2 || len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Fatalf("unexpected number of layers after removal: %d layers, %d diffids", len(manifest.Layers), len(mutator.config.RootFS.DiffIDs))
+	}
+	if history := mutator.config.History; len(history) != 2 || history[0].CreatedBy != "layer/0" || history[1].CreatedBy != "layer/2" {
+		t.Errorf("unexpected history after removal: %+v", history)
+	}
+
+	// The image must still be unpackable (which verifies the DiffIDs), and
+	// the contents of the removed layer must be gone.
+	blob, err := engineExt.FromDescriptor(context.Background(), newPath.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	rootfs := filepath.Join(dir, "rootfs")
+	unpackOptions := &layer.UnpackOptions{MapOptions: layer.MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    os.Geteuid() != 0,
+	}}
+	if err := layer.UnpackRootfs(context.Background(), engineExt, rootfs, blob.Data.(ispec.Manifest), unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	for _, name := range []string{"etc/base", "etc/app", "var"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, name)); err != nil {
+			t.Errorf("expected %s to exist after removal: %v", name, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "var/cache")); !os.IsNotExist(err) {
+		t.Errorf("expected contents of removed layer to be gone: %v", err)
+	}
+}
+
+func TestMutateRemoveLayerDependency(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		layers [][]layerFile
+	}{
+		{"Whiteout", [][]layerFile{
+			{{"var/", ""}, {"var/cache/", ""}, {"var/cache/blob", "cache"}},
+			{{"var/cache/.wh.blob", ""}},
+		}},
+		{"ParentWhiteout", [][]layerFile{
+			{{"var/", ""}, {"var/cache/", ""}, {"var/cache/blob", "cache"}},
+			{{"var/.wh.cache", ""}},
+		}},
+		{"Opaque", [][]layerFile{
+			{{"var/", ""}, {"var/cache/", ""}, {"var/cache/blob", "cache"}},
+			{{"var/cache/.wh..wh..opq", ""}},
+		}},
+		{"Overwrite", [][]layerFile{
+			{{"var/", ""}, {"var/cache/", ""}, {"var/cache/blob", "cache"}},
+			{{"var/cache/blob", "new"}},
+		}},
+		{"OwnWhiteout", [][]layerFile{
+			{{"var/.wh.old", ""}},
+			{{"etc/", ""}},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestMutateRemoveLayerDependency")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			engineExt, mutator := setupLayers(t, dir, test.layers...)
+			defer engineExt.Close()
+
+			if err := mutator.RemoveLayer(context.Background(), 0, false); !errors.Is(err, ErrLayerDependency) {
+				t.Fatalf("expected ErrLayerDependency removing depended-on layer: %+v", err)
+			}
+			if len(mutator.manifest.Layers) != 2 {
+				t.Errorf("failed removal modified the manifest")
+			}
+			if err := mutator.RemoveLayer(context.Background(), 0, true); err != nil {
+				t.Fatalf("unexpected error force-removing layer: %+v", err)
+			}
+			if len(mutator.manifest.Layers) != 1 || len(mutator.config.RootFS.DiffIDs) != 1 || len(mutator.config.History) != 1 {
+				t.Errorf("unexpected image after forced removal: %d layers", len(mutator.manifest.Layers))
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mutate
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// RepairDiffIDs replaces the DiffIDs in the image configuration with the
+// DiffIDs computed by decompressing every layer in the manifest. This is
+// useful for rescuing images whose configuration was corrupted or
+// incorrectly hand-edited. The number of layers in the manifest is taken to
+// be correct, and a warning is logged if the image history does not match
+// it. The number of DiffIDs which were changed is returned.
+func (m *Mutator) RepairDiffIDs(ctx context.Context) (int, error) {
+	if err := m.cache(ctx); err != nil {
+		return 0, errors.Wrap(err, "getting cache failed")
+	}
+
+	// Only modify the configuration once every layer has been read.
+	diffIDs := make([]digest.Digest, len(m.manifest.Layers))
+	for idx, desc := range m.manifest.Layers {
+		diffID, err := m.layerDiffID(ctx, desc)
+		if err != nil {
+			return 0, errors.Wrapf(err, "compute diffid of layer %d", idx)
+		}
+		diffIDs[idx] = diffID
+	}
+
+	changed := 0
+	for idx, diffID := range diffIDs {
+		if idx >= len(m.config.RootFS.DiffIDs) || m.config.RootFS.DiffIDs[idx] != diffID {
+			log.Infof("repairing diffid of layer %d: %s", idx, diffID)
+			changed++
+		}
+	}
+	if extra := len(m.config.RootFS.DiffIDs) - len(diffIDs); extra > 0 {
+		log.Infof("removing %d extra diffids", extra)
+		changed += extra
+	}
+	m.config.RootFS.Type = "layers"
+	m.config.RootFS.DiffIDs = diffIDs
+
+	if err := layer.CheckHistory(*m.manifest, *m.config); err != nil {
+		log.Warnf("image history does not match its layers: %v", err)
+	}
+	return changed, nil
+}
+
+// emptyLayerHint returns whether the given history entry looks like it was
+// produced by a configuration-only change (and so should be an empty-layer
+// entry), based on the markers used by common build tools.
+func emptyLayerHint(history ispec.History) bool {
+	// Docker (and tools imitating it) mark non-RUN instructions with "#(nop)",
+	// though ADD and COPY still produce layers.
+	if idx := strings.Index(history.CreatedBy, "#(nop)"); idx != -1 {
+		instruction := strings.Fields(history.CreatedBy[idx+len("#(nop)"):])
+		return len(instruction) == 0 || (instruction[0] != "ADD" && instruction[0] != "COPY")
+	}
+	return strings.HasPrefix(history.CreatedBy, "umoci config")
+}
+
+// RepairEmptyLayers corrects the empty_layer flags of the image history so
+// that the number of non-empty history entries matches the number of layers
+// in the manifest (which is taken to be correct), since tools such as Docker
+// otherwise attribute layers to the wrong history entries. If the flags are
+// already consistent (or the image has no history), nothing is changed.
+//
+// Otherwise, each entry is ranked by how likely it is to describe a layer:
+// entries which are currently non-empty rank above entries which are empty,
+// and within each group entries without configuration-only markers (such as
+// Docker's "#(nop)") rank above those with them. The highest-ranked entries
+// (earlier entries first, for entries with the same rank) are marked
+// non-empty, and the rest are marked empty. An error wrapping
+// layer.ErrHistoryMismatch is returned if there are fewer history entries
+// than layers. The number of entries whose flag was changed is returned.
+func (m *Mutator) RepairEmptyLayers(ctx context.Context) (int, error) {
+	if err := m.cache(ctx); err != nil {
+		return 0, errors.Wrap(err, "getting cache failed")
+	}
+	if err := layer.CheckHistory(*m.manifest, *m.config); err == nil {
+		return 0, nil
+	}
+	history := m.config.History
+	if len(history) < len(m.manifest.Layers) {
+		return 0, errors.Wrapf(layer.ErrHistoryMismatch, "repair empty layers: config has %d history entries but manifest has %d layers", len(history), len(m.manifest.Layers))
+	}
+
+	rank := func(h ispec.History) int {
+		r := 0
+		if h.EmptyLayer {
+			r += 2
+		}
+		if emptyLayerHint(h) {
+			r++
+		}
+		return r
+	}
+	order := make([]int, len(history))
+	for idx := range order {
+		order[idx] = idx
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rank(history[order[i]]) < rank(history[order[j]])
+	})
+	layerEntries := map[int]bool{}
+	for _, idx := range order[:len(m.manifest.Layers)] {
+		layerEntries[idx] = true
+	}
+
+	// Don't modify the caller's copy of the history.
+	repaired := make([]ispec.History, len(history))
+	changed := 0
+	for idx, h := range history {
+		if empty := !layerEntries[idx]; h.EmptyLayer != empty {
+			log.Infof("repairing history entry %d (%q): empty_layer=%v", idx, h.CreatedBy, empty)
+			h.EmptyLayer = empty
+			changed++
+		}
+		repaired[idx] = h
+	}
+	m.config.History = repaired
+	return changed, nil
+}
+
+// layerDiffID returns the digest of the uncompressed contents of the given
+// layer blob.
+func (m *Mutator) layerDiffID(ctx context.Context, desc ispec.Descriptor) (digest.Digest, error) {
+	reader, _, err := m.layerReader(ctx, desc)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	digester := cas.BlobAlgorithm.Digester()
+	if _, err := io.Copy(digester.Hash(), reader); err != nil {
+		return "", errors.Wrap(err, "read layer")
+	}
+	return digester.Digest(), nil
+}
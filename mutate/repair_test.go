@@ -0,0 +1,187 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mutate
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestMutateRepairDiffIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRepairDiffIDs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, mutator := setupLayers(t, dir,
+		[]layerFile{{"etc/", ""}, {"etc/base", "base"}},
+		[]layerFile{{"etc/app", "app"}},
+	)
+	defer engineExt.Close()
+
+	goodDiffIDs := append([]digest.Digest{}, mutator.config.RootFS.DiffIDs...)
+
+	// Break the DiffIDs and commit the broken image.
+	mutator.config.RootFS.DiffIDs = []digest.Digest{
+		digest.FromString("bad diffid"),
+		goodDiffIDs[1],
+		digest.FromString("extra diffid"),
+	}
+	brokenPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing broken image: %+v", err)
+	}
+
+	mutator, err = New(engineExt, brokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := mutator.RepairDiffIDs(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error repairing diffids: %+v", err)
+	}
+	if changed != 2 {
+		t.Errorf("expected 2 diffids to be repaired, got %d", changed)
+	}
+	repairedPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing repaired image: %+v", err)
+	}
+
+	// The repaired image must pass verification when it is unpacked.
+	blob, err := engineExt.FromDescriptor(context.Background(), repairedPath.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	manifest := blob.Data.(ispec.Manifest)
+	configBlob, err := engineExt.FromDescriptor(context.Background(), manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer configBlob.Close()
+	config := configBlob.Data.(ispec.Image)
+	if err := layer.CheckDiffIDs(manifest, config); err != nil {
+		t.Errorf("repaired image fails diffid check: %+v", err)
+	}
+	for idx, diffID := range config.RootFS.DiffIDs {
+		if diffID != goodDiffIDs[idx] {
+			t.Errorf("diffid %d not repaired: expected %s got %s", idx, goodDiffIDs[idx], diffID)
+		}
+	}
+	rootfs, err := ioutil.TempDir(dir, "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := layer.UnpackRootfs(context.Background(), engineExt, rootfs, manifest, &layer.UnpackOptions{
+		MapOptions: layer.MapOptions{Rootless: os.Geteuid() != 0},
+	}); err != nil {
+		t.Errorf("unexpected error unpacking repaired image: %+v", err)
+	}
+
+	// Repairing a correct image is a no-op.
+	if changed, err := mutator.RepairDiffIDs(context.Background()); err != nil || changed != 0 {
+		t.Errorf("expected repairing a correct image to change nothing: changed=%d err=%+v", changed, err)
+	}
+}
+
+func TestMutateRepairEmptyLayers(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		history   []ispec.History
+		wantEmpty []bool
+		changed   int
+	}{
+		{"TooManyNonEmpty", []ispec.History{
+			{CreatedBy: "/bin/sh -c #(nop) ENV FOO=bar"},
+			{CreatedBy: "/bin/sh -c #(nop) ADD file:abc in /"},
+			{CreatedBy: "/bin/sh -c make install"},
+			{CreatedBy: "umoci config --config.cmd=/bin/app"},
+		}, []bool{true, false, false, true}, 2},
+		{"TooFewNonEmpty", []ispec.History{
+			{CreatedBy: "layer/0"},
+			{CreatedBy: "umoci config", EmptyLayer: true},
+			{CreatedBy: "layer/1", EmptyLayer: true},
+		}, []bool{false, true, false}, 1},
+		{"Consistent", []ispec.History{
+			{CreatedBy: "layer/0"},
+			{CreatedBy: "umoci config", EmptyLayer: true},
+			{CreatedBy: "layer/1"},
+		}, []bool{false, true, false}, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestMutateRepairEmptyLayers")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			engineExt, mutator := setupLayers(t, dir,
+				[]layerFile{{"etc/", ""}, {"etc/base", "base"}},
+				[]layerFile{{"etc/app", "app"}},
+			)
+			defer engineExt.Close()
+
+			mutator.config.History = test.history
+			changed, err := mutator.RepairEmptyLayers(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error repairing empty layers: %+v", err)
+			}
+			if changed != test.changed {
+				t.Errorf("unexpected number of changed entries: expected %d got %d", test.changed, changed)
+			}
+			for idx, h := range mutator.config.History {
+				if h.EmptyLayer != test.wantEmpty[idx] {
+					t.Errorf("history entry %d (%q): expected empty_layer=%v", idx, h.CreatedBy, test.wantEmpty[idx])
+				}
+			}
+			if err := layer.CheckHistory(*mutator.manifest, *mutator.config); err != nil {
+				t.Errorf("repaired history still doesn't match layers: %v", err)
+			}
+			if test.changed > 0 && test.history[0].EmptyLayer != false {
+				t.Errorf("caller's history was modified")
+			}
+		})
+	}
+
+	t.Run("TooFewEntries", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "umoci-TestMutateRepairEmptyLayers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		engineExt, mutator := setupLayers(t, dir,
+			[]layerFile{{"etc/", ""}},
+			[]layerFile{{"etc/app", "app"}},
+		)
+		defer engineExt.Close()
+
+		mutator.config.History = []ispec.History{{CreatedBy: "layer/0", EmptyLayer: true}}
+		if _, err := mutator.RepairEmptyLayers(context.Background()); errors.Cause(err) != layer.ErrHistoryMismatch {
+			t.Errorf("expected ErrHistoryMismatch with too few history entries: %+v", err)
+		}
+	})
+}
@@ -0,0 +1,367 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mutate
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// squashKey identifies an entry (by its index in the archive) of one of the
+// layers being squashed.
+type squashKey struct {
+	layer, entry int
+}
+
+func (k squashKey) less(other squashKey) bool {
+	if k.layer != other.layer {
+		return k.layer < other.layer
+	}
+	return k.entry < other.entry
+}
+
+// squashPlan describes which entries of the squashed layers are part of the
+// new layer.
+type squashPlan struct {
+	// keep is the set of entries which are copied to the new layer.
+	keep map[squashKey]bool
+
+	// linknames maps every kept hardlink to the (cleaned absolute) path of
+	// its target in the new layer.
+	linknames map[squashKey]string
+
+	// moved maps the entries which were replaced by a later layer but are
+	// still the target of a kept hardlink to the path of the first such
+	// hardlink. The entry is copied to the new layer under that path (in
+	// place of the hardlink).
+	moved map[squashKey]string
+}
+
+// squashTree is the set of live paths while planning a squash. Paths are also
+// indexed by their parent directory, so that removing a subtree only needs to
+// visit the paths inside it.
+type squashTree struct {
+	live     map[string]squashKey
+	children map[string]map[string]struct{}
+}
+
+func newSquashTree() *squashTree {
+	return &squashTree{
+		live:     map[string]squashKey{},
+		children: map[string]map[string]struct{}{},
+	}
+}
+
+// add marks pth as created by the given entry, replacing any previous entry
+// for pth (but not its children).
+func (t *squashTree) add(pth string, key squashKey) {
+	t.live[pth] = key
+	for pth != "/" {
+		parent := path.Dir(pth)
+		siblings, ok := t.children[parent]
+		if !ok {
+			siblings = map[string]struct{}{}
+			t.children[parent] = siblings
+		}
+		if _, ok := siblings[pth]; ok {
+			break
+		}
+		siblings[pth] = struct{}{}
+		pth = parent
+	}
+}
+
+// remove removes pth (or only its children, if self is not set) if it was
+// created by a layer before the given one.
+func (t *squashTree) remove(pth string, self bool, before int) {
+	for child := range t.children[pth] {
+		t.remove(child, true, before)
+	}
+	if key, ok := t.live[pth]; ok && self && key.layer < before {
+		delete(t.live, pth)
+	}
+	// Drop paths which no longer have anything live underneath them.
+	if _, ok := t.live[pth]; !ok && len(t.children[pth]) == 0 {
+		delete(t.children, pth)
+		if pth != "/" {
+			delete(t.children[path.Dir(pth)], pth)
+		}
+	}
+}
+
+// planSquash computes the squashPlan for the first count layers of the image,
+// by applying the entries of each layer (including whiteouts) in order.
+func (m *Mutator) planSquash(ctx context.Context, count int) (*squashPlan, error) {
+	var (
+		tree    = newSquashTree()
+		paths   = map[squashKey]string{}
+		targets = map[squashKey]squashKey{}
+	)
+
+	for layerIdx := 0; layerIdx < count; layerIdx++ {
+		entries, err := m.layerEntries(ctx, m.manifest.Layers[layerIdx])
+		if err != nil {
+			return nil, errors.Wrapf(err, "read layer %d", layerIdx)
+		}
+		for entryIdx, entry := range entries {
+			key := squashKey{layer: layerIdx, entry: entryIdx}
+
+			// Whiteouts only apply to lower layers.
+			switch {
+			case entry.Whiteout:
+				tree.remove(entry.Path, true, layerIdx)
+				continue
+			case entry.Opaque:
+				tree.remove(entry.Path, false, layerIdx)
+				continue
+			}
+
+			// Hardlinks are resolved when they are extracted, so we need to
+			// track the original entry they refer to.
+			if entry.Linkname != "" {
+				target, ok := tree.live[entry.Linkname]
+				if !ok {
+					return nil, errors.Errorf("layer %d: hardlink %s refers to non-existent %s", layerIdx, entry.Path, entry.Linkname)
+				}
+				if root, ok := targets[target]; ok {
+					target = root
+				}
+				targets[key] = target
+			}
+
+			// Non-directories replace anything at their path, while
+			// directories only replace the metadata of an existing directory.
+			if !entry.IsDir {
+				tree.remove(entry.Path, true, layerIdx+1)
+			}
+			tree.add(entry.Path, key)
+			paths[key] = entry.Path
+		}
+	}
+
+	plan := &squashPlan{
+		keep:      map[squashKey]bool{},
+		linknames: map[squashKey]string{},
+		moved:     map[squashKey]string{},
+	}
+	var kept []squashKey
+	for _, key := range tree.live {
+		plan.keep[key] = true
+		kept = append(kept, key)
+	}
+	// Go through the hardlinks in order, so that the result is reproducible.
+	sort.Slice(kept, func(i, j int) bool { return kept[i].less(kept[j]) })
+	for _, key := range kept {
+		target, ok := targets[key]
+		if !ok {
+			continue
+		}
+		switch movedPath, moved := plan.moved[target]; {
+		case plan.keep[target]:
+			plan.linknames[key] = paths[target]
+		case moved:
+			plan.linknames[key] = movedPath
+		default:
+			plan.moved[target] = paths[key]
+			delete(plan.keep, key)
+		}
+	}
+	return plan, nil
+}
+
+// writeSquashed writes the entries of the given layer which are part of the
+// squashed layer (according to plan) to tw.
+func (m *Mutator) writeSquashed(ctx context.Context, tw *tar.Writer, layerIdx int, plan *squashPlan) error {
+	reader, _, err := m.layerReader(ctx, m.manifest.Layers[layerIdx])
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	for entryIdx := 0; ; entryIdx++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		key := squashKey{layer: layerIdx, entry: entryIdx}
+		if plan.keep[key] {
+			if linkname, ok := plan.linknames[key]; ok {
+				hdr.Linkname = strings.TrimPrefix(linkname, "/")
+				delete(hdr.PAXRecords, "linkpath")
+				hdr.Format = tar.FormatUnknown
+			}
+		} else if movedPath, ok := plan.moved[key]; ok {
+			hdr.Name = strings.TrimPrefix(movedPath, "/")
+			delete(hdr.PAXRecords, "path")
+			hdr.Format = tar.FormatUnknown
+		} else {
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write header for %s", hdr.Name)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrapf(err, "copy contents of %s", hdr.Name)
+		}
+	}
+	return nil
+}
+
+// squashHistory returns a copy of history where the history entries of the
+// first count layers have been replaced by a single entry (in the place of
+// the entry of the last of those layers). Empty-layer entries are left
+// untouched. The CreatedBy of the new entry is the CreatedBy of every replaced
+// entry (ignoring empty and repeated values) separated by "; ". If history
+// doesn't have entries for count layers, ok is false.
+func squashHistory(history []ispec.History, count int) (_ []ispec.History, ok bool) {
+	var (
+		squashed  []ispec.History
+		createdBy []string
+		layerIdx  int
+	)
+	for _, h := range history {
+		if h.EmptyLayer || layerIdx >= count {
+			squashed = append(squashed, h)
+			continue
+		}
+		if h.CreatedBy != "" && (len(createdBy) == 0 || createdBy[len(createdBy)-1] != h.CreatedBy) {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+		layerIdx++
+		if layerIdx == count {
+			h.CreatedBy = strings.Join(createdBy, collapsedCreatedBySeparator)
+			squashed = append(squashed, h)
+		}
+	}
+	return squashed, layerIdx == count
+}
+
+// SquashLayers replaces the oldest count layers of the image (the base layer
+// and the count-1 layers above it) with a single layer compressed with the
+// given compressor, which has the same contents as the squashed layers when
+// extracted. The whiteouts in the squashed layers are resolved (and are not
+// included in the new layer, since there are no layers below it). The
+// DiffIDs and history are updated to match -- see squashHistory for how the
+// history entries are merged. The new layer is never chunked, and the
+// annotations of the squashed layer descriptors are not retained.
+func (m *Mutator) SquashLayers(ctx context.Context, count int, compressor Compressor) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if count < 2 || count > len(m.manifest.Layers) {
+		return errors.Errorf("squash layers: cannot squash %d of %d layers", count, len(m.manifest.Layers))
+	}
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("squash layers: config has %d diff_ids but manifest has %d layers", len(m.config.RootFS.DiffIDs), len(m.manifest.Layers))
+	}
+
+	plan, err := m.planSquash(ctx, count)
+	if err != nil {
+		return errors.Wrap(err, "squash layers")
+	}
+
+	// Use the (uncompressed) media-type of the last squashed layer.
+	lastReader, lastDesc, err := m.layerReader(ctx, m.manifest.Layers[count-1])
+	if err != nil {
+		return errors.Wrap(err, "squash layers")
+	}
+	lastReader.Close()
+	mediaType := lastDesc.MediaType
+	if sep := strings.Index(mediaType, "+"); sep != -1 {
+		mediaType = mediaType[:sep]
+	}
+	if compressor.MediaTypeSuffix() != "" {
+		mediaType = mediaType + "+" + compressor.MediaTypeSuffix()
+	}
+
+	reader, writer := io.Pipe()
+	go func() (Err error) {
+		// Close with the returned error.
+		defer func() {
+			// #nosec G104
+			_ = writer.CloseWithError(errors.Wrap(Err, "squash layers"))
+		}()
+
+		tw := tar.NewWriter(writer)
+		for idx := 0; idx < count; idx++ {
+			if err := m.writeSquashed(ctx, tw, idx, plan); err != nil {
+				return errors.Wrapf(err, "copy layer %d", idx)
+			}
+		}
+		return errors.Wrap(tw.Close(), "close tar writer")
+	}()
+	defer reader.Close()
+
+	diffidDigester := cas.BlobAlgorithm.Digester()
+	compressed, err := compressor.Compress(io.TeeReader(reader, diffidDigester.Hash()))
+	if err != nil {
+		return errors.Wrap(err, "couldn't create compression for blob")
+	}
+	defer compressed.Close()
+
+	layerDigest, layerSize, err := m.engine.PutBlob(ctx, compressed)
+	if err != nil {
+		return errors.Wrap(err, "put squashed layer blob")
+	}
+	log.Debugf("mutate: squashed %d layers into %s", count, layerDigest)
+
+	history, ok := squashHistory(m.config.History, count)
+	if ok {
+		m.config.History = history
+	} else {
+		log.Warnf("squash layers: no history entries found for the %d squashed layers", count)
+	}
+	m.config.RootFS.DiffIDs = append([]digest.Digest{diffidDigester.Digest()}, m.config.RootFS.DiffIDs[count:]...)
+	m.manifest.Layers = append([]ispec.Descriptor{{
+		MediaType: mediaType,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}}, m.manifest.Layers[count:]...)
+	return nil
+}
+
+// LimitLayers squashes the oldest layers of the image (see SquashLayers) so
+// that the image has at most maxLayers layers. If the image already has at
+// most maxLayers layers, it is left unchanged.
+func (m *Mutator) LimitLayers(ctx context.Context, maxLayers int, compressor Compressor) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if maxLayers < 1 {
+		return errors.Errorf("limit layers: invalid maximum layer count %d", maxLayers)
+	}
+	if len(m.manifest.Layers) <= maxLayers {
+		return nil
+	}
+	return m.SquashLayers(ctx, len(m.manifest.Layers)-maxLayers+1, compressor)
+}
@@ -0,0 +1,243 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"golang.org/x/net/context"
+)
+
+// unpackCommitted commits the mutator and unpacks the resulting image into
+// dir/name, returning the path of the rootfs.
+func unpackCommitted(t *testing.T, engineExt casext.Engine, mutator *Mutator, dir, name string) string {
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+	blob, err := engineExt.FromDescriptor(context.Background(), newPath.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	rootfs := filepath.Join(dir, name)
+	unpackOptions := &layer.UnpackOptions{MapOptions: layer.MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    os.Geteuid() != 0,
+	}}
+	if err := layer.UnpackRootfs(context.Background(), engineExt, rootfs, blob.Data.(ispec.Manifest), unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	return rootfs
+}
+
+func TestMutateLimitLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateLimitLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layers := [][]layerFile{
+		{{"etc/", ""}, {"etc/base", "base"}, {"etc/old", "old"}},
+		{{"var/", ""}, {"var/cache/", ""}, {"var/cache/blob", "cache"}},
+		{{"etc/.wh.old", ""}, {"etc/base", "base-v2"}},
+		{{"var/cache/.wh..wh..opq", ""}, {"var/cache/new", "new"}},
+		{{"etc/.wh.base", ""}, {"etc/base/", ""}, {"etc/base/file", "dir"}},
+		{{"opt/", ""}, {"opt/app", "app"}},
+	}
+	engineExt, mutator := setupLayers(t, dir)
+	defer engineExt.Close()
+
+	const maxLayers = 3
+	for idx, files := range layers {
+		history := &ispec.History{CreatedBy: fmt.Sprintf("layer/%d", idx)}
+		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, layerTar(t, files), history, GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer %d: %+v", idx, err)
+		}
+		if err := mutator.LimitLayers(context.Background(), maxLayers, GzipCompressor); err != nil {
+			t.Fatalf("unexpected error limiting layers after layer %d: %+v", idx, err)
+		}
+
+		wantLayers := idx + 1
+		if wantLayers > maxLayers {
+			wantLayers = maxLayers
+		}
+		if got := len(mutator.manifest.Layers); got != wantLayers {
+			t.Errorf("unexpected number of layers after layer %d: expected %d got %d", idx, wantLayers, got)
+		}
+		if got := len(mutator.config.RootFS.DiffIDs); got != wantLayers {
+			t.Errorf("unexpected number of diffids after layer %d: expected %d got %d", idx, wantLayers, got)
+		}
+		if got := len(mutator.config.History); got != wantLayers {
+			t.Errorf("unexpected number of history entries after layer %d: expected %d got %d", idx, wantLayers, got)
+		}
+	}
+
+	history := mutator.config.History
+	if want := "layer/0; layer/1; layer/2; layer/3"; history[0].CreatedBy != want {
+		t.Errorf("unexpected squashed history entry: expected %q got %q", want, history[0].CreatedBy)
+	}
+	if history[1].CreatedBy != "layer/4" || history[2].CreatedBy != "layer/5" {
+		t.Errorf("unexpected history after squashing: %+v", history)
+	}
+
+	// Unpacking verifies the DiffIDs.
+	rootfs := unpackCommitted(t, engineExt, mutator, dir, "rootfs")
+	for name, contents := range map[string]string{
+		"etc/base/file": "dir",
+		"var/cache/new": "new",
+		"opt/app":       "app",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(rootfs, name))
+		if err != nil {
+			t.Errorf("expected %s to exist: %v", name, err)
+		} else if string(data) != contents {
+			t.Errorf("unexpected contents of %s: expected %q got %q", name, contents, string(data))
+		}
+	}
+	for _, name := range []string{"etc/old", "var/cache/blob"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, name)); !os.IsNotExist(err) {
+			t.Errorf("expected whited-out %s to not exist: %v", name, err)
+		}
+	}
+}
+
+func TestMutateSquashLayersHardlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSquashLayersHardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The target of the hardlink is replaced in a later layer, so the
+	// squashed layer must store the original contents under the link's name.
+	engineExt, mutator := setupLayers(t, dir,
+		[]layerFile{{"etc/", ""}, {"etc/target", "original"}},
+	)
+	defer engineExt.Close()
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/link", Typeflag: tar.TypeLink, Linkname: "etc/target"},
+		{Name: "etc/link2", Typeflag: tar.TypeLink, Linkname: "etc/link"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, &buffer, &ispec.History{CreatedBy: "link"}, GzipCompressor, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, layerTar(t, []layerFile{{"etc/target", "replaced"}}), &ispec.History{CreatedBy: "replace"}, GzipCompressor, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.SquashLayers(context.Background(), 1, GzipCompressor); err == nil {
+		t.Errorf("expected error squashing a single layer")
+	}
+	if err := mutator.SquashLayers(context.Background(), 3, GzipCompressor); err != nil {
+		t.Fatalf("unexpected error squashing layers: %+v", err)
+	}
+	if len(mutator.manifest.Layers) != 1 {
+		t.Fatalf("expected a single layer after squashing: got %d", len(mutator.manifest.Layers))
+	}
+
+	rootfs := unpackCommitted(t, engineExt, mutator, dir, "rootfs")
+	for name, contents := range map[string]string{
+		"etc/target": "replaced",
+		"etc/link":   "original",
+		"etc/link2":  "original",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(rootfs, name))
+		if err != nil {
+			t.Errorf("expected %s to exist: %v", name, err)
+		} else if string(data) != contents {
+			t.Errorf("unexpected contents of %s: expected %q got %q", name, contents, string(data))
+		}
+	}
+	linkFi, err := os.Stat(filepath.Join(rootfs, "etc/link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link2Fi, err := os.Stat(filepath.Join(rootfs, "etc/link2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(linkFi, link2Fi) {
+		t.Errorf("expected etc/link and etc/link2 to still be hardlinked")
+	}
+}
+
+func TestSquashTreeRemove(t *testing.T) {
+	tree := newSquashTree()
+	for idx, pth := range []string{"/", "/a", "/a/b", "/a/b/c", "/ab", "/a/d"} {
+		tree.add(pth, squashKey{layer: 0, entry: idx})
+	}
+	tree.add("/a/e", squashKey{layer: 1, entry: 0})
+
+	// Only the children of /a from before layer 1 are removed by an opaque
+	// whiteout in layer 1.
+	tree.remove("/a", false, 1)
+	for pth, expected := range map[string]bool{
+		"/":      true,
+		"/a":     true,
+		"/a/b":   false,
+		"/a/b/c": false,
+		"/a/d":   false,
+		"/a/e":   true,
+		"/ab":    true,
+	} {
+		if _, ok := tree.live[pth]; ok != expected {
+			t.Errorf("after opaque whiteout: expected %s live=%v, got %v", pth, expected, ok)
+		}
+	}
+	if _, ok := tree.children["/a/b"]; ok {
+		t.Errorf("removed directory /a/b is still indexed")
+	}
+
+	// Removing /a itself must not affect /ab.
+	tree.remove("/a", true, 2)
+	for pth, expected := range map[string]bool{
+		"/":    true,
+		"/a":   false,
+		"/a/e": false,
+		"/ab":  true,
+	} {
+		if _, ok := tree.live[pth]; ok != expected {
+			t.Errorf("after whiteout: expected %s live=%v, got %v", pth, expected, ok)
+		}
+	}
+	if children := tree.children["/"]; len(children) != 1 {
+		t.Errorf("unexpected children of / after whiteout: %v", children)
+	}
+}
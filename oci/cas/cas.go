@@ -58,8 +58,49 @@ var (
 	// ErrClobber is returned when a requested operation would require clobbering a
 	// reference or blob which already exists.
 	ErrClobber = fmt.Errorf("operation would clobber existing object")
+
+	// ErrBlobNotExist is returned (as a *BlobNotExistError) when a requested
+	// blob does not exist. Such errors also match ErrNotExist.
+	ErrBlobNotExist = fmt.Errorf("no such blob")
 )
 
+// BlobNotExistError is the error returned by Engine implementations when a
+// requested blob does not exist. It can be matched using errors.Is with either
+// ErrBlobNotExist or ErrNotExist, while errors.Cause (and errors.Unwrap)
+// return the underlying error (such as an *os.PathError) for compatibility.
+type BlobNotExistError struct {
+	// Digest is the digest of the requested blob.
+	Digest digest.Digest
+
+	// Err is the underlying error returned by the backing store.
+	Err error
+}
+
+func (e *BlobNotExistError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("blob %s: %v", e.Digest, ErrBlobNotExist)
+	}
+	return fmt.Sprintf("blob %s: %v: %v", e.Digest, ErrBlobNotExist, e.Err)
+}
+
+// Is returns whether the target is ErrBlobNotExist or ErrNotExist.
+func (e *BlobNotExistError) Is(target error) bool {
+	return target == ErrBlobNotExist || target == ErrNotExist
+}
+
+// Unwrap returns the underlying error.
+func (e *BlobNotExistError) Unwrap() error {
+	return e.Cause()
+}
+
+// Cause returns the underlying error (or ErrBlobNotExist if there is none).
+func (e *BlobNotExistError) Cause() error {
+	if e.Err == nil {
+		return ErrBlobNotExist
+	}
+	return e.Err
+}
+
 // Engine is an interface that provides methods for accessing and modifying an
 // OCI image, namely allowing access to reference descriptors and blobs.
 type Engine interface {
@@ -107,3 +148,29 @@ type Engine interface {
 	// may fail.
 	Close() (err error)
 }
+
+// MultiIndexEngine is implemented by Engines which store more than one
+// top-level index (only one of which is returned by GetIndex). Operations
+// which must know every reachable blob, such as garbage collection, have to
+// consider all of them.
+type MultiIndexEngine interface {
+	Engine
+
+	// GetIndexes returns every top-level index stored by the engine,
+	// including the one returned by GetIndex.
+	GetIndexes(ctx context.Context) (indexes []ispec.Index, err error)
+}
+
+// GetIndexes returns every top-level index stored by the given engine. For
+// engines which are not a MultiIndexEngine, this is just the index returned
+// by GetIndex.
+func GetIndexes(ctx context.Context, engine Engine) ([]ispec.Index, error) {
+	if multi, ok := engine.(MultiIndexEngine); ok {
+		return multi.GetIndexes(ctx)
+	}
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []ispec.Index{index}, nil
+}
@@ -23,6 +23,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/apex/log"
 	"github.com/opencontainers/go-digest"
@@ -71,10 +73,96 @@ func blobPath(digest digest.Digest) (string, error) {
 	return filepath.Join(blobDirectory, algo.String(), hash), nil
 }
 
+// shardPrefixLen is the number of hex characters of the digest used to name
+// the shard subdirectory of a blob when sharding is enabled.
+const shardPrefixLen = 2
+
+// shardedBlobPath returns the path to a blob given its digest, relative to the
+// root of the OCI image, when using the sharded layout. This is the same as
+// blobPath except that the blob is stored in a subdirectory named after the
+// first shardPrefixLen characters of the digest (blobs/sha256/ab/abcdef...).
+func shardedBlobPath(digest digest.Digest) (string, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return "", err
+	}
+	dir, hash := filepath.Split(path)
+	return filepath.Join(dir, hash[:shardPrefixLen], hash), nil
+}
+
+// blobPaths returns all of the possible paths to a blob given its digest,
+// relative to the root of the OCI image. The preferred path for new blobs
+// (based on whether sharding is enabled) is returned first.
+func (e *dirEngine) blobPaths(digest digest.Digest) ([]string, error) {
+	flatPath, err := blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	shardedPath, err := shardedBlobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	if e.opt.ShardBlobs {
+		return []string{shardedPath, flatPath}, nil
+	}
+	return []string{flatPath, shardedPath}, nil
+}
+
+// Options are the set of optional settings for a dir-backed cas.Engine.
+type Options struct {
+	// ShardBlobs causes new blobs to be stored in subdirectories named after
+	// the prefix of their digest (blobs/sha256/ab/abcdef...) rather than in a
+	// single flat directory, which performs better on some filesystems when
+	// there are very many blobs. Blobs are read (and deleted) from both the
+	// sharded and flat locations regardless of this setting. Note that other
+	// tools will not be able to read sharded blobs, since the layout is not
+	// part of the OCI image specification.
+	ShardBlobs bool
+
+	// IndexFile is the path (relative to the root of the layout) of the index
+	// to use as the top-level index of the image, instead of "index.json".
+	// This allows several indexes (such as a staging and a published index)
+	// to be kept in the same layout. The index must already exist. Blobs
+	// referenced by either "index.json" or the chosen index are considered to
+	// be reachable by operations like GC (but not blobs only referenced by
+	// other index files in the layout).
+	IndexFile string
+
+	// MmapThreshold, if non-zero, causes GetBlob to memory-map blobs which
+	// are at least MmapThreshold bytes long rather than reading them through
+	// regular read(2) calls, which speeds up the verification of very large
+	// blobs. Smaller blobs (or blobs which cannot be mapped) are read as
+	// usual. Note that modifying a blob file while it is mapped (which should
+	// never happen, since blobs are immutable) can crash the process.
+	MmapThreshold int64
+
+	// Sync controls when written blobs and indexes are synced to disk. By
+	// default (SyncNone) nothing is explicitly synced.
+	Sync SyncMode
+
+	// SyncBatchSize is the number of blobs synced at once with SyncBatch. If
+	// zero, a default of 64 is used.
+	SyncBatchSize int
+}
+
 type dirEngine struct {
 	path     string
 	temp     string
 	tempFile *os.File
+	opt      Options
+
+	// syncLock protects syncPending, the paths of blobs which have been
+	// written but not yet synced (with SyncBatch).
+	syncLock    sync.Mutex
+	syncPending []string
+}
+
+// indexPath returns the path to the top-level index of the image.
+func (e *dirEngine) indexPath() string {
+	if e.opt.IndexFile != "" {
+		return filepath.Join(e.path, e.opt.IndexFile)
+	}
+	return filepath.Join(e.path, indexFile)
 }
 
 func (e *dirEngine) ensureTempDir() error {
@@ -135,7 +223,7 @@ func (e *dirEngine) validate() error {
 		return errors.Wrap(cas.ErrInvalid, "blobdir is not a directory")
 	}
 
-	if fi, err := os.Stat(filepath.Join(e.path, indexFile)); err != nil {
+	if fi, err := os.Stat(e.indexPath()); err != nil {
 		if os.IsNotExist(err) {
 			err = cas.ErrInvalid
 		}
@@ -171,38 +259,76 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 	if err != nil {
 		return "", -1, errors.Wrap(err, "copy to temporary blob")
 	}
+	if e.opt.Sync == SyncEach {
+		if err := fh.Sync(); err != nil {
+			return "", -1, errors.Wrap(err, "sync temporary blob")
+		}
+	}
 	if err := fh.Close(); err != nil {
 		return "", -1, errors.Wrap(err, "close temporary blob")
 	}
 
 	// Get the digest.
-	path, err := blobPath(digester.Digest())
+	paths, err := e.blobPaths(digester.Digest())
 	if err != nil {
 		return "", -1, errors.Wrap(err, "compute blob name")
 	}
 
 	// Move the blob to its correct path.
-	path = filepath.Join(e.path, path)
+	path := filepath.Join(e.path, paths[0])
+	if e.opt.ShardBlobs {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", -1, errors.Wrap(err, "mkdir blob shard")
+		}
+	}
 	if err := os.Rename(tempPath, path); err != nil {
 		return "", -1, errors.Wrap(err, "rename temporary blob")
 	}
 
+	switch e.opt.Sync {
+	case SyncEach:
+		if err := e.syncBlobDirs([]string{path}); err != nil {
+			return "", -1, err
+		}
+	case SyncBatch:
+		if err := e.queueSync(path); err != nil {
+			return "", -1, errors.Wrap(err, "sync blob batch")
+		}
+	}
+
 	return digester.Digest(), int64(size), nil
 }
 
 // GetBlob returns a reader for retrieving a blob from the image, which the
-// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+// caller must Close(). Returns a *cas.BlobNotExistError (which wraps
+// os.ErrNotExist) if the digest is not found.
 func (e *dirEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
-	path, err := blobPath(digest)
+	paths, err := e.blobPaths(digest)
 	if err != nil {
 		return nil, errors.Wrap(err, "compute blob path")
 	}
-	fh, err := os.Open(filepath.Join(e.path, path))
+	var fh *os.File
+	for _, path := range paths {
+		fh, err = os.Open(filepath.Join(e.path, path))
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		return nil, errors.Wrap(&cas.BlobNotExistError{Digest: digest, Err: err}, "open blob")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "open blob")
+	}
+	var reader io.ReadCloser = fh
+	if e.opt.MmapThreshold > 0 {
+		reader = mmapBlob(fh, e.opt.MmapThreshold)
+	}
 	return &hardening.VerifiedReadCloser{
-		Reader:         fh,
+		Reader:         reader,
 		ExpectedDigest: digest,
 		ExpectedSize:   int64(-1), // We don't know the expected size.
-	}, errors.Wrap(err, "open blob")
+	}, nil
 }
 
 // PutIndex sets the index of the OCI image to the given index, replacing the
@@ -214,6 +340,13 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 		return errors.Wrap(err, "ensure tempdir")
 	}
 
+	// Make sure the index never refers to blobs which haven't been synced.
+	if e.opt.Sync == SyncBatch {
+		if err := e.flushSync(); err != nil {
+			return errors.Wrap(err, "sync blob batch")
+		}
+	}
+
 	// We copy this into a temporary index to ensure the atomicity of this
 	// operation.
 	fh, err := ioutil.TempFile(e.temp, "index-")
@@ -227,15 +360,24 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 	if err := json.NewEncoder(fh).Encode(index); err != nil {
 		return errors.Wrap(err, "write temporary index")
 	}
+	if e.opt.Sync != SyncNone {
+		if err := fh.Sync(); err != nil {
+			return errors.Wrap(err, "sync temporary index")
+		}
+	}
 	if err := fh.Close(); err != nil {
 		return errors.Wrap(err, "close temporary index")
 	}
 
 	// Move the blob to its correct path.
-	path := filepath.Join(e.path, indexFile)
-	if err := os.Rename(tempPath, path); err != nil {
+	if err := os.Rename(tempPath, e.indexPath()); err != nil {
 		return errors.Wrap(err, "rename temporary index")
 	}
+	if e.opt.Sync != SyncNone {
+		if err := syncPath(filepath.Dir(e.indexPath())); err != nil {
+			return errors.Wrap(err, "sync index directory")
+		}
+	}
 	return nil
 }
 
@@ -249,7 +391,31 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 // that implements various reference resolution functions that should work for
 // most users.
 func (e *dirEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
-	content, err := ioutil.ReadFile(filepath.Join(e.path, indexFile))
+	return readIndex(e.indexPath())
+}
+
+// GetIndexes returns both "index.json" and the index given by
+// Options.IndexFile (if set), so that garbage collection doesn't remove blobs
+// which are only referenced by one of them.
+func (e *dirEngine) GetIndexes(ctx context.Context) ([]ispec.Index, error) {
+	paths := []string{filepath.Join(e.path, indexFile)}
+	if e.indexPath() != paths[0] {
+		paths = append(paths, e.indexPath())
+	}
+	var indexes []ispec.Index
+	for _, path := range paths {
+		index, err := readIndex(path)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// readIndex reads and parses the index at the given path.
+func readIndex(path string) (ispec.Index, error) {
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			err = cas.ErrInvalid
@@ -269,14 +435,17 @@ func (e *dirEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
 // error means "the content is not in the store" without implying "because
 // of this DeleteBlob() call".
 func (e *dirEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
-	path, err := blobPath(digest)
+	paths, err := e.blobPaths(digest)
 	if err != nil {
 		return errors.Wrap(err, "compute blob path")
 	}
 
-	err = os.Remove(filepath.Join(e.path, path))
-	if err != nil && !os.IsNotExist(err) {
-		return errors.Wrap(err, "remove blob")
+	// The blob could be stored in either layout (or even both).
+	for _, path := range paths {
+		err = os.Remove(filepath.Join(e.path, path))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove blob")
+		}
 	}
 	return nil
 }
@@ -284,17 +453,29 @@ func (e *dirEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error
 // ListBlobs returns the set of blob digests stored in the image.
 func (e *dirEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
 	digests := []digest.Digest{}
+	seen := map[digest.Digest]struct{}{}
 	blobDir := filepath.Join(e.path, blobDirectory, cas.BlobAlgorithm.String())
 
-	if err := filepath.Walk(blobDir, func(path string, _ os.FileInfo, _ error) error {
+	if err := filepath.Walk(blobDir, func(path string, fi os.FileInfo, _ error) error {
 		// Skip the actual directory.
 		if path == blobDir {
 			return nil
 		}
 
-		// XXX: Do we need to handle multiple-directory-deep cases?
+		// Blobs may be stored in shard subdirectories, which are only ever
+		// one level deep.
+		if fi != nil && fi.IsDir() {
+			if filepath.Dir(path) != blobDir || len(fi.Name()) != shardPrefixLen {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		digest := digest.NewDigestFromHex(cas.BlobAlgorithm.String(), filepath.Base(path))
-		digests = append(digests, digest)
+		if _, ok := seen[digest]; !ok {
+			seen[digest] = struct{}{}
+			digests = append(digests, digest)
+		}
 		return nil
 	}); err != nil {
 		return nil, errors.Wrap(err, "walk blobdir")
@@ -350,6 +531,8 @@ func (e *dirEngine) cleanPath(ctx context.Context, path string) error {
 // Close releases all references held by the e. Subsequent operations may
 // fail.
 func (e *dirEngine) Close() error {
+	// The tempdir must still be removed (and unlocked) if syncing fails.
+	syncErr := e.flushSync()
 	if e.temp != "" {
 		if err := unix.Flock(int(e.tempFile.Fd()), unix.LOCK_UN); err != nil {
 			return errors.Wrap(err, "unlock tempdir")
@@ -361,15 +544,36 @@ func (e *dirEngine) Close() error {
 			return errors.Wrap(err, "remove tempdir")
 		}
 	}
-	return nil
+	return errors.Wrap(syncErr, "sync blob batch")
 }
 
 // Open opens a new reference to the directory-backed OCI image referenced by
 // the provided path.
 func Open(path string) (cas.Engine, error) {
+	return OpenWithOptions(path, Options{})
+}
+
+// OpenWithOptions is like Open, except that the behaviour of the returned
+// engine can be modified with the given Options.
+func OpenWithOptions(path string, opt Options) (cas.Engine, error) {
+	if opt.IndexFile != "" {
+		// The index must be inside the layout.
+		clean := filepath.Clean(opt.IndexFile)
+		if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return nil, errors.Errorf("invalid index file %q: must be a path inside the image layout", opt.IndexFile)
+		}
+		opt.IndexFile = clean
+	}
+	switch opt.Sync {
+	case SyncNone, SyncEach, SyncBatch:
+	default:
+		return nil, errors.Errorf("invalid sync mode %d", opt.Sync)
+	}
+
 	engine := &dirEngine{
 		path: path,
 		temp: "",
+		opt:  opt,
 	}
 
 	if err := engine.validate(); err != nil {
@@ -19,13 +19,19 @@ package dir
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/pkg/hardening"
 	"github.com/opencontainers/umoci/pkg/testutils"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -512,3 +518,578 @@ func TestEngineBlobReadonly(t *testing.T) {
 		testutils.MakeReadWrite(t, image)
 	}
 }
+
+func TestEngineBlobSharded(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobSharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	flatEngine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer flatEngine.Close()
+
+	shardedEngine, err := OpenWithOptions(image, Options{ShardBlobs: true})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer shardedEngine.Close()
+
+	// Write a blob in each layout.
+	flatContent := []byte("flat blob")
+	flatDigest, _, err := flatEngine.PutBlob(ctx, bytes.NewReader(flatContent))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	shardedContent := []byte("sharded blob")
+	shardedDigest, _, err := shardedEngine.PutBlob(ctx, bytes.NewReader(shardedContent))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+
+	// Make sure they were stored in the right place.
+	for _, test := range []struct {
+		path string
+		dgst digest.Digest
+	}{
+		{filepath.Join(image, "blobs", "sha256", flatDigest.Hex()), flatDigest},
+		{filepath.Join(image, "blobs", "sha256", shardedDigest.Hex()[:2], shardedDigest.Hex()), shardedDigest},
+	} {
+		if _, err := os.Lstat(test.path); err != nil {
+			t.Errorf("blob %s not stored at expected path %s: %v", test.dgst, test.path, err)
+		}
+	}
+
+	// Both engines must be able to read both blobs.
+	for _, engine := range []cas.Engine{flatEngine, shardedEngine} {
+		for _, test := range []struct {
+			dgst    digest.Digest
+			content []byte
+		}{
+			{flatDigest, flatContent},
+			{shardedDigest, shardedContent},
+		} {
+			blobReader, err := engine.GetBlob(ctx, test.dgst)
+			if err != nil {
+				t.Fatalf("GetBlob: unexpected error: %+v", err)
+			}
+			gotBytes, err := ioutil.ReadAll(blobReader)
+			blobReader.Close()
+			if err != nil {
+				t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+			}
+			if !bytes.Equal(test.content, gotBytes) {
+				t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(test.content), string(gotBytes))
+			}
+		}
+
+		if blobs, err := engine.ListBlobs(ctx); err != nil {
+			t.Errorf("unexpected error getting list of blobs: %+v", err)
+		} else if len(blobs) != 2 {
+			t.Errorf("expected to get two blobs, got %v", blobs)
+		}
+	}
+
+	// Deleting must work regardless of the layout.
+	for _, dgst := range []digest.Digest{flatDigest, shardedDigest} {
+		if err := flatEngine.DeleteBlob(ctx, dgst); err != nil {
+			t.Errorf("DeleteBlob: unexpected error: %+v", err)
+		}
+	}
+	if blobs, err := shardedEngine.ListBlobs(ctx); err != nil {
+		t.Errorf("unexpected error getting list of blobs: %+v", err)
+	} else if len(blobs) > 0 {
+		t.Errorf("got blobs in a clean image: %v", blobs)
+	}
+}
+
+func TestEngineCustomIndex(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineCustomIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	// The custom index must exist.
+	if _, err := OpenWithOptions(image, Options{IndexFile: "staging.json"}); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("expected missing custom index to be invalid: %+v", err)
+	}
+
+	// Create a secondary index with a single (fake) entry.
+	stagingIndex, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	stagingIndex.Manifests = append(stagingIndex.Manifests, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("staging"),
+		Size:      7,
+		Annotations: map[string]string{
+			ispec.AnnotationRefName: "staging",
+		},
+	})
+	stagingFh, err := os.Create(filepath.Join(image, "staging.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewEncoder(stagingFh).Encode(stagingIndex); err != nil {
+		t.Fatal(err)
+	}
+	stagingFh.Close()
+
+	stagingEngine, err := OpenWithOptions(image, Options{IndexFile: "staging.json"})
+	if err != nil {
+		t.Fatalf("unexpected error opening image with custom index: %+v", err)
+	}
+	defer stagingEngine.Close()
+
+	// Each engine must only see its own index.
+	if index, err := stagingEngine.GetIndex(ctx); err != nil {
+		t.Errorf("unexpected error getting custom index: %+v", err)
+	} else if len(index.Manifests) != 1 || index.Manifests[0].Annotations[ispec.AnnotationRefName] != "staging" {
+		t.Errorf("custom index has unexpected contents: %+v", index)
+	}
+	if index, err := engine.GetIndex(ctx); err != nil {
+		t.Errorf("unexpected error getting index: %+v", err)
+	} else if len(index.Manifests) != 0 {
+		t.Errorf("default index has unexpected contents: %+v", index)
+	}
+
+	// Writes must only affect the custom index.
+	stagingIndex.Manifests = nil
+	if err := stagingEngine.PutIndex(ctx, stagingIndex); err != nil {
+		t.Fatalf("unexpected error putting custom index: %+v", err)
+	}
+	if index, err := stagingEngine.GetIndex(ctx); err != nil || len(index.Manifests) != 0 {
+		t.Errorf("custom index was not updated: %+v (%v)", index, err)
+	}
+	if index, err := engine.GetIndex(ctx); err != nil || !reflect.DeepEqual(index, stagingIndex) {
+		t.Errorf("default index was modified: %+v (%v)", index, err)
+	}
+
+	// The index must be inside the layout.
+	for _, indexFile := range []string{"/tmp/index.json", "../index.json", "a/../../index.json", "."} {
+		if _, err := OpenWithOptions(image, Options{IndexFile: indexFile}); err == nil {
+			t.Errorf("expected index file %q to be rejected", indexFile)
+		}
+	}
+}
+
+func TestEngineBlobErrors(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobErrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	// Missing blobs.
+	missing := digest.FromString("missing blob")
+	_, err = engine.GetBlob(ctx, missing)
+	if !errors.Is(err, cas.ErrBlobNotExist) || !errors.Is(err, cas.ErrNotExist) {
+		t.Errorf("expected GetBlob of missing blob to match ErrBlobNotExist and ErrNotExist: %+v", err)
+	}
+	var notExistErr *cas.BlobNotExistError
+	if !errors.As(err, &notExistErr) {
+		t.Errorf("expected GetBlob of missing blob to return BlobNotExistError: %+v", err)
+	} else if notExistErr.Digest != missing {
+		t.Errorf("BlobNotExistError has wrong digest: expected %s, got %s", missing, notExistErr.Digest)
+	}
+	// For compatibility, os.ErrNotExist must still be the cause.
+	if !os.IsNotExist(errors.Cause(err)) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected GetBlob of missing blob to match os.ErrNotExist: %+v", err)
+	}
+
+	// Corrupt blobs.
+	blobDigest, _, err := engine.PutBlob(ctx, bytes.NewReader([]byte("original contents")))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(image, "blobs", "sha256", blobDigest.Hex()), []byte("corrupt contents!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blobReader, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	defer blobReader.Close()
+	if _, err := io.Copy(ioutil.Discard, blobReader); !errors.Is(err, hardening.ErrDigestMismatch) {
+		t.Errorf("expected reading corrupt blob to match ErrDigestMismatch: %+v", err)
+	}
+}
+
+func TestEngineBlobMmap(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobMmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	const threshold = 16
+	engine, err := OpenWithOptions(image, Options{MmapThreshold: threshold})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	for _, test := range []struct {
+		name   string
+		bytes  []byte
+		mapped bool
+	}{
+		{"Empty", []byte(""), false},
+		{"Small", []byte("small blob"), false},
+		{"Threshold", bytes.Repeat([]byte("x"), threshold), true},
+		{"Large", bytes.Repeat([]byte("large blob "), 4096), true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			digest, _, err := engine.PutBlob(ctx, bytes.NewReader(test.bytes))
+			if err != nil {
+				t.Fatalf("PutBlob: unexpected error: %+v", err)
+			}
+
+			blobReader, err := engine.GetBlob(ctx, digest)
+			if err != nil {
+				t.Fatalf("GetBlob: unexpected error: %+v", err)
+			}
+			gotBytes, err := ioutil.ReadAll(blobReader)
+			if err != nil {
+				t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+			}
+			if !bytes.Equal(test.bytes, gotBytes) {
+				t.Errorf("GetBlob: bytes did not match: expected=%q got=%q", string(test.bytes), string(gotBytes))
+			}
+			if err := blobReader.Close(); err != nil {
+				t.Errorf("GetBlob: unexpected error closing blob: %+v", err)
+			}
+
+			// Check that mmap is only used for blobs above the threshold.
+			path, err := blobPath(digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fh, err := os.Open(filepath.Join(image, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := mmapBlob(fh, threshold)
+			defer reader.Close()
+			if _, mapped := reader.(*mmapReadCloser); mapped != test.mapped {
+				t.Errorf("mmapBlob: expected mapped=%v, got reader %T", test.mapped, reader)
+			}
+			if !test.mapped {
+				return
+			}
+			if err := reader.Close(); err != nil {
+				t.Errorf("mmapBlob: unexpected error unmapping blob: %+v", err)
+			}
+			if _, err := reader.Read(make([]byte, 1)); err != os.ErrClosed {
+				t.Errorf("mmapBlob: expected read after close to fail with os.ErrClosed: %v", err)
+			}
+		})
+	}
+
+	// Digests of mapped blobs are still verified.
+	content := bytes.Repeat([]byte("verified blob "), 64)
+	digest, _, err := engine.PutBlob(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	path, err := blobPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(image, path), bytes.ToUpper(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blobReader, err := engine.GetBlob(ctx, digest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	defer blobReader.Close()
+	if _, err := io.Copy(ioutil.Discard, blobReader); errors.Cause(err) != hardening.ErrDigestMismatch {
+		t.Errorf("GetBlob: expected corrupted mapped blob to fail verification: %+v", err)
+	}
+}
+
+func BenchmarkEngineGetBlob(b *testing.B) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-BenchmarkEngineGetBlob")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		b.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	const size = 64 << 20
+	content := bytes.Repeat([]byte("umoci benchmark blob\n"), size/21)
+
+	for _, test := range []struct {
+		name string
+		opt  Options
+	}{
+		{"Read", Options{}},
+		{"Mmap", Options{MmapThreshold: 1 << 20}},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			engine, err := OpenWithOptions(image, test.opt)
+			if err != nil {
+				b.Fatalf("unexpected error opening image: %+v", err)
+			}
+			defer engine.Close()
+
+			digest, _, err := engine.PutBlob(ctx, bytes.NewReader(content))
+			if err != nil {
+				b.Fatalf("PutBlob: unexpected error: %+v", err)
+			}
+
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				blobReader, err := engine.GetBlob(ctx, digest)
+				if err != nil {
+					b.Fatalf("GetBlob: unexpected error: %+v", err)
+				}
+				if _, err := io.Copy(ioutil.Discard, blobReader); err != nil {
+					b.Fatalf("GetBlob: unexpected error reading blob: %+v", err)
+				}
+				blobReader.Close()
+			}
+		})
+	}
+}
+
+func TestEngineSync(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineSync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, test := range []struct {
+		name string
+		opt  Options
+	}{
+		{"None", Options{}},
+		{"Each", Options{Sync: SyncEach}},
+		{"Each-Sharded", Options{Sync: SyncEach, ShardBlobs: true}},
+		{"Batch", Options{Sync: SyncBatch, SyncBatchSize: 8}},
+		{"Batch-Sharded", Options{Sync: SyncBatch, SyncBatchSize: 8, ShardBlobs: true}},
+		{"Batch-Default", Options{Sync: SyncBatch}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			image := filepath.Join(root, test.name)
+			if err := Create(image); err != nil {
+				t.Fatalf("unexpected error creating image: %+v", err)
+			}
+			engine, err := OpenWithOptions(image, test.opt)
+			if err != nil {
+				t.Fatalf("unexpected error opening image: %+v", err)
+			}
+
+			const numBlobs = 100
+			blobs := map[digest.Digest][]byte{}
+			for i := 0; i < numBlobs; i++ {
+				content := []byte(fmt.Sprintf("blob %d", i))
+				digest, _, err := engine.PutBlob(ctx, bytes.NewReader(content))
+				if err != nil {
+					t.Fatalf("PutBlob: unexpected error: %+v", err)
+				}
+				blobs[digest] = content
+
+				if test.opt.Sync == SyncBatch && test.opt.SyncBatchSize > 0 {
+					if pending := len(engine.(*dirEngine).syncPending); pending >= test.opt.SyncBatchSize {
+						t.Errorf("blob batch was not synced: %d blobs pending", pending)
+					}
+				}
+			}
+
+			// Replacing the index must sync all outstanding blobs.
+			if err := engine.PutIndex(ctx, ispec.Index{}); err != nil {
+				t.Fatalf("PutIndex: unexpected error: %+v", err)
+			}
+			if pending := len(engine.(*dirEngine).syncPending); pending != 0 {
+				t.Errorf("PutIndex did not sync outstanding blobs: %d blobs pending", pending)
+			}
+
+			// A partial batch must be synced by Close.
+			content := []byte("last blob")
+			digest, _, err := engine.PutBlob(ctx, bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("PutBlob: unexpected error: %+v", err)
+			}
+			blobs[digest] = content
+			if err := engine.Close(); err != nil {
+				t.Fatalf("Close: unexpected error: %+v", err)
+			}
+			if pending := len(engine.(*dirEngine).syncPending); pending != 0 {
+				t.Errorf("Close did not sync outstanding blobs: %d blobs pending", pending)
+			}
+
+			// All of the blobs must be retrievable.
+			engine, err = Open(image)
+			if err != nil {
+				t.Fatalf("unexpected error re-opening image: %+v", err)
+			}
+			defer engine.Close()
+			for digest, content := range blobs {
+				blobReader, err := engine.GetBlob(ctx, digest)
+				if err != nil {
+					t.Fatalf("GetBlob: unexpected error: %+v", err)
+				}
+				gotBytes, err := ioutil.ReadAll(blobReader)
+				if err != nil {
+					t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+				}
+				if !bytes.Equal(content, gotBytes) {
+					t.Errorf("GetBlob: bytes did not match: expected=%q got=%q", string(content), string(gotBytes))
+				}
+				if err := blobReader.Close(); err != nil {
+					t.Errorf("GetBlob: unexpected error closing blob: %+v", err)
+				}
+			}
+		})
+	}
+
+	if _, err := OpenWithOptions(filepath.Join(root, "None"), Options{Sync: SyncMode(-1)}); err == nil {
+		t.Errorf("expected error opening image with invalid sync mode")
+	}
+}
+
+func TestEngineCloseSyncError(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineCloseSyncError")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := OpenWithOptions(image, Options{Sync: SyncBatch})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	if _, _, err := engine.PutBlob(ctx, bytes.NewReader([]byte("unsynced blob"))); err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	tempDir := engine.(*dirEngine).temp
+	if tempDir == "" {
+		t.Fatalf("expected PutBlob to create a tempdir")
+	}
+
+	// Make the pending sync fail by removing the blob.
+	pending := engine.(*dirEngine).syncPending
+	if len(pending) == 0 {
+		t.Fatalf("expected blob to be pending sync")
+	}
+	if err := os.Remove(pending[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Close(); err == nil {
+		t.Errorf("expected Close to fail when syncing fails")
+	}
+	if _, err := os.Lstat(tempDir); !os.IsNotExist(err) {
+		t.Errorf("expected tempdir to be removed after failed sync: %v", err)
+	}
+}
+
+func BenchmarkEnginePutBlobSync(b *testing.B) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-BenchmarkEnginePutBlobSync")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	const numBlobs = 256
+	for _, test := range []struct {
+		name string
+		opt  Options
+	}{
+		{"None", Options{}},
+		{"Each", Options{Sync: SyncEach}},
+		{"Batch", Options{Sync: SyncBatch}},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dir, err := ioutil.TempDir(root, test.name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				image := filepath.Join(dir, "image")
+				if err := Create(image); err != nil {
+					b.Fatalf("unexpected error creating image: %+v", err)
+				}
+				engine, err := OpenWithOptions(image, test.opt)
+				if err != nil {
+					b.Fatalf("unexpected error opening image: %+v", err)
+				}
+				for j := 0; j < numBlobs; j++ {
+					content := []byte(fmt.Sprintf("small blob %d", j))
+					if _, _, err := engine.PutBlob(ctx, bytes.NewReader(content)); err != nil {
+						b.Fatalf("PutBlob: unexpected error: %+v", err)
+					}
+				}
+				if err := engine.PutIndex(ctx, ispec.Index{}); err != nil {
+					b.Fatalf("PutIndex: unexpected error: %+v", err)
+				}
+				if err := engine.Close(); err != nil {
+					b.Fatalf("Close: unexpected error: %+v", err)
+				}
+			}
+		})
+	}
+}
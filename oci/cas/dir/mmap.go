@@ -0,0 +1,101 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"golang.org/x/sys/unix"
+)
+
+// mmapReadCloser is an io.ReadCloser which reads from a memory-mapped blob.
+// The mapping is removed when the reader is closed.
+type mmapReadCloser struct {
+	data   []byte
+	offset int
+}
+
+// Read implements io.Reader.
+func (r *mmapReadCloser) Read(p []byte) (int, error) {
+	if r.data == nil {
+		return 0, os.ErrClosed
+	}
+	if r.offset >= len(r.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.offset:])
+	r.offset += n
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo, allowing the remainder of the blob to be
+// passed to w in a single Write.
+func (r *mmapReadCloser) WriteTo(w io.Writer) (int64, error) {
+	if r.data == nil {
+		return 0, os.ErrClosed
+	}
+	if r.offset >= len(r.data) {
+		return 0, nil
+	}
+	n, err := w.Write(r.data[r.offset:])
+	r.offset += n
+	return int64(n), err
+}
+
+// Close removes the mapping of the blob. Reading from the reader after it has
+// been closed will fail.
+func (r *mmapReadCloser) Close() error {
+	if r.data == nil {
+		return nil
+	}
+	data := r.data
+	r.data = nil
+	return unix.Munmap(data)
+}
+
+// mmapBlob returns a reader for the contents of the given blob file. If the
+// blob is at least threshold bytes long, it is memory-mapped (and fh is
+// closed). Otherwise, or if the blob cannot be mapped, fh itself is returned.
+func mmapBlob(fh *os.File, threshold int64) io.ReadCloser {
+	fi, err := fh.Stat()
+	if err != nil {
+		log.Debugf("dir: stat blob %s for mmap: %v", fh.Name(), err)
+		return fh
+	}
+	size := fi.Size()
+	if size < threshold || size <= 0 || int64(int(size)) != size {
+		return fh
+	}
+
+	data, err := unix.Mmap(int(fh.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		log.Debugf("dir: falling back to regular reads of blob %s: mmap failed: %v", fh.Name(), err)
+		return fh
+	}
+	// The blob is read sequentially (to verify its digest), so read-ahead is
+	// beneficial. Failing to give the hint is harmless.
+	_ = unix.Madvise(data, unix.MADV_SEQUENTIAL)
+
+	// The mapping stays valid after the file is closed.
+	if err := fh.Close(); err != nil {
+		log.Debugf("dir: close mapped blob %s: %v", fh.Name(), err)
+	}
+	return &mmapReadCloser{data: data}
+}
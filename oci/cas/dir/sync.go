@@ -0,0 +1,121 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// SyncMode describes when the blobs and index written by a dir-backed
+// cas.Engine are synced to disk.
+type SyncMode int
+
+const (
+	// SyncNone leaves it to the operating system to decide when written data
+	// is persisted (no fsync(2) calls are made). This is the default.
+	SyncNone SyncMode = iota
+
+	// SyncEach syncs every blob (and the directory containing it) before
+	// PutBlob returns, and the index before PutIndex returns.
+	SyncEach
+
+	// SyncBatch syncs blobs in groups of Options.SyncBatchSize, trading the
+	// durability of individual blobs for throughput during bulk imports. Any
+	// outstanding blobs are always synced before the index is replaced by
+	// PutIndex (so the index never refers to blobs which have not been
+	// synced) and when the engine is closed.
+	SyncBatch
+)
+
+// defaultSyncBatchSize is the number of blobs synced at once with SyncBatch if
+// Options.SyncBatchSize is not set.
+const defaultSyncBatchSize = 64
+
+// syncPath opens the given path (which may be a directory) and syncs it.
+func syncPath(path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer fh.Close()
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "fsync")
+	}
+	return fh.Close()
+}
+
+// syncBlobDirs syncs the directories containing the given blob paths (and
+// the blob directory itself, in case a new shard directory was created).
+func (e *dirEngine) syncBlobDirs(paths []string) error {
+	dirs := map[string]struct{}{}
+	for _, path := range paths {
+		dirs[filepath.Dir(path)] = struct{}{}
+		if e.opt.ShardBlobs {
+			dirs[filepath.Dir(filepath.Dir(path))] = struct{}{}
+		}
+	}
+	for dir := range dirs {
+		if err := syncPath(dir); err != nil {
+			return errors.Wrapf(err, "sync blob directory %s", dir)
+		}
+	}
+	return nil
+}
+
+// queueSync records a newly written blob (with SyncBatch), syncing all of the
+// outstanding blobs once a full batch has been written.
+func (e *dirEngine) queueSync(path string) error {
+	e.syncLock.Lock()
+	defer e.syncLock.Unlock()
+
+	e.syncPending = append(e.syncPending, path)
+	batchSize := e.opt.SyncBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultSyncBatchSize
+	}
+	if len(e.syncPending) < batchSize {
+		return nil
+	}
+	return e.flushSyncLocked()
+}
+
+// flushSync syncs every outstanding blob written with SyncBatch.
+func (e *dirEngine) flushSync() error {
+	e.syncLock.Lock()
+	defer e.syncLock.Unlock()
+	return e.flushSyncLocked()
+}
+
+func (e *dirEngine) flushSyncLocked() error {
+	if len(e.syncPending) == 0 {
+		return nil
+	}
+	for _, path := range e.syncPending {
+		if err := syncPath(path); err != nil {
+			return errors.Wrapf(err, "sync blob %s", path)
+		}
+	}
+	if err := e.syncBlobDirs(e.syncPending); err != nil {
+		return err
+	}
+	e.syncPending = nil
+	return nil
+}
@@ -0,0 +1,322 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package httpdir provides a read-only cas.Engine for OCI image layouts which
+// are served over plain HTTP(S) by a static web server (as opposed to a
+// registry speaking the distribution API).
+package httpdir
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// blobDirectory is the directory inside an OCI image that contains blobs.
+	blobDirectory = "blobs"
+
+	// indexFile is the file inside an OCI image that contains the top-level
+	// index.
+	indexFile = "index.json"
+
+	// layoutFile is the file in side an OCI image the indicates what version
+	// of the OCI spec the image is.
+	layoutFile = "oci-layout"
+
+	// maxResumes is the number of times a blob download which fails part-way
+	// through is resumed (using a range request) before giving up.
+	maxResumes = 3
+)
+
+// IsURL returns whether the given image path is an HTTP(S) URL which should
+// be opened with this package rather than as a local directory.
+func IsURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// Options are the set of optional settings for an HTTP-backed cas.Engine.
+type Options struct {
+	// Client is the HTTP client used for all requests. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+type httpEngine struct {
+	base *url.URL
+	opt  Options
+}
+
+// url returns the URL of the given path (relative to the root of the layout).
+func (e *httpEngine) url(relPath string) string {
+	u := *e.base
+	u.Path = path.Join(u.Path, relPath)
+	return u.String()
+}
+
+// get issues a GET request for the given path (relative to the root of the
+// layout), starting at the given byte offset. A response with any status
+// other than 200 (or 206 if offset is non-zero) is returned as an error, with
+// a 404 being translated to cas.ErrNotExist.
+func (e *httpEngine) get(ctx context.Context, relPath string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, e.url(relPath), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := e.opt.Client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %s", relPath)
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errors.Wrapf(cas.ErrNotExist, "get %s", relPath)
+	default:
+		resp.Body.Close()
+		return nil, errors.Errorf("get %s: unexpected status %s", relPath, resp.Status)
+	}
+	return resp, nil
+}
+
+// getJSON fetches the given path (relative to the root of the layout) and
+// decodes it as JSON into v.
+func (e *httpEngine) getJSON(ctx context.Context, relPath string, v interface{}) error {
+	resp, err := e.get(ctx, relPath, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrapf(err, "parse %s", relPath)
+	}
+	return nil
+}
+
+// validate ensures that the image is valid.
+func (e *httpEngine) validate(ctx context.Context) error {
+	var ociLayout ispec.ImageLayout
+	if err := e.getJSON(ctx, layoutFile, &ociLayout); err != nil {
+		if errors.Cause(err) == cas.ErrNotExist {
+			err = cas.ErrInvalid
+		}
+		return errors.Wrap(err, "read oci-layout")
+	}
+
+	// XXX: Currently the meaning of this field is not adequately defined by
+	//      the spec, nor is the "official" value determined by the spec.
+	if ociLayout.Version != dir.ImageLayoutVersion {
+		return errors.Wrap(cas.ErrInvalid, "layout version is not supported")
+	}
+	return nil
+}
+
+// blobPath returns the path to a blob given its digest, relative to the root
+// of the OCI image. The digest must be of the form algorithm:hex.
+func blobPath(digest digest.Digest) (string, error) {
+	if err := digest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+	if algo := digest.Algorithm(); algo != cas.BlobAlgorithm {
+		return "", errors.Errorf("unsupported algorithm: %q", algo)
+	}
+	return path.Join(blobDirectory, digest.Algorithm().String(), digest.Hex()), nil
+}
+
+// PutBlob is not supported, since HTTP layouts are read-only.
+func (e *httpEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	return "", -1, errors.Wrap(cas.ErrNotImplemented, "put blob")
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns a *cas.BlobNotExistError if the digest is not
+// found. If the download fails part-way through, it is transparently resumed
+// with a range request.
+func (e *httpEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	relPath, err := blobPath(digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute blob path")
+	}
+	resp, err := e.get(ctx, relPath, 0)
+	if err != nil {
+		if errors.Cause(err) == cas.ErrNotExist {
+			err = &cas.BlobNotExistError{Digest: digest, Err: err}
+		}
+		return nil, errors.Wrap(err, "open blob")
+	}
+	return &hardening.VerifiedReadCloser{
+		Reader: &blobReader{
+			ctx:     ctx,
+			engine:  e,
+			relPath: relPath,
+			body:    resp.Body,
+		},
+		ExpectedDigest: digest,
+		ExpectedSize:   resp.ContentLength, // -1 if the length is unknown.
+	}, nil
+}
+
+// PutIndex is not supported, since HTTP layouts are read-only.
+func (e *httpEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	return errors.Wrap(cas.ErrNotImplemented, "put index")
+}
+
+// GetIndex returns the index of the OCI image. If the image doesn't have an
+// index, ErrInvalid is returned (a valid OCI image MUST have an image index).
+func (e *httpEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	var index ispec.Index
+	if err := e.getJSON(ctx, indexFile, &index); err != nil {
+		if errors.Cause(err) == cas.ErrNotExist {
+			err = cas.ErrInvalid
+		}
+		return ispec.Index{}, errors.Wrap(err, "read index")
+	}
+	return index, nil
+}
+
+// DeleteBlob is not supported, since HTTP layouts are read-only.
+func (e *httpEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return errors.Wrap(cas.ErrNotImplemented, "delete blob")
+}
+
+// ListBlobs is not supported, since static web servers do not provide a way
+// of listing the contents of a directory.
+func (e *httpEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	return nil, errors.Wrap(cas.ErrNotImplemented, "list blobs")
+}
+
+// Clean is a no-op, since there is nothing we could clean up.
+func (e *httpEngine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close releases all references held by the engine.
+func (e *httpEngine) Close() error {
+	return nil
+}
+
+// Open opens a new read-only reference to the OCI image layout served at the
+// given HTTP(S) URL.
+func Open(rawURL string) (cas.Engine, error) {
+	return OpenWithOptions(rawURL, Options{})
+}
+
+// OpenWithOptions is like Open, except that the behaviour of the returned
+// engine can be modified with the given Options.
+func OpenWithOptions(rawURL string, opt Options) (cas.Engine, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse url")
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errors.Errorf("unsupported url scheme %q", base.Scheme)
+	}
+	if opt.Client == nil {
+		opt.Client = http.DefaultClient
+	}
+
+	engine := &httpEngine{
+		base: base,
+		opt:  opt,
+	}
+	if err := engine.validate(context.Background()); err != nil {
+		return nil, errors.Wrap(err, "validate")
+	}
+	return engine, nil
+}
+
+// blobReader is an io.ReadCloser for the body of a blob, which resumes the
+// download using a range request if reading the body fails.
+type blobReader struct {
+	ctx     context.Context
+	engine  *httpEngine
+	relPath string
+	body    io.ReadCloser
+	offset  int64
+	resumes int
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			if err := r.resume(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		// Return whatever we got before the error. The next read should hit
+		// the same error, at which point we resume.
+		if n > 0 {
+			return n, nil
+		}
+		if r.resumes >= maxResumes {
+			return 0, errors.Wrapf(err, "read %s", r.relPath)
+		}
+		log.Warnf("resuming download of %s at offset %d: %v", r.relPath, r.offset, err)
+		r.body.Close()
+		r.body = nil
+		r.resumes++
+	}
+}
+
+// resume re-opens the body of the blob at the current offset. If the server
+// does not support range requests, the already-read prefix is skipped.
+func (r *blobReader) resume() error {
+	resp, err := r.engine.get(r.ctx, r.relPath, r.offset)
+	if err != nil {
+		return errors.Wrap(err, "resume blob")
+	}
+	if resp.StatusCode == http.StatusOK {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, r.offset); err != nil {
+			resp.Body.Close()
+			return errors.Wrap(err, "skip blob prefix")
+		}
+	}
+	r.body = resp.Body
+	return nil
+}
+
+func (r *blobReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
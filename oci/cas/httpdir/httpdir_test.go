@@ -0,0 +1,207 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpdir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// setupLayout creates an image layout (in a new temporary directory) with a
+// single blob and an index referencing it.
+func setupLayout(t *testing.T, blob []byte) (string, digest.Digest) {
+	root, err := ioutil.TempDir("", "umoci-TestHTTPDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening layout: %+v", err)
+	}
+	defer engine.Close()
+
+	blobDigest, blobSize, err := engine.PutBlob(context.Background(), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+	if err := engine.PutIndex(context.Background(), ispec.Index{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Manifests: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    blobDigest,
+			Size:      blobSize,
+		}},
+	}); err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+	return root, blobDigest
+}
+
+func TestEngineRead(t *testing.T) {
+	blob := []byte("some blob contents")
+	root, blobDigest := setupLayout(t, blob)
+	defer os.RemoveAll(root)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join(root, "image"))))
+	defer server.Close()
+
+	engine, err := Open(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error opening http layout: %+v", err)
+	}
+	defer engine.Close()
+
+	index, err := engine.GetIndex(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != blobDigest {
+		t.Errorf("unexpected index contents: %+v", index)
+	}
+
+	reader, err := engine.GetBlob(context.Background(), blobDigest)
+	if err != nil {
+		t.Fatalf("unexpected error getting blob: %+v", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("unexpected error reading blob: %+v", err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Errorf("unexpected blob contents: %q", data)
+	}
+
+	if _, err := engine.GetBlob(context.Background(), digest.FromString("missing")); !errors.Is(err, cas.ErrBlobNotExist) {
+		t.Errorf("expected missing blob to give ErrBlobNotExist: %+v", err)
+	}
+	if _, _, err := engine.PutBlob(context.Background(), bytes.NewReader(blob)); errors.Cause(err) != cas.ErrNotImplemented {
+		t.Errorf("expected PutBlob to be unsupported: %+v", err)
+	}
+	if err := engine.PutIndex(context.Background(), index); errors.Cause(err) != cas.ErrNotImplemented {
+		t.Errorf("expected PutIndex to be unsupported: %+v", err)
+	}
+	if err := engine.DeleteBlob(context.Background(), blobDigest); errors.Cause(err) != cas.ErrNotImplemented {
+		t.Errorf("expected DeleteBlob to be unsupported: %+v", err)
+	}
+}
+
+func TestEngineResume(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789"), 4096)
+	root, blobDigest := setupLayout(t, blob)
+	defer os.RemoveAll(root)
+
+	// The first request for the blob is cut short half-way, so the engine has
+	// to resume the download with a range request.
+	var truncated int32
+	fileServer := http.FileServer(http.Dir(filepath.Join(root, "image")))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/blobs/") && atomic.CompareAndSwapInt32(&truncated, 0, 1) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			w.Write(blob[:len(blob)/2])
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	engine, err := Open(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error opening http layout: %+v", err)
+	}
+	defer engine.Close()
+
+	reader, err := engine.GetBlob(context.Background(), blobDigest)
+	if err != nil {
+		t.Fatalf("unexpected error getting blob: %+v", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("unexpected error reading resumed blob: %+v", err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Errorf("resumed blob does not match original")
+	}
+	if atomic.LoadInt32(&truncated) != 1 {
+		t.Errorf("blob download was never truncated")
+	}
+}
+
+func TestEngineVerify(t *testing.T) {
+	blob := []byte("some blob contents")
+	root, blobDigest := setupLayout(t, blob)
+	defer os.RemoveAll(root)
+
+	// Corrupt the blob on the server.
+	blobFile := filepath.Join(root, "image", "blobs", blobDigest.Algorithm().String(), blobDigest.Hex())
+	if err := ioutil.WriteFile(blobFile, []byte("some blob CONTENTS"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join(root, "image"))))
+	defer server.Close()
+
+	engine, err := Open(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error opening http layout: %+v", err)
+	}
+	defer engine.Close()
+
+	reader, err := engine.GetBlob(context.Background(), blobDigest)
+	if err != nil {
+		t.Fatalf("unexpected error getting blob: %+v", err)
+	}
+	defer reader.Close()
+	if _, err := ioutil.ReadAll(reader); errors.Cause(err) != hardening.ErrDigestMismatch {
+		t.Errorf("expected corrupted blob to fail verification: %+v", err)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	if _, err := Open(server.URL); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("expected opening non-layout to fail with ErrInvalid: %+v", err)
+	}
+	if _, err := Open("ftp://example.com/image"); err == nil {
+		t.Errorf("expected opening non-http url to fail")
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tee provides a cas.Engine which writes every blob to two engines in
+// a single pass, so that (for instance) newly generated layers can be stored
+// in a local image and copied to another store without being read twice.
+package tee
+
+import (
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type teeEngine struct {
+	primary   cas.Engine
+	secondary cas.Engine
+}
+
+// putResult is the result of a PutBlob call.
+type putResult struct {
+	digest digest.Digest
+	size   int64
+	err    error
+}
+
+// PutBlob adds a new blob to both engines, reading the blob only once. An
+// error is returned if either engine fails to store the blob, or if the two
+// engines disagree about the digest or size of the blob.
+func (e *teeEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	pr, pw := io.Pipe()
+	secondaryCh := make(chan putResult, 1)
+	go func() {
+		var res putResult
+		res.digest, res.size, res.err = e.secondary.PutBlob(ctx, pr)
+		// Make sure that the primary doesn't block writing to the pipe if the
+		// secondary has stopped reading.
+		if res.err != nil {
+			pr.CloseWithError(res.err)
+		} else {
+			pr.Close()
+		}
+		secondaryCh <- res
+	}()
+
+	primaryDigest, primarySize, err := e.primary.PutBlob(ctx, io.TeeReader(reader, pw))
+	// Propagate the primary's error (if any) to the secondary, so that it
+	// doesn't store a truncated blob.
+	if err != nil {
+		pw.CloseWithError(err)
+	} else {
+		pw.Close()
+	}
+	secondary := <-secondaryCh
+	if err != nil {
+		return "", -1, errors.Wrap(err, "put blob in primary")
+	}
+	if secondary.err != nil {
+		return "", -1, errors.Wrap(secondary.err, "put blob in secondary")
+	}
+
+	if primaryDigest != secondary.digest || primarySize != secondary.size {
+		return "", -1, errors.Errorf("primary and secondary stored different blobs: %s (%d bytes) != %s (%d bytes)", primaryDigest, primarySize, secondary.digest, secondary.size)
+	}
+	return primaryDigest, primarySize, nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the primary engine,
+// which the caller must Close().
+func (e *teeEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	return e.primary.GetBlob(ctx, digest)
+}
+
+// PutIndex sets the index of the primary engine. The index of the secondary
+// engine is not modified, since it may not contain every blob referenced by
+// the primary's index.
+func (e *teeEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	return e.primary.PutIndex(ctx, index)
+}
+
+// GetIndex returns the index of the primary engine.
+func (e *teeEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	return e.primary.GetIndex(ctx)
+}
+
+// GetIndexes returns every top-level index of the primary engine.
+func (e *teeEngine) GetIndexes(ctx context.Context) ([]ispec.Index, error) {
+	return cas.GetIndexes(ctx, e.primary)
+}
+
+// DeleteBlob removes a blob from the primary engine. Blobs are never removed
+// from the secondary engine, since they may still be referenced by it.
+func (e *teeEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return e.primary.DeleteBlob(ctx, digest)
+}
+
+// ListBlobs returns the set of blob digests stored in the primary engine.
+func (e *teeEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	return e.primary.ListBlobs(ctx)
+}
+
+// Clean executes a garbage collection of any non-blob garbage in both
+// engines.
+func (e *teeEngine) Clean(ctx context.Context) error {
+	if err := e.primary.Clean(ctx); err != nil {
+		return errors.Wrap(err, "clean primary")
+	}
+	return errors.Wrap(e.secondary.Clean(ctx), "clean secondary")
+}
+
+// Close releases all references held by both engines.
+func (e *teeEngine) Close() error {
+	primaryErr := e.primary.Close()
+	secondaryErr := e.secondary.Close()
+	if primaryErr != nil {
+		return errors.Wrap(primaryErr, "close primary")
+	}
+	return errors.Wrap(secondaryErr, "close secondary")
+}
+
+// New returns a cas.Engine which writes every blob to both the primary and
+// secondary engines in a single pass. All other operations (including reading
+// blobs and modifying the index) only use the primary engine, so the
+// secondary engine acts as a sink for blobs (references to which must be
+// managed separately).
+func New(primary, secondary cas.Engine) cas.Engine {
+	return &teeEngine{
+		primary:   primary,
+		secondary: secondary,
+	}
+}
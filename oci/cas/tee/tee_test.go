@@ -0,0 +1,160 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tee
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func openImage(t *testing.T, path string) cas.Engine {
+	if err := dir.Create(path); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	return engine
+}
+
+func TestTeeMutateAdd(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestTeeMutateAdd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	local := openImage(t, filepath.Join(root, "local"))
+	remote := openImage(t, filepath.Join(root, "remote"))
+	engine := New(local, remote)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Create an empty image to add a layer to.
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{})
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	})
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+
+	mutator, err := mutate.New(engine, casext.DescriptorPath{
+		Walk: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := bytes.Repeat([]byte("some layer contents\n"), 4096)
+	desc, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, bytes.NewReader(layer), nil, mutate.GzipCompressor, nil)
+	if err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	// The compressed layer must be stored identically in both images.
+	for name, engine := range map[string]cas.Engine{"local": local, "remote": remote} {
+		reader, err := engine.GetBlob(ctx, desc.Digest)
+		if err != nil {
+			t.Errorf("layer %s missing from %s image: %+v", desc.Digest, name, err)
+			continue
+		}
+		digester := digest.Canonical.Digester()
+		size, err := io.Copy(digester.Hash(), reader)
+		reader.Close()
+		if err != nil {
+			t.Errorf("read layer from %s image: %+v", name, err)
+			continue
+		}
+		if got := digester.Digest(); got != desc.Digest || size != desc.Size {
+			t.Errorf("unexpected layer in %s image: expected %s (%d bytes) got %s (%d bytes)", name, desc.Digest, desc.Size, got, size)
+		}
+	}
+}
+
+// badEngine is a cas.Engine whose PutBlob either fails or misreports the
+// digest of the blob.
+type badEngine struct {
+	cas.Engine
+	err error
+}
+
+func (e badEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	_, size, err := e.Engine.PutBlob(ctx, reader)
+	if err != nil {
+		return "", -1, err
+	}
+	if e.err != nil {
+		return "", -1, e.err
+	}
+	return digest.FromString("not the blob"), size, nil
+}
+
+func TestTeePutBlobMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestTeePutBlobMismatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	local := openImage(t, filepath.Join(root, "local"))
+	defer local.Close()
+	remote := openImage(t, filepath.Join(root, "remote"))
+	defer remote.Close()
+
+	// A secondary which disagrees about the digest.
+	engine := New(local, badEngine{Engine: remote})
+	if _, _, err := engine.PutBlob(ctx, bytes.NewBufferString("blob")); err == nil {
+		t.Errorf("expected PutBlob to fail with mismatched digests")
+	}
+
+	// A secondary which fails.
+	failure := errors.New("secondary failure")
+	engine = New(local, badEngine{Engine: remote, err: failure})
+	if _, _, err := engine.PutBlob(ctx, bytes.NewBufferString("blob")); errors.Cause(err) != failure {
+		t.Errorf("expected PutBlob to fail with %v: got %v", failure, err)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Annotations used by BuildKit to mark image index entries which are
+// attestation manifests (containing in-toto SBOM or provenance payloads)
+// rather than runnable images.
+const (
+	// AnnotationReferenceType is the annotation describing the kind of
+	// reference an index entry is.
+	AnnotationReferenceType = "vnd.docker.reference.type"
+
+	// AnnotationReferenceDigest is the annotation containing the digest of the
+	// manifest an attestation manifest refers to.
+	AnnotationReferenceDigest = "vnd.docker.reference.digest"
+
+	// ReferenceTypeAttestation is the value of AnnotationReferenceType for
+	// attestation manifests.
+	ReferenceTypeAttestation = "attestation-manifest"
+)
+
+// IsAttestation returns whether the given descriptor refers to an attestation
+// manifest.
+func IsAttestation(descriptor ispec.Descriptor) bool {
+	return descriptor.Annotations[AnnotationReferenceType] == ReferenceTypeAttestation
+}
+
+// ListAttestations returns the descriptor paths of all attestation manifests
+// reachable from the entries in the top-level index matching refname.
+func (e Engine) ListAttestations(ctx context.Context, refname string) ([]DescriptorPath, error) {
+	if !IsValidReferenceName(refname) {
+		return nil, errors.Errorf("refusing to resolve invalid reference %q", refname)
+	}
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+
+	var attestations []DescriptorPath
+	for _, root := range index.Manifests {
+		if root.Annotations[ispec.AnnotationRefName] != refname {
+			continue
+		}
+		if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+			if IsAttestation(descriptorPath.Descriptor()) {
+				attestations = append(attestations, descriptorPath)
+				return ErrSkipDescriptor
+			}
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "walk %s", root.Digest)
+		}
+	}
+	return attestations, nil
+}
+
+// stripAttestations removes all attestation manifests from the image index
+// referenced by descriptor (and any nested indexes), returning the descriptor
+// of the new index and the list of removed descriptors. If descriptor is not an
+// image index (or contains no attestations) it is returned unmodified.
+func (e Engine) stripAttestations(ctx context.Context, descriptor ispec.Descriptor) (ispec.Descriptor, []ispec.Descriptor, error) {
+	if descriptor.MediaType != ispec.MediaTypeImageIndex {
+		return descriptor, nil, nil
+	}
+
+	blob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return descriptor, nil, errors.Wrapf(err, "get index %s", descriptor.Digest)
+	}
+	defer blob.Close()
+	index, ok := blob.Data.(ispec.Index)
+	if !ok {
+		return descriptor, nil, errors.Errorf("[internal error] unknown index blob type: %T", blob.Data)
+	}
+
+	var (
+		removed   []ispec.Descriptor
+		manifests []ispec.Descriptor
+	)
+	for _, child := range index.Manifests {
+		if IsAttestation(child) {
+			removed = append(removed, child)
+			continue
+		}
+		newChild, childRemoved, err := e.stripAttestations(ctx, child)
+		if err != nil {
+			return descriptor, nil, err
+		}
+		removed = append(removed, childRemoved...)
+		manifests = append(manifests, newChild)
+	}
+	if len(removed) == 0 {
+		return descriptor, nil, nil
+	}
+
+	index.Manifests = manifests
+	if index.Manifests == nil {
+		index.Manifests = []ispec.Descriptor{}
+	}
+	indexDigest, indexSize, err := e.PutBlobJSON(ctx, index)
+	if err != nil {
+		return descriptor, nil, errors.Wrap(err, "put stripped index")
+	}
+	descriptor.Digest = indexDigest
+	descriptor.Size = indexSize
+	return descriptor, removed, nil
+}
+
+// StripAttestations removes all attestation manifests from the image indexes
+// reachable from the entries in the top-level index matching refname, and
+// updates the references to point to the new indexes. The descriptors of the
+// removed attestation manifests are returned. The blobs of the attestations
+// are not deleted, callers should use GC to remove them once they are no
+// longer referenced.
+func (e Engine) StripAttestations(ctx context.Context, refname string) ([]ispec.Descriptor, error) {
+	if !IsValidReferenceName(refname) {
+		return nil, errors.Errorf("refusing to update invalid reference %q", refname)
+	}
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+
+	var removed []ispec.Descriptor
+	for idx, root := range index.Manifests {
+		if root.Annotations[ispec.AnnotationRefName] != refname {
+			continue
+		}
+		newRoot, rootRemoved, err := e.stripAttestations(ctx, root)
+		if err != nil {
+			return nil, errors.Wrapf(err, "strip attestations from %s", root.Digest)
+		}
+		index.Manifests[idx] = newRoot
+		removed = append(removed, rootRemoved...)
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	log.WithFields(log.Fields{
+		"removed": removed,
+	}).Debugf("casext.StripAttestations(%s) removed these descriptors", refname)
+
+	if err := e.PutIndex(ctx, index); err != nil {
+		return nil, errors.Wrap(err, "replace index")
+	}
+	return removed, nil
+}
@@ -0,0 +1,152 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"golang.org/x/net/context"
+)
+
+func TestStripAttestations(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestStripAttestations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	putBlob := func(mediaType, data string) ispec.Descriptor {
+		blobDigest, size, err := engineExt.PutBlob(ctx, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatalf("unexpected error putting blob: %+v", err)
+		}
+		return ispec.Descriptor{MediaType: mediaType, Digest: blobDigest, Size: size}
+	}
+	putManifest := func(config ispec.Descriptor, layers ...ispec.Descriptor) ispec.Descriptor {
+		blobDigest, size, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+			Versioned: ispecs.Versioned{SchemaVersion: 2},
+			Config:    config,
+			Layers:    layers,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error putting manifest: %+v", err)
+		}
+		return ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: blobDigest, Size: size}
+	}
+
+	// The runnable image.
+	config := putBlob(ispec.MediaTypeImageConfig, `{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	imageLayer := putBlob(ispec.MediaTypeImageLayer, "not really a layer")
+	manifest := putManifest(config, imageLayer)
+	manifest.Platform = &ispec.Platform{OS: "linux", Architecture: "amd64"}
+
+	// The attestation manifest, in the form generated by BuildKit.
+	attestationConfig := putBlob(ispec.MediaTypeImageConfig, `{"architecture":"unknown","os":"unknown"}`)
+	attestationLayer := putBlob("application/vnd.in-toto+json", `{"_type":"https://in-toto.io/Statement/v0.1"}`)
+	attestation := putManifest(attestationConfig, attestationLayer)
+	attestation.Platform = &ispec.Platform{OS: "unknown", Architecture: "unknown"}
+	attestation.Annotations = map[string]string{
+		AnnotationReferenceType:   ReferenceTypeAttestation,
+		AnnotationReferenceDigest: manifest.Digest.String(),
+	}
+
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(ctx, ispec.Index{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		Manifests: []ispec.Descriptor{manifest, attestation},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "latest", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}); err != nil {
+		t.Fatalf("unexpected error updating reference: %+v", err)
+	}
+
+	attestations, err := engineExt.ListAttestations(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error listing attestations: %+v", err)
+	}
+	if len(attestations) != 1 || attestations[0].Descriptor().Digest != attestation.Digest {
+		t.Fatalf("expected to find attestation %s, got %v", attestation.Digest, attestations)
+	}
+
+	removed, err := engineExt.StripAttestations(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error stripping attestations: %+v", err)
+	}
+	if len(removed) != 1 || removed[0].Digest != attestation.Digest {
+		t.Errorf("expected to remove attestation %s, got %v", attestation.Digest, removed)
+	}
+
+	// Stripping again is a no-op.
+	if removed, err := engineExt.StripAttestations(ctx, "latest"); err != nil {
+		t.Errorf("unexpected error stripping attestations again: %+v", err)
+	} else if len(removed) != 0 {
+		t.Errorf("expected nothing to be removed, got %v", removed)
+	}
+
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("unexpected error running gc: %+v", err)
+	}
+
+	// Only the runnable image should remain.
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error resolving reference: %+v", err)
+	}
+	if len(descriptorPaths) != 1 || descriptorPaths[0].Descriptor().Digest != manifest.Digest {
+		t.Errorf("expected reference to resolve to %s, got %v", manifest.Digest, descriptorPaths)
+	}
+	for _, desc := range []ispec.Descriptor{manifest, config, imageLayer} {
+		if blob, err := engine.GetBlob(ctx, desc.Digest); err != nil {
+			t.Errorf("image blob %s was removed: %+v", desc.Digest, err)
+		} else {
+			blob.Close()
+		}
+	}
+	for _, blobDigest := range []digest.Digest{attestation.Digest, attestationConfig.Digest, attestationLayer.Digest, indexDigest} {
+		if blob, err := engine.GetBlob(ctx, blobDigest); err == nil {
+			blob.Close()
+			t.Errorf("attestation blob %s was not removed", blobDigest)
+		}
+	}
+}
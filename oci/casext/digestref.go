@@ -0,0 +1,109 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// digestReferencePrefix is the prefix of digest references. Reference names
+// must start with an alphanumeric character, so digest references can never
+// be confused with reference names.
+const digestReferencePrefix = "@"
+
+// DigestReference returns the digest reference for the given digest, which
+// can be used in place of a reference name with ResolveReference to resolve
+// the blob with that digest (bypassing the reference names in the top-level
+// index).
+func DigestReference(blobDigest digest.Digest) string {
+	return digestReferencePrefix + blobDigest.String()
+}
+
+// IsDigestReference returns whether the given reference is a digest reference
+// (of the form "@<algorithm>:<hex>") rather than a reference name.
+func IsDigestReference(ref string) bool {
+	return strings.HasPrefix(ref, digestReferencePrefix)
+}
+
+// blobMediaType guesses the media-type of a JSON blob, for blobs whose
+// descriptor is not known. The "mediaType" field is used if present,
+// otherwise the presence of the "manifests" or "config" fields is used to
+// distinguish image indexes from manifests.
+func blobMediaType(data []byte) (string, error) {
+	var blob struct {
+		MediaType string           `json:"mediaType"`
+		Manifests *json.RawMessage `json:"manifests"`
+		Config    *json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return "", errors.Wrap(err, "parse blob")
+	}
+	switch {
+	case blob.MediaType != "":
+		return blob.MediaType, nil
+	case blob.Manifests != nil:
+		return ispec.MediaTypeImageIndex, nil
+	case blob.Config != nil:
+		return ispec.MediaTypeImageManifest, nil
+	}
+	return "", errors.New("unknown blob media-type")
+}
+
+// ResolveDigest resolves all of the descriptor paths to manifests (or any
+// unknown blobs) reachable from the blob with the given digest, which must be
+// an image manifest or image index. The blob does not need to be referenced
+// by the top-level index. The root of each returned DescriptorPath is a
+// descriptor for the blob itself.
+func (e Engine) ResolveDigest(ctx context.Context, blobDigest digest.Digest) ([]DescriptorPath, error) {
+	if err := blobDigest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid digest %q", blobDigest)
+	}
+
+	reader, err := e.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read blob")
+	}
+	if got := blobDigest.Algorithm().FromBytes(data); got != blobDigest {
+		return nil, errors.Errorf("blob digest mismatch: expected %s got %s", blobDigest, got)
+	}
+
+	mediaType, err := blobMediaType(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve %s", blobDigest)
+	}
+	if mediaType != ispec.MediaTypeImageManifest && mediaType != ispec.MediaTypeImageIndex {
+		return nil, errors.Errorf("resolve %s: blob is not an image manifest or index: %s", blobDigest, mediaType)
+	}
+	return e.resolveRoot(ctx, ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      int64(len(data)),
+	})
+}
@@ -0,0 +1,222 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// CorruptBlob describes a blob whose contents do not match its digest.
+type CorruptBlob struct {
+	// Digest is the digest the blob is stored under.
+	Digest digest.Digest
+
+	// Actual is the digest of the blob's contents, if it was computed.
+	Actual digest.Digest
+}
+
+// DanglingReference describes a descriptor which references a blob that does
+// not exist in the image.
+type DanglingReference struct {
+	// Parent is the digest of the blob containing the descriptor. It is empty
+	// if the descriptor is contained in the top-level index.
+	Parent digest.Digest
+
+	// Descriptor is the descriptor referencing the missing blob.
+	Descriptor ispec.Descriptor
+}
+
+// FsckReport is the set of problems found by Fsck.
+type FsckReport struct {
+	// Misnamed is the set of blobs whose name is not a valid digest.
+	Misnamed []digest.Digest
+
+	// Corrupt is the set of blobs whose contents do not match their digest.
+	Corrupt []CorruptBlob
+
+	// Dangling is the set of descriptors referencing blobs which do not exist.
+	Dangling []DanglingReference
+
+	// Orphans is the set of blobs which are not reachable from the top-level
+	// index (or indexes, for a cas.MultiIndexEngine). Orphans are not an error (they will be removed by GC), but are
+	// reported for completeness.
+	Orphans []digest.Digest
+}
+
+// Clean returns whether the report contains no errors. Orphaned blobs are not
+// considered to be errors.
+func (r FsckReport) Clean() bool {
+	return len(r.Misnamed) == 0 && len(r.Corrupt) == 0 && len(r.Dangling) == 0
+}
+
+// FsckOptions configures Fsck.
+type FsckOptions struct {
+	// Quick skips hashing the contents of every blob, and only checks that
+	// referenced blobs exist. Blobs which need to be parsed to find their
+	// references are still verified as they are read.
+	Quick bool
+}
+
+// Fsck checks the consistency of every blob in the image, as opposed to only
+// the blobs reachable from a particular reference. Every blob is checked to
+// have a valid name and (unless opt.Quick is set) contents that match that
+// name, every descriptor reachable from the top-level index is checked to
+// reference an existing blob, and any blobs not reachable from the top-level
+// index are reported as orphans.
+//
+// Problems with the image are returned in the report, and an error is only
+// returned if Fsck was unable to complete the check.
+func (e Engine) Fsck(ctx context.Context, opt FsckOptions) (*FsckReport, error) {
+	report := new(FsckReport)
+
+	blobs, err := e.ListBlobs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob list")
+	}
+
+	present := map[digest.Digest]struct{}{}
+	corrupt := map[digest.Digest]struct{}{}
+	for _, blob := range blobs {
+		if err := blob.Validate(); err != nil {
+			log.Debugf("fsck: blob %q has an invalid name: %v", blob, err)
+			report.Misnamed = append(report.Misnamed, blob)
+			continue
+		}
+		present[blob] = struct{}{}
+		if opt.Quick {
+			continue
+		}
+
+		actual, err := e.blobDigest(ctx, blob)
+		if err != nil {
+			return nil, errors.Wrapf(err, "check blob %s", blob)
+		}
+		if actual != blob {
+			log.Debugf("fsck: blob %s has contents %s", blob, actual)
+			report.Corrupt = append(report.Corrupt, CorruptBlob{
+				Digest: blob,
+				Actual: actual,
+			})
+			corrupt[blob] = struct{}{}
+		}
+	}
+
+	indexes, err := cas.GetIndexes(ctx, e.Engine)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level indexes")
+	}
+
+	// Walk every descriptor reachable from the top-level index. We can't use
+	// Walk here because we need to continue past missing and corrupt blobs.
+	type step struct {
+		parent     digest.Digest
+		descriptor ispec.Descriptor
+	}
+	var queue []step
+	for _, index := range indexes {
+		for _, descriptor := range index.Manifests {
+			queue = append(queue, step{descriptor: descriptor})
+		}
+	}
+	reachable := map[digest.Digest]struct{}{}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		if _, ok := present[cur.descriptor.Digest]; !ok {
+			report.Dangling = append(report.Dangling, DanglingReference{
+				Parent:     cur.parent,
+				Descriptor: cur.descriptor,
+			})
+			continue
+		}
+		if _, ok := reachable[cur.descriptor.Digest]; ok {
+			continue
+		}
+		reachable[cur.descriptor.Digest] = struct{}{}
+		if _, ok := corrupt[cur.descriptor.Digest]; ok {
+			continue
+		}
+		// Only blobs we can parse can contain descriptors, so there's no need
+		// to read any other blobs (such as layers).
+		if mediatype.GetParser(cur.descriptor.MediaType) == nil {
+			continue
+		}
+
+		blob, err := e.FromDescriptor(ctx, cur.descriptor)
+		if err != nil {
+			switch errors.Cause(err) {
+			case hardening.ErrDigestMismatch, hardening.ErrSizeMismatch:
+				log.Debugf("fsck: blob %s failed verification: %v", cur.descriptor.Digest, err)
+				report.Corrupt = append(report.Corrupt, CorruptBlob{
+					Digest: cur.descriptor.Digest,
+				})
+				corrupt[cur.descriptor.Digest] = struct{}{}
+				continue
+			}
+			return nil, errors.Wrapf(err, "get blob %s", cur.descriptor.Digest)
+		}
+		for _, child := range childDescriptors(blob.Data) {
+			queue = append(queue, step{
+				parent:     cur.descriptor.Digest,
+				descriptor: child,
+			})
+		}
+		if err := blob.Close(); err != nil {
+			return nil, errors.Wrapf(err, "close blob %s", cur.descriptor.Digest)
+		}
+	}
+
+	for blob := range present {
+		if _, ok := reachable[blob]; !ok {
+			report.Orphans = append(report.Orphans, blob)
+		}
+	}
+	sort.Slice(report.Orphans, func(i, j int) bool {
+		return report.Orphans[i] < report.Orphans[j]
+	})
+	return report, nil
+}
+
+// blobDigest returns the digest of the contents of the given blob, computed
+// with the same algorithm as the blob's digest.
+func (e Engine) blobDigest(ctx context.Context, blob digest.Digest) (digest.Digest, error) {
+	reader, err := e.GetBlob(ctx, blob)
+	if err != nil {
+		return "", errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	// The reader returned by GetBlob is verified, so we need to ignore the
+	// verification error and return the actual digest instead.
+	digester := blob.Algorithm().Digester()
+	if _, err := io.Copy(digester.Hash(), reader); err != nil && errors.Cause(err) != hardening.ErrDigestMismatch {
+		return "", errors.Wrap(err, "hash blob")
+	}
+	return digester.Digest(), nil
+}
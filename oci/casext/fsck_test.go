@@ -0,0 +1,168 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"golang.org/x/net/context"
+)
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestFsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewBufferString("layer contents"))
+	if err != nil {
+		t.Fatalf("put layer: %+v", err)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{})
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+	orphanDigest, _, err := engineExt.PutBlob(ctx, bytes.NewBufferString("orphan"))
+	if err != nil {
+		t.Fatalf("put orphan: %+v", err)
+	}
+	missingDigest := digest.FromString("missing layer")
+
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{
+			{
+				MediaType: ispec.MediaTypeImageLayer,
+				Digest:    layerDigest,
+				Size:      layerSize,
+			},
+			{
+				MediaType: ispec.MediaTypeImageLayer,
+				Digest:    missingDigest,
+				Size:      13,
+			},
+		},
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "latest", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}); err != nil {
+		t.Fatalf("update reference: %+v", err)
+	}
+
+	// Corrupt the layer blob in-place.
+	layerPath := filepath.Join(image, "blobs", layerDigest.Algorithm().String(), layerDigest.Hex())
+	if err := ioutil.WriteFile(layerPath, []byte("corrupt contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	corruptDigest := digest.FromString("corrupt contents")
+
+	t.Run("Full", func(t *testing.T) {
+		report, err := engineExt.Fsck(ctx, FsckOptions{})
+		if err != nil {
+			t.Fatalf("unexpected fsck error: %+v", err)
+		}
+		if report.Clean() {
+			t.Errorf("expected fsck to report errors")
+		}
+		if len(report.Misnamed) != 0 {
+			t.Errorf("unexpected misnamed blobs: %v", report.Misnamed)
+		}
+		if len(report.Corrupt) != 1 {
+			t.Errorf("expected exactly one corrupt blob: got %v", report.Corrupt)
+		} else if report.Corrupt[0].Digest != layerDigest || report.Corrupt[0].Actual != corruptDigest {
+			t.Errorf("unexpected corrupt blob: expected %s (%s) got %s (%s)", layerDigest, corruptDigest, report.Corrupt[0].Digest, report.Corrupt[0].Actual)
+		}
+		if len(report.Dangling) != 1 {
+			t.Errorf("expected exactly one dangling reference: got %v", report.Dangling)
+		} else if report.Dangling[0].Descriptor.Digest != missingDigest || report.Dangling[0].Parent != manifestDigest {
+			t.Errorf("unexpected dangling reference: expected %s (from %s) got %s (from %s)", missingDigest, manifestDigest, report.Dangling[0].Descriptor.Digest, report.Dangling[0].Parent)
+		}
+		if len(report.Orphans) != 1 || report.Orphans[0] != orphanDigest {
+			t.Errorf("expected only %s to be orphaned: got %v", orphanDigest, report.Orphans)
+		}
+	})
+
+	t.Run("Quick", func(t *testing.T) {
+		report, err := engineExt.Fsck(ctx, FsckOptions{Quick: true})
+		if err != nil {
+			t.Fatalf("unexpected fsck error: %+v", err)
+		}
+		// The layer is never read in quick mode, so the corruption is missed.
+		if len(report.Corrupt) != 0 {
+			t.Errorf("unexpected corrupt blobs in quick mode: %v", report.Corrupt)
+		}
+		if len(report.Dangling) != 1 || report.Dangling[0].Descriptor.Digest != missingDigest {
+			t.Errorf("expected %s to be dangling: got %v", missingDigest, report.Dangling)
+		}
+		if len(report.Orphans) != 1 || report.Orphans[0] != orphanDigest {
+			t.Errorf("expected only %s to be orphaned: got %v", orphanDigest, report.Orphans)
+		}
+	})
+
+	t.Run("Misnamed", func(t *testing.T) {
+		misnamedPath := filepath.Join(image, "blobs", layerDigest.Algorithm().String(), "not-a-digest")
+		if err := ioutil.WriteFile(misnamedPath, []byte("misnamed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(misnamedPath)
+
+		report, err := engineExt.Fsck(ctx, FsckOptions{Quick: true})
+		if err != nil {
+			t.Fatalf("unexpected fsck error: %+v", err)
+		}
+		if len(report.Misnamed) != 1 || report.Misnamed[0].Hex() != "not-a-digest" {
+			t.Errorf("expected not-a-digest to be misnamed: got %v", report.Misnamed)
+		}
+	})
+}
@@ -18,9 +18,13 @@
 package casext
 
 import (
+	"runtime"
+	"sync"
+
 	"github.com/apex/log"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -28,9 +32,14 @@ import (
 // GCPolicy is a policy function that returns 'true' if a blob can be GC'ed
 type GCPolicy func(ctx context.Context, digest digest.Digest) (bool, error)
 
+// gcMarkWorkers is the number of blobs which GC will fetch and parse
+// concurrently during the mark phase.
+var gcMarkWorkers = runtime.NumCPU()
+
 // GC will perform a mark-and-sweep garbage collection of the OCI image
 // referenced by the given CAS engine. The root set is taken to be the set of
-// references stored in the image, and all blobs not reachable by following a
+// references stored in the image (in every top-level index, if the engine is a
+// cas.MultiIndexEngine), and all blobs not reachable by following a
 // descriptor path from the root set will be removed.
 //
 // GC will only call ListBlobs and ListReferences once, and assumes that there
@@ -46,32 +55,24 @@ func (e Engine) GC(ctx context.Context, policies ...GCPolicy) error {
 	// Generate the root set of descriptors.
 	var root []ispec.Descriptor
 
-	index, err := e.GetIndex(ctx)
+	indexes, err := cas.GetIndexes(ctx, e.Engine)
 	if err != nil {
-		return errors.Wrap(err, "get top-level index")
+		return errors.Wrap(err, "get top-level indexes")
 	}
 
-	for _, descriptor := range index.Manifests {
-		log.WithFields(log.Fields{
-			"digest": descriptor.Digest,
-		}).Debugf("GC: got reference")
-		root = append(root, descriptor)
+	for _, index := range indexes {
+		for _, descriptor := range index.Manifests {
+			log.WithFields(log.Fields{
+				"digest": descriptor.Digest,
+			}).Debugf("GC: got reference")
+			root = append(root, descriptor)
+		}
 	}
 
 	// Mark from the root sets.
-	black := map[digest.Digest]struct{}{}
-	for idx, descriptor := range root {
-		log.WithFields(log.Fields{
-			"digest": descriptor.Digest,
-		}).Debugf("GC: marking from root")
-
-		reachables, err := e.reachable(ctx, descriptor)
-		if err != nil {
-			return errors.Wrapf(err, "getting reachables from root %d", idx)
-		}
-		for _, reachable := range reachables {
-			black[reachable] = struct{}{}
-		}
+	black, err := e.mark(ctx, root, gcMarkWorkers)
+	if err != nil {
+		return err
 	}
 
 	// Sweep all blobs in the white set.
@@ -116,3 +117,119 @@ sweep:
 	log.Debugf("garbage collected %d blobs", n)
 	return nil
 }
+
+// markState stores the shared state of a concurrent mark of the blobs
+// reachable from a root set.
+type markState struct {
+	engine Engine
+
+	// sem bounds the number of blobs being fetched and parsed at once.
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	// cancel aborts all outstanding work after the first error.
+	cancel context.CancelFunc
+
+	lock  sync.Mutex
+	black map[digest.Digest]struct{}
+	err   error
+}
+
+// fail records err (if it is the first error seen) and cancels all other
+// outstanding work.
+func (ms *markState) fail(err error) {
+	ms.lock.Lock()
+	if ms.err == nil {
+		ms.err = err
+	}
+	ms.lock.Unlock()
+	ms.cancel()
+}
+
+// visit adds descriptor to the black set, returning false if it was already
+// present (in which case its children have been or are being marked).
+func (ms *markState) visit(descriptor ispec.Descriptor) bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.black[descriptor.Digest]; ok {
+		return false
+	}
+	ms.black[descriptor.Digest] = struct{}{}
+	return true
+}
+
+// children fetches the blob referenced by descriptor and returns the
+// descriptors it contains. Blobs of unknown media-types have no children.
+func (ms *markState) children(ctx context.Context, descriptor ispec.Descriptor) ([]ispec.Descriptor, error) {
+	ms.sem <- struct{}{}
+	defer func() { <-ms.sem }()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	blob, err := ms.engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		if err == cas.ErrUnknownType {
+			log.Infof("skipping walk into unknown media-type %v of blob %v", descriptor.MediaType, descriptor.Digest)
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer blob.Close()
+	return childDescriptors(blob.Data), nil
+}
+
+// mark marks descriptor and (asynchronously) everything reachable from it.
+// Errors are wrapped to reference the index of the root they were reached
+// from.
+func (ms *markState) mark(ctx context.Context, rootIdx int, descriptor ispec.Descriptor) {
+	defer ms.wg.Done()
+
+	if !ms.visit(descriptor) {
+		return
+	}
+	children, err := ms.children(ctx, descriptor)
+	if err != nil {
+		ms.fail(errors.Wrapf(err, "getting reachables from root %d", rootIdx))
+		return
+	}
+	for _, child := range children {
+		ms.wg.Add(1)
+		go ms.mark(ctx, rootIdx, child)
+	}
+}
+
+// mark returns the set of digests reachable from any of the given root
+// descriptors. It is equivalent to taking the union of reachable() for each
+// root, except that subtrees are walked concurrently (with at most workers
+// blobs being fetched at any one time) and shared subtrees are only walked
+// once.
+func (e Engine) mark(ctx context.Context, roots []ispec.Descriptor, workers int) (map[digest.Digest]struct{}, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ms := &markState{
+		engine: e,
+		sem:    make(chan struct{}, workers),
+		cancel: cancel,
+		black:  map[digest.Digest]struct{}{},
+	}
+	for idx, descriptor := range roots {
+		log.WithFields(log.Fields{
+			"digest": descriptor.Digest,
+		}).Debugf("GC: marking from root")
+
+		ms.wg.Add(1)
+		go ms.mark(ctx, idx, descriptor)
+	}
+	ms.wg.Wait()
+
+	if ms.err != nil {
+		return nil, ms.err
+	}
+	return ms.black, nil
+}
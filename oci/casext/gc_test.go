@@ -317,3 +317,282 @@ func TestGCWithPolicy(t *testing.T) {
 		t.Fatalf("expected blob list with two entries after GC")
 	}
 }
+
+// fakeManyManifests creates n images (each referenced through an index) which
+// share a pool of layers, returning the root descriptors of the images.
+func fakeManyManifests(tb testing.TB, engineExt Engine, n int) []ispec.Descriptor {
+	ctx := context.Background()
+
+	var layers []ispec.Descriptor
+	for idx := 0; idx < 16; idx++ {
+		digest, size, err := engineExt.PutBlob(ctx, strings.NewReader(fmt.Sprintf("shared layer %d", idx)))
+		if err != nil {
+			tb.Fatalf("error putting layer%d blob: %+v", idx, err)
+		}
+		layers = append(layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    digest,
+			Size:      size,
+		})
+	}
+
+	var roots []ispec.Descriptor
+	for k := 0; k < n; k++ {
+		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+			Author: fmt.Sprintf("image %d", k),
+		})
+		if err != nil {
+			tb.Fatalf("image %d: error putting config blob: %+v", k, err)
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: []ispec.Descriptor{
+				layers[k%len(layers)],
+				layers[(k*7+3)%len(layers)],
+			},
+		})
+		if err != nil {
+			tb.Fatalf("image %d: error putting manifest blob: %+v", k, err)
+		}
+		indexDigest, indexSize, err := engineExt.PutBlobJSON(ctx, ispec.Index{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2,
+			},
+			Manifests: []ispec.Descriptor{
+				{
+					MediaType: ispec.MediaTypeImageManifest,
+					Digest:    manifestDigest,
+					Size:      manifestSize,
+				},
+			},
+		})
+		if err != nil {
+			tb.Fatalf("image %d: error putting index blob: %+v", k, err)
+		}
+		roots = append(roots, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageIndex,
+			Digest:    indexDigest,
+			Size:      indexSize,
+		})
+	}
+	return roots
+}
+
+func TestGCMarkConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestGCMarkConcurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	roots := fakeManyManifests(t, engineExt, 64)
+	for _, m := range descMap {
+		// The custom media-type images contain dangling descriptors, so we
+		// can only mark from the standard images.
+		if m.result.MediaType == ispec.MediaTypeImageManifest {
+			roots = append(roots, m.index)
+		}
+	}
+	// Duplicate roots must not change the result.
+	roots = append(roots, roots[:8]...)
+
+	// Compute the reachable set serially.
+	expected := map[digest.Digest]struct{}{}
+	for idx, descriptor := range roots {
+		reachables, err := engineExt.reachable(ctx, descriptor)
+		if err != nil {
+			t.Fatalf("getting reachables from root %d: %+v", idx, err)
+		}
+		for _, reachable := range reachables {
+			expected[reachable] = struct{}{}
+		}
+	}
+
+	for _, workers := range []int{1, 2, 8, 64} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			black, err := engineExt.mark(ctx, roots, workers)
+			if err != nil {
+				t.Fatalf("unexpected error marking: %+v", err)
+			}
+			if len(black) != len(expected) {
+				t.Errorf("expected %d reachable blobs, got %d", len(expected), len(black))
+			}
+			for digest := range expected {
+				if _, ok := black[digest]; !ok {
+					t.Errorf("reachable blob %s was not marked", digest)
+				}
+			}
+		})
+	}
+}
+
+func TestGCMarkMissingBlob(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestGCMarkMissingBlob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	roots := fakeManyManifests(t, engineExt, 16)
+	roots = append(roots, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("missing manifest"),
+		Size:      16,
+	})
+
+	if _, err := engineExt.mark(ctx, roots, 4); err == nil {
+		t.Errorf("expected mark to fail with a missing blob")
+	}
+}
+
+func BenchmarkGCMark(b *testing.B) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-BenchmarkGCMark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		b.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		b.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	roots := fakeManyManifests(b, engineExt, 1024)
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := engineExt.mark(ctx, roots, workers); err != nil {
+					b.Fatalf("unexpected error marking: %+v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestGCWithCustomIndex(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestGCWithCustomIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(image, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(image, "staging.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+	stagingEngine, err := dir.OpenWithOptions(image, dir.Options{IndexFile: "staging.json"})
+	if err != nil {
+		t.Fatalf("unexpected error opening image with custom index: %+v", err)
+	}
+	defer stagingEngine.Close()
+
+	// One blob referenced by each index, and one orphan.
+	var descriptors []ispec.Descriptor
+	for _, content := range []string{"default blob", "staging blob", "orphan blob"} {
+		digest, size, err := engine.PutBlob(ctx, strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("error writing blob: %+v", err)
+		}
+		descriptors = append(descriptors, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    digest,
+			Size:      size,
+		})
+	}
+	for idx, engine := range []interface {
+		PutIndex(context.Context, ispec.Index) error
+	}{engine, stagingEngine} {
+		if err := engine.PutIndex(ctx, ispec.Index{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2,
+			},
+			Manifests: []ispec.Descriptor{descriptors[idx]},
+		}); err != nil {
+			t.Fatalf("error writing index %d: %+v", idx, err)
+		}
+	}
+
+	// GC through the custom index must not remove blobs which are only
+	// referenced by index.json.
+	if err := NewEngine(stagingEngine).GC(ctx); err != nil {
+		t.Fatalf("GC failed: %+v", err)
+	}
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+	remaining := map[digest.Digest]struct{}{}
+	for _, blob := range blobs {
+		remaining[blob] = struct{}{}
+	}
+	for idx, descriptor := range descriptors {
+		_, ok := remaining[descriptor.Digest]
+		if expected := idx < 2; ok != expected {
+			t.Errorf("blob %d: expected present=%v after GC, got %v", idx, expected, ok)
+		}
+	}
+}
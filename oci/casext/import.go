@@ -0,0 +1,157 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ImportBlobMediaType is the media type used for the descriptors returned by
+// ImportBlobs. Loose blobs carry no type information, so callers that know
+// what a blob actually contains should replace it.
+const ImportBlobMediaType = "application/octet-stream"
+
+// ImportBlobsError is returned by ImportBlobs when one or more files could not
+// be imported. Files which were imported successfully are still stored (and
+// returned) -- Failed only lists the files that were not.
+type ImportBlobsError struct {
+	// Failed maps the path of each file that could not be imported to the
+	// reason it failed.
+	Failed map[string]error
+}
+
+func (e *ImportBlobsError) Error() string {
+	var paths []string
+	for path := range e.Failed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var reasons []string
+	for _, path := range paths {
+		reasons = append(reasons, path+": "+e.Failed[path].Error())
+	}
+	return "import blobs: failed to import " + strings.Join(reasons, "; ")
+}
+
+// ImportBlobs stores every regular file in the given directory as a blob,
+// returning a descriptor for each of them (in lexical order of the file
+// names). This is intended for reconstructing a store from loose blobs, so
+// the name of each file is irrelevant -- only its contents are used to compute
+// the digest. Files whose blob already exists in the store are not re-written,
+// but their descriptors are still returned. Sub-directories and other
+// non-regular files are ignored.
+//
+// If some files cannot be imported, the descriptors of the ones that were
+// imported are returned alongside an *ImportBlobsError describing the
+// failures.
+func (e Engine) ImportBlobs(ctx context.Context, dir string) ([]ispec.Descriptor, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "import blobs: read directory")
+	}
+
+	var (
+		descriptors []ispec.Descriptor
+		failed      = map[string]error{}
+	)
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if !info.Mode().IsRegular() {
+			log.Debugf("import blobs: skipping non-regular file %s", path)
+			continue
+		}
+		descriptor, err := e.importBlob(ctx, path)
+		if err != nil {
+			failed[path] = err
+			continue
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	if len(failed) > 0 {
+		return descriptors, &ImportBlobsError{Failed: failed}
+	}
+	return descriptors, nil
+}
+
+// importBlob stores the contents of a single file as a blob, unless a blob
+// with the same digest already exists.
+func (e Engine) importBlob(ctx context.Context, path string) (ispec.Descriptor, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "open")
+	}
+	defer fh.Close()
+
+	digester := cas.BlobAlgorithm.Digester()
+	size, err := io.Copy(digester.Hash(), fh)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "compute digest")
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ImportBlobMediaType,
+		Digest:    digester.Digest(),
+		Size:      size,
+	}
+
+	exists, err := e.blobExists(ctx, descriptor.Digest)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if exists {
+		log.Debugf("import blobs: %s already exists as %s", path, descriptor.Digest)
+		return descriptor, nil
+	}
+
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "rewind")
+	}
+	gotDigest, gotSize, err := e.PutBlob(ctx, fh)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put blob")
+	}
+	// The file may have been modified while we were reading it.
+	if gotDigest != descriptor.Digest || gotSize != descriptor.Size {
+		return ispec.Descriptor{}, errors.Errorf("file changed during import: got %s (%d bytes) expected %s (%d bytes)", gotDigest, gotSize, descriptor.Digest, descriptor.Size)
+	}
+	return descriptor, nil
+}
+
+// blobExists returns whether a blob with the given digest is present.
+func (e Engine) blobExists(ctx context.Context, blobDigest digest.Digest) (bool, error) {
+	reader, err := e.GetBlob(ctx, blobDigest)
+	if errors.Is(err, cas.ErrBlobNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "check blob")
+	}
+	reader.Close()
+	return true, nil
+}
@@ -0,0 +1,151 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// failPutEngine is a cas.Engine which refuses to store a particular blob.
+type failPutEngine struct {
+	cas.Engine
+	reject []byte
+}
+
+func (e failPutEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", -1, err
+	}
+	if bytes.Equal(data, e.reject) {
+		return "", -1, errors.New("rejected blob")
+	}
+	return e.Engine.PutBlob(ctx, bytes.NewReader(data))
+}
+
+func TestImportBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestImportBlobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engineExt.Close()
+
+	loose := filepath.Join(root, "loose")
+	if err := os.Mkdir(loose, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a":         "first blob",
+		"b":         "second blob",
+		"duplicate": "first blob",
+		"empty":     "",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(loose, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Non-regular files must be ignored.
+	if err := os.Mkdir(filepath.Join(loose, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(loose, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	descriptors, err := engineExt.ImportBlobs(ctx, loose)
+	if err != nil {
+		t.Fatalf("unexpected error importing blobs: %+v", err)
+	}
+	names := []string{"a", "b", "duplicate", "empty"}
+	if len(descriptors) != len(names) {
+		t.Fatalf("expected %d descriptors, got %d: %v", len(names), len(descriptors), descriptors)
+	}
+	for idx, descriptor := range descriptors {
+		contents := files[names[idx]]
+		if expected := digest.FromString(contents); descriptor.Digest != expected {
+			t.Errorf("descriptor %d (%s): expected digest %s, got %s", idx, names[idx], expected, descriptor.Digest)
+		}
+		if descriptor.Size != int64(len(contents)) {
+			t.Errorf("descriptor %d (%s): expected size %d, got %d", idx, names[idx], len(contents), descriptor.Size)
+		}
+
+		reader, err := engineExt.GetVerifiedBlob(ctx, descriptor)
+		if err != nil {
+			t.Errorf("descriptor %d (%s): unexpected error getting blob: %+v", idx, names[idx], err)
+			continue
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Errorf("descriptor %d (%s): unexpected error reading blob: %+v", idx, names[idx], err)
+		} else if string(data) != contents {
+			t.Errorf("descriptor %d (%s): unexpected blob contents: %q", idx, names[idx], string(data))
+		}
+	}
+
+	// Importing a directory with an already-stored blob and a failing one
+	// must skip the former and report the latter.
+	partial := filepath.Join(root, "partial")
+	if err := os.Mkdir(partial, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(partial, "existing"), []byte("first blob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(partial, "bad"), []byte("bad blob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	failExt := NewEngine(failPutEngine{Engine: engine, reject: []byte("bad blob")})
+
+	descriptors, err = failExt.ImportBlobs(ctx, partial)
+	importErr, ok := err.(*ImportBlobsError)
+	if !ok {
+		t.Fatalf("expected *ImportBlobsError, got %T: %v", err, err)
+	}
+	if len(importErr.Failed) != 1 || importErr.Failed[filepath.Join(partial, "bad")] == nil {
+		t.Errorf("unexpected failed files: %v", importErr.Failed)
+	}
+	if len(descriptors) != 1 || descriptors[0].Digest != digest.FromString("first blob") {
+		t.Errorf("unexpected descriptors for partial import: %v", descriptors)
+	}
+}
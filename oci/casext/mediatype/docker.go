@@ -0,0 +1,53 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mediatype
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Media-types of the Docker image manifest (version 2, schema 2) format. The
+// manifest and configuration blobs are JSON-compatible with their OCI
+// equivalents, and the gzip layers are byte-for-byte identical to OCI gzip
+// layers.
+const (
+	// DockerMediaTypeManifest is the media-type of a Docker manifest.
+	DockerMediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// DockerMediaTypeImageConfig is the media-type of a Docker image
+	// configuration.
+	DockerMediaTypeImageConfig = "application/vnd.docker.container.image.v1+json"
+
+	// DockerMediaTypeLayerGzip is the media-type of a gzip-compressed Docker
+	// layer.
+	DockerMediaTypeLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// DockerMediaTypeForeignLayerGzip is the media-type of a gzip-compressed
+	// Docker layer which should not be pushed to registries (the equivalent
+	// of an OCI non-distributable layer).
+	DockerMediaTypeForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// Register the Docker types as their OCI equivalents, so that the blobs they
+// reference are discovered by walks (and thus not garbage collected).
+func init() {
+	RegisterParser(DockerMediaTypeImageConfig, CustomJSONParser(ispec.Image{}))
+
+	RegisterTarget(DockerMediaTypeManifest)
+	RegisterParser(DockerMediaTypeManifest, CustomJSONParser(ispec.Manifest{}))
+}
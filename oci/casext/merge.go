@@ -0,0 +1,307 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// MergePolicy describes how Merge handles a reference in the source layout
+// which has the same name as a reference in the destination layout (but
+// refers to a different descriptor).
+type MergePolicy int
+
+const (
+	// MergeSkip keeps the destination reference, and the colliding source
+	// reference is not merged. This is the default.
+	MergeSkip MergePolicy = iota
+
+	// MergeOverwrite replaces the destination reference with the source
+	// reference.
+	MergeOverwrite
+
+	// MergeRename keeps the destination reference, and the source reference
+	// is merged under a new name of the form "<name>-<n>" (using the smallest
+	// n >= 1 which is not already in use).
+	MergeRename
+)
+
+// MergeResult describes what was done by Merge.
+type MergeResult struct {
+	// Copied is the set of blobs which were copied from the source layout.
+	Copied []digest.Digest
+
+	// Deduplicated is the set of blobs which were needed by merged references
+	// but were already present in the destination layout.
+	Deduplicated []digest.Digest
+
+	// Skipped lists the source references which were not merged because of
+	// a name collision (with MergeSkip).
+	Skipped []string
+
+	// Overwritten lists the destination references which were replaced by a
+	// source reference (with MergeOverwrite).
+	Overwritten []string
+
+	// Renamed maps the name of each source reference which was merged under a
+	// different name (with MergeRename) to its new name.
+	Renamed map[string]string
+}
+
+// Merge copies the references of the src layout (and every blob reachable from
+// them) into this layout. Blobs which already exist in this layout are not
+// copied again, and references in src which have the same name as a
+// reference in this layout are handled according to policy. References which
+// are identical in both layouts are left alone. Source entries which share a
+// name are treated as a single reference, and never collide with each other.
+//
+// All blobs are copied before the top-level index is modified, and the index
+// is then replaced in a single (atomic) operation. Thus if Merge fails, this
+// layout may contain some extra (unreferenced) blobs which will be removed by
+// GC, but its index is left untouched.
+func (e Engine) Merge(ctx context.Context, src Engine, policy MergePolicy) (*MergeResult, error) {
+	switch policy {
+	case MergeSkip, MergeOverwrite, MergeRename:
+	default:
+		return nil, errors.Errorf("merge: unknown policy %d", policy)
+	}
+
+	srcIndex, err := src.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "merge: get source index")
+	}
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "merge: get destination index")
+	}
+
+	// Names which are in use, so we can pick unused names when renaming.
+	used := map[string]struct{}{}
+	for _, layout := range [][]ispec.Descriptor{index.Manifests, srcIndex.Manifests} {
+		for _, descriptor := range layout {
+			if name, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+				used[name] = struct{}{}
+			}
+		}
+	}
+
+	// Compute the new index (and which source entries need to be copied).
+	// Several source entries can share a name (such as the manifests of
+	// different platforms), so collisions are only checked against the
+	// original destination entries and are resolved once for each name.
+	result := &MergeResult{Renamed: map[string]string{}}
+	isIdentical := func(descriptor ispec.Descriptor) bool {
+		name, named := descriptor.Annotations[ispec.AnnotationRefName]
+		for _, existing := range index.Manifests {
+			existingName := existing.Annotations[ispec.AnnotationRefName]
+			if existing.Digest != descriptor.Digest {
+				continue
+			}
+			// With MergeRename, a previous merge may have already added this
+			// entry under a different name.
+			if existingName == name || (policy == MergeRename && named && isRenamedRefName(existingName, name)) {
+				return true
+			}
+		}
+		return false
+	}
+	colliding := map[string]bool{}
+	for _, descriptor := range srcIndex.Manifests {
+		name, named := descriptor.Annotations[ispec.AnnotationRefName]
+		// Unnamed entries cannot collide with each other.
+		if !named || isIdentical(descriptor) {
+			continue
+		}
+		for _, existing := range index.Manifests {
+			if existing.Annotations[ispec.AnnotationRefName] == name {
+				colliding[name] = true
+				break
+			}
+		}
+	}
+
+	skipped := map[string]struct{}{}
+	overwritten := map[string]struct{}{}
+	var merged []ispec.Descriptor
+	for _, descriptor := range srcIndex.Manifests {
+		name := descriptor.Annotations[ispec.AnnotationRefName]
+		if !colliding[name] {
+			if !isIdentical(descriptor) {
+				merged = append(merged, descriptor)
+			}
+			continue
+		}
+		switch policy {
+		case MergeSkip:
+			if _, ok := skipped[name]; !ok {
+				log.Debugf("merge: skipping colliding reference %q", name)
+				skipped[name] = struct{}{}
+				result.Skipped = append(result.Skipped, name)
+			}
+		case MergeOverwrite:
+			// Every source entry with the name replaces the destination
+			// entries, even if one of them is already present.
+			if _, ok := overwritten[name]; !ok {
+				log.Debugf("merge: overwriting reference %q", name)
+				overwritten[name] = struct{}{}
+				result.Overwritten = append(result.Overwritten, name)
+			}
+			merged = append(merged, descriptor)
+		case MergeRename:
+			if isIdentical(descriptor) {
+				continue
+			}
+			newName, ok := result.Renamed[name]
+			if !ok {
+				newName = uniqueRefName(name, used)
+				if !IsValidReferenceName(newName) {
+					return nil, errors.Errorf("merge: cannot rename reference %q: %q is not a valid reference name", name, newName)
+				}
+				log.Debugf("merge: renaming reference %q to %q", name, newName)
+				used[newName] = struct{}{}
+				result.Renamed[name] = newName
+			}
+			descriptor.Annotations = copyAnnotations(descriptor.Annotations)
+			descriptor.Annotations[ispec.AnnotationRefName] = newName
+			merged = append(merged, descriptor)
+		}
+	}
+
+	var newManifests []ispec.Descriptor
+	for _, existing := range index.Manifests {
+		if _, ok := overwritten[existing.Annotations[ispec.AnnotationRefName]]; !ok {
+			newManifests = append(newManifests, existing)
+		}
+	}
+	newManifests = append(newManifests, merged...)
+
+	// Copy all of the blobs before touching the index.
+	if err := e.mergeBlobs(ctx, src, merged, result); err != nil {
+		return nil, err
+	}
+
+	index.Manifests = newManifests
+	if err := e.PutIndex(ctx, index); err != nil {
+		return nil, errors.Wrap(err, "merge: replace index")
+	}
+	return result, nil
+}
+
+// uniqueRefName returns a name of the form "<name>-<n>" which is not in used,
+// with the smallest possible n >= 1.
+func uniqueRefName(name string, used map[string]struct{}) string {
+	for n := 1; ; n++ {
+		newName := fmt.Sprintf("%s-%d", name, n)
+		if _, ok := used[newName]; !ok {
+			return newName
+		}
+	}
+}
+
+// isRenamedRefName returns whether newName is of the form "<name>-<n>", as
+// generated by uniqueRefName.
+func isRenamedRefName(newName, name string) bool {
+	suffix := strings.TrimPrefix(newName, name+"-")
+	if suffix == newName || suffix == "" {
+		return false
+	}
+	n, err := strconv.Atoi(suffix)
+	return err == nil && n >= 1 && strconv.Itoa(n) == suffix
+}
+
+// copyAnnotations returns a copy of the given annotations map, so that it can
+// be modified without affecting the original.
+func copyAnnotations(annotations map[string]string) map[string]string {
+	copied := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		copied[k] = v
+	}
+	return copied
+}
+
+// mergeBlobs copies every blob reachable from roots in src into this layout,
+// unless it is already present.
+func (e Engine) mergeBlobs(ctx context.Context, src Engine, roots []ispec.Descriptor, result *MergeResult) error {
+	blobs := map[digest.Digest]ispec.Descriptor{}
+	for _, root := range roots {
+		if err := src.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+			descriptor := descriptorPath.Descriptor()
+			if _, ok := blobs[descriptor.Digest]; ok {
+				return ErrSkipDescriptor
+			}
+			blobs[descriptor.Digest] = descriptor
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "merge: walk %s", root.Digest)
+		}
+	}
+
+	digests := make([]digest.Digest, 0, len(blobs))
+	for blobDigest := range blobs {
+		digests = append(digests, blobDigest)
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+
+	for _, blobDigest := range digests {
+		exists, err := e.blobExists(ctx, blobDigest)
+		if err != nil {
+			return errors.Wrapf(err, "merge: %s", blobDigest)
+		}
+		if exists {
+			result.Deduplicated = append(result.Deduplicated, blobDigest)
+			continue
+		}
+		if err := e.copyBlob(ctx, src, blobs[blobDigest]); err != nil {
+			return errors.Wrapf(err, "merge: copy %s", blobDigest)
+		}
+		result.Copied = append(result.Copied, blobDigest)
+	}
+	return nil
+}
+
+// copyBlob copies the blob described by descriptor from src into this layout,
+// verifying its contents along the way.
+func (e Engine) copyBlob(ctx context.Context, src Engine, descriptor ispec.Descriptor) (Err error) {
+	reader, err := src.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer func() {
+		if err := reader.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "verify blob")
+		}
+	}()
+
+	gotDigest, gotSize, err := e.PutBlob(ctx, reader)
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	if gotDigest != descriptor.Digest || gotSize != descriptor.Size {
+		return errors.Errorf("copied blob mismatch: got %s (%d bytes) expected %s (%d bytes)", gotDigest, gotSize, descriptor.Digest, descriptor.Size)
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"golang.org/x/net/context"
+)
+
+// mergeTestBase is the contents of the layer shared by every image created by
+// setupMergeLayout.
+var mergeTestBase = []byte("shared base layer")
+
+// setupMergeLayout creates a new layout at path, wrapping the engine with wrap
+// (if non-nil). For each of the given tags, an image consisting of the shared
+// base layer and a layer with the given contents is created.
+func setupMergeLayout(t *testing.T, path string, wrap func(cas.Engine) cas.Engine, tags map[string]string) (Engine, map[string]ispec.Descriptor) {
+	ctx := context.Background()
+
+	if err := dir.Create(path); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	if wrap != nil {
+		engine = wrap(engine)
+	}
+	engineExt := NewEngine(engine)
+
+	putBlob := func(data []byte) ispec.Descriptor {
+		blobDigest, size, err := engineExt.PutBlob(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("unexpected error putting blob: %+v", err)
+		}
+		return ispec.Descriptor{MediaType: ispec.MediaTypeImageLayer, Digest: blobDigest, Size: size}
+	}
+
+	descriptors := map[string]ispec.Descriptor{}
+	for tag, contents := range tags {
+		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+			Author: contents,
+			RootFS: ispec.RootFS{Type: "layers"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+			Versioned: imeta.Versioned{SchemaVersion: 2},
+			Config:    ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: configDigest, Size: configSize},
+			Layers:    []ispec.Descriptor{putBlob(mergeTestBase), putBlob([]byte(contents))},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		descriptor := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize}
+		if err := engineExt.UpdateReference(ctx, tag, descriptor); err != nil {
+			t.Fatalf("unexpected error updating reference: %+v", err)
+		}
+		descriptors[tag] = descriptor
+	}
+	return engineExt, descriptors
+}
+
+// mergeTestRefs returns the references in the layout, mapped to the digest
+// they refer to.
+func mergeTestRefs(t *testing.T, engineExt Engine) map[string]digest.Digest {
+	index, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	refs := map[string]digest.Digest{}
+	for _, descriptor := range index.Manifests {
+		name := descriptor.Annotations[ispec.AnnotationRefName]
+		if _, ok := refs[name]; ok {
+			t.Errorf("duplicate reference %q in merged index", name)
+		}
+		refs[name] = descriptor.Digest
+	}
+	return refs
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestMerge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src, srcRefs := setupMergeLayout(t, filepath.Join(root, "src"), nil, map[string]string{
+		"shared": "source layer",
+		"extra":  "extra layer",
+	})
+	defer src.Close()
+
+	for _, test := range []struct {
+		name   string
+		policy MergePolicy
+		refs   func(dst, src map[string]ispec.Descriptor) map[string]digest.Digest
+		check  func(t *testing.T, result *MergeResult)
+	}{
+		{"Skip", MergeSkip, func(dst, src map[string]ispec.Descriptor) map[string]digest.Digest {
+			return map[string]digest.Digest{"shared": dst["shared"].Digest, "extra": src["extra"].Digest}
+		}, func(t *testing.T, result *MergeResult) {
+			if !reflect.DeepEqual(result.Skipped, []string{"shared"}) {
+				t.Errorf("unexpected skipped references: %v", result.Skipped)
+			}
+		}},
+		{"Overwrite", MergeOverwrite, func(dst, src map[string]ispec.Descriptor) map[string]digest.Digest {
+			return map[string]digest.Digest{"shared": src["shared"].Digest, "extra": src["extra"].Digest}
+		}, func(t *testing.T, result *MergeResult) {
+			if !reflect.DeepEqual(result.Overwritten, []string{"shared"}) {
+				t.Errorf("unexpected overwritten references: %v", result.Overwritten)
+			}
+		}},
+		{"Rename", MergeRename, func(dst, src map[string]ispec.Descriptor) map[string]digest.Digest {
+			return map[string]digest.Digest{"shared": dst["shared"].Digest, "shared-1": src["shared"].Digest, "extra": src["extra"].Digest}
+		}, func(t *testing.T, result *MergeResult) {
+			if !reflect.DeepEqual(result.Renamed, map[string]string{"shared": "shared-1"}) {
+				t.Errorf("unexpected renamed references: %v", result.Renamed)
+			}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dst, dstRefs := setupMergeLayout(t, filepath.Join(root, "dst-"+test.name), nil, map[string]string{
+				"shared": "destination layer",
+			})
+			defer dst.Close()
+
+			result, err := dst.Merge(ctx, src, test.policy)
+			if err != nil {
+				t.Fatalf("unexpected error merging layouts: %+v", err)
+			}
+			test.check(t, result)
+
+			expected := test.refs(dstRefs, srcRefs)
+			if got := mergeTestRefs(t, dst); !reflect.DeepEqual(got, expected) {
+				t.Errorf("unexpected references after merge: expected %v got %v", expected, got)
+			}
+
+			// The shared base layer must not have been copied.
+			base := digest.FromBytes(mergeTestBase)
+			if !reflect.DeepEqual(result.Deduplicated, []digest.Digest{base}) {
+				t.Errorf("expected only the base layer to be deduplicated, got %v", result.Deduplicated)
+			}
+			for _, copied := range result.Copied {
+				if copied == base {
+					t.Errorf("shared base layer was copied")
+				}
+			}
+
+			// Every merged reference must be fully usable.
+			for name := range expected {
+				if _, err := dst.ResolveReference(ctx, name); err != nil {
+					t.Errorf("unexpected error resolving %s: %+v", name, err)
+				}
+				descriptor := mergeTestRefsDescriptor(t, dst, name)
+				reachable, err := dst.reachable(ctx, descriptor)
+				if err != nil {
+					t.Errorf("unexpected error walking %s: %+v", name, err)
+				}
+				for _, blobDigest := range reachable {
+					if exists, err := dst.blobExists(ctx, blobDigest); err != nil || !exists {
+						t.Errorf("%s: blob %s missing after merge (err=%v)", name, blobDigest, err)
+					}
+				}
+			}
+
+			// Merging again must be a no-op.
+			again, err := dst.Merge(ctx, src, test.policy)
+			if err != nil {
+				t.Fatalf("unexpected error re-merging layouts: %+v", err)
+			}
+			if len(again.Copied) != 0 || len(again.Overwritten) != 0 || len(again.Renamed) != 0 {
+				t.Errorf("re-merging modified the layout: %+v", again)
+			}
+			if got := mergeTestRefs(t, dst); !reflect.DeepEqual(got, expected) {
+				t.Errorf("unexpected references after re-merge: expected %v got %v", expected, got)
+			}
+		})
+	}
+}
+
+// mergeTestRefsDescriptor returns the top-level index entry for name.
+func mergeTestRefsDescriptor(t *testing.T, engineExt Engine, name string) ispec.Descriptor {
+	index, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == name {
+			return descriptor
+		}
+	}
+	t.Fatalf("reference %s not found", name)
+	return ispec.Descriptor{}
+}
+
+func TestMergeSharedName(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestMergeSharedName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Two source entries (like the manifests of a multi-platform image)
+	// share the name "multi".
+	src, _ := setupMergeLayout(t, filepath.Join(root, "src"), nil, map[string]string{
+		"multi": "first platform",
+		"other": "second platform",
+	})
+	defer src.Close()
+	srcIndex, err := src.GetIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var multi []digest.Digest
+	for idx := range srcIndex.Manifests {
+		srcIndex.Manifests[idx].Annotations = map[string]string{ispec.AnnotationRefName: "multi"}
+		multi = append(multi, srcIndex.Manifests[idx].Digest)
+	}
+	if err := src.PutIndex(ctx, srcIndex); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		policy   MergePolicy
+		dstTags  map[string]string
+		expected func(dst map[string]ispec.Descriptor) map[string][]digest.Digest
+	}{
+		{"NoCollision", MergeSkip, map[string]string{}, func(dst map[string]ispec.Descriptor) map[string][]digest.Digest {
+			return map[string][]digest.Digest{"multi": multi}
+		}},
+		{"Skip", MergeSkip, map[string]string{"multi": "destination"}, func(dst map[string]ispec.Descriptor) map[string][]digest.Digest {
+			return map[string][]digest.Digest{"multi": {dst["multi"].Digest}}
+		}},
+		{"Overwrite", MergeOverwrite, map[string]string{"multi": "destination"}, func(dst map[string]ispec.Descriptor) map[string][]digest.Digest {
+			return map[string][]digest.Digest{"multi": multi}
+		}},
+		{"Rename", MergeRename, map[string]string{"multi": "destination"}, func(dst map[string]ispec.Descriptor) map[string][]digest.Digest {
+			return map[string][]digest.Digest{"multi": {dst["multi"].Digest}, "multi-1": multi}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dst, dstRefs := setupMergeLayout(t, filepath.Join(root, "dst-"+test.name), nil, test.dstTags)
+			defer dst.Close()
+
+			result, err := dst.Merge(ctx, src, test.policy)
+			if err != nil {
+				t.Fatalf("unexpected error merging layouts: %+v", err)
+			}
+			if len(result.Skipped) > 1 || len(result.Overwritten) > 1 || len(result.Renamed) > 1 {
+				t.Errorf("shared name was handled more than once: %+v", result)
+			}
+
+			index, err := dst.GetIndex(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string][]digest.Digest{}
+			for _, descriptor := range index.Manifests {
+				name := descriptor.Annotations[ispec.AnnotationRefName]
+				got[name] = append(got[name], descriptor.Digest)
+			}
+			if expected := test.expected(dstRefs); !reflect.DeepEqual(got, expected) {
+				t.Errorf("unexpected references after merge: expected %v got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestMergeFailure(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestMergeFailure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src, _ := setupMergeLayout(t, filepath.Join(root, "src"), nil, map[string]string{
+		"a": "first layer",
+		"b": "rejected layer",
+	})
+	defer src.Close()
+
+	dst, _ := setupMergeLayout(t, filepath.Join(root, "dst"), func(engine cas.Engine) cas.Engine {
+		return failPutEngine{Engine: engine, reject: []byte("rejected layer")}
+	}, map[string]string{
+		"a": "destination layer",
+	})
+	defer dst.Close()
+
+	before, err := dst.GetIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.Merge(ctx, src, MergeOverwrite); err == nil {
+		t.Fatalf("expected merge to fail")
+	}
+	after, err := dst.GetIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("index modified by failed merge: before %+v after %+v", before, after)
+	}
+
+	if _, err := dst.Merge(ctx, src, MergePolicy(-1)); err == nil {
+		t.Errorf("expected error with unknown merge policy")
+	}
+}
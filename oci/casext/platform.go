@@ -0,0 +1,106 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"runtime"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ParsePlatform parses a platform string of the form "os/arch[/variant]"
+// (such as "linux/arm64" or "linux/arm/v7") into an ispec.Platform.
+func ParsePlatform(platform string) (ispec.Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ispec.Platform{}, errors.Errorf("invalid platform %q: must be of the form os/arch[/variant]", platform)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return ispec.Platform{}, errors.Errorf("invalid platform %q: empty component", platform)
+		}
+	}
+	p := ispec.Platform{
+		OS:           parts[0],
+		Architecture: parts[1],
+	}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// PlatformString returns the "os/arch[/variant]" form of the given platform,
+// which is the same format accepted by ParsePlatform.
+func PlatformString(platform ispec.Platform) string {
+	str := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		str += "/" + platform.Variant
+	}
+	return str
+}
+
+// HostPlatform returns the platform of the running system.
+func HostPlatform() ispec.Platform {
+	return ispec.Platform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+	}
+}
+
+// Platform returns the platform of the target of the DescriptorPath, which is
+// the platform of the closest descriptor in the walk that has one (usually
+// the entry in the image index that references the manifest). If no
+// descriptor in the walk has a platform, nil is returned.
+func (d DescriptorPath) Platform() *ispec.Platform {
+	for idx := len(d.Walk) - 1; idx >= 0; idx-- {
+		if platform := d.Walk[idx].Platform; platform != nil {
+			return platform
+		}
+	}
+	return nil
+}
+
+// MatchPlatform returns whether the given DescriptorPath is usable on the
+// requested platform. The variant is only compared if the requested platform
+// specifies one. Descriptor paths without any platform information are
+// considered to match every platform.
+func (d DescriptorPath) MatchPlatform(platform ispec.Platform) bool {
+	have := d.Platform()
+	if have == nil {
+		return true
+	}
+	if have.OS != platform.OS || have.Architecture != platform.Architecture {
+		return false
+	}
+	return platform.Variant == "" || have.Variant == platform.Variant
+}
+
+// FilterPlatform returns the subset of the given descriptor paths which match
+// the requested platform (see DescriptorPath.MatchPlatform).
+func FilterPlatform(descriptorPaths []DescriptorPath, platform ispec.Platform) []DescriptorPath {
+	var matched []DescriptorPath
+	for _, descriptorPath := range descriptorPaths {
+		if descriptorPath.MatchPlatform(platform) {
+			matched = append(matched, descriptorPath)
+		}
+	}
+	return matched
+}
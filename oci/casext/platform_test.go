@@ -0,0 +1,77 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected ispec.Platform
+		valid    bool
+	}{
+		{"linux/amd64", ispec.Platform{OS: "linux", Architecture: "amd64"}, true},
+		{"linux/arm/v7", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{"linux", ispec.Platform{}, false},
+		{"linux/", ispec.Platform{}, false},
+		{"/amd64", ispec.Platform{}, false},
+		{"linux/arm/v7/extra", ispec.Platform{}, false},
+	} {
+		platform, err := ParsePlatform(test.input)
+		if test.valid != (err == nil) {
+			t.Errorf("ParsePlatform(%q): expected valid=%v, got err=%v", test.input, test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if platform.OS != test.expected.OS || platform.Architecture != test.expected.Architecture || platform.Variant != test.expected.Variant {
+			t.Errorf("ParsePlatform(%q): expected %v, got %v", test.input, test.expected, platform)
+		}
+		if got := PlatformString(platform); got != test.input {
+			t.Errorf("PlatformString(ParsePlatform(%q)) = %q", test.input, got)
+		}
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	arm := &ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	for _, test := range []struct {
+		name     string
+		walk     []ispec.Descriptor
+		platform ispec.Platform
+		expected bool
+	}{
+		{"NoPlatform", []ispec.Descriptor{{}, {}}, ispec.Platform{OS: "linux", Architecture: "amd64"}, true},
+		{"Match", []ispec.Descriptor{{}, {Platform: arm}}, ispec.Platform{OS: "linux", Architecture: "arm"}, true},
+		{"MatchVariant", []ispec.Descriptor{{}, {Platform: arm}}, ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{"WrongVariant", []ispec.Descriptor{{}, {Platform: arm}}, ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, false},
+		{"WrongArch", []ispec.Descriptor{{Platform: arm}, {}}, ispec.Platform{OS: "linux", Architecture: "arm64"}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			descriptorPath := DescriptorPath{Walk: test.walk}
+			if got := descriptorPath.MatchPlatform(test.platform); got != test.expected {
+				t.Errorf("MatchPlatform(%v) = %v, expected %v", test.platform, got, test.expected)
+			}
+		})
+	}
+}
@@ -19,8 +19,10 @@ package casext
 
 import (
 	"regexp"
+	"strings"
 
 	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/oci/casext/mediatype"
 	"github.com/pkg/errors"
@@ -53,9 +55,20 @@ func IsValidReferenceName(refname string) bool {
 // that if the returned slice of descriptors is greater than zero that the user
 // be consulted to resolve the conflict (due to ambiguity in resolution paths).
 //
+// If refname is a digest reference (see DigestReference), it is resolved with
+// ResolveDigest instead.
+//
 // TODO: How are we meant to implement other restrictions such as the
 //       architecture and feature flags? The API will need to change.
 func (e Engine) ResolveReference(ctx context.Context, refname string) ([]DescriptorPath, error) {
+	if IsDigestReference(refname) {
+		blobDigest, err := digest.Parse(strings.TrimPrefix(refname, digestReferencePrefix))
+		if err != nil {
+			return nil, errors.Wrapf(err, "refusing to resolve invalid digest reference %q", refname)
+		}
+		return e.ResolveDigest(ctx, blobDigest)
+	}
+
 	// XXX: It should be possible to override this somehow, in case we are
 	//      dealing with an image that abuses the image specification in some
 	//      way.
@@ -85,22 +98,11 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 	// The resolved set of descriptors.
 	var resolutions []DescriptorPath
 	for _, root := range roots {
-		// Find all manifests or other blobs that are reachable from the given
-		// descriptor.
-		if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
-			descriptor := descriptorPath.Descriptor()
-
-			// If the media-type should be treated as a "target media-type" for
-			// reference resolution, we stop resolution here and add it to the
-			// set of resolved paths.
-			if mediatype.IsTarget(descriptor.MediaType) {
-				resolutions = append(resolutions, descriptorPath)
-				return ErrSkipDescriptor
-			}
-			return nil
-		}); err != nil {
-			return nil, errors.Wrapf(err, "walk %s", root.Digest)
+		rootResolutions, err := e.resolveRoot(ctx, root)
+		if err != nil {
+			return nil, err
 		}
+		resolutions = append(resolutions, rootResolutions...)
 	}
 
 	log.WithFields(log.Fields{
@@ -109,6 +111,27 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 	return resolutions, nil
 }
 
+// resolveRoot returns the descriptor paths of all of the manifests (or any
+// unknown blobs) reachable from the given root descriptor.
+func (e Engine) resolveRoot(ctx context.Context, root ispec.Descriptor) ([]DescriptorPath, error) {
+	var resolutions []DescriptorPath
+	if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+
+		// If the media-type should be treated as a "target media-type" for
+		// reference resolution, we stop resolution here and add it to the
+		// set of resolved paths.
+		if mediatype.IsTarget(descriptor.MediaType) {
+			resolutions = append(resolutions, descriptorPath)
+			return ErrSkipDescriptor
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "walk %s", root.Digest)
+	}
+	return resolutions, nil
+}
+
 // XXX: Should the *Reference set of interfaces support DescriptorPath? While
 //      it might seem like it doesn't make sense, a DescriptorPath entirely
 //      removes ambiguity with regards to which root needs to be operated on.
@@ -118,12 +141,24 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 // descriptor. If there are multiple descriptors that match the refname they
 // are all replaced with the given descriptor.
 func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor ispec.Descriptor) error {
+	return e.UpdateReferenceWithAnnotations(ctx, refname, descriptor, nil)
+}
+
+// UpdateReferenceWithAnnotations is like UpdateReference, except that the
+// given annotations are also added to the top-level index entry for refname
+// (in addition to any annotations the descriptor already has). The
+// org.opencontainers.image.ref.name annotation is always set to refname, so
+// it is an error to provide a different value for it.
+func (e Engine) UpdateReferenceWithAnnotations(ctx context.Context, refname string, descriptor ispec.Descriptor, annotations map[string]string) error {
 	// XXX: It should be possible to override this somehow, in case we are
 	//      dealing with an image that abuses the image specification in some
 	//      way.
 	if !IsValidReferenceName(refname) {
 		return errors.Errorf("refusing to update invalid reference %q", refname)
 	}
+	if name, ok := annotations[ispec.AnnotationRefName]; ok && name != refname {
+		return errors.Errorf("refusing to set %s annotation of reference %q to %q", ispec.AnnotationRefName, refname, name)
+	}
 
 	// Get index to modify.
 	index, err := e.GetIndex(ctx)
@@ -147,6 +182,9 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 	if descriptor.Annotations == nil {
 		descriptor.Annotations = map[string]string{}
 	}
+	for k, v := range annotations {
+		descriptor.Annotations[k] = v
+	}
 	descriptor.Annotations[ispec.AnnotationRefName] = refname
 	newIndex = append(newIndex, descriptor)
 
@@ -194,6 +232,61 @@ func (e Engine) DeleteReference(ctx context.Context, refname string) error {
 	return nil
 }
 
+// RenameReference replaces all entries in the index that match the refname to
+// with the entries that match the refname from (renaming them to to). The
+// index is only written once, so (with the dir engine) the rename is atomic --
+// other users of the image will either see the old or the new references. It
+// is an error if from does not exist.
+func (e Engine) RenameReference(ctx context.Context, from, to string) error {
+	// XXX: It should be possible to override this somehow, in case we are
+	//      dealing with an image that abuses the image specification in some
+	//      way.
+	if !IsValidReferenceName(from) {
+		return errors.Errorf("refusing to rename invalid reference %q", from)
+	}
+	if !IsValidReferenceName(to) {
+		return errors.Errorf("refusing to rename to invalid reference %q", to)
+	}
+
+	// Get index to modify.
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+
+	var (
+		newIndex []ispec.Descriptor
+		renamed  []ispec.Descriptor
+	)
+	for _, descriptor := range index.Manifests {
+		switch descriptor.Annotations[ispec.AnnotationRefName] {
+		case from:
+			// Copy the annotations so we don't modify the original index.
+			annotations := map[string]string{}
+			for k, v := range descriptor.Annotations {
+				annotations[k] = v
+			}
+			annotations[ispec.AnnotationRefName] = to
+			descriptor.Annotations = annotations
+			renamed = append(renamed, descriptor)
+		case to:
+			// Drop the old references.
+		default:
+			newIndex = append(newIndex, descriptor)
+		}
+	}
+	if len(renamed) == 0 {
+		return errors.Errorf("cannot rename non-existent reference %q", from)
+	}
+
+	// Commit to image.
+	index.Manifests = append(newIndex, renamed...)
+	if err := e.PutIndex(ctx, index); err != nil {
+		return errors.Wrap(err, "replace index")
+	}
+	return nil
+}
+
 // ListReferences returns all of the ref.name entries that are specified in the
 // top-level index. Note that the list may contain duplicates, due to the
 // nature of references in the image-spec.
@@ -213,3 +306,55 @@ func (e Engine) ListReferences(ctx context.Context) ([]string, error) {
 	}
 	return refs, nil
 }
+
+// ResolvedReference is an entry in the top-level index which has a reference
+// name, together with the descriptors it resolves to.
+type ResolvedReference struct {
+	// Name is the value of the "org.opencontainers.image.ref.name" annotation.
+	Name string `json:"name"`
+
+	// Descriptor is the entry in the top-level index.
+	Descriptor ispec.Descriptor `json:"descriptor"`
+
+	// Manifests are the descriptors of the manifests (or unknown blobs) the
+	// entry resolves to, as with ResolveReference. The Platform of each
+	// descriptor is set to the platform of its DescriptorPath (usually taken
+	// from the image index which referenced it).
+	Manifests []ispec.Descriptor `json:"manifests"`
+}
+
+// ListResolvedReferences returns every entry in the top-level index which has
+// a reference name, in index order, along with the descriptors each entry
+// resolves to. Unlike ListReferences, an entry is returned for each index
+// entry, so a name which is used by several entries will be listed several
+// times.
+func (e Engine) ListResolvedReferences(ctx context.Context) ([]ResolvedReference, error) {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+
+	var refs []ResolvedReference
+	for _, descriptor := range index.Manifests {
+		name, ok := descriptor.Annotations[ispec.AnnotationRefName]
+		if !ok {
+			continue
+		}
+		resolutions, err := e.resolveRoot(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolve %s", name)
+		}
+		ref := ResolvedReference{
+			Name:       name,
+			Descriptor: descriptor,
+			Manifests:  []ispec.Descriptor{},
+		}
+		for _, descriptorPath := range resolutions {
+			manifest := descriptorPath.Descriptor()
+			manifest.Platform = descriptorPath.Platform()
+			ref.Manifests = append(ref.Manifests, manifest)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
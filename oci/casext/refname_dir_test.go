@@ -21,6 +21,7 @@ import (
 	"archive/tar"
 	"bytes"
 	crand "crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -415,6 +416,140 @@ func TestEngineReference(t *testing.T) {
 	}
 }
 
+func TestEngineRenameReference(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineRenameReference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if len(descMap) < 2 {
+		t.Fatalf("need at least two descriptors, got %d", len(descMap))
+	}
+
+	if err := engineExt.UpdateReference(ctx, "target", descMap[0].index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "target.tmp", descMap[1].index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	if err := engineExt.RenameReference(ctx, "target.tmp", "target"); err != nil {
+		t.Fatalf("RenameReference: unexpected error: %+v", err)
+	}
+
+	gotDescriptorPaths, err := engineExt.ResolveReference(ctx, "target")
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(gotDescriptorPaths) != 1 {
+		t.Fatalf("ResolveReference: expected 1 descriptor, got %d: %+v", len(gotDescriptorPaths), gotDescriptorPaths)
+	}
+	if got := gotDescriptorPaths[0].Descriptor(); !reflect.DeepEqual(descMap[1].result, got) {
+		t.Errorf("ResolveReference: got wrong descriptor after rename: expected=%v got=%v", descMap[1].result, got)
+	}
+	if gotDescriptorPaths, err := engineExt.ResolveReference(ctx, "target.tmp"); err != nil {
+		t.Errorf("ResolveReference: unexpected error: %+v", err)
+	} else if len(gotDescriptorPaths) > 0 {
+		t.Errorf("ResolveReference: old reference still exists after rename")
+	}
+
+	// Renaming a non-existent reference must fail without touching the index.
+	if err := engineExt.RenameReference(ctx, "target.tmp", "target"); err == nil {
+		t.Errorf("RenameReference: expected error renaming non-existent reference")
+	}
+	if gotDescriptorPaths, err := engineExt.ResolveReference(ctx, "target"); err != nil || len(gotDescriptorPaths) != 1 {
+		t.Errorf("ResolveReference: target was modified by failed rename: %+v", err)
+	}
+}
+
+func TestEngineReferenceAnnotations(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineReferenceAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	descriptor := descMap[0].index
+	descriptor.Annotations = nil
+
+	annotations := map[string]string{
+		"org.opencontainers.image.description": "an annotated tag",
+		ispec.AnnotationRefName:                "annotated",
+	}
+	if err := engineExt.UpdateReferenceWithAnnotations(ctx, "annotated", descriptor, annotations); err != nil {
+		t.Fatalf("UpdateReferenceWithAnnotations: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReferenceWithAnnotations(ctx, "bad", descriptor, map[string]string{
+		ispec.AnnotationRefName: "other",
+	}); err == nil {
+		t.Errorf("UpdateReferenceWithAnnotations: expected error with mismatched ref.name annotation")
+	}
+	// Updating other references must not affect the annotated entry.
+	if err := engineExt.UpdateReference(ctx, "other", descriptor); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	engine.Close()
+
+	// Reload the image to make sure the annotations were persisted.
+	engine, err = dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error re-opening image: %+v", err)
+	}
+	defer engine.Close()
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	found := map[string]map[string]string{}
+	for _, entry := range index.Manifests {
+		found[entry.Annotations[ispec.AnnotationRefName]] = entry.Annotations
+	}
+	if got := found["annotated"]; !reflect.DeepEqual(got, annotations) {
+		t.Errorf("unexpected annotations for annotated entry: expected %v got %v", annotations, got)
+	}
+	if got, expected := found["other"], map[string]string{ispec.AnnotationRefName: "other"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected annotations for other entry: expected %v got %v", expected, got)
+	}
+	if _, ok := found["bad"]; ok {
+		t.Errorf("reference with mismatched ref.name annotation was created")
+	}
+}
+
 func TestEngineReferenceReadonly(t *testing.T) {
 	ctx := context.Background()
 
@@ -496,3 +631,131 @@ func TestEngineReferenceReadonly(t *testing.T) {
 		testutils.MakeReadWrite(t, image)
 	}
 }
+
+func TestEngineListResolvedReferences(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineListResolvedReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// Create a manifest for each platform. The manifests don't need to have
+	// valid configs or layers since resolution stops at the manifest.
+	putManifest := func(marker string) ispec.Descriptor {
+		blobDigest, size, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+			Versioned: ispecs.Versioned{SchemaVersion: 2},
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    digest.FromString(marker),
+				Size:      int64(len(marker)),
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error putting manifest: %+v", err)
+		}
+		return ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    blobDigest,
+			Size:      size,
+		}
+	}
+	amd64 := putManifest("amd64")
+	arm64 := putManifest("arm64")
+	single := putManifest("single")
+
+	platformAmd64 := ispec.Platform{OS: "linux", Architecture: "amd64"}
+	platformArm64 := ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	indexAmd64, indexArm64 := amd64, arm64
+	indexAmd64.Platform = &platformAmd64
+	indexArm64.Platform = &platformArm64
+
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(ctx, ispec.Index{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		Manifests: []ispec.Descriptor{indexAmd64, indexArm64},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+	multi := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}
+
+	if err := engineExt.UpdateReference(ctx, "multi", multi); err != nil {
+		t.Fatalf("unexpected error updating reference: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "single", single); err != nil {
+		t.Fatalf("unexpected error updating reference: %+v", err)
+	}
+
+	refs, err := engineExt.ListResolvedReferences(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing references: %+v", err)
+	}
+
+	// Check the JSON form, since that is what tooling consumes.
+	data, err := json.Marshal(refs)
+	if err != nil {
+		t.Fatalf("unexpected error encoding references: %+v", err)
+	}
+	var got []struct {
+		Name       string `json:"name"`
+		Descriptor struct {
+			MediaType string `json:"mediaType"`
+		} `json:"descriptor"`
+		Manifests []struct {
+			MediaType string          `json:"mediaType"`
+			Digest    string          `json:"digest"`
+			Platform  *ispec.Platform `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unexpected error decoding references: %+v", err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 references, got %d: %s", len(got), data)
+	}
+	if got[0].Name != "multi" || got[0].Descriptor.MediaType != ispec.MediaTypeImageIndex {
+		t.Errorf("unexpected first reference: %s", data)
+	}
+	if len(got[0].Manifests) != 2 {
+		t.Fatalf("expected multi to resolve to 2 manifests, got %d: %s", len(got[0].Manifests), data)
+	}
+	for idx, expected := range []struct {
+		digest   string
+		platform ispec.Platform
+	}{
+		{amd64.Digest.String(), platformAmd64},
+		{arm64.Digest.String(), platformArm64},
+	} {
+		manifest := got[0].Manifests[idx]
+		if manifest.MediaType != ispec.MediaTypeImageManifest || manifest.Digest != expected.digest {
+			t.Errorf("multi manifest %d: unexpected descriptor: %+v", idx, manifest)
+		}
+		if manifest.Platform == nil || !reflect.DeepEqual(*manifest.Platform, expected.platform) {
+			t.Errorf("multi manifest %d: expected platform %v, got %v", idx, expected.platform, manifest.Platform)
+		}
+	}
+
+	if got[1].Name != "single" || got[1].Descriptor.MediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("unexpected second reference: %s", data)
+	}
+	if len(got[1].Manifests) != 1 || got[1].Manifests[0].Digest != single.Digest.String() || got[1].Manifests[0].Platform != nil {
+		t.Errorf("unexpected single manifests: %s", data)
+	}
+}
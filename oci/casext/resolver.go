@@ -0,0 +1,109 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DefaultReferenceName is the reference name conventionally used when a user
+// doesn't specify one.
+const DefaultReferenceName = "latest"
+
+// NameResolver maps a user-provided reference name to the name of a reference
+// in an image layout. This allows callers to implement naming conventions
+// (such as default tags or short aliases for long reference names). The name
+// passed to ResolveName is empty if the user did not provide a name.
+type NameResolver interface {
+	ResolveName(name string) (string, error)
+}
+
+// NameResolverFunc is an adapter to allow the use of ordinary functions as a
+// NameResolver.
+type NameResolverFunc func(name string) (string, error)
+
+// ResolveName calls f(name).
+func (f NameResolverFunc) ResolveName(name string) (string, error) {
+	return f(name)
+}
+
+// DefaultNameResolver returns a NameResolver which resolves an empty name to
+// defaultName, and leaves all other names unchanged.
+func DefaultNameResolver(defaultName string) NameResolver {
+	return NameResolverFunc(func(name string) (string, error) {
+		if name == "" {
+			if defaultName == "" {
+				return "", errors.New("no reference name given and there is no default")
+			}
+			return defaultName, nil
+		}
+		return name, nil
+	})
+}
+
+// AliasNameResolver returns a NameResolver which resolves each name which is
+// a key in aliases to the corresponding value. Aliases are not expanded
+// recursively. The result (or the original name, if it is not an alias) is
+// then resolved using next, unless next is nil.
+func AliasNameResolver(aliases map[string]string, next NameResolver) NameResolver {
+	return NameResolverFunc(func(name string) (string, error) {
+		if target, ok := aliases[name]; ok {
+			name = target
+		}
+		if next != nil {
+			return next.ResolveName(name)
+		}
+		return name, nil
+	})
+}
+
+// ResolveName resolves the given user-provided name using resolver (if
+// non-nil), returning the name of the reference. Digest references are never
+// passed to resolver. It is an error if the resolved name is not a valid
+// reference name.
+func ResolveName(resolver NameResolver, name string) (string, error) {
+	if IsDigestReference(name) {
+		return name, nil
+	}
+	refname := name
+	if resolver != nil {
+		var err error
+		refname, err = resolver.ResolveName(name)
+		if err != nil {
+			return "", errors.Wrapf(err, "resolve reference name %q", name)
+		}
+	}
+	if refname == "" {
+		return "", errors.Errorf("reference name %q resolved to an empty name", name)
+	}
+	if !IsValidReferenceName(refname) {
+		return "", errors.Errorf("reference name %q resolved to invalid reference %q", name, refname)
+	}
+	return refname, nil
+}
+
+// ResolveReferenceName is like ResolveReference, except that the given name
+// is first resolved to a reference name using resolver (see ResolveName).
+func (e Engine) ResolveReferenceName(ctx context.Context, resolver NameResolver, name string) ([]DescriptorPath, error) {
+	refname, err := ResolveName(resolver, name)
+	if err != nil {
+		return nil, err
+	}
+	return e.ResolveReference(ctx, refname)
+}
@@ -0,0 +1,157 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestResolveNameDefault(t *testing.T) {
+	for _, test := range []struct {
+		resolver NameResolver
+		name     string
+		expected string
+		invalid  bool
+	}{
+		{DefaultNameResolver(DefaultReferenceName), "", "latest", false},
+		{DefaultNameResolver(DefaultReferenceName), "v1.0", "v1.0", false},
+		{DefaultNameResolver("stable"), "", "stable", false},
+		{DefaultNameResolver("stable"), "latest", "latest", false},
+		{DefaultNameResolver(""), "", "", true},
+		{DefaultNameResolver("../invalid"), "", "", true},
+		{nil, "", "", true},
+		{nil, "v1.0", "v1.0", false},
+		// Digest references are never resolved.
+		{DefaultNameResolver("stable"), DigestReference(digest.FromString("")), DigestReference(digest.FromString("")), false},
+	} {
+		got, err := ResolveName(test.resolver, test.name)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ResolveName(%q): expected error, got %q", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ResolveName(%q): unexpected error: %+v", test.name, err)
+		} else if got != test.expected {
+			t.Errorf("ResolveName(%q): expected %q got %q", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestResolveNameAlias(t *testing.T) {
+	aliases := map[string]string{
+		"web":   "registry.example.com/team/web:1.2.3",
+		"db":    "web",
+		"empty": "",
+	}
+	resolver := AliasNameResolver(aliases, DefaultNameResolver("stable"))
+
+	for _, test := range []struct {
+		name     string
+		expected string
+		invalid  bool
+	}{
+		{"web", "registry.example.com/team/web:1.2.3", false},
+		// Aliases are not recursive.
+		{"db", "web", false},
+		{"other", "other", false},
+		// The default is applied after aliases.
+		{"", "stable", false},
+		{"empty", "stable", false},
+	} {
+		got, err := ResolveName(resolver, test.name)
+		if err != nil {
+			t.Errorf("ResolveName(%q): unexpected error: %+v", test.name, err)
+		} else if got != test.expected {
+			t.Errorf("ResolveName(%q): expected %q got %q", test.name, test.expected, got)
+		}
+	}
+
+	// A custom resolver can implement any naming convention.
+	custom := NameResolverFunc(func(name string) (string, error) {
+		if strings.HasPrefix(name, "forbidden") {
+			return "", errors.New("forbidden name")
+		}
+		return "team/" + name, nil
+	})
+	if got, err := ResolveName(AliasNameResolver(aliases, custom), "db"); err != nil || got != "team/web" {
+		t.Errorf("ResolveName with custom resolver: expected team/web got %q (err=%v)", got, err)
+	}
+	if _, err := ResolveName(custom, "forbidden-name"); err == nil {
+		t.Errorf("expected custom resolver error to be returned")
+	}
+}
+
+func TestEngineResolveReferenceName(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineResolveReferenceName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engineExt.Close()
+
+	blobDigest, size, err := engineExt.PutBlob(ctx, bytes.NewReader([]byte("some unknown blob")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := ispec.Descriptor{MediaType: unknownMediaType, Digest: blobDigest, Size: size}
+	for _, name := range []string{"latest", "team/web:1.2.3"} {
+		if err := engineExt.UpdateReference(ctx, name, descriptor); err != nil {
+			t.Fatalf("unexpected error updating reference: %+v", err)
+		}
+	}
+
+	resolver := AliasNameResolver(map[string]string{"web": "team/web:1.2.3"}, DefaultNameResolver(DefaultReferenceName))
+	for _, name := range []string{"", "latest", "web", "team/web:1.2.3"} {
+		descriptorPaths, err := engineExt.ResolveReferenceName(ctx, resolver, name)
+		if err != nil {
+			t.Errorf("ResolveReferenceName(%q): unexpected error: %+v", name, err)
+			continue
+		}
+		if len(descriptorPaths) != 1 || descriptorPaths[0].Descriptor().Digest != blobDigest {
+			t.Errorf("ResolveReferenceName(%q): unexpected result %+v", name, descriptorPaths)
+		}
+	}
+	if descriptorPaths, err := engineExt.ResolveReferenceName(ctx, resolver, "missing"); err != nil || len(descriptorPaths) != 0 {
+		t.Errorf("ResolveReferenceName(missing): expected no results, got %+v (err=%v)", descriptorPaths, err)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ImageSize is a summary of the size of an image, computed from the sizes
+// recorded in the descriptors of its manifest. Note that layer blobs are
+// usually compressed, so LayersSize is the size of the image when transferred
+// (not the size of its unpacked root filesystem).
+type ImageSize struct {
+	// Manifest is the size of the manifest blob.
+	Manifest int64
+
+	// Config is the size of the configuration blob.
+	Config int64
+
+	// Layers is the number of layers in the image.
+	Layers int
+
+	// LayersSize is the sum of the sizes of all of the layer blobs.
+	LayersSize int64
+}
+
+// Total returns the total size of all of the blobs which make up the image.
+func (s ImageSize) Total() int64 {
+	return s.Manifest + s.Config + s.LayersSize
+}
+
+// ImageSize computes the ImageSize of the image described by the given
+// manifest descriptor (such as the result of ResolveReference). Only the
+// manifest blob is read -- the sizes of the other blobs are taken from their
+// descriptors.
+func (e Engine) ImageSize(ctx context.Context, manifestDescriptor ispec.Descriptor) (ImageSize, error) {
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return ImageSize{}, errors.Errorf("image size: descriptor does not point to %s: %s", ispec.MediaTypeImageManifest, manifestDescriptor.MediaType)
+	}
+
+	blob, err := e.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		return ImageSize{}, errors.Wrap(err, "get manifest")
+	}
+	defer blob.Close()
+
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ImageSize{}, errors.Errorf("[internal error] unknown manifest blob type: %s", blob.Descriptor.MediaType)
+	}
+
+	size := ImageSize{
+		Manifest: manifestDescriptor.Size,
+		Config:   manifest.Config.Size,
+		Layers:   len(manifest.Layers),
+	}
+	for _, layer := range manifest.Layers {
+		size.LayersSize += layer.Size
+	}
+	return size, nil
+}
@@ -0,0 +1,114 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"golang.org/x/net/context"
+)
+
+func TestImageSize(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestImageSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engineExt.Close()
+
+	var layers []ispec.Descriptor
+	for _, contents := range []string{"layer one", "the second layer", "3"} {
+		digest, size, err := engineExt.PutBlob(ctx, strings.NewReader(contents))
+		if err != nil {
+			t.Fatalf("unexpected error putting layer: %+v", err)
+		}
+		layers = append(layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    digest,
+			Size:      size,
+		})
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{OS: "linux"})
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %+v", err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %+v", err)
+	}
+
+	size, err := engineExt.ImageSize(ctx, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error computing image size: %+v", err)
+	}
+
+	expectedLayersSize := int64(len("layer one") + len("the second layer") + len("3"))
+	if size.Layers != len(layers) {
+		t.Errorf("unexpected layer count: expected %d, got %d", len(layers), size.Layers)
+	}
+	if size.LayersSize != expectedLayersSize {
+		t.Errorf("unexpected layers size: expected %d, got %d", expectedLayersSize, size.LayersSize)
+	}
+	if size.Config != configSize {
+		t.Errorf("unexpected config size: expected %d, got %d", configSize, size.Config)
+	}
+	if size.Manifest != manifestSize {
+		t.Errorf("unexpected manifest size: expected %d, got %d", manifestSize, size.Manifest)
+	}
+	if expected := manifestSize + configSize + expectedLayersSize; size.Total() != expected {
+		t.Errorf("unexpected total size: expected %d, got %d", expected, size.Total())
+	}
+
+	// Non-manifest descriptors are rejected.
+	if _, err := engineExt.ImageSize(ctx, layers[0]); err == nil {
+		t.Errorf("expected error computing image size of a layer")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"strings"
 
 	"github.com/apex/log"
+	"github.com/cyphar/filepath-securejoin"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/runc/libcontainer/user"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
@@ -125,9 +126,11 @@ func MutateRuntimeSpec(spec *rspec.Spec, rootfs string, image ispec.Image) error
 	spec.Root.Path = filepath.Base(rootfs)
 	spec.Root.Readonly = false
 
+	// The runtime-spec requires an absolute cwd, but Docker has historically
+	// accepted relative WorkingDir values (treating them as relative to /).
 	spec.Process.Cwd = "/"
-	if ig.ConfigWorkingDir() != "" {
-		spec.Process.Cwd = ig.ConfigWorkingDir()
+	if workingDir := ig.ConfigWorkingDir(); workingDir != "" {
+		spec.Process.Cwd = filepath.Join("/", workingDir)
 	}
 
 	for _, env := range ig.ConfigEnv() {
@@ -158,11 +161,18 @@ func MutateRuntimeSpec(spec *rspec.Spec, rootfs string, image ispec.Image) error
 	// Set parsed fields
 	// Get the *actual* uid and gid of the user. If the image doesn't contain
 	// an /etc/passwd or /etc/group file then GetExecUserPath will just do a
-	// numerical parsing.
+	// numerical parsing. The paths are resolved inside the rootfs, so that a
+	// symlinked /etc/passwd doesn't end up referencing the host's files.
 	var passwdPath, groupPath string
 	if rootfs != "" {
-		passwdPath = filepath.Join(rootfs, "/etc/passwd")
-		groupPath = filepath.Join(rootfs, "/etc/group")
+		passwdPath, err = securejoin.SecureJoin(rootfs, "/etc/passwd")
+		if err != nil {
+			return errors.Wrap(err, "resolve /etc/passwd in rootfs")
+		}
+		groupPath, err = securejoin.SecureJoin(rootfs, "/etc/group")
+		if err != nil {
+			return errors.Wrap(err, "resolve /etc/group in rootfs")
+		}
 	}
 	execUser, err := user.GetExecUserPath(ig.ConfigUser(), nil, passwdPath, groupPath)
 	if err != nil {
@@ -0,0 +1,100 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package convert
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func makeRootfs(t *testing.T, files map[string]string) string {
+	rootfs, err := ioutil.TempDir("", "umoci-TestToRuntimeSpec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range files {
+		path = filepath.Join(rootfs, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootfs
+}
+
+func TestToRuntimeSpecNamedUser(t *testing.T) {
+	rootfs := makeRootfs(t, map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh\napp:x:1234:5678::/home/app:/bin/sh\n",
+		"etc/group":  "root:x:0:\napp:x:5678:\nextra:x:9000:app\n",
+	})
+	defer os.RemoveAll(rootfs)
+
+	image := ispec.Image{OS: "linux"}
+	image.Config.User = "app"
+	image.Config.WorkingDir = "srv/../data"
+
+	spec, err := ToRuntimeSpec(rootfs, image)
+	if err != nil {
+		t.Fatalf("unexpected error converting config: %+v", err)
+	}
+	if spec.Process.User.UID != 1234 || spec.Process.User.GID != 5678 {
+		t.Errorf("named user not resolved: expected 1234:5678, got %d:%d", spec.Process.User.UID, spec.Process.User.GID)
+	}
+	if expected := []uint32{9000}; !reflect.DeepEqual(spec.Process.User.AdditionalGids, expected) {
+		t.Errorf("unexpected additional gids: expected %v, got %v", expected, spec.Process.User.AdditionalGids)
+	}
+	if spec.Process.Cwd != "/data" {
+		t.Errorf("relative WorkingDir not normalised: expected %q, got %q", "/data", spec.Process.Cwd)
+	}
+}
+
+func TestToRuntimeSpecSymlinkedPasswd(t *testing.T) {
+	rootfs := makeRootfs(t, map[string]string{
+		"usr/lib/passwd": "app:x:1234:5678::/home/app:/bin/sh\n",
+	})
+	defer os.RemoveAll(rootfs)
+
+	// An absolute symlink must be resolved inside the rootfs rather than
+	// pointing to the host's files.
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/lib/passwd", filepath.Join(rootfs, "etc", "passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	image := ispec.Image{OS: "linux"}
+	image.Config.User = "app"
+
+	spec, err := ToRuntimeSpec(rootfs, image)
+	if err != nil {
+		t.Fatalf("unexpected error converting config: %+v", err)
+	}
+	if spec.Process.User.UID != 1234 || spec.Process.User.GID != 5678 {
+		t.Errorf("named user not resolved: expected 1234:5678, got %d:%d", spec.Process.User.UID, spec.Process.User.GID)
+	}
+	if spec.Process.Cwd != "/" {
+		t.Errorf("unexpected default cwd: %q", spec.Process.Cwd)
+	}
+}
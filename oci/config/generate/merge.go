@@ -0,0 +1,213 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package generate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// schemaType is a (very) minimal description of a JSON schema type, which is
+// sufficient to describe the "config" object of the OCI image configuration
+// schema. We don't vendor a full JSON schema implementation, so this is
+// hand-written to match image-spec's config-schema.json.
+type schemaType int
+
+const (
+	schemaString schemaType = iota
+	schemaStringArray
+	schemaStringMap
+	schemaEmptyObjectMap
+)
+
+func (t schemaType) String() string {
+	switch t {
+	case schemaString:
+		return "string"
+	case schemaStringArray:
+		return "array of strings"
+	case schemaStringMap:
+		return "object of strings"
+	case schemaEmptyObjectMap:
+		return "object of empty objects"
+	}
+	return fmt.Sprintf("schemaType(%d)", int(t))
+}
+
+// configSchema describes the permitted fields of ispec.ImageConfig, and their
+// types. XXX: This must be kept in sync with image-spec.
+var configSchema = map[string]schemaType{
+	"User":         schemaString,
+	"ExposedPorts": schemaEmptyObjectMap,
+	"Env":          schemaStringArray,
+	"Entrypoint":   schemaStringArray,
+	"Cmd":          schemaStringArray,
+	"Volumes":      schemaEmptyObjectMap,
+	"WorkingDir":   schemaString,
+	"Labels":       schemaStringMap,
+	"StopSignal":   schemaString,
+}
+
+// jsonTypeName returns a human-readable name for the type of a decoded JSON
+// value, for use in error messages.
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// validateField checks that the decoded JSON value matches the given
+// schemaType. The returned error includes the path of the offending value.
+func validateField(path string, typ schemaType, value interface{}) error {
+	switch typ {
+	case schemaString:
+		if _, ok := value.(string); !ok {
+			return errors.Errorf("%s: expected %s, got %s", path, typ, jsonTypeName(value))
+		}
+	case schemaStringArray:
+		// null is permitted for Entrypoint and Cmd (and is harmless for Env).
+		if value == nil {
+			return nil
+		}
+		array, ok := value.([]interface{})
+		if !ok {
+			return errors.Errorf("%s: expected %s, got %s", path, typ, jsonTypeName(value))
+		}
+		for idx, elem := range array {
+			if _, ok := elem.(string); !ok {
+				return errors.Errorf("%s[%d]: expected string, got %s", path, idx, jsonTypeName(elem))
+			}
+		}
+		// Env entries must be of the form name=value.
+		if path == "config.Env" {
+			for idx, elem := range array {
+				if parts := strings.SplitN(elem.(string), "=", 2); len(parts) != 2 || parts[0] == "" {
+					return errors.Errorf("%s[%d]: must be of the form name=value: %q", path, idx, elem)
+				}
+			}
+		}
+	case schemaStringMap, schemaEmptyObjectMap:
+		if value == nil {
+			return nil
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("%s: expected %s, got %s", path, typ, jsonTypeName(value))
+		}
+		for key, elem := range object {
+			elemPath := fmt.Sprintf("%s[%q]", path, key)
+			if typ == schemaStringMap {
+				if _, ok := elem.(string); !ok {
+					return errors.Errorf("%s: expected string, got %s", elemPath, jsonTypeName(elem))
+				}
+			} else {
+				if inner, ok := elem.(map[string]interface{}); !ok || len(inner) != 0 {
+					return errors.Errorf("%s: expected empty object, got %s", elemPath, jsonTypeName(elem))
+				}
+			}
+		}
+	default:
+		return errors.Errorf("[internal error] unknown schema type %v", typ)
+	}
+	return nil
+}
+
+// ValidateConfigJSON verifies that the given JSON document is a valid
+// (possibly partial) image configuration "config" object, as defined by the
+// OCI image configuration schema. Unknown fields are rejected. Any error
+// returned includes the path of the offending field.
+func ValidateConfigJSON(data []byte) error {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&doc); err != nil {
+		return errors.Wrap(err, "parse config json")
+	}
+	if decoder.More() {
+		return errors.Errorf("parse config json: trailing data after top-level object")
+	}
+
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		return errors.Errorf("config: expected object, got %s", jsonTypeName(doc))
+	}
+
+	// Iterate in a stable order so that error messages are reproducible.
+	var keys []string
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		path := "config." + key
+		typ, ok := configSchema[key]
+		if !ok {
+			return errors.Errorf("%s: unknown field", path)
+		}
+		if err := validateField(path, typ, object[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MergeConfigJSON merges the given (possibly partial) JSON image "config"
+// object into the current configuration, after validating it with
+// ValidateConfigJSON. Scalar and list fields present in the document replace
+// the existing values, while map fields (such as Labels) are merged with the
+// existing entries. If the document is invalid, the configuration is not
+// modified.
+func (g *Generator) MergeConfigJSON(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "read config json")
+	}
+	if err := ValidateConfigJSON(data); err != nil {
+		return errors.Wrap(err, "validate config json")
+	}
+
+	// Decoding into the existing struct gives us the merge semantics we want
+	// -- only fields present in the document are touched, and maps have
+	// their keys added rather than being replaced.
+	config := g.image.Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return errors.Wrap(err, "merge config json")
+	}
+	g.image.Config = config
+	g.init()
+	return nil
+}
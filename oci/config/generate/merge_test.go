@@ -0,0 +1,81 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package generate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeConfigJSON(t *testing.T) {
+	g := New()
+	g.SetConfigUser("root")
+	g.SetConfigWorkingDir("/old")
+	g.AddConfigEnv("OLD", "value")
+	g.AddConfigLabel("old.label", "a")
+
+	doc := `{"WorkingDir": "/srv", "Env": ["PATH=/bin", "FOO=bar"], "Labels": {"new.label": "b"}}`
+	if err := g.MergeConfigJSON(strings.NewReader(doc)); err != nil {
+		t.Fatalf("unexpected error merging config: %+v", err)
+	}
+
+	if got := g.ConfigWorkingDir(); got != "/srv" {
+		t.Errorf("WorkingDir not merged: expected %q, got %q", "/srv", got)
+	}
+	if got, expected := g.ConfigEnv(), []string{"PATH=/bin", "FOO=bar"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Env not merged: expected %v, got %v", expected, got)
+	}
+	if got, expected := g.ConfigLabels(), map[string]string{"old.label": "a", "new.label": "b"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Labels not merged: expected %v, got %v", expected, got)
+	}
+	// Fields not in the document must be left alone.
+	if got := g.ConfigUser(); got != "root" {
+		t.Errorf("User was modified: expected %q, got %q", "root", got)
+	}
+}
+
+func TestMergeConfigJSONInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name, doc, path string
+	}{
+		{"NotObject", `["Env"]`, "config"},
+		{"UnknownField", `{"Enviroment": []}`, "config.Enviroment"},
+		{"WrongScalar", `{"WorkingDir": 1234}`, "config.WorkingDir"},
+		{"WrongArrayElem", `{"Env": ["A=b", false]}`, "config.Env[1]"},
+		{"BadEnv", `{"Env": ["NOEQUALS"]}`, "config.Env[0]"},
+		{"WrongMapElem", `{"Labels": {"a": 1}}`, `config.Labels["a"]`},
+		{"NonEmptyPort", `{"ExposedPorts": {"80/tcp": {"a": "b"}}}`, `config.ExposedPorts["80/tcp"]`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			g := New()
+			g.SetConfigWorkingDir("/unchanged")
+
+			err := g.MergeConfigJSON(strings.NewReader(test.doc))
+			if err == nil {
+				t.Fatalf("expected error merging invalid config %s", test.doc)
+			}
+			if !strings.Contains(err.Error(), test.path+":") {
+				t.Errorf("error does not cite offending path %q: %v", test.path, err)
+			}
+			if got := g.ConfigWorkingDir(); got != "/unchanged" {
+				t.Errorf("config modified by failed merge: WorkingDir=%q", got)
+			}
+		})
+	}
+}
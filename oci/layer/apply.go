@@ -0,0 +1,68 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// contextReader is an io.Reader which fails once its context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// ApplyAndDigest extracts the layer blob read from r (which has the given
+// media-type, and is decompressed accordingly) onto the root filesystem at
+// root, in the same manner as UnpackLayer. The DiffID of the layer (the
+// digest of the uncompressed layer) is computed as the layer is extracted
+// and returned, so that layers whose DiffIDs are not yet known (such as when
+// importing layers to create a new image configuration) only need to be read
+// once. Extraction is aborted if ctx is cancelled.
+func ApplyAndDigest(ctx context.Context, root string, r io.Reader, mediaType string, opt *UnpackOptions) (digest.Digest, error) {
+	layerRaw, err := decompressLayer(contextReader{ctx: ctx, r: r}, ispec.Descriptor{MediaType: mediaType}, opt)
+	if err != nil {
+		return "", errors.Wrap(err, "apply layer")
+	}
+	defer layerRaw.Close()
+
+	layerDigester := digest.SHA256.Digester()
+	layer := io.TeeReader(layerRaw, layerDigester.Hash())
+	if err := UnpackLayer(root, layer, opt); err != nil {
+		return "", errors.Wrap(err, "apply layer")
+	}
+	// As with UnpackRootfs, the tar reader might not consume the entire
+	// stream so we need to digest any trailing bytes.
+	if _, err := io.Copy(ioutil.Discard, layer); err != nil {
+		return "", errors.Wrap(err, "discard trailing archive bits")
+	}
+	return layerDigester.Digest(), nil
+}
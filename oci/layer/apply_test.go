@@ -0,0 +1,110 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestApplyAndDigest(t *testing.T) {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	contents := []byte("applied contents")
+	for _, hdr := range []*tar.Header{
+		{Name: "dir/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "dir/file", Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(contents))},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Add some trailing padding which the tar reader will not consume.
+	layer.Write(make([]byte, 4096))
+	expectedDiffID := digest.FromBytes(layer.Bytes())
+
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	if _, err := gzw.Write(layer.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		mediaType string
+		blob      []byte
+	}{
+		{"Uncompressed", ispec.MediaTypeImageLayer, layer.Bytes()},
+		{"Gzip", ispec.MediaTypeImageLayerGzip, compressed.Bytes()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "umoci-TestApplyAndDigest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			diffID, err := ApplyAndDigest(context.Background(), root, bytes.NewReader(test.blob), test.mediaType, nil)
+			if err != nil {
+				t.Fatalf("unexpected error applying layer: %+v", err)
+			}
+			if diffID != expectedDiffID {
+				t.Errorf("unexpected diffid: expected %s got %s", expectedDiffID, diffID)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(root, "dir/file"))
+			if err != nil {
+				t.Fatalf("unexpected error reading extracted file: %+v", err)
+			}
+			if !bytes.Equal(got, contents) {
+				t.Errorf("unexpected extracted contents: %q", got)
+			}
+		})
+	}
+
+	t.Run("Cancelled", func(t *testing.T) {
+		root, err := ioutil.TempDir("", "umoci-TestApplyAndDigest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := ApplyAndDigest(ctx, root, bytes.NewReader(layer.Bytes()), ispec.MediaTypeImageLayer, nil); err == nil {
+			t.Errorf("expected error applying layer with cancelled context")
+		}
+	})
+}
@@ -0,0 +1,86 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// paxBirthtime is the PAX record keyword used to store the birth (creation)
+// time of an entry. This is the same keyword used by libarchive.
+const paxBirthtime = "LIBARCHIVE.creationtime"
+
+// formatPAXTime formats a timestamp in the decimal "seconds[.fraction]" form
+// used by PAX time records. Sub-second precision is only kept for timestamps
+// after the Unix epoch.
+func formatPAXTime(t time.Time) string {
+	sec, nsec := t.Unix(), t.Nanosecond()
+	if nsec == 0 || sec < 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+	return strings.TrimRight(fmt.Sprintf("%d.%09d", sec, nsec), "0")
+}
+
+// parsePAXTime is the inverse of formatPAXTime. Fractions with more than
+// nanosecond precision are truncated.
+func parsePAXTime(value string) (time.Time, error) {
+	secStr, fracStr := value, ""
+	if idx := strings.IndexByte(value, '.'); idx >= 0 {
+		secStr, fracStr = value[:idx], value[idx+1:]
+	}
+	sec, err := strconv.ParseInt(secStr, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid PAX time %q", value)
+	}
+	if fracStr == "" {
+		return time.Unix(sec, 0), nil
+	}
+	for _, ch := range fracStr {
+		if ch < '0' || ch > '9' {
+			return time.Time{}, errors.Errorf("invalid PAX time %q", value)
+		}
+	}
+	if len(fracStr) > 9 {
+		fracStr = fracStr[:9]
+	}
+	nsec, _ := strconv.ParseInt(fracStr+strings.Repeat("0", 9-len(fracStr)), 10, 64)
+	if strings.HasPrefix(secStr, "-") {
+		nsec = -nsec
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// getBirthtime returns the paxBirthtime value for the given path, or "" if
+// the filesystem does not record birth times.
+func getBirthtime(fsEval fseval.FsEval, path string) (string, error) {
+	btime, err := fsEval.Lbirthtime(path)
+	if err != nil {
+		if InnerErrno(err) == unix.ENOTSUP {
+			return "", nil
+		}
+		return "", err
+	}
+	return formatPAXTime(btime), nil
+}
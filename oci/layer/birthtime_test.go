@@ -0,0 +1,118 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/umoci/pkg/system"
+	"golang.org/x/sys/unix"
+)
+
+func TestPAXTime(t *testing.T) {
+	for _, test := range []struct {
+		time  time.Time
+		value string
+	}{
+		{time.Unix(0, 0), "0"},
+		{time.Unix(1234567890, 0), "1234567890"},
+		{time.Unix(1234567890, 500000000), "1234567890.5"},
+		{time.Unix(1234567890, 123456789), "1234567890.123456789"},
+		{time.Unix(-100, 0), "-100"},
+	} {
+		if got := formatPAXTime(test.time); got != test.value {
+			t.Errorf("formatPAXTime(%v) = %q, expected %q", test.time, got, test.value)
+		}
+		got, err := parsePAXTime(test.value)
+		if err != nil {
+			t.Errorf("parsePAXTime(%q): unexpected error: %+v", test.value, err)
+		} else if !got.Equal(test.time) {
+			t.Errorf("parsePAXTime(%q) = %v, expected %v", test.value, got, test.time)
+		}
+	}
+
+	if got, err := parsePAXTime("1.1234567899"); err != nil || !got.Equal(time.Unix(1, 123456789)) {
+		t.Errorf("parsePAXTime should truncate sub-nanosecond precision: got %v, %v", got, err)
+	}
+	for _, value := range []string{"", "abc", "1.-5", "1.2.3", "1e9"} {
+		if _, err := parsePAXTime(value); err == nil {
+			t.Errorf("parsePAXTime(%q): expected an error", value)
+		}
+	}
+}
+
+func TestBirthtimeRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestBirthtimeRecord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("birthtime"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Generate an entry for the file, which records the birthtime if the
+	// filesystem supports it.
+	var layer bytes.Buffer
+	tg := newTarGenerator(&layer, MapOptions{})
+	tg.preserveBirthtime = true
+	if err := tg.AddFile("file", src); err != nil {
+		t.Fatalf("unexpected error adding file: %+v", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := tar.NewReader(bytes.NewReader(layer.Bytes())).Next()
+	if err != nil {
+		t.Fatalf("unexpected error reading layer: %+v", err)
+	}
+	srcBtime, err := system.Lbirthtime(src)
+	switch {
+	case InnerErrno(err) == unix.ENOTSUP:
+		if value, ok := hdr.PAXRecords[paxBirthtime]; ok {
+			t.Errorf("birthtime recorded on filesystem without birthtime support: %q", value)
+		}
+	case err != nil:
+		t.Fatalf("unexpected error getting birthtime: %+v", err)
+	default:
+		if value := hdr.PAXRecords[paxBirthtime]; value != formatPAXTime(srcBtime) {
+			t.Errorf("unexpected recorded birthtime: expected %q got %q", formatPAXTime(srcBtime), value)
+		}
+	}
+
+	// Birth times are only recorded, but unpacking a layer containing them
+	// must still succeed.
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer(rootfs, bytes.NewReader(layer.Bytes()), nil); err != nil {
+		t.Fatalf("unexpected UnpackLayer error: %+v", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(rootfs, "file")); err != nil || string(got) != "birthtime" {
+		t.Errorf("unexpected contents of unpacked file: %q (%v)", got, err)
+	}
+}
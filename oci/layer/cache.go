@@ -0,0 +1,626 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
+)
+
+// LayerCache is an on-disk cache of extracted root filesystems, which can be
+// shared between unpack operations of different images. Each entry is the
+// state of a root filesystem after extracting a particular chain of layers
+// (identified by the ChainID of their DiffIDs), so images which share base
+// layers can restore the extracted base from the cache rather than
+// decompressing and extracting it again.
+//
+// Entries are only added to the cache after the DiffID of every layer in the
+// chain has been verified, and each entry records the DiffIDs (and unpack
+// options) it was created with so that mismatched entries are never used.
+//
+// Files are copied out of the cache rather than hardlinked, so that changes
+// made to an unpacked bundle can never modify the cache (and so that link
+// counts in the bundle are not affected by the cache). Within the cache,
+// regular files which are identical to those in the entry for the parent
+// chain are hardlinked to it, so each entry only takes up space for the files
+// changed by its top layer. Because a damaged inode could thus affect several
+// entries, every entry stores an mtree manifest of its root filesystem which
+// is checked before the entry is restored.
+type LayerCache struct {
+	root string
+}
+
+// NewLayerCache opens the LayerCache stored in the given directory, creating
+// it if necessary.
+func NewLayerCache(root string) (*LayerCache, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, errors.Wrap(err, "create layer cache")
+	}
+	return &LayerCache{root: root}, nil
+}
+
+const (
+	// layerCacheRootfs is the name of the root filesystem inside a cache
+	// entry.
+	layerCacheRootfs = "rootfs"
+
+	// layerCacheKey is the name of the file inside a cache entry which
+	// contains the layerCacheEntryKey the entry was created with.
+	layerCacheKey = "key.json"
+
+	// layerCacheStats is the name of the file inside a cache entry which
+	// contains the UnpackStats of extracting every layer in the chain.
+	layerCacheStats = "stats.json"
+
+	// layerCacheFileFlags is the name of the file inside a cache entry which
+	// contains the inode flags recorded while extracting every layer in the
+	// chain (see UnpackOptions.FileFlags). It is omitted if there were none.
+	layerCacheFileFlags = "fflags.json"
+
+	// layerCacheManifest is the name of the file inside a cache entry which
+	// contains the mtree manifest of the entry's root filesystem.
+	layerCacheManifest = "rootfs.mtree"
+)
+
+// layerCacheKeywords are the mtree keywords recorded in the manifest of each
+// cache entry. "nlink" is not included, since the link count of an inode
+// shared with other entries changes as entries are added.
+var layerCacheKeywords = []mtree.Keyword{
+	"size",
+	"type",
+	"uid",
+	"gid",
+	"mode",
+	"link",
+	"tar_time",
+	"sha256digest",
+	"xattr",
+}
+
+// parent returns the key of the cache entry for the chain without its top
+// layer, or false if the chain only has one layer.
+func (key layerCacheEntryKey) parent() (layerCacheEntryKey, bool) {
+	if len(key.DiffIDs) < 2 {
+		return key, false
+	}
+	key.DiffIDs = key.DiffIDs[:len(key.DiffIDs)-1]
+	key.ChainID = chainID(key.DiffIDs)
+	return key, true
+}
+
+// layerCacheEntryKey describes everything that affects the contents of an
+// extracted root filesystem. Entries can only be reused if their entire key
+// is identical.
+type layerCacheEntryKey struct {
+	ChainID         digest.Digest       `json:"chain_id"`
+	DiffIDs         []digest.Digest     `json:"diff_ids"`
+	MapOptions      MapOptions          `json:"map_options"`
+	KeepDirlinks    bool                `json:"keep_dirlinks,omitempty"`
+	DirTimesLast    bool                `json:"directory_times_last,omitempty"`
+	ImplicitDirMode os.FileMode         `json:"implicit_directory_mode,omitempty"`
+	WhiteoutMode    WhiteoutMode        `json:"whiteout_mode,omitempty"`
+	IncludePaths    []string            `json:"include_paths,omitempty"`
+	UnsafeNameMode  UnsafeNameMode      `json:"unsafe_name_mode,omitempty"`
+	AbsolutePath    AbsolutePathMode    `json:"absolute_path_mode,omitempty"`
+	UnknownPAXMode  UnknownPAXMode      `json:"unknown_pax_mode,omitempty"`
+	UnsupportedType UnsupportedTypeMode `json:"unsupported_type_mode,omitempty"`
+	AllowedIDRange  *IDRange            `json:"allowed_id_range,omitempty"`
+	IDRangeMode     IDRangeMode         `json:"id_range_mode,omitempty"`
+	RootlessDevice  RootlessDeviceMode  `json:"rootless_device_mode,omitempty"`
+	FifoMode        FifoMode            `json:"fifo_mode,omitempty"`
+	SocketMode      SocketMode          `json:"socket_mode,omitempty"`
+	InUserNamespace bool                `json:"in_user_namespace,omitempty"`
+}
+
+// chainID computes the ChainID of the given set of DiffIDs, as defined by the
+// image-spec.
+func chainID(diffIDs []digest.Digest) digest.Digest {
+	var chain digest.Digest
+	for idx, diffID := range diffIDs {
+		if idx == 0 {
+			chain = diffID
+			continue
+		}
+		chain = digest.FromString(chain.String() + " " + diffID.String())
+	}
+	return chain
+}
+
+// layerCacheKeys returns the key of the cache entry corresponding to every
+// prefix of the given DiffIDs (so the key at index n describes the root
+// filesystem after extracting layers 0 to n).
+func layerCacheKeys(diffIDs []digest.Digest, opt *UnpackOptions) []layerCacheEntryKey {
+	var keys []layerCacheEntryKey
+	for idx := range diffIDs {
+		chain := diffIDs[:idx+1]
+		keys = append(keys, layerCacheEntryKey{
+			ChainID:         chainID(chain),
+			DiffIDs:         chain,
+			MapOptions:      opt.MapOptions,
+			KeepDirlinks:    opt.KeepDirlinks,
+			DirTimesLast:    opt.DirectoryTimesLast,
+			ImplicitDirMode: opt.ImplicitDirectoryMode,
+			WhiteoutMode:    opt.WhiteoutMode,
+			IncludePaths:    opt.IncludePaths,
+			UnsafeNameMode:  opt.UnsafeNameMode,
+			AbsolutePath:    opt.AbsolutePathMode,
+			UnknownPAXMode:  opt.UnknownPAXMode,
+			UnsupportedType: opt.UnsupportedTypeMode,
+			AllowedIDRange:  opt.AllowedIDRange,
+			IDRangeMode:     opt.IDRangeMode,
+			RootlessDevice:  opt.RootlessDeviceMode,
+			FifoMode:        opt.FifoMode,
+			SocketMode:      opt.SocketMode,
+			InUserNamespace: inUserNamespace,
+		})
+	}
+	return keys
+}
+
+// entryPath returns the path of the cache entry with the given key.
+func (c *LayerCache) entryPath(key layerCacheEntryKey) (string, []byte, error) {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "marshal layer cache key")
+	}
+	return filepath.Join(c.root, digest.FromBytes(data).Encoded()), data, nil
+}
+
+// restore copies the cache entry with the given key to rootfs (which must be
+// an empty directory), returning false if there is no usable entry. The
+// statistics of extracting the cached layers are stored in stats, and their
+// recorded inode flags are added to fileFlags.
+func (c *LayerCache) restore(key layerCacheEntryKey, rootfs string, fsEval fseval.FsEval, stats *UnpackStats, fileFlags map[string]string) (bool, error) {
+	entry, keyData, err := c.entryPath(key)
+	if err != nil {
+		return false, err
+	}
+	storedKey, err := ioutil.ReadFile(filepath.Join(entry, layerCacheKey))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "read layer cache entry key")
+	}
+	if !bytes.Equal(storedKey, keyData) {
+		log.Warnf("layer cache: ignoring entry %s with mismatched key", entry)
+		return false, nil
+	}
+	statsData, err := ioutil.ReadFile(filepath.Join(entry, layerCacheStats))
+	if os.IsNotExist(err) {
+		log.Warnf("layer cache: ignoring entry %s without stats", entry)
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "read layer cache entry stats")
+	}
+	var entryStats UnpackStats
+	if err := json.Unmarshal(statsData, &entryStats); err != nil {
+		return false, errors.Wrap(err, "parse layer cache entry stats")
+	}
+	entryFileFlags := map[string]string{}
+	if fileFlagsData, err := ioutil.ReadFile(filepath.Join(entry, layerCacheFileFlags)); err == nil {
+		if err := json.Unmarshal(fileFlagsData, &entryFileFlags); err != nil {
+			return false, errors.Wrap(err, "parse layer cache entry inode flags")
+		}
+	} else if !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "read layer cache entry inode flags")
+	}
+
+	if err := c.verify(entry, c.fsEval(key)); err != nil {
+		log.Warnf("layer cache: ignoring entry %s: %v", entry, err)
+		return false, nil
+	}
+
+	log.Infof("restore layer cache entry: %s", key.ChainID)
+	if err := cloneTree(c.fsEval(key), filepath.Join(entry, layerCacheRootfs), fsEval, rootfs, "", key.MapOptions.Rootless); err != nil {
+		return false, errors.Wrapf(err, "restore layer cache entry %s", key.ChainID)
+	}
+	*stats = entryStats
+	for pth, flags := range entryFileFlags {
+		fileFlags[pth] = flags
+	}
+	return true, nil
+}
+
+// verify checks that the root filesystem of the given cache entry still
+// matches the mtree manifest stored with it.
+func (c *LayerCache) verify(entry string, cacheEval fseval.FsEval) error {
+	manifest, err := os.Open(filepath.Join(entry, layerCacheManifest))
+	if err != nil {
+		return errors.Wrap(err, "open manifest")
+	}
+	defer manifest.Close()
+
+	spec, err := mtree.ParseSpec(manifest)
+	if err != nil {
+		return errors.Wrap(err, "parse manifest")
+	}
+	diffs, err := mtree.Check(filepath.Join(entry, layerCacheRootfs), spec, layerCacheKeywords, cacheEval)
+	if err != nil {
+		return errors.Wrap(err, "check manifest")
+	}
+	if len(diffs) > 0 {
+		return errors.Errorf("rootfs does not match manifest: %d differences (first: %s)", len(diffs), diffs[0].Path())
+	}
+	return nil
+}
+
+// store adds a copy of rootfs (and the statistics and inode flags recorded
+// while extracting it) to the cache with the given key, if there is no such
+// entry already. Regular files which are unchanged from the entry of the
+// parent chain (if it is in the cache) are hardlinked to it rather than
+// copied. The entry only becomes visible once it is complete.
+func (c *LayerCache) store(key layerCacheEntryKey, rootfs string, fsEval fseval.FsEval, stats UnpackStats, fileFlags map[string]string) error {
+	entry, keyData, err := c.entryPath(key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(entry); err == nil {
+		return nil
+	}
+
+	tmpDir, err := ioutil.TempDir(c.root, ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary layer cache entry")
+	}
+	cacheEval := c.fsEval(key)
+	defer func() {
+		// #nosec G104
+		_ = cacheEval.RemoveAll(tmpDir)
+	}()
+
+	var base string
+	if parent, ok := key.parent(); ok {
+		parentEntry, _, err := c.entryPath(parent)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(parentEntry, layerCacheKey)); err == nil {
+			base = filepath.Join(parentEntry, layerCacheRootfs)
+		}
+	}
+
+	log.Infof("store layer cache entry: %s", key.ChainID)
+	tmpRootfs := filepath.Join(tmpDir, layerCacheRootfs)
+	if err := cloneTree(fsEval, rootfs, cacheEval, tmpRootfs, base, key.MapOptions.Rootless); err != nil {
+		return errors.Wrapf(err, "store layer cache entry %s", key.ChainID)
+	}
+	dh, err := mtree.Walk(tmpRootfs, nil, layerCacheKeywords, cacheEval)
+	if err != nil {
+		return errors.Wrap(err, "generate layer cache entry manifest")
+	}
+	manifest, err := os.OpenFile(filepath.Join(tmpDir, layerCacheManifest), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "create layer cache entry manifest")
+	}
+	defer manifest.Close()
+	if _, err := dh.WriteTo(manifest); err != nil {
+		return errors.Wrap(err, "write layer cache entry manifest")
+	}
+	if err := manifest.Close(); err != nil {
+		return errors.Wrap(err, "close layer cache entry manifest")
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, layerCacheKey), keyData, 0600); err != nil {
+		return errors.Wrap(err, "write layer cache entry key")
+	}
+	statsData, err := json.Marshal(stats)
+	if err != nil {
+		return errors.Wrap(err, "marshal layer cache entry stats")
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, layerCacheStats), statsData, 0600); err != nil {
+		return errors.Wrap(err, "write layer cache entry stats")
+	}
+	if len(fileFlags) > 0 {
+		fileFlagsData, err := json.Marshal(fileFlags)
+		if err != nil {
+			return errors.Wrap(err, "marshal layer cache entry inode flags")
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, layerCacheFileFlags), fileFlagsData, 0600); err != nil {
+			return errors.Wrap(err, "write layer cache entry inode flags")
+		}
+	}
+	if err := os.Rename(tmpDir, entry); err != nil {
+		// Someone else may have stored the same entry concurrently.
+		if _, err2 := os.Lstat(entry); err2 == nil {
+			return nil
+		}
+		return errors.Wrap(err, "add layer cache entry")
+	}
+	return nil
+}
+
+// fsEval returns the fseval.FsEval used to access cache entries with the
+// given key.
+func (c *LayerCache) fsEval(key layerCacheEntryKey) fseval.FsEval {
+	if key.MapOptions.Rootless {
+		return fseval.Rootless
+	}
+	return fseval.Default
+}
+
+// cloneSkipXattrs are xattrs which are host-specific, and thus are not copied
+// by cloneTree.
+var cloneSkipXattrs = map[string]struct{}{
+	"security.selinux": {},
+	"system.nfs4_acl":  {},
+}
+
+// cloneTree makes a full copy of the tree at src (accessed using srcEval) at
+// dst (accessed using dstEval), including all metadata and hardlinks within
+// the tree. If base is non-empty, it is a tree (also accessed using dstEval)
+// whose regular files are hardlinked into dst instead of being copied if they
+// are identical to the file at the same path in src.
+func cloneTree(srcEval fseval.FsEval, src string, dstEval fseval.FsEval, dst string, base string, rootless bool) error {
+	// Directory metadata has to be applied after their contents have been
+	// copied, otherwise the mtimes would be modified (and read-only
+	// directories would be unwritable for rootless).
+	type dirMeta struct {
+		path string
+		info os.FileInfo
+		stat unix.Stat_t
+	}
+	var dirs []dirMeta
+	inodes := map[uint64]string{}
+	// Directories (relative to src) which are also directories in base. We
+	// only look for files in base inside these, so that we never follow a
+	// symlink in base.
+	baseDirs := map[string]struct{}{}
+
+	err := srcEval.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.Wrap(err, "get relative path")
+		}
+		target := filepath.Join(dst, rel)
+		stat, err := srcEval.Lstatx(path)
+		if err != nil {
+			return errors.Wrap(err, "lstat source")
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := dstEval.MkdirAll(target, 0700); err != nil {
+				return errors.Wrap(err, "mkdir")
+			}
+			dirs = append(dirs, dirMeta{path: target, info: info, stat: stat})
+			if base != "" {
+				if baseInfo, err := dstEval.Lstat(filepath.Join(base, rel)); err == nil && baseInfo.IsDir() {
+					baseDirs[rel] = struct{}{}
+				}
+			}
+			return nil
+		case mode.IsRegular():
+			if stat.Nlink > 1 {
+				if linkTarget, ok := inodes[stat.Ino]; ok {
+					return errors.Wrap(dstEval.Link(linkTarget, target), "link")
+				}
+				inodes[stat.Ino] = target
+			}
+			if _, ok := baseDirs[filepath.Dir(rel)]; ok {
+				basePath := filepath.Join(base, rel)
+				same, err := sameFile(srcEval, path, info, stat, dstEval, basePath, rootless)
+				if err != nil {
+					return err
+				}
+				if same {
+					return errors.Wrap(dstEval.Link(basePath, target), "link base")
+				}
+			}
+			if err := cloneFile(srcEval, path, dstEval, target); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink == os.ModeSymlink:
+			linkname, err := srcEval.Readlink(path)
+			if err != nil {
+				return errors.Wrap(err, "readlink")
+			}
+			if err := dstEval.Symlink(linkname, target); err != nil {
+				return errors.Wrap(err, "symlink")
+			}
+		default:
+			if err := dstEval.Mknod(target, os.FileMode(stat.Mode), uint64(stat.Rdev)); err != nil {
+				return errors.Wrap(err, "mknod")
+			}
+		}
+		return cloneMetadata(srcEval, path, dstEval, target, info, stat, rootless)
+	})
+	if err != nil {
+		return errors.Wrap(err, "clone tree")
+	}
+
+	for idx := len(dirs) - 1; idx >= 0; idx-- {
+		dir := dirs[idx]
+		rel, _ := filepath.Rel(dst, dir.path)
+		if err := cloneMetadata(srcEval, filepath.Join(src, rel), dstEval, dir.path, dir.info, dir.stat, rootless); err != nil {
+			return errors.Wrap(err, "clone tree")
+		}
+	}
+	return nil
+}
+
+// sameFile returns whether basePath (accessed using baseEval) is a regular
+// file with the same contents and metadata as the regular file at path
+// (accessed using srcEval), so that it can be shared rather than copied.
+func sameFile(srcEval fseval.FsEval, path string, info os.FileInfo, stat unix.Stat_t, baseEval fseval.FsEval, basePath string, rootless bool) (bool, error) {
+	baseInfo, err := baseEval.Lstat(basePath)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "lstat base")
+	}
+	if !baseInfo.Mode().IsRegular() || baseInfo.Mode() != info.Mode() || baseInfo.Size() != info.Size() {
+		return false, nil
+	}
+	baseStat, err := baseEval.Lstatx(basePath)
+	if err != nil {
+		return false, errors.Wrap(err, "lstat base")
+	}
+	if baseStat.Mtim != stat.Mtim {
+		return false, nil
+	}
+	if !rootless && (baseStat.Uid != stat.Uid || baseStat.Gid != stat.Gid) {
+		return false, nil
+	}
+
+	xattrs, err := cloneXattrs(srcEval, path)
+	if err != nil {
+		return false, err
+	}
+	baseXattrs, err := cloneXattrs(baseEval, basePath)
+	if err != nil {
+		return false, err
+	}
+	if len(xattrs) != len(baseXattrs) {
+		return false, nil
+	}
+	for name, value := range xattrs {
+		if baseValue, ok := baseXattrs[name]; !ok || baseValue != value {
+			return false, nil
+		}
+	}
+
+	srcFile, err := srcEval.Open(path)
+	if err != nil {
+		return false, errors.Wrap(err, "open source")
+	}
+	defer srcFile.Close()
+	baseFile, err := baseEval.Open(basePath)
+	if err != nil {
+		return false, errors.Wrap(err, "open base")
+	}
+	defer baseFile.Close()
+
+	srcBuf := make([]byte, 32*1024)
+	baseBuf := make([]byte, 32*1024)
+	for {
+		n, err := io.ReadFull(srcFile, srcBuf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return false, errors.Wrapf(err, "read %s", path)
+		}
+		baseN, baseErr := io.ReadFull(baseFile, baseBuf)
+		if baseErr != nil && baseErr != io.EOF && baseErr != io.ErrUnexpectedEOF {
+			return false, errors.Wrapf(baseErr, "read %s", basePath)
+		}
+		if !bytes.Equal(srcBuf[:n], baseBuf[:baseN]) {
+			return false, nil
+		}
+		if err != nil || baseErr != nil {
+			return err != nil && baseErr != nil, nil
+		}
+	}
+}
+
+// cloneXattrs returns the xattrs of an inode which would be copied by
+// cloneMetadata.
+func cloneXattrs(fsEval fseval.FsEval, path string) (map[string]string, error) {
+	names, err := fsEval.Llistxattr(path)
+	if err != nil && errors.Cause(err) != unix.ENOTSUP {
+		return nil, errors.Wrap(err, "llistxattr")
+	}
+	xattrs := map[string]string{}
+	for _, name := range names {
+		if _, skip := cloneSkipXattrs[name]; skip {
+			continue
+		}
+		value, err := fsEval.Lgetxattr(path, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "lgetxattr %s", name)
+		}
+		xattrs[name] = string(value)
+	}
+	return xattrs, nil
+}
+
+// cloneFile copies the contents of a regular file.
+func cloneFile(srcEval fseval.FsEval, src string, dstEval fseval.FsEval, dst string) error {
+	srcFile, err := srcEval.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open source")
+	}
+	defer srcFile.Close()
+
+	dstFile, err := dstEval.Create(dst)
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return errors.Wrapf(err, "copy %s", src)
+	}
+	return errors.Wrap(dstFile.Close(), "close")
+}
+
+// cloneMetadata copies the owner, mode, xattrs and timestamps of an inode.
+func cloneMetadata(srcEval fseval.FsEval, src string, dstEval fseval.FsEval, dst string, info os.FileInfo, stat unix.Stat_t, rootless bool) error {
+	isSymlink := info.Mode()&os.ModeSymlink == os.ModeSymlink
+
+	// In rootless mode everything is owned by us (the real owner is stored
+	// in the "user.rootlesscontainers" xattr, which is copied below).
+	if !rootless {
+		if err := dstEval.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+			return errors.Wrap(err, "lchown")
+		}
+	}
+	// Must be done after the chown, which clears setuid bits.
+	if !isSymlink {
+		if err := dstEval.Chmod(dst, info.Mode()); err != nil {
+			return errors.Wrap(err, "chmod")
+		}
+	}
+
+	xattrs, err := srcEval.Llistxattr(src)
+	if err != nil && errors.Cause(err) != unix.ENOTSUP {
+		return errors.Wrap(err, "llistxattr")
+	}
+	for _, name := range xattrs {
+		if _, skip := cloneSkipXattrs[name]; skip {
+			continue
+		}
+		value, err := srcEval.Lgetxattr(src, name)
+		if err != nil {
+			return errors.Wrapf(err, "lgetxattr %s", name)
+		}
+		if err := dstEval.Lsetxattr(dst, name, value, 0); err != nil {
+			if rootless && os.IsPermission(errors.Cause(err)) {
+				log.Warnf("rootless{%s} ignoring (usually) harmless EPERM on setxattr %q", dst, name)
+				continue
+			}
+			return errors.Wrapf(err, "lsetxattr %s", name)
+		}
+	}
+
+	atime := time.Unix(stat.Atim.Unix())
+	mtime := time.Unix(stat.Mtim.Unix())
+	return errors.Wrap(dstEval.Lutimes(dst, atime, mtime), "lutimes")
+}
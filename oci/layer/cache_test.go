@@ -0,0 +1,365 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+func testCacheUnpackOptions(cache *LayerCache) *UnpackOptions {
+	return &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+				{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+				{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+		LayerCache: cache,
+	}
+}
+
+// rewriteCacheManifest regenerates the mtree manifest of a cache entry after
+// its root filesystem has been modified by a test.
+func rewriteCacheManifest(t *testing.T, cache *LayerCache, key layerCacheEntryKey) {
+	entry, _, err := cache.entryPath(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh, err := mtree.Walk(filepath.Join(entry, layerCacheRootfs), nil, layerCacheKeywords, cache.fsEval(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err := os.Create(filepath.Join(entry, layerCacheManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if _, err := dh.WriteTo(fh); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// makeSiblingManifest creates a manifest which shares the base layer of the
+// given manifest, but has a different (uncompressed) top layer.
+func makeSiblingManifest(t *testing.T, engineExt casext.Engine, manifest ispec.Manifest, baseDiffID digest.Digest) ispec.Manifest {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	data := []byte("sibling layer")
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "sibling_file",
+		Mode:     0644,
+		Size:     int64(len(data)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{baseDiffID, layerDigest},
+		},
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{
+			manifest.Layers[0],
+			{
+				MediaType: ispec.MediaTypeImageLayer,
+				Digest:    layerDigest,
+				Size:      layerSize,
+			},
+		},
+	}
+}
+
+func imageDiffIDs(t *testing.T, engineExt casext.Engine, manifest ispec.Manifest) []digest.Digest {
+	configBlob, err := engineExt.FromDescriptor(context.Background(), manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer configBlob.Close()
+	return configBlob.Data.(ispec.Image).RootFS.DiffIDs
+}
+
+func TestLayerCacheSharedBase(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	cache, err := NewLayerCache(filepath.Join(root, "cache"))
+	if err != nil {
+		t.Fatalf("unexpected NewLayerCache error: %+v", err)
+	}
+	opt := testCacheUnpackOptions(cache)
+
+	rootfsA := filepath.Join(root, "rootfs-a")
+	if err := UnpackRootfs(ctx, engineExt, rootfsA, manifest, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+
+	// Every prefix of the chain must have been stored.
+	keys := layerCacheKeys(imageDiffIDs(t, engineExt, manifest), opt)
+	for _, key := range keys {
+		entry, _, err := cache.entryPath(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(filepath.Join(entry, layerCacheRootfs, "test_file")); err != nil {
+			t.Errorf("layer cache entry %s missing: %v", key.ChainID, err)
+		}
+	}
+
+	// Add a marker to the cached base layer, so we can tell whether the
+	// second unpack re-extracted the layer or reused the cached copy.
+	baseEntry, _, err := cache.entryPath(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(baseEntry, layerCacheRootfs, "cache_marker"), []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rewriteCacheManifest(t, cache, keys[0])
+
+	sibling := makeSiblingManifest(t, engineExt, manifest, keys[0].DiffIDs[0])
+	rootfsB := filepath.Join(root, "rootfs-b")
+	called := 0
+	opt.AfterLayerUnpack = func(m ispec.Manifest, d ispec.Descriptor) error {
+		called++
+		return nil
+	}
+	if err := UnpackRootfs(ctx, engineExt, rootfsB, sibling, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(rootfsB, "cache_marker")); err != nil {
+		t.Errorf("base layer was not restored from layer cache: %v", err)
+	}
+	if called != 1 {
+		t.Errorf("expected AfterLayerUnpack to only be called for the uncached layer: called %d times", called)
+	}
+	for _, path := range []string{"test_file", "test_dir", "sibling_file"} {
+		if _, err := os.Lstat(filepath.Join(rootfsB, path)); err != nil {
+			t.Errorf("expected %s to exist: %v", path, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(rootfsB, "test_script.sh")); !os.IsNotExist(err) {
+		t.Errorf("unexpected file from other image's top layer: %v", err)
+	}
+	if fi, err := os.Lstat(filepath.Join(rootfsB, "test_dir")); err != nil || fi.Mode().Perm() != 0707 {
+		t.Errorf("restored directory has wrong mode: %v (%v)", fi, err)
+	}
+
+	// Changes to the bundle must not affect the cache.
+	if err := ioutil.WriteFile(filepath.Join(rootfsB, "test_file"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(baseEntry, layerCacheRootfs, "test_file")); err != nil || string(data) == "modified" {
+		t.Errorf("modifying bundle changed layer cache: %q (%v)", data, err)
+	}
+}
+
+func TestLayerCacheMismatchedKey(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	cache, err := NewLayerCache(filepath.Join(root, "cache"))
+	if err != nil {
+		t.Fatalf("unexpected NewLayerCache error: %+v", err)
+	}
+	opt := testCacheUnpackOptions(cache)
+
+	if err := UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs-a"), manifest, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+
+	// Corrupt the key of every entry, and mark their contents.
+	for _, key := range layerCacheKeys(imageDiffIDs(t, engineExt, manifest), opt) {
+		entry, _, err := cache.entryPath(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(entry, layerCacheKey), []byte(`{"chain_id":"sha256:bad"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(entry, layerCacheRootfs, "cache_marker"), []byte("cached"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rootfsB := filepath.Join(root, "rootfs-b")
+	if err := UnpackRootfs(ctx, engineExt, rootfsB, manifest, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(rootfsB, "cache_marker")); !os.IsNotExist(err) {
+		t.Errorf("layer cache entry with mismatched key was used: %v", err)
+	}
+}
+
+func TestLayerCacheSharedInodes(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	cache, err := NewLayerCache(filepath.Join(root, "cache"))
+	if err != nil {
+		t.Fatalf("unexpected NewLayerCache error: %+v", err)
+	}
+	opt := testCacheUnpackOptions(cache)
+
+	if err := UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs-a"), manifest, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+
+	keys := layerCacheKeys(imageDiffIDs(t, engineExt, manifest), opt)
+	if len(keys) < 2 {
+		t.Fatalf("test image needs at least two layers: got %d", len(keys))
+	}
+	baseEntry, _, err := cache.entryPath(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	topEntry, _, err := cache.entryPath(keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// test_file is not changed by the top layer, so the top entry must share
+	// the inode of the base entry.
+	baseFi, err := os.Lstat(filepath.Join(baseEntry, layerCacheRootfs, "test_file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topFi, err := os.Lstat(filepath.Join(topEntry, layerCacheRootfs, "test_file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(baseFi, topFi) {
+		t.Errorf("unchanged file was copied rather than shared between layer cache entries")
+	}
+
+	// Restoring must not hardlink the bundle to the cache.
+	rootfsB := filepath.Join(root, "rootfs-b")
+	if err := UnpackRootfs(ctx, engineExt, rootfsB, manifest, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+	fi, err := os.Lstat(filepath.Join(rootfsB, "test_file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(fi, topFi) {
+		t.Errorf("restored file shares an inode with the layer cache")
+	}
+}
+
+func TestLayerCacheCorruptEntry(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	cache, err := NewLayerCache(filepath.Join(root, "cache"))
+	if err != nil {
+		t.Fatalf("unexpected NewLayerCache error: %+v", err)
+	}
+	opt := testCacheUnpackOptions(cache)
+
+	if err := UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs-a"), manifest, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+
+	// Modify a (shared) file in the cache without updating the manifests.
+	keys := layerCacheKeys(imageDiffIDs(t, engineExt, manifest), opt)
+	baseEntry, _, err := cache.entryPath(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFile := filepath.Join(baseEntry, layerCacheRootfs, "test_file")
+	fi, err := os.Lstat(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(testFile, bytes.Repeat([]byte("X"), int(fi.Size())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(testFile, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	rootfsB := filepath.Join(root, "rootfs-b")
+	if err := UnpackRootfs(ctx, engineExt, rootfsB, manifest, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+	expected, err := ioutil.ReadFile(filepath.Join(root, "rootfs-a", "test_file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(rootfsB, "test_file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("corrupt layer cache entry was restored: got %q expected %q", got, expected)
+	}
+}
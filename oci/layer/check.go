@@ -0,0 +1,53 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// CheckDiffIDs returns an error wrapping ErrDiffIDMismatch if the image
+// configuration does not have exactly one DiffID for each layer in the
+// manifest.
+func CheckDiffIDs(manifest ispec.Manifest, config ispec.Image) error {
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.Wrapf(ErrDiffIDMismatch, "config has %d diff_ids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	return nil
+}
+
+// CheckHistory returns an error wrapping ErrHistoryMismatch if the number of
+// non-empty entries in the history of the image configuration does not match
+// the number of layers in the manifest. Images without any history are
+// accepted, since the history is optional.
+func CheckHistory(manifest ispec.Manifest, config ispec.Image) error {
+	if len(config.History) == 0 {
+		return nil
+	}
+	var nonEmpty int
+	for _, history := range config.History {
+		if !history.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty != len(manifest.Layers) {
+		return errors.Wrapf(ErrHistoryMismatch, "config has %d non-empty history entries but manifest has %d layers", nonEmpty, len(manifest.Layers))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestCheckLayerCounts(t *testing.T) {
+	manifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{
+			{Digest: digest.FromString("layer0")},
+			{Digest: digest.FromString("layer1")},
+		},
+	}
+	diffIDs := []digest.Digest{digest.FromString("diffid0"), digest.FromString("diffid1")}
+
+	for _, test := range []struct {
+		name     string
+		diffIDs  []digest.Digest
+		history  []ispec.History
+		expected error
+		contains string
+	}{
+		{"Valid", diffIDs, []ispec.History{{}, {EmptyLayer: true}, {}}, nil, ""},
+		{"NoHistory", diffIDs, nil, nil, ""},
+		{"MissingDiffID", diffIDs[:1], nil, ErrDiffIDMismatch, "config has 1 diff_ids but manifest has 2 layers"},
+		{"ExtraDiffID", append(append([]digest.Digest{}, diffIDs...), digest.FromString("extra")), nil, ErrDiffIDMismatch, "config has 3 diff_ids but manifest has 2 layers"},
+		{"MissingHistory", diffIDs, []ispec.History{{}, {EmptyLayer: true}}, ErrHistoryMismatch, "config has 1 non-empty history entries but manifest has 2 layers"},
+		{"ExtraHistory", diffIDs, []ispec.History{{}, {}, {}}, ErrHistoryMismatch, "config has 3 non-empty history entries but manifest has 2 layers"},
+		{"AllEmptyHistory", diffIDs, []ispec.History{{EmptyLayer: true}}, ErrHistoryMismatch, "config has 0 non-empty history entries but manifest has 2 layers"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := ispec.Image{
+				RootFS:  ispec.RootFS{Type: "layers", DiffIDs: test.diffIDs},
+				History: test.history,
+			}
+			err := CheckDiffIDs(manifest, config)
+			if err == nil {
+				err = CheckHistory(manifest, config)
+			}
+			if test.expected == nil {
+				if err != nil {
+					t.Errorf("unexpected error: %+v", err)
+				}
+				return
+			}
+			if !errors.Is(err, test.expected) {
+				t.Fatalf("expected error to match %v: %+v", test.expected, err)
+			}
+			if !strings.Contains(err.Error(), test.contains) {
+				t.Errorf("error does not describe the problem (%q): %v", test.contains, err)
+			}
+		})
+	}
+}
+
+// UnpackRootfs must only check the history if asked to.
+func TestUnpackRootfsCheckHistory(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer configBlob.Close()
+	config := configBlob.Data.(ispec.Image)
+
+	// Only one of the two layers has a history entry.
+	config.History = []ispec.History{{CreatedBy: "layer0"}, {CreatedBy: "config", EmptyLayer: true}}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config.Digest = configDigest
+	manifest.Config.Size = configSize
+
+	if err := UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs"), manifest, &UnpackOptions{FsEval: fseval.NewMemory()}); err != nil {
+		t.Errorf("unexpected UnpackRootfs error without CheckHistory: %+v", err)
+	}
+
+	err = UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs-check"), manifest, &UnpackOptions{
+		FsEval:       fseval.NewMemory(),
+		CheckHistory: true,
+	})
+	if !errors.Is(err, ErrHistoryMismatch) {
+		t.Fatalf("expected UnpackRootfs to fail with ErrHistoryMismatch: %+v", err)
+	}
+	if !strings.Contains(err.Error(), "config has 1 non-empty history entries but manifest has 2 layers") {
+		t.Errorf("UnpackRootfs error does not describe the problem: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// MediaTypeChunkedLayer is the media-type of a ChunkedLayer blob, which
+	// is used in place of a layer blob that has been split into fixed-size
+	// chunks (see RepackOptions.FixedChunkBytes).
+	MediaTypeChunkedLayer = "application/vnd.umoci.image.layer.chunked.v1+json"
+
+	// MediaTypeLayerChunk is the media-type of a single chunk of a layer blob
+	// referenced by a ChunkedLayer.
+	MediaTypeLayerChunk = "application/vnd.umoci.image.layer.chunk.v1"
+)
+
+// ChunkedLayer describes a layer blob which is stored as a sequence of chunk
+// blobs (each of the same size, except for the last one) rather than as a
+// single blob. This allows CDNs to cache uniformly-sized blobs. The layer blob
+// itself is not stored in the image, and is reassembled (and verified) from
+// the chunks when it is read.
+type ChunkedLayer struct {
+	// MediaType, Digest and Size describe the reassembled layer blob. They
+	// are intentionally not an ispec.Descriptor, since the blob they refer
+	// to is not present in the image.
+	MediaType string        `json:"mediaType"`
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+
+	// Chunks are the descriptors of the chunks of the layer blob, in order.
+	Chunks []ispec.Descriptor `json:"chunks"`
+}
+
+func init() {
+	// Registering the parser means that the chunks are found when walking
+	// the image (and so aren't garbage collected).
+	mediatype.RegisterParser(MediaTypeChunkedLayer, mediatype.CustomJSONParser(ChunkedLayer{}))
+}
+
+// OpenLayer returns a reader for the layer blob referenced by the given
+// manifest layer descriptor, as well as the descriptor of that blob. If the
+// layer is stored as a ChunkedLayer, the chunks are reassembled and the
+// returned descriptor describes the reassembled blob (with the annotations of
+// the given descriptor). Otherwise, the blob and descriptor are returned
+// as-is. The reader is verified against the returned descriptor, and so must
+// be read to EOF (and closed) to detect corruption.
+func OpenLayer(ctx context.Context, engine casext.Engine, desc ispec.Descriptor) (io.ReadCloser, ispec.Descriptor, error) {
+	blob, err := engine.FromDescriptor(ctx, desc)
+	if err != nil {
+		return nil, ispec.Descriptor{}, errors.Wrap(err, "get layer blob")
+	}
+	switch data := blob.Data.(type) {
+	case io.ReadCloser:
+		return data, desc, nil
+	case ChunkedLayer:
+		if len(data.Chunks) == 0 {
+			return nil, ispec.Descriptor{}, errors.Errorf("chunked layer %s has no chunks", desc.Digest)
+		}
+		layerDesc := ispec.Descriptor{
+			MediaType:   data.MediaType,
+			Digest:      data.Digest,
+			Size:        data.Size,
+			Annotations: desc.Annotations,
+		}
+		return &hardening.VerifiedReadCloser{
+			Reader: &chunkReader{
+				ctx:    ctx,
+				engine: engine,
+				chunks: data.Chunks,
+			},
+			ExpectedDigest: data.Digest,
+			ExpectedSize:   data.Size,
+		}, layerDesc, nil
+	}
+	blob.Close()
+	return nil, ispec.Descriptor{}, errors.Wrapf(ErrUnsupportedMediaType, "blob is not a layer: %s", desc.MediaType)
+}
+
+// chunkReader reads the concatenated contents of a list of chunk blobs. Each
+// chunk is verified against its descriptor, and is only opened once the
+// previous chunk has been read.
+type chunkReader struct {
+	ctx    context.Context
+	engine casext.Engine
+	chunks []ispec.Descriptor
+	cur    io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := r.engine.GetVerifiedBlob(r.ctx, r.chunks[0])
+			if err != nil {
+				return 0, errors.Wrapf(err, "get layer chunk %s", r.chunks[0].Digest)
+			}
+			r.cur, r.chunks = chunk, r.chunks[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		err = r.cur.Close()
+		r.cur = nil
+		if err != nil {
+			return n, errors.Wrap(err, "close layer chunk")
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
@@ -0,0 +1,110 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+	"sync"
+
+	zstd "github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ZstdDictionaryAnnotation is the layer descriptor annotation used to record
+// the digest of the zstd dictionary a layer was compressed with.
+const ZstdDictionaryAnnotation = "org.opencontainers.umoci.zstd.dictionary"
+
+// The zstd layer media-types are not yet defined by the image-spec version we
+// use, so we define them here (following the same naming as gzip).
+const (
+	mediaTypeImageLayerZstd                 = ispec.MediaTypeImageLayer + "+zstd"
+	mediaTypeImageLayerNonDistributableZstd = ispec.MediaTypeImageLayerNonDistributable + "+zstd"
+)
+
+func needsZstd(mediaType string) bool {
+	return mediaType == mediaTypeImageLayerZstd || mediaType == mediaTypeImageLayerNonDistributableZstd
+}
+
+// zstdReader returns a reader for the decompressed contents of the given zstd
+// layer. If the layer descriptor has a ZstdDictionaryAnnotation, the
+// dictionary with the matching digest is used (and it is an error if no such
+// dictionary is in dicts).
+func zstdReader(r io.Reader, desc ispec.Descriptor, dicts [][]byte) (io.ReadCloser, error) {
+	var opts []zstd.DOption
+	if dictDigest, ok := desc.Annotations[ZstdDictionaryAnnotation]; ok {
+		var dict []byte
+		for _, d := range dicts {
+			if digest.FromBytes(d).String() == dictDigest {
+				dict = d
+				break
+			}
+		}
+		if dict == nil {
+			return nil, errors.Wrapf(ErrMissingZstdDictionary, "layer %s: dictionary %s", desc.Digest, dictDigest)
+		}
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	dec, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd reader")
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// DecompressFunc is a decompressor that is registered for a given layer
+// media-type. It is given the raw layer blob and must return a reader for the
+// uncompressed tar archive. The returned reader is closed once the layer has
+// been extracted (the layer blob itself is closed separately).
+type DecompressFunc func(io.Reader) (io.ReadCloser, error)
+
+var (
+	decompressorsLock sync.RWMutex
+
+	// decompressors is a mapping of layer media-type to decompressor.
+	decompressors = map[string]DecompressFunc{}
+)
+
+// GetDecompressor returns the DecompressFunc that was previously registered
+// for the given media-type with RegisterDecompressor (or nil if no
+// decompressor was registered).
+func GetDecompressor(mediaType string) DecompressFunc {
+	decompressorsLock.RLock()
+	fn := decompressors[mediaType]
+	decompressorsLock.RUnlock()
+	return fn
+}
+
+// RegisterDecompressor registers a new DecompressFunc to be used when
+// unpacking layers of the given media-type. This allows for layers using
+// non-standard compression schemes (such as xz) to be unpacked. Registered
+// decompressors take precedence over umoci's built-in handling of the
+// standard OCI layer media-types. The DiffID of the layer is always verified
+// against the uncompressed stream.
+func RegisterDecompressor(mediaType string, fn DecompressFunc) {
+	decompressorsLock.Lock()
+	_, old := decompressors[mediaType]
+	decompressors[mediaType] = fn
+	decompressorsLock.Unlock()
+
+	// This should never happen, and is a programmer bug.
+	if old {
+		panic("RegisterDecompressor() called with already-registered media-type: " + mediaType)
+	}
+}
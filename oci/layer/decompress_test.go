@@ -0,0 +1,172 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"golang.org/x/net/context"
+)
+
+const testMediaTypeLayerXz = "application/vnd.example.image.layer.v1.tar+xz"
+
+// xzReader is the output of an "xz -d" process.
+type xzReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r xzReader) Close() error {
+	// #nosec G104
+	_ = r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
+
+// xzDecompress is a DecompressFunc which uses xz(1).
+func xzDecompress(r io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command("xz", "-d", "-c")
+	cmd.Stdin = r
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return xzReader{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+func init() {
+	RegisterDecompressor(testMediaTypeLayerXz, xzDecompress)
+}
+
+func TestUnpackRootfsCustomDecompressor(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not installed")
+	}
+	ctx := context.Background()
+
+	// Create an xz-compressed layer.
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	contents := []byte("compressed with xz\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	diffID := digest.FromBytes(layer.Bytes())
+
+	cmd := exec.Command("xz", "-z", "-c")
+	cmd.Stdin = bytes.NewReader(layer.Bytes())
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("xz failed: %v", err)
+	}
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsCustomDecompressor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engineExt.Close()
+
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{diffID},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: testMediaTypeLayerXz,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}},
+	}
+
+	fsEval := fseval.NewMemory()
+	if err := UnpackRootfs(ctx, engineExt, "/rootfs", manifest, &UnpackOptions{FsEval: fsEval}); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+
+	fh, err := fsEval.Open("/rootfs/file")
+	if err != nil {
+		t.Fatalf("unexpected open error: %+v", err)
+	}
+	defer fh.Close()
+	data, err := ioutil.ReadAll(fh)
+	if err != nil {
+		t.Fatalf("unexpected read error: %+v", err)
+	}
+	if !bytes.Equal(data, contents) {
+		t.Errorf("unexpected file contents: %q", string(data))
+	}
+}
+
+func TestRegisterDecompressorDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected duplicate registration to panic")
+		}
+	}()
+	RegisterDecompressor(testMediaTypeLayerXz, xzDecompress)
+}
@@ -0,0 +1,61 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Exposed errors. These are always wrapped with more context, so callers
+// should match them with errors.Is.
+var (
+	// ErrUnsupportedMediaType is returned when a blob which is being unpacked
+	// does not have a media type that can be unpacked (such as a layer with no
+	// registered decompressor, or a config which is not an image config).
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+	// ErrDiffIDMismatch is returned when the digest of an uncompressed layer
+	// does not match the corresponding DiffID in the image configuration,
+	// indicating that the layer (or the configuration) is corrupt.
+	ErrDiffIDMismatch = errors.New("layer diffid mismatch")
+
+	// ErrHistoryMismatch is returned when the number of non-empty history
+	// entries in the image configuration does not match the number of layers
+	// in the manifest.
+	ErrHistoryMismatch = errors.New("layer history mismatch")
+
+	// ErrMissingZstdDictionary is returned when a zstd layer was compressed
+	// with a dictionary (as recorded by ZstdDictionaryAnnotation) that was not
+	// provided in UnpackOptions.ZstdDictionaries.
+	ErrMissingZstdDictionary = errors.New("missing zstd dictionary")
+
+	// ErrNoChanges is returned by umoci.Repack when RepackOptions.FailOnNoChange
+	// is set and the bundle has no changes relative to the image it was
+	// unpacked from.
+	ErrNoChanges = errors.New("no changes to repack")
+
+	// ErrOwnerOutOfRange is returned when the host owner of an entry being
+	// extracted is outside of UnpackOptions.AllowedIDRange (and the
+	// IDRangeMode is RejectOutOfRangeIDs).
+	ErrOwnerOutOfRange = errors.New("owner outside of allowed id range")
+
+	// ErrInsufficientSpace is returned by UnpackRootfs when
+	// UnpackOptions.CheckFreeSpace is set and the filesystem being extracted
+	// to does not have enough space available for the image's layers.
+	ErrInsufficientSpace = errors.New("insufficient space")
+)
@@ -0,0 +1,191 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/cyphar/filepath-securejoin"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// paxFileFlags is the PAX record keyword used to store the inode flags of an
+// entry. The record value is a comma-separated list of flag names, in the
+// same format used by libarchive (and thus bsdtar).
+const paxFileFlags = "SCHILY.fflags"
+
+// fileFlagNames maps the names of the inode flags umoci understands to their
+// values. The names match those used by libarchive.
+var fileFlagNames = []struct {
+	name string
+	flag uint32
+}{
+	{"sappnd", system.InodeAppend},
+	{"schg", system.InodeImmutable},
+}
+
+// formatFileFlags converts a set of inode flags to the format used in
+// paxFileFlags. Flags umoci doesn't understand are ignored, and if none of the
+// flags are understood "" is returned.
+func formatFileFlags(flags uint32) string {
+	var names []string
+	for _, f := range fileFlagNames {
+		if flags&f.flag == f.flag {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// parseFileFlags is the inverse of formatFileFlags. Unknown flag names are
+// ignored (with a warning).
+func parseFileFlags(value string) uint32 {
+	var flags uint32
+next:
+	for _, name := range strings.Split(value, ",") {
+		if name == "" {
+			continue
+		}
+		for _, f := range fileFlagNames {
+			if f.name == name {
+				flags |= f.flag
+				continue next
+			}
+		}
+		log.Warnf("ignoring unknown inode flag %q", name)
+	}
+	return flags
+}
+
+// getFileFlags returns the paxFileFlags value for the given path, or "" if it
+// has no flags umoci understands. Only regular files and directories can have
+// inode flags, and filesystems which don't support inode flags are treated as
+// though the path has no flags.
+func getFileFlags(fsEval fseval.FsEval, path string, fi os.FileInfo) (string, error) {
+	if !fi.Mode().IsRegular() && !fi.IsDir() {
+		return "", nil
+	}
+	fh, err := fsEval.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "open file")
+	}
+	defer fh.Close()
+	flags, err := system.GetInodeFlags(fh)
+	if err != nil {
+		switch InnerErrno(err) {
+		case unix.ENOTTY, unix.ENOTSUP, unix.EINVAL:
+			return "", nil
+		}
+		return "", err
+	}
+	return formatFileFlags(flags), nil
+}
+
+// forgetFileFlags removes the given path (relative to the root) and all of
+// its descendants from the set of recorded inode flags.
+func forgetFileFlags(fileFlags map[string]string, path string) {
+	path = filepath.Join("/", path)
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for pth := range fileFlags {
+		if pth == path || strings.HasPrefix(pth, prefix) {
+			delete(fileFlags, pth)
+		}
+	}
+}
+
+// ApplyFileFlags sets the inode flags recorded in fileFlags (as filled by
+// UnpackOptions.FileFlags) on the paths inside the root filesystem at root.
+// This must be done after all of the layers have been extracted, since paths
+// which are immutable (or append-only) cannot be modified by later entries.
+// Setting these flags requires CAP_LINUX_IMMUTABLE, so this cannot be used in
+// rootless mode. Inode flags that are already set on the paths but are not
+// understood by umoci are preserved.
+func ApplyFileFlags(root string, fileFlags map[string]string) error {
+	// Apply the flags to the deepest paths first, so that an immutable
+	// directory doesn't stop us from modifying its children.
+	paths := make([]string, 0, len(fileFlags))
+	for pth := range fileFlags {
+		paths = append(paths, pth)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	for _, pth := range paths {
+		fullPath, err := securejoin.SecureJoinVFS(root, pth, fseval.Default)
+		if err != nil {
+			return errors.Wrapf(err, "resolve path %s", pth)
+		}
+		if err := applyFileFlags(fullPath, parseFileFlags(fileFlags[pth])); err != nil {
+			return errors.Wrapf(err, "apply inode flags to %s", pth)
+		}
+	}
+	return nil
+}
+
+// ClearFileFlags removes the inode flags recorded in fileFlags from the paths
+// inside the root filesystem at root, undoing ApplyFileFlags. This is needed
+// before a rootfs with immutable (or append-only) paths can be removed. Paths
+// which no longer exist are ignored.
+func ClearFileFlags(root string, fileFlags map[string]string) error {
+	// Clear the flags of the shallowest paths first, so that an immutable
+	// directory doesn't stop us from modifying its children.
+	paths := make([]string, 0, len(fileFlags))
+	for pth := range fileFlags {
+		paths = append(paths, pth)
+	}
+	sort.Strings(paths)
+
+	for _, pth := range paths {
+		fullPath, err := securejoin.SecureJoinVFS(root, pth, fseval.Default)
+		if err != nil {
+			return errors.Wrapf(err, "resolve path %s", pth)
+		}
+		if err := applyFileFlags(fullPath, 0); err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			}
+			return errors.Wrapf(err, "clear inode flags of %s", pth)
+		}
+	}
+	return nil
+}
+
+// applyFileFlags sets the given inode flags on the path, replacing any of the
+// inode flags umoci understands.
+func applyFileFlags(path string, flags uint32) error {
+	fh, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return errors.Wrap(err, "open file")
+	}
+	defer fh.Close()
+	oldFlags, err := system.GetInodeFlags(fh)
+	if err != nil {
+		return err
+	}
+	var known uint32
+	for _, f := range fileFlagNames {
+		known |= f.flag
+	}
+	return system.SetInodeFlags(fh, (oldFlags&^known)|flags)
+}
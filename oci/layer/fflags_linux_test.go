@@ -0,0 +1,173 @@
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/umoci/pkg/system"
+)
+
+// setInodeFlags sets the immutable and append-only inode flags of the given
+// path to the given value, preserving any other flags.
+func setInodeFlags(t *testing.T, path string, flags uint32) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	oldFlags, err := system.GetInodeFlags(fh)
+	if err != nil {
+		return err
+	}
+	return system.SetInodeFlags(fh, (oldFlags&^(system.InodeImmutable|system.InodeAppend))|flags)
+}
+
+// getInodeFlags returns the inode flags of the given path.
+func getInodeFlags(t *testing.T, path string) uint32 {
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	flags, err := system.GetInodeFlags(fh)
+	if err != nil {
+		t.Fatalf("unexpected error getting inode flags of %s: %+v", path, err)
+	}
+	return flags
+}
+
+// clearInodeFlags clears the immutable and append-only flags of every path
+// under root, so that it can be removed.
+func clearInodeFlags(t *testing.T, root string) {
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && (info.Mode().IsRegular() || info.IsDir()) {
+			_ = setInodeFlags(t, path, 0)
+		}
+		return nil
+	})
+}
+
+func TestFileFlagsRoundTrip(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("inode flags can only be set by root")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestFileFlagsRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer clearInodeFlags(t, dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"dir/child", "immutable", "appendonly", "plain"} {
+		if err := ioutil.WriteFile(filepath.Join(src, file), []byte("contents of "+file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := setInodeFlags(t, filepath.Join(src, "immutable"), system.InodeImmutable); err != nil {
+		t.Skipf("filesystem does not support inode flags: %v", err)
+	}
+	if err := setInodeFlags(t, filepath.Join(src, "appendonly"), system.InodeAppend); err != nil {
+		t.Fatal(err)
+	}
+	// An immutable directory must not stop its contents from being extracted.
+	if err := setInodeFlags(t, filepath.Join(src, "dir"), system.InodeImmutable); err != nil {
+		t.Fatal(err)
+	}
+
+	var layer bytes.Buffer
+	tg := newTarGenerator(&layer, MapOptions{})
+	for _, name := range []string{"appendonly", "dir", "dir/child", "immutable", "plain"} {
+		if err := tg.AddFile(name, filepath.Join(src, name)); err != nil {
+			t.Fatalf("unexpected error adding %s: %+v", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the generated PAX records.
+	expected := map[string]string{
+		"/appendonly": "sappnd",
+		"/dir":        "schg",
+		"/immutable":  "schg",
+	}
+	tr := tar.NewReader(bytes.NewReader(layer.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		name := filepath.Join("/", hdr.Name)
+		if got, want := hdr.PAXRecords[paxFileFlags], expected[name]; got != want {
+			t.Errorf("unexpected inode flags record for %s: expected %q got %q", name, want, got)
+		}
+	}
+
+	root := filepath.Join(dir, "root")
+	fileFlags := map[string]string{}
+	if err := UnpackLayer(root, bytes.NewReader(layer.Bytes()), &UnpackOptions{FileFlags: fileFlags}); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+	if len(fileFlags) != len(expected) {
+		t.Errorf("unexpected recorded inode flags: %v", fileFlags)
+	}
+	for pth, want := range expected {
+		if got := fileFlags[pth]; got != want {
+			t.Errorf("unexpected recorded inode flags for %s: expected %q got %q", pth, want, got)
+		}
+	}
+	// The flags are not applied until ApplyFileFlags is called.
+	if flags := getInodeFlags(t, filepath.Join(root, "immutable")); flags&system.InodeImmutable != 0 {
+		t.Errorf("inode flags applied before ApplyFileFlags")
+	}
+	if err := ApplyFileFlags(root, fileFlags); err != nil {
+		t.Fatalf("unexpected error applying inode flags: %+v", err)
+	}
+
+	for _, test := range []struct {
+		path  string
+		flags uint32
+	}{
+		{"appendonly", system.InodeAppend},
+		{"dir", system.InodeImmutable},
+		{"dir/child", 0},
+		{"immutable", system.InodeImmutable},
+		{"plain", 0},
+	} {
+		path := filepath.Join(root, test.path)
+		if got := getInodeFlags(t, path) & (system.InodeImmutable | system.InodeAppend); got != test.flags {
+			t.Errorf("unexpected inode flags for %s: expected %#x got %#x", test.path, test.flags, got)
+		}
+		if content, err := ioutil.ReadFile(path); err == nil && string(content) != "contents of "+test.path {
+			t.Errorf("unexpected contents of %s: %q", test.path, content)
+		}
+	}
+}
@@ -23,32 +23,173 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/pkg/mtreefilter"
 	"github.com/opencontainers/umoci/pkg/unpriv"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
 )
 
 // inodeDeltas is a wrapper around []mtree.InodeDelta that allows for sorting
-// the set of deltas by the pathname.
+// the set of deltas by the pathname (such that parent directories always come
+// before their contents, see pathLess).
 type inodeDeltas []mtree.InodeDelta
 
 func (ids inodeDeltas) Len() int           { return len(ids) }
-func (ids inodeDeltas) Less(i, j int) bool { return ids[i].Path() < ids[j].Path() }
+func (ids inodeDeltas) Less(i, j int) bool { return pathLess(ids[i].Path(), ids[j].Path()) }
 func (ids inodeDeltas) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
 
+// isMetadataOnlyDelta returns whether the given delta only modifies the
+// metadata of an inode (its mode, ownership, xattrs or timestamps) and not its
+// type or contents.
+func isMetadataOnlyDelta(delta mtree.InodeDelta) bool {
+	if delta.Type() != mtree.Modified {
+		return false
+	}
+	for _, keyDelta := range delta.Diff() {
+		switch name := keyDelta.Name(); name.Prefix() {
+		case "uid", "gid", "mode", "nlink", "time", "tar_time", "xattr":
+			// Metadata-only keywords.
+		default:
+			log.Debugf("generate layer: %s has non-metadata changes to %s", delta.Path(), name)
+			return false
+		}
+	}
+	return true
+}
+
+// orderDeltas reorders the (sorted) deltas according to the given ordering.
+// Deltas which must stay in lexicographic order (directories and whiteouts)
+// are always kept at the start, so that every directory still comes before
+// its contents.
+func orderDeltas(path string, deltas []mtree.InodeDelta, ordering EntryOrdering) ([]mtree.InodeDelta, error) {
+	if ordering != ExtensionOrdering {
+		return deltas, nil
+	}
+
+	var ordered, files []mtree.InodeDelta
+	for _, delta := range deltas {
+		if delta.Type() == mtree.Missing {
+			ordered = append(ordered, delta)
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(path, delta.Path()))
+		if err != nil {
+			return nil, errors.Wrap(err, "order entries")
+		}
+		if fi.IsDir() {
+			ordered = append(ordered, delta)
+		} else {
+			files = append(files, delta)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		iExt := strings.ToLower(filepath.Ext(files[i].Path()))
+		jExt := strings.ToLower(filepath.Ext(files[j].Path()))
+		return iExt < jExt
+	})
+	return append(ordered, files...), nil
+}
+
+// checkIDMapping verifies that NoIDMapping is not combined with any UID or GID
+// mappings, since the two contradict each other.
+func (opt RepackOptions) checkIDMapping() error {
+	if opt.NoIDMapping && (len(opt.MapOptions.UIDMappings) > 0 || len(opt.MapOptions.GIDMappings) > 0) {
+		return errors.New("NoIDMapping cannot be used with uid or gid mappings")
+	}
+	return nil
+}
+
+// referenceTimestamp returns the modification time of TimestampReference (or
+// nil if it is not set).
+func (opt RepackOptions) referenceTimestamp() (*time.Time, error) {
+	if opt.TimestampReference == "" {
+		return nil, nil
+	}
+	fi, err := os.Stat(opt.TimestampReference)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat timestamp reference")
+	}
+	mtime := fi.ModTime()
+	return &mtime, nil
+}
+
+// extraWhiteoutPaths returns the sorted (see pathLess), de-duplicated list of
+// opt.ExtraWhiteouts which are not already whited out by deltas. An error is
+// returned if any of the paths still exist in the root filesystem at path.
+func extraWhiteoutPaths(path string, deltas []mtree.InodeDelta, opt RepackOptions) ([]string, error) {
+	if len(opt.ExtraWhiteouts) == 0 {
+		return nil, nil
+	}
+	if opt.MetadataOnly {
+		return nil, errors.Errorf("metadata-only layer cannot contain extra whiteouts")
+	}
+
+	seen := map[string]struct{}{}
+	for _, delta := range deltas {
+		if delta.Type() == mtree.Missing {
+			seen[CleanPath("/"+delta.Path())] = struct{}{}
+		}
+	}
+
+	var names []string
+	for _, name := range opt.ExtraWhiteouts {
+		name = CleanPath("/" + name)
+		if name == "/" {
+			return nil, errors.Errorf("cannot add extra whiteout for root directory")
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		if _, err := os.Lstat(filepath.Join(path, name)); err == nil {
+			return nil, errors.Errorf("cannot add extra whiteout for %s: path still exists", name)
+		} else if !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "check extra whiteout %s", name)
+		}
+		names = append(names, name[1:])
+	}
+	sort.Slice(names, func(i, j int) bool { return pathLess(names[i], names[j]) })
+	return names, nil
+}
+
 // GenerateLayer creates a new OCI diff layer based on the mtree diff provided.
 // All of the mtree.Modified and mtree.Extra blobs are read relative to the
 // provided path (which should be the rootfs of the layer that was diffed). The
 // returned reader is for the *raw* tar data, it is the caller's responsibility
-// to gzip it.
+// to gzip it. Whiteouts for opt.ExtraWhiteouts are added in addition to those
+// for the mtree.Missing deltas.
 func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (io.ReadCloser, error) {
 	var packOptions RepackOptions
 	if opt != nil {
 		packOptions = *opt
 	}
 
+	if err := packOptions.checkIDMapping(); err != nil {
+		return nil, errors.Wrap(err, "generate layer")
+	}
+	excludeFilter, err := mtreefilter.ExcludeFilter(packOptions.Excludes)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate layer")
+	}
+	extraWhiteouts, err := extraWhiteoutPaths(path, deltas, packOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate layer")
+	}
+	timestamp, err := packOptions.referenceTimestamp()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate layer")
+	}
+	if ordering := packOptions.CompressionOrdering; ordering != LexicalOrdering && ordering != ExtensionOrdering {
+		return nil, errors.Errorf("generate layer: unknown entry ordering %d", ordering)
+	}
+
 	reader, writer := io.Pipe()
 
 	go func() (Err error) {
@@ -62,25 +203,52 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 		// to emulate a proper tar generator. Luckily there aren't that many
 		// things to emulate (and we can do them all in tar.go).
 		tg := newTarGenerator(writer, packOptions.MapOptions)
+		tg.timestamp = timestamp
+		tg.preserveBirthtime = packOptions.PreserveBirthtime
+		tg.noIDMapping = packOptions.NoIDMapping
 
 		// Sort the delta paths.
 		// FIXME: We need to add whiteouts first, otherwise we might end up
 		//        doing something silly like deleting a file which we actually
 		//        meant to modify.
 		sort.Sort(inodeDeltas(deltas))
+		deltas, err := orderDeltas(path, deltas, packOptions.CompressionOrdering)
+		if err != nil {
+			return err
+		}
 
 		for _, delta := range deltas {
 			name := delta.Path()
 			fullPath := filepath.Join(path, name)
 
+			// Forced whiteouts are merged into the sorted deltas, so that
+			// they also come after their parent directory.
+			for len(extraWhiteouts) > 0 && pathLess(extraWhiteouts[0], name) {
+				if err := tg.AddWhiteout(extraWhiteouts[0]); err != nil {
+					return errors.Wrap(err, "generate extra whiteout")
+				}
+				extraWhiteouts = extraWhiteouts[1:]
+			}
+
+			if !excludeFilter(name) {
+				continue
+			}
+
 			// XXX: It's possible that if we unlink a hardlink, we're going to
 			//      AddFile() for no reason. Maybe we should drop nlink= from
 			//      the set of keywords we care about?
 
+			if packOptions.MetadataOnly && !isMetadataOnlyDelta(delta) {
+				return errors.Errorf("metadata-only layer: %s has non-metadata changes (%s)", name, delta.Type())
+			}
+
 			switch delta.Type() {
 			case mtree.Modified, mtree.Extra:
+				// Only overlayfs whiteouts are translated -- everything else
+				// (including empty directories) must still be included in the
+				// layer.
 				if packOptions.TranslateOverlayWhiteouts {
-					fi, err := os.Stat(fullPath)
+					fi, err := os.Lstat(fullPath)
 					if err != nil {
 						return errors.Wrapf(err, "couldn't determine overlay whiteout for %s", fullPath)
 					}
@@ -90,11 +258,11 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 						return err
 					}
 					if whiteout {
-						if err := tg.AddWhiteout(fullPath); err != nil {
+						if err := tg.AddWhiteout(name); err != nil {
 							return errors.Wrap(err, "generate whiteout from overlayfs")
 						}
+						continue
 					}
-					continue
 				}
 				if err := tg.AddFile(name, fullPath); err != nil {
 					log.Warnf("generate layer: could not add file '%s': %s", name, err)
@@ -108,6 +276,12 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 			}
 		}
 
+		for _, name := range extraWhiteouts {
+			if err := tg.AddWhiteout(name); err != nil {
+				return errors.Wrap(err, "generate extra whiteout")
+			}
+		}
+
 		if err := tg.tw.Close(); err != nil {
 			log.Warnf("generate layer: could not close tar.Writer: %s", err)
 			return errors.Wrap(err, "close tar writer")
@@ -138,19 +312,37 @@ func GenerateInsertLayer(root string, target string, opaque bool, opt *RepackOpt
 			_ = writer.CloseWithError(errors.Wrap(Err, "generate layer"))
 		}()
 
+		if err := packOptions.checkIDMapping(); err != nil {
+			return err
+		}
+		excludeFilter, err := mtreefilter.ExcludeFilter(packOptions.Excludes)
+		if err != nil {
+			return err
+		}
+		timestamp, err := packOptions.referenceTimestamp()
+		if err != nil {
+			return err
+		}
+
 		tg := newTarGenerator(writer, packOptions.MapOptions)
+		tg.timestamp = timestamp
+		tg.preserveBirthtime = packOptions.PreserveBirthtime
+		tg.noIDMapping = packOptions.NoIDMapping
 
-		if opaque {
-			if err := tg.AddOpaqueWhiteout(target); err != nil {
-				return err
-			}
-		}
 		if root == "" {
+			if opaque {
+				if err := tg.AddOpaqueWhiteout(target); err != nil {
+					return err
+				}
+			}
 			return tg.AddWhiteout(target)
 		}
-		return unpriv.Walk(root, func(curPath string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
+		addPath := func(curPath string, info os.FileInfo) error {
+			// Exclusions are relative to the directory being inserted. We
+			// can't skip excluded directories entirely, because an exception
+			// pattern might re-include some of their contents.
+			if !excludeFilter(curPath[len(root):]) {
+				return nil
 			}
 
 			pathInTar := path.Join(target, curPath[len(root):])
@@ -164,7 +356,39 @@ func GenerateInsertLayer(root string, target string, opaque bool, opt *RepackOpt
 			}
 
 			return tg.AddFile(pathInTar, curPath)
+		}
+		return unpriv.Walk(root, func(curPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := addPath(curPath, info); err != nil {
+				return err
+			}
+			// The opaque whiteout is added right after the entry for target
+			// itself, so that the directory entry comes before its contents.
+			if opaque && curPath == root {
+				return tg.AddOpaqueWhiteout(target)
+			}
+			return nil
 		})
 	}()
 	return reader
 }
+
+// InsertLayerDiffID returns the DiffID of the layer which GenerateInsertLayer
+// would generate with the same arguments, without compressing or storing the
+// layer. Build systems can use it as a cheap cache key to decide whether a
+// previously built layer can be reused. The DiffID is the digest of the
+// uncompressed layer, so it does not depend on the compression used. Note
+// that unless opt.TimestampReference is set, the DiffID depends on the
+// timestamps of the files in root.
+func InsertLayerDiffID(root string, target string, opaque bool, opt *RepackOptions) (digest.Digest, error) {
+	reader := GenerateInsertLayer(root, target, opaque, opt)
+	defer reader.Close()
+
+	digester := cas.BlobAlgorithm.Digester()
+	if _, err := io.Copy(digester.Hash(), reader); err != nil {
+		return "", errors.Wrap(err, "compute insert layer diffid")
+	}
+	return digester.Digest(), nil
+}
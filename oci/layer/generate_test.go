@@ -20,12 +20,20 @@ package layer
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/vbatts/go-mtree"
 )
 
@@ -270,3 +278,591 @@ func TestGenerateWrongRootError(t *testing.T) {
 		}
 	}
 }
+
+// diffDir walks dir before and after calling modify, and returns the deltas.
+func diffDir(t *testing.T, dir string, modify func()) []mtree.InodeDelta {
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify()
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return diffs
+}
+
+func TestGenerateMetadataOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateMetadataOnly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "some"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "some", "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "some", "unchanged"), []byte("unchanged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := diffDir(t, dir, func() {
+		if err := os.Chmod(filepath.Join(dir, "some", "file"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{MetadataOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name != filepath.Join("some", "file") {
+			continue
+		}
+		if hdr.Mode&0777 != 0700 {
+			t.Errorf("metadata-only entry has wrong mode: expected 0700, got 0%o", hdr.Mode&0777)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Errorf("unexpected error reading entry contents: %+v", err)
+		}
+		if !bytes.Equal(contents, []byte("contents")) {
+			t.Errorf("metadata-only entry has wrong contents: %q", contents)
+		}
+	}
+	if len(names) != 1 || names[0] != filepath.Join("some", "file") {
+		t.Errorf("expected only the chmod'd file in the layer, got %v", names)
+	}
+}
+
+func TestGenerateMetadataOnlyContentChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateMetadataOnlyContentChange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := diffDir(t, dir, func() {
+		if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("new contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{MetadataOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Errorf("expected metadata-only layer generation to fail with content changes")
+	}
+}
+
+// Directories (even empty ones) and other regular entries must still be
+// included in the layer when translating overlayfs whiteouts.
+func TestGenerateEmptyDirectoryOverlayWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateEmptyDirectoryOverlayWhiteouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "some"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := diffDir(t, dir, func() {
+		if err := os.MkdirAll(filepath.Join(dir, "some", "empty", "dir"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, translate := range []bool{false, true} {
+		reader, err := GenerateLayer(dir, diffs, &RepackOptions{TranslateOverlayWhiteouts: translate})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries := map[string]byte{}
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected error reading layer: %+v", err)
+			}
+			entries[hdr.Name] = hdr.Typeflag
+		}
+		reader.Close()
+
+		for name, typeflag := range map[string]byte{
+			"some/empty/":     tar.TypeDir,
+			"some/empty/dir/": tar.TypeDir,
+			"file":            tar.TypeReg,
+		} {
+			if got, ok := entries[name]; !ok {
+				t.Errorf("translate=%v: entry %s missing from layer: got %v", translate, name, entries)
+			} else if got != typeflag {
+				t.Errorf("translate=%v: entry %s has wrong type: expected %c, got %c", translate, name, typeflag, got)
+			}
+		}
+	}
+}
+
+// tarEntryNames returns the names of all entries in the given tar stream.
+func tarEntryNames(t *testing.T, reader io.Reader) []string {
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func TestGenerateExcludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateExcludes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a tree with some build artifacts and secrets.
+	for _, path := range []string{"src", "build/obj", "logs"} {
+		if err := os.MkdirAll(filepath.Join(dir, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"src/main.c", "src/main.o", "build/obj/a.o", ".env", "logs/keep", "logs/debug"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludes := []string{"build", "**/*.o", ".env", "logs", "!logs/keep"}
+	// The root directory itself was also modified.
+	expected := []string{".", "logs/keep", "src/", "src/main.c"}
+
+	// GenerateLayer (used by repack).
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{Excludes: excludes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := tarEntryNames(t, reader)
+	reader.Close()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("GenerateLayer: unexpected entries: expected %v, got %v", expected, got)
+	}
+
+	// GenerateInsertLayer (used by insert), relative to the inserted tree.
+	reader = GenerateInsertLayer(dir, "/opt/app", false, &RepackOptions{Excludes: excludes})
+	got = tarEntryNames(t, reader)
+	reader.Close()
+	sort.Strings(got)
+	expected = []string{"opt/app/", "opt/app/logs/keep", "opt/app/src/", "opt/app/src/main.c"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("GenerateInsertLayer: unexpected entries: expected %v, got %v", expected, got)
+	}
+
+	// Invalid patterns are rejected up-front.
+	if _, err := GenerateLayer(dir, diffs, &RepackOptions{Excludes: []string{"[invalid"}}); err == nil {
+		t.Errorf("GenerateLayer: expected error with invalid exclude pattern")
+	}
+}
+
+func TestGenerateTimestampReference(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateTimestampReference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reference := filepath.Join(dir, "VERSION")
+	if err := ioutil.WriteFile(reference, []byte("1.0.0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(reference, timestamp, timestamp); err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "some", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "some", "deleted"), []byte("deleted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	initDh, err := mtree.Walk(rootfs, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(rootfs, "some", "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "some", "dir", "file"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(rootfs, "some", "link")); err != nil {
+		t.Fatal(err)
+	}
+	postDh, err := mtree.Walk(rootfs, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTimestamps := func(name string, reader io.ReadCloser) {
+		defer reader.Close()
+
+		var n int
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error reading layer: %+v", name, err)
+			}
+			n++
+			if !hdr.ModTime.Equal(timestamp) {
+				t.Errorf("%s: entry %s has mtime %v, expected %v", name, hdr.Name, hdr.ModTime, timestamp)
+			}
+			if !hdr.AccessTime.IsZero() && !hdr.AccessTime.Equal(timestamp) {
+				t.Errorf("%s: entry %s has atime %v, expected %v", name, hdr.Name, hdr.AccessTime, timestamp)
+			}
+		}
+		if n == 0 {
+			t.Errorf("%s: generated layer was empty", name)
+		}
+	}
+
+	opt := &RepackOptions{TimestampReference: reference}
+	reader, err := GenerateLayer(rootfs, diffs, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTimestamps("GenerateLayer", reader)
+	checkTimestamps("GenerateInsertLayer", GenerateInsertLayer(rootfs, "/", false, opt))
+
+	if _, err := GenerateLayer(rootfs, diffs, &RepackOptions{TimestampReference: filepath.Join(dir, "nonexistent")}); err == nil {
+		t.Errorf("expected error with missing timestamp reference")
+	}
+}
+
+// checkParentOrder verifies that every entry in the given list of tar entry
+// names comes after the entry for its parent directory (if there is one), and
+// that the contents of each directory are contiguous.
+func checkParentOrder(t *testing.T, names []string) {
+	seen := map[string]int{}
+	for idx, name := range names {
+		name = CleanPath("/" + name)
+		seen[name] = idx
+		for parent := filepath.Dir(name); parent != "/"; parent = filepath.Dir(parent) {
+			pidx, ok := seen[parent]
+			if !ok {
+				continue
+			}
+			// Every entry between the parent and us must also be inside the
+			// parent directory.
+			for _, between := range names[pidx+1 : idx] {
+				if !strings.HasPrefix(CleanPath("/"+between), parent+"/") {
+					t.Errorf("contents of %s are not contiguous: %s is between %s and %s", parent, between, parent, name)
+				}
+			}
+		}
+	}
+	for _, name := range names {
+		name = CleanPath("/" + name)
+		for parent := filepath.Dir(name); parent != "/"; parent = filepath.Dir(parent) {
+			if pidx, ok := seen[parent]; ok && pidx > seen[name] {
+				t.Errorf("entry %s comes before its parent directory %s", name, parent)
+			}
+		}
+	}
+}
+
+func TestGenerateParentOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateParentOrder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names which sort between a directory and its contents (or before the
+	// root) when compared as plain strings.
+	for _, path := range []string{"a/b/c", "a-b", "a.d", "-x/y"} {
+		if err := os.MkdirAll(filepath.Join(dir, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"a/file", "a/b/c/file", "a-b/file", "-x/y/file", "!top", "a.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+		ExtraWhiteouts: []string{"a/b/gone", "a-b/gone", "a/zz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := tarEntryNames(t, reader)
+	reader.Close()
+
+	expected := []string{
+		".",
+		"!top",
+		"-x/", "-x/y/", "-x/y/file",
+		"a/", "a/b/", "a/b/c/", "a/b/c/file", "a/b/.wh.gone", "a/file", "a/.wh.zz",
+		"a-b/", "a-b/file", "a-b/.wh.gone",
+		"a.d/",
+		"a.txt",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("GenerateLayer: unexpected entry order: expected %v, got %v", expected, got)
+	}
+	checkParentOrder(t, got)
+
+	// GenerateInsertLayer must put the opaque whiteout after the target.
+	reader = GenerateInsertLayer(dir, "/opt/app", true, nil)
+	got = tarEntryNames(t, reader)
+	reader.Close()
+	if len(got) < 2 || got[0] != "opt/app/" || got[1] != "opt/app/.wh..wh..opq" {
+		t.Errorf("GenerateInsertLayer: unexpected opaque whiteout order: %v", got)
+	}
+	checkParentOrder(t, got)
+}
+
+func TestGenerateNoIDMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateNoIDMapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only root can give files arbitrary owners, otherwise the best we can do
+	// is to use our own ids (which are still translated in rootless mode).
+	owners := map[string][2]int{
+		"a": {os.Getuid(), os.Getgid()},
+		"b": {os.Getuid(), os.Getgid()},
+	}
+	if os.Geteuid() == 0 {
+		owners = map[string][2]int{
+			"a": {1234, 5678},
+			"b": {100000, 0},
+		}
+	}
+
+	diffs := diffDir(t, dir, func() {
+		for name, owner := range owners {
+			path := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if os.Geteuid() == 0 {
+				if err := os.Lchown(path, owner[0], owner[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	})
+
+	for _, rootless := range []bool{false, true} {
+		reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+			MapOptions:  MapOptions{Rootless: rootless},
+			NoIDMapping: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen := 0
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected error reading layer: %+v", err)
+			}
+			owner, ok := owners[hdr.Name]
+			if !ok {
+				continue
+			}
+			seen++
+			if hdr.Uid != owner[0] || hdr.Gid != owner[1] {
+				t.Errorf("rootless=%v: %s has owner %d:%d, expected %d:%d", rootless, hdr.Name, hdr.Uid, hdr.Gid, owner[0], owner[1])
+			}
+		}
+		reader.Close()
+		if seen != len(owners) {
+			t.Errorf("rootless=%v: expected %d entries in layer, got %d", rootless, len(owners), seen)
+		}
+	}
+
+	// NoIDMapping contradicts any uid or gid mappings.
+	if _, err := GenerateLayer(dir, diffs, &RepackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		},
+		NoIDMapping: true,
+	}); err == nil {
+		t.Errorf("expected error using NoIDMapping with uid mappings")
+	}
+}
+
+func TestGenerateCompressionOrdering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateCompressionOrdering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each directory contains an incompressible blob (larger than the gzip
+	// window) and a copy of the same text file. With the default ordering the
+	// blobs separate the copies of the text file, so only grouping them lets
+	// the compressor deduplicate them.
+	text := make([]byte, 8*1024)
+	if _, err := rand.Read(text); err != nil {
+		t.Fatal(err)
+	}
+	diffs := diffDir(t, dir, func() {
+		for idx := 0; idx < 8; idx++ {
+			sub := filepath.Join(dir, fmt.Sprintf("dir%d", idx))
+			if err := os.Mkdir(sub, 0755); err != nil {
+				t.Fatal(err)
+			}
+			blob := make([]byte, 64*1024)
+			if _, err := rand.Read(blob); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(sub, "data.bin"), blob, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(sub, "notes.txt"), text, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	compressedSize := func(ordering EntryOrdering) (int, []string) {
+		reader, err := GenerateLayer(dir, diffs, &RepackOptions{CompressionOrdering: ordering})
+		if err != nil {
+			t.Fatalf("unexpected error generating layer: %+v", err)
+		}
+		defer reader.Close()
+		layer, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+
+		var compressed bytes.Buffer
+		gzw := gzip.NewWriter(&compressed)
+		if _, err := gzw.Write(layer); err != nil {
+			t.Fatal(err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return compressed.Len(), tarEntryNames(t, bytes.NewReader(layer))
+	}
+
+	lexicalSize, lexicalNames := compressedSize(LexicalOrdering)
+	groupedSize, groupedNames := compressedSize(ExtensionOrdering)
+	if groupedSize >= lexicalSize {
+		t.Errorf("grouped layer is not smaller: %d bytes (grouped) >= %d bytes (lexical)", groupedSize, lexicalSize)
+	}
+
+	// The same entries must be present, with every directory before its
+	// contents.
+	if len(groupedNames) != len(lexicalNames) {
+		t.Errorf("grouped layer has %d entries, expected %d", len(groupedNames), len(lexicalNames))
+	}
+	seen := map[string]bool{}
+	for _, name := range groupedNames {
+		name = CleanPath("/" + name)
+		if parent := filepath.Dir(name); parent != "/" && !seen[parent] {
+			t.Errorf("entry %s comes before its parent directory %s", name, parent)
+		}
+		seen[name] = true
+	}
+	for idx := 0; idx < 8; idx++ {
+		if name := groupedNames[len(groupedNames)-1-idx]; !strings.HasSuffix(name, ".txt") {
+			t.Errorf("expected .txt files to be grouped at the end, got %s", name)
+		}
+	}
+
+	if _, err := GenerateLayer(dir, diffs, &RepackOptions{CompressionOrdering: EntryOrdering(1234)}); err == nil {
+		t.Errorf("expected error with unknown entry ordering")
+	}
+}
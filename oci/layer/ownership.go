@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Ownership is the owner of an extracted path, both as it was described in
+// the layer (the container IDs) and as it was actually written to the host.
+// They differ if ID mappings are in use, or in rootless mode where every path
+// is owned by the unpacking user.
+type Ownership struct {
+	ContainerUID int `json:"container_uid"`
+	ContainerGID int `json:"container_gid"`
+	HostUID      int `json:"host_uid"`
+	HostGID      int `json:"host_gid"`
+}
+
+// OwnershipReportEntry is a single entry of an OwnershipReport.
+type OwnershipReportEntry struct {
+	Ownership
+
+	// Path is the absolute path of the entry within the rootfs.
+	Path string `json:"path"`
+
+	// Recursive indicates that every extracted path below Path has the same
+	// ownership as Path itself (and so is not listed separately).
+	Recursive bool `json:"recursive,omitempty"`
+}
+
+// OwnershipReport records the intended (container) and actual (host) owner of
+// every path extracted by a TarExtractor, so that ownership which could not
+// be applied (such as when unpacking rootless) can be fixed up later by a
+// privileged process. Paths which are removed by later entries or whiteouts
+// are dropped from the report. The zero value is an empty report.
+type OwnershipReport struct {
+	paths map[string]Ownership
+}
+
+// record sets the ownership of the given path (relative to the rootfs).
+func (r *OwnershipReport) record(path string, owner Ownership) {
+	if r.paths == nil {
+		r.paths = make(map[string]Ownership)
+	}
+	r.paths[filepath.Join("/", path)] = owner
+}
+
+// forget removes the given path (relative to the rootfs) and all of its
+// children from the report.
+func (r *OwnershipReport) forget(path string) {
+	path = filepath.Join("/", path)
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for pth := range r.paths {
+		if pth == path || strings.HasPrefix(pth, prefix) {
+			delete(r.paths, pth)
+		}
+	}
+}
+
+// Entries returns the contents of the report in a compact form, sorted by
+// path. If a path and every path below it have the same ownership, only a
+// single Recursive entry is returned for the whole subtree.
+func (r *OwnershipReport) Entries() []OwnershipReportEntry {
+	paths := make([]string, 0, len(r.paths))
+	for pth := range r.paths {
+		paths = append(paths, pth)
+	}
+	sort.Strings(paths)
+
+	// Figure out which paths have descendants, and which of those have a
+	// descendant with a different owner.
+	hasChildren := map[string]bool{}
+	mixed := map[string]bool{}
+	for _, pth := range paths {
+		owner := r.paths[pth]
+		for anc := filepath.Dir(pth); ; anc = filepath.Dir(anc) {
+			if ancOwner, ok := r.paths[anc]; ok {
+				hasChildren[anc] = true
+				if ancOwner != owner {
+					mixed[anc] = true
+				}
+			}
+			if anc == "/" {
+				break
+			}
+		}
+	}
+
+	var entries []OwnershipReportEntry
+next:
+	for _, pth := range paths {
+		// Skip paths covered by a recursive entry for an ancestor.
+		if pth != "/" {
+			for anc := filepath.Dir(pth); ; anc = filepath.Dir(anc) {
+				if _, ok := r.paths[anc]; ok && !mixed[anc] {
+					continue next
+				}
+				if anc == "/" {
+					break
+				}
+			}
+		}
+		entries = append(entries, OwnershipReportEntry{
+			Ownership: r.paths[pth],
+			Path:      pth,
+			Recursive: hasChildren[pth] && !mixed[pth],
+		})
+	}
+	return entries
+}
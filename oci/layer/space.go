@@ -0,0 +1,90 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// statfsAvailable returns the number of bytes available to unprivileged users
+// on the filesystem containing path. It is a variable so that the tests can
+// simulate a full filesystem.
+var statfsAvailable = func(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// requiredSpace returns an estimate of the number of bytes needed to extract
+// the layers of the manifest selected by startFrom and onlyDiffIDs (as in
+// UnpackRootfs). Images do not record the uncompressed size of their layers,
+// so the size of each layer blob is used (for a ChunkedLayer, the size of the
+// reassembled blob). For compressed layers this is a lower bound on the space
+// actually required.
+func requiredSpace(ctx context.Context, engine casext.Engine, manifest ispec.Manifest, diffIDs []digest.Digest, startFrom ispec.Descriptor, onlyDiffIDs map[digest.Digest]struct{}) (uint64, error) {
+	var required uint64
+	found := false
+	for idx, layerDescriptor := range manifest.Layers {
+		if !found && startFrom.MediaType != "" && layerDescriptor.Digest.String() != startFrom.Digest.String() {
+			continue
+		}
+		found = true
+		if onlyDiffIDs != nil {
+			if _, ok := onlyDiffIDs[diffIDs[idx]]; !ok {
+				continue
+			}
+		}
+		size := layerDescriptor.Size
+		if layerDescriptor.MediaType == MediaTypeChunkedLayer {
+			blob, err := engine.FromDescriptor(ctx, layerDescriptor)
+			if err != nil {
+				return 0, errors.Wrapf(err, "get chunked layer %s", layerDescriptor.Digest)
+			}
+			blob.Close()
+			chunked, ok := blob.Data.(ChunkedLayer)
+			if !ok {
+				return 0, errors.Errorf("chunked layer %s has unexpected type %T", layerDescriptor.Digest, blob.Data)
+			}
+			size = chunked.Size
+		}
+		if size > 0 {
+			required += uint64(size)
+		}
+	}
+	return required, nil
+}
+
+// checkFreeSpace returns an error wrapping ErrInsufficientSpace if the
+// filesystem containing path has fewer than required bytes available.
+func checkFreeSpace(path string, required uint64) error {
+	available, err := statfsAvailable(path)
+	if err != nil {
+		return errors.Wrap(err, "statfs")
+	}
+	if available < required {
+		return errors.Wrapf(ErrInsufficientSpace, "need at least %d bytes but only %d bytes are available for %s", required, available, path)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+func TestUnpackRootfsCheckFreeSpace(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer configBlob.Close()
+	diffIDs := configBlob.Data.(ispec.Image).RootFS.DiffIDs
+
+	total := uint64(manifest.Layers[0].Size + manifest.Layers[1].Size)
+	top := uint64(manifest.Layers[1].Size)
+
+	var available uint64
+	oldStatfs := statfsAvailable
+	statfsAvailable = func(string) (uint64, error) { return available, nil }
+	defer func() { statfsAvailable = oldStatfs }()
+
+	for _, test := range []struct {
+		name        string
+		available   uint64
+		onlyDiffIDs []digest.Digest
+		fail        bool
+	}{
+		{"Full", 0, nil, true},
+		{"TooSmall", total - 1, nil, true},
+		{"Exact", total, nil, false},
+		{"OnlyDiffIDsTooSmall", top - 1, []digest.Digest{diffIDs[1]}, true},
+		{"OnlyDiffIDs", top, []digest.Digest{diffIDs[1]}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bundle, err := ioutil.TempDir("", "umoci-TestUnpackRootfsCheckFreeSpace")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(bundle)
+			rootfs := filepath.Join(bundle, "rootfs")
+
+			available = test.available
+			err = UnpackRootfs(ctx, engineExt, rootfs, manifest, &UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+						{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+					},
+					GIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+						{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+					},
+					Rootless: os.Geteuid() != 0,
+				},
+				OnlyDiffIDs:    test.onlyDiffIDs,
+				CheckFreeSpace: true,
+			})
+			if !test.fail {
+				if err != nil {
+					t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInsufficientSpace) {
+				t.Fatalf("expected UnpackRootfs to fail with ErrInsufficientSpace: %+v", err)
+			}
+			if _, err := os.Lstat(rootfs); !os.IsNotExist(err) {
+				t.Errorf("expected rootfs to be removed after failed space check: %v", err)
+			}
+		})
+	}
+}
+
+func TestStatfsAvailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestStatfsAvailable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := statfsAvailable(dir); err != nil {
+		t.Errorf("unexpected statfs error: %+v", err)
+	}
+	if _, err := statfsAvailable(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected statfs of missing path to fail")
+	}
+	// Any real filesystem has more than zero bytes available.
+	if err := checkFreeSpace(dir, 0); err != nil {
+		t.Errorf("unexpected checkFreeSpace error: %+v", err)
+	}
+}
+
+func TestRequiredSpaceChunked(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	// Store the top layer as a single chunk, so the manifest refers to the
+	// (much smaller) ChunkedLayer blob.
+	top := manifest.Layers[1]
+	chunkedDigest, chunkedSize, err := engineExt.PutBlobJSON(ctx, ChunkedLayer{
+		MediaType: top.MediaType,
+		Digest:    top.Digest,
+		Size:      top.Size,
+		Chunks: []ispec.Descriptor{{
+			MediaType: MediaTypeLayerChunk,
+			Digest:    top.Digest,
+			Size:      top.Size,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Layers[1] = ispec.Descriptor{
+		MediaType: MediaTypeChunkedLayer,
+		Digest:    chunkedDigest,
+		Size:      chunkedSize,
+	}
+
+	required, err := requiredSpace(ctx, engineExt, manifest, nil, ispec.Descriptor{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected requiredSpace error: %+v", err)
+	}
+	if expected := uint64(manifest.Layers[0].Size + top.Size); required != expected {
+		t.Errorf("unexpected required space for chunked layer: expected %d got %d", expected, required)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/pkg/errors"
+)
+
+// SymlinkRewriteMode describes how RewriteSymlinks rewrites symlink targets.
+type SymlinkRewriteMode int
+
+const (
+	// RelativeSymlinks rewrites absolute symlink targets (which are relative
+	// to the root filesystem) to be relative to the directory containing the
+	// symlink. This makes the root filesystem relocatable, since the
+	// symlinks can be resolved correctly outside of a container.
+	RelativeSymlinks SymlinkRewriteMode = iota
+
+	// AbsoluteSymlinks rewrites relative symlink targets to be absolute
+	// (relative to the root filesystem). This is the inverse of
+	// RelativeSymlinks.
+	AbsoluteSymlinks
+)
+
+// cleanSymlinkTarget returns whether the given symlink target can be
+// rewritten lexically. This is not the case if a ".." component follows a
+// regular component, since the regular component might be a symlink (and so
+// resolving ".." against it would not be equivalent to removing it).
+func cleanSymlinkTarget(target string) bool {
+	leading := true
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if !leading {
+				return false
+			}
+		default:
+			leading = false
+		}
+	}
+	return true
+}
+
+// rewriteSymlinkTarget returns the rewritten target for a symlink (with the
+// given target) located in linkDir, a directory relative to the root
+// filesystem. If the symlink should not be rewritten, ok is false.
+func rewriteSymlinkTarget(linkDir, target string, mode SymlinkRewriteMode) (_ string, ok bool) {
+	if !cleanSymlinkTarget(target) {
+		return "", false
+	}
+	switch mode {
+	case RelativeSymlinks:
+		if !filepath.IsAbs(target) {
+			return "", false
+		}
+		// Absolute targets are always inside the root filesystem (any
+		// leading ".." components are dropped by Clean, just as they are
+		// when the target is resolved inside a container).
+		newTarget, err := filepath.Rel(filepath.Join("/", linkDir), filepath.Clean(target))
+		if err != nil {
+			return "", false
+		}
+		return newTarget, true
+	case AbsoluteSymlinks:
+		if filepath.IsAbs(target) {
+			return "", false
+		}
+		resolved := filepath.Join(linkDir, target)
+		if resolved == ".." || strings.HasPrefix(resolved, "../") {
+			// The target is outside of the root filesystem.
+			return "", false
+		}
+		return filepath.Join("/", resolved), true
+	}
+	return "", false
+}
+
+// RewriteSymlinks rewrites the targets of the symlinks inside the root
+// filesystem at root, as described by mode. Only symlinks whose targets are
+// inside the root filesystem, and which can be rewritten without resolving
+// any other symlinks, are modified -- all other symlinks are left as-is. The
+// ownership and timestamps of the symlinks (and their parent directories) are
+// preserved. No symlinks are followed while rewriting. opt may be nil.
+func RewriteSymlinks(root string, mode SymlinkRewriteMode, opt *MapOptions) error {
+	var mapOptions MapOptions
+	if opt != nil {
+		mapOptions = *opt
+	}
+	fsEval := fseval.Default
+	if mapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	return fsEval.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return errors.Wrap(err, "get relative path")
+		}
+		target, err := fsEval.Readlink(path)
+		if err != nil {
+			return errors.Wrap(err, "read symlink")
+		}
+		newTarget, ok := rewriteSymlinkTarget(filepath.Dir(relPath), target, mode)
+		if !ok || newTarget == target {
+			return nil
+		}
+		log.Debugf("rewrite symlink %s: %s -> %s", relPath, target, newTarget)
+
+		// Save the metadata of the symlink and its parent directory, so it
+		// can be restored after the symlink is re-created.
+		linkHdr, err := lstatHeader(fsEval, path)
+		if err != nil {
+			return errors.Wrap(err, "lstat symlink")
+		}
+		parent := filepath.Dir(path)
+		parentHdr, err := lstatHeader(fsEval, parent)
+		if err != nil {
+			return errors.Wrap(err, "lstat symlink parent")
+		}
+
+		if err := fsEval.RemoveAll(path); err != nil {
+			return errors.Wrap(err, "remove old symlink")
+		}
+		if err := fsEval.Symlink(newTarget, path); err != nil {
+			return errors.Wrap(err, "create new symlink")
+		}
+		if err := fsEval.Lchown(path, linkHdr.Uid, linkHdr.Gid); err != nil {
+			return errors.Wrap(err, "restore symlink owner")
+		}
+		if err := fsEval.Lutimes(path, linkHdr.AccessTime, linkHdr.ModTime); err != nil {
+			return errors.Wrap(err, "restore symlink times")
+		}
+		if err := fsEval.Lutimes(parent, parentHdr.AccessTime, parentHdr.ModTime); err != nil {
+			return errors.Wrap(err, "restore symlink parent times")
+		}
+		return nil
+	})
+}
+
+// lstatHeader returns a tar.Header describing the metadata of the given path
+// (without following symlinks).
+func lstatHeader(fsEval fseval.FsEval, path string) (*tar.Header, error) {
+	fi, err := fsEval.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	return tar.FileInfoHeader(fi, "")
+}
@@ -0,0 +1,111 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/umoci/pkg/system"
+)
+
+func TestRewriteSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRewriteSymlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{"bin", "etc", "usr/bin", "usr/lib", "usr/share/zoneinfo"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"bin/bash", "usr/share/zoneinfo/UTC"} {
+		if err := ioutil.WriteFile(filepath.Join(root, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	symlinks := []struct {
+		path, target, relative, absolute string
+	}{
+		{"usr/bin/sh", "/bin/bash", "../../bin/bash", "/bin/bash"},
+		{"etc/localtime", "/usr/share/zoneinfo/UTC", "../usr/share/zoneinfo/UTC", "/usr/share/zoneinfo/UTC"},
+		{"lib", "/usr/lib", "usr/lib", "/usr/lib"},
+		{"usr/bin/bash", "../../bin/bash", "../../bin/bash", "/bin/bash"},
+		// Targets which are outside the rootfs, or which would require
+		// resolving other symlinks, are never modified.
+		{"usr/bin/escape", "../../../host", "../../../host", "../../../host"},
+		{"usr/bin/dotdot", "/lib/../etc", "/lib/../etc", "/lib/../etc"},
+	}
+	mtime := time.Unix(123456789, 0)
+	for _, link := range symlinks {
+		path := filepath.Join(root, link.path)
+		if err := os.Symlink(link.target, path); err != nil {
+			t.Fatal(err)
+		}
+		if err := system.Lutimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSymlinks := func(absolute bool) {
+		for _, link := range symlinks {
+			path := filepath.Join(root, link.path)
+			want := link.relative
+			if absolute {
+				want = link.absolute
+			}
+			if got, err := os.Readlink(path); err != nil {
+				t.Errorf("unexpected error reading symlink %s: %+v", link.path, err)
+			} else if got != want {
+				t.Errorf("unexpected target of symlink %s: expected %q got %q", link.path, want, got)
+			}
+			if fi, err := os.Lstat(path); err != nil {
+				t.Errorf("unexpected error stat-ing symlink %s: %+v", link.path, err)
+			} else if !fi.ModTime().Equal(mtime) {
+				t.Errorf("symlink %s mtime not preserved: got %s", link.path, fi.ModTime())
+			}
+		}
+	}
+
+	if err := RewriteSymlinks(root, RelativeSymlinks, nil); err != nil {
+		t.Fatalf("unexpected error making symlinks relative: %+v", err)
+	}
+	checkSymlinks(false)
+	// The relative symlinks must resolve correctly outside of a container.
+	for link, want := range map[string]string{
+		"usr/bin/sh":    "bin/bash",
+		"etc/localtime": "usr/share/zoneinfo/UTC",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(root, link))
+		if err != nil {
+			t.Errorf("unexpected error reading through symlink %s: %+v", link, err)
+		} else if string(got) != want {
+			t.Errorf("symlink %s resolved to the wrong file: expected %q got %q", link, want, got)
+		}
+	}
+
+	if err := RewriteSymlinks(root, AbsoluteSymlinks, nil); err != nil {
+		t.Fatalf("unexpected error making symlinks absolute: %+v", err)
+	}
+	checkSymlinks(true)
+}
@@ -22,8 +22,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -78,24 +80,257 @@ type TarExtractor struct {
 
 	// whiteoutMode indicates how this TarExtractor will handle whiteouts.
 	whiteoutMode WhiteoutMode
+
+	// includePaths is the corresponding set of patterns from the
+	// UnpackOptions supplied when this TarExtractor was constructed.
+	includePaths []string
+
+	// unsafeNameMode indicates how this TarExtractor will handle entries with
+	// control characters in their names.
+	unsafeNameMode UnsafeNameMode
+
+	// absolutePathMode indicates how this TarExtractor will handle entries
+	// with absolute names.
+	absolutePathMode AbsolutePathMode
+
+	// unknownPAXMode indicates how this TarExtractor will handle PAX records
+	// with unknown keywords, and unknownPAXRecords is where they are
+	// recorded with RecordUnknownPAX.
+	unknownPAXMode    UnknownPAXMode
+	unknownPAXRecords map[string]map[string]string
+
+	// unsupportedTypeMode indicates how this TarExtractor will handle
+	// entries with unsupported typeflags.
+	unsupportedTypeMode UnsupportedTypeMode
+
+	// rootlessDeviceMode indicates how this TarExtractor will handle device
+	// entries when partialRootless is set, and skippedDevices is where
+	// skipped devices are recorded with SkipRootlessDevices.
+	rootlessDeviceMode RootlessDeviceMode
+	skippedDevices     map[string]DeviceNode
+
+	// fifoMode and socketMode indicate how this TarExtractor will handle FIFO
+	// and socket entries (which are recorded in skippedDevices if skipped).
+	fifoMode   FifoMode
+	socketMode SocketMode
+
+	// stats, if non-nil, is updated with every entry extracted.
+	stats *UnpackStats
+
+	// ownership, if non-nil, is updated with the owner of every entry
+	// extracted (and every path removed).
+	ownership *OwnershipReport
+
+	// fileFlags, if non-nil, is updated with the inode flags of every entry
+	// extracted (and every path removed). See UnpackOptions.FileFlags.
+	fileFlags map[string]string
+
+	// ownerOverride is the corresponding callback from the UnpackOptions
+	// supplied when this TarExtractor was constructed.
+	ownerOverride OwnerOverrideCallback
+
+	// contentScan is the corresponding callback from the UnpackOptions
+	// supplied when this TarExtractor was constructed.
+	contentScan ContentScanCallback
+
+	// xattrRewrite is the corresponding callback from the UnpackOptions
+	// supplied when this TarExtractor was constructed.
+	xattrRewrite XattrRewriteCallback
+
+	// allowedIDRange and idRangeMode are the corresponding options from the
+	// UnpackOptions supplied when this TarExtractor was constructed.
+	allowedIDRange *IDRange
+	idRangeMode    IDRangeMode
+
+	// copyBuffer, if non-nil, is the buffer used to copy the contents of
+	// regular files (see UnpackOptions.CopyBufferSize).
+	copyBuffer []byte
+
+	// dirTimes, if non-nil, is the set of access and modification times of
+	// every directory extracted, keyed by the path relative to the root. They
+	// are re-applied by RestoreDirectoryTimes (see
+	// UnpackOptions.DirectoryTimesLast).
+	dirTimes map[string][2]time.Time
+
+	// implicitDirMode is the mode of implicitly-created parent directories
+	// (see UnpackOptions.ImplicitDirectoryMode).
+	implicitDirMode os.FileMode
 }
 
 // NewTarExtractor creates a new TarExtractor.
 func NewTarExtractor(opt UnpackOptions) *TarExtractor {
-	fsEval := fseval.Default
-	if opt.MapOptions.Rootless {
-		fsEval = fseval.Rootless
+	var copyBuffer []byte
+	if opt.CopyBufferSize > 0 {
+		copyBuffer = make([]byte, opt.CopyBufferSize)
+	}
+	var dirTimes map[string][2]time.Time
+	if opt.DirectoryTimesLast {
+		dirTimes = make(map[string][2]time.Time)
 	}
-
 	return &TarExtractor{
-		mapOptions:      opt.MapOptions,
-		partialRootless: opt.MapOptions.Rootless || inUserNamespace,
-		fsEval:          fsEval,
-		upperPaths:      make(map[string]struct{}),
-		enotsupWarned:   false,
-		keepDirlinks:    opt.KeepDirlinks,
-		whiteoutMode:    opt.WhiteoutMode,
+		mapOptions:          opt.MapOptions,
+		partialRootless:     opt.MapOptions.Rootless || inUserNamespace,
+		fsEval:              unpackFsEval(&opt),
+		upperPaths:          make(map[string]struct{}),
+		enotsupWarned:       false,
+		keepDirlinks:        opt.KeepDirlinks,
+		whiteoutMode:        opt.WhiteoutMode,
+		includePaths:        opt.IncludePaths,
+		unsafeNameMode:      opt.UnsafeNameMode,
+		absolutePathMode:    opt.AbsolutePathMode,
+		unknownPAXMode:      opt.UnknownPAXMode,
+		unknownPAXRecords:   opt.UnknownPAXRecords,
+		unsupportedTypeMode: opt.UnsupportedTypeMode,
+		rootlessDeviceMode:  opt.RootlessDeviceMode,
+		skippedDevices:      opt.SkippedDevices,
+		fifoMode:            opt.FifoMode,
+		socketMode:          opt.SocketMode,
+		stats:               opt.Stats,
+		ownership:           opt.OwnershipReport,
+		fileFlags:           opt.FileFlags,
+		ownerOverride:       opt.OwnerOverride,
+		contentScan:         opt.ContentScan,
+		xattrRewrite:        opt.XattrRewrite,
+		allowedIDRange:      opt.AllowedIDRange,
+		idRangeMode:         opt.IDRangeMode,
+		copyBuffer:          copyBuffer,
+		dirTimes:            dirTimes,
+		implicitDirMode:     opt.ImplicitDirectoryMode,
+	}
+}
+
+// mkdirParents creates the given parent directory of an entry, as well as any
+// of its missing ancestors. If an implicitDirMode was configured, every
+// directory created is given that mode (otherwise they are created with 0777
+// modified by the umask).
+func (te *TarExtractor) mkdirParents(dir string) error {
+	if te.implicitDirMode == 0 {
+		return te.fsEval.MkdirAll(dir, 0777)
+	}
+
+	var missing []string
+	for path := dir; ; path = filepath.Dir(path) {
+		if _, err := te.fsEval.Lstat(path); err == nil {
+			break
+		} else if !os.IsNotExist(errors.Cause(err)) {
+			return errors.Wrap(err, "lstat parent")
+		}
+		missing = append(missing, path)
+		if filepath.Dir(path) == path {
+			break
+		}
+	}
+	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// Apply the mode from the top down, so that restrictive modes don't stop
+	// us from reaching the directories below.
+	for idx := len(missing) - 1; idx >= 0; idx-- {
+		if err := te.fsEval.Chmod(missing[idx], te.implicitDirMode); err != nil {
+			return errors.Wrap(err, "chmod implicit parent")
+		}
+	}
+	return nil
+}
+
+// rewriteXattrs applies the xattrRewrite callback of the TarExtractor (if any)
+// to the xattrs of the given header.
+func (te *TarExtractor) rewriteXattrs(hdr *tar.Header) error {
+	if te.xattrRewrite == nil || len(hdr.Xattrs) == 0 {
+		return nil
+	}
+
+	// Go through the xattrs in order, so that the callback is called
+	// deterministically.
+	var names []string
+	for name := range hdr.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	xattrs := map[string]string{}
+	for _, name := range names {
+		newName, newValue, keep := te.xattrRewrite(name, []byte(hdr.Xattrs[name]))
+		if !keep {
+			log.Debugf("xattr{%s} dropping rewritten xattr %q", hdr.Name, name)
+			continue
+		}
+		if _, ok := xattrs[newName]; ok {
+			return errors.Errorf("entry %s has more than one xattr rewritten to %q", hdr.Name, newName)
+		}
+		if newName != name {
+			log.Debugf("xattr{%s} rewriting xattr %q to %q", hdr.Name, name, newName)
+		}
+		xattrs[newName] = string(newValue)
+	}
+	hdr.Xattrs = xattrs
+	return nil
+}
+
+// handleUnknownPAX applies the UnknownPAXMode of the TarExtractor to the PAX
+// records of the given header which have unknown keywords.
+func (te *TarExtractor) handleUnknownPAX(hdr *tar.Header) error {
+	unknown := map[string]string{}
+	for keyword, value := range hdr.PAXRecords {
+		if !isKnownPAXKeyword(keyword) {
+			unknown[keyword] = value
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
 	}
+
+	switch te.unknownPAXMode {
+	case IgnoreUnknownPAX:
+		log.Debugf("ignoring unknown pax records of %s: %v", hdr.Name, unknown)
+	case RecordUnknownPAX:
+		if te.unknownPAXRecords == nil {
+			return errors.Errorf("[internal error] no map to record unknown pax records in")
+		}
+		te.unknownPAXRecords[filepath.Join("/", hdr.Name)] = unknown
+	case RejectUnknownPAX:
+		var keywords []string
+		for keyword := range unknown {
+			keywords = append(keywords, keyword)
+		}
+		sort.Strings(keywords)
+		return errors.Errorf("entry %s has unknown pax records: %s", hdr.Name, strings.Join(keywords, ", "))
+	default:
+		return errors.Errorf("[internal error] unknown pax mode %d", te.unknownPAXMode)
+	}
+	return nil
+}
+
+// isSupportedType returns whether the given typeflag can be extracted.
+func isSupportedType(typeflag byte) bool {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeLink, tar.TypeSymlink,
+		tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	}
+	return false
+}
+
+// handleUnsupportedType applies the UnsupportedTypeMode of the TarExtractor to
+// the given header if it has an unsupported typeflag, and returns whether the
+// entry should be skipped.
+func (te *TarExtractor) handleUnsupportedType(hdr *tar.Header) (bool, error) {
+	if isSupportedType(hdr.Typeflag) {
+		return false, nil
+	}
+
+	switch te.unsupportedTypeMode {
+	case RejectUnsupportedTypes:
+		return false, errors.Errorf("entry %s has unsupported typeflag '\\x%x'", hdr.Name, hdr.Typeflag)
+	case SkipUnsupportedTypes:
+		log.Warnf("skipping entry %s with unsupported typeflag '\\x%x'", hdr.Name, hdr.Typeflag)
+		return true, nil
+	case RegularUnsupportedTypes:
+		log.Debugf("extracting entry %s with unsupported typeflag '\\x%x' as a regular file", hdr.Name, hdr.Typeflag)
+		hdr.Typeflag = tar.TypeReg
+		return false, nil
+	}
+	return false, errors.Errorf("[internal error] unknown unsupported type mode %d", te.unsupportedTypeMode)
 }
 
 // restoreMetadata applies the state described in tar.Header to the filesystem
@@ -114,8 +349,7 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 	// Apply the owner. If we are rootless then "user.rootlesscontainers" has
 	// already been set up by unmapHeader, so nothing to do here.
 	if !te.mapOptions.Rootless {
-		// NOTE: This is not done through fsEval.
-		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		if err := te.fsEval.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
 			return errors.Wrapf(err, "restore chown metadata: %s", path)
 		}
 	}
@@ -130,19 +364,7 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 		}
 	}
 
-	// Apply access and modified time. Note that some archives won't fill the
-	// atime and mtime fields, so we have to set them to a more sane value.
-	// Otherwise Linux will start screaming at us, and nobody wants that.
-	mtime := hdr.ModTime
-	if mtime.IsZero() {
-		// XXX: Should we instead default to atime if it's non-zero?
-		mtime = time.Now()
-	}
-	atime := hdr.AccessTime
-	if atime.IsZero() {
-		// Default to the mtime.
-		atime = mtime
-	}
+	atime, mtime := headerTimes(hdr)
 
 	// Apply xattrs. In order to make sure that we *only* have the xattr set we
 	// want, we first clear the set of xattrs from the file then apply the ones
@@ -220,6 +442,43 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 	return nil
 }
 
+// headerTimes returns the access and modified time to apply for the given
+// header. Note that some archives won't fill the atime and mtime fields, so we
+// have to set them to a more sane value. Otherwise Linux will start screaming
+// at us, and nobody wants that.
+func headerTimes(hdr *tar.Header) (atime, mtime time.Time) {
+	mtime = hdr.ModTime
+	if mtime.IsZero() {
+		// XXX: Should we instead default to atime if it's non-zero?
+		mtime = time.Now()
+	}
+	atime = hdr.AccessTime
+	if atime.IsZero() {
+		// Default to the mtime.
+		atime = mtime
+	}
+	return atime, mtime
+}
+
+// RestoreDirectoryTimes re-applies the access and modification times of every
+// directory extracted by this TarExtractor under the given root. It is a no-op
+// unless UnpackOptions.DirectoryTimesLast was set, and must be called after the
+// final entry has been extracted.
+func (te *TarExtractor) RestoreDirectoryTimes(root string) error {
+	paths := make([]string, 0, len(te.dirTimes))
+	for pth := range te.dirTimes {
+		paths = append(paths, pth)
+	}
+	sort.Strings(paths)
+	for _, pth := range paths {
+		times := te.dirTimes[pth]
+		if err := te.fsEval.Lutimes(filepath.Join(root, pth), times[0], times[1]); err != nil {
+			return errors.Wrapf(err, "restore directory times: %s", pth)
+		}
+	}
+	return nil
+}
+
 // applyMetadata applies the state described in tar.Header to the filesystem at
 // the given path, using the state of the TarExtractor to remap information
 // within the header. This should only be used with headers from a tar layer
@@ -230,11 +489,41 @@ func (te *TarExtractor) applyMetadata(path string, hdr *tar.Header) error {
 	if err := unmapHeader(hdr, te.mapOptions); err != nil {
 		return errors.Wrap(err, "unmap header")
 	}
+	if te.ownerOverride != nil && !te.mapOptions.Rootless {
+		if uid, gid, ok := te.ownerOverride(filepath.Join("/", hdr.Name), hdr); ok {
+			hdr.Uid, hdr.Gid = uid, gid
+		}
+	}
+	if te.allowedIDRange != nil && !te.mapOptions.Rootless {
+		if err := te.checkIDRange(hdr); err != nil {
+			return err
+		}
+	}
 
 	// Restore it on the filesystme.
 	return te.restoreMetadata(path, hdr)
 }
 
+// checkIDRange applies the IDRangeMode of the TarExtractor to the (already
+// mapped) host owner of the given header.
+func (te *TarExtractor) checkIDRange(hdr *tar.Header) error {
+	idRange := *te.allowedIDRange
+	if idRange.Contains(hdr.Uid) && idRange.Contains(hdr.Gid) {
+		return nil
+	}
+
+	switch te.idRangeMode {
+	case RejectOutOfRangeIDs:
+		return errors.Wrapf(ErrOwnerOutOfRange, "entry %s: host owner %d:%d not in range [%d, %d]", hdr.Name, hdr.Uid, hdr.Gid, idRange.Min, idRange.Max)
+	case ClampOutOfRangeIDs:
+		uid, gid := idRange.Clamp(hdr.Uid), idRange.Clamp(hdr.Gid)
+		log.Debugf("clamping host owner of %s from %d:%d to %d:%d", hdr.Name, hdr.Uid, hdr.Gid, uid, gid)
+		hdr.Uid, hdr.Gid = uid, gid
+		return nil
+	}
+	return errors.Errorf("[internal error] unknown id range mode %d", te.idRangeMode)
+}
+
 // isDirlink returns whether the given path is a link to a directory (or a
 // dirlink in rsync(1) parlance) which is used by --keep-dirlink to see whether
 // we should extract through the link or clobber the link with a directory (in
@@ -279,6 +568,43 @@ func (te *TarExtractor) isDirlink(root string, path string) (bool, error) {
 	return targetInfo.IsDir(), nil
 }
 
+// hardlinkTarget returns the path (scoped to root) of the target of a hardlink
+// entry with the given linkname.
+func (te *TarExtractor) hardlinkTarget(root string, linkname string) (string, error) {
+	// Because hardlinks are inode-based we need to scope the link to the
+	// rootfs using SecureJoinVFS. As before, we need to be careful that we
+	// don't resolve the last part of the link path (in case the user actually
+	// wanted to hardlink to a symlink).
+	unsafeLinkDir, linkFile := filepath.Split(CleanPath(linkname))
+	linkDir, err := securejoin.SecureJoinVFS(root, unsafeLinkDir, te.fsEval)
+	if err != nil {
+		return "", errors.Wrap(err, "sanitise hardlink target in root")
+	}
+	return filepath.Join(linkDir, linkFile), nil
+}
+
+// isHardlinked returns whether path and target both exist and are the same
+// (non-directory) inode, meaning that a hardlink from path to target already
+// exists.
+func (te *TarExtractor) isHardlinked(path string, target string) (bool, error) {
+	pathStat, err := te.fsEval.Lstatx(path)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			err = nil
+		}
+		return false, errors.Wrap(err, "lstat hardlink")
+	}
+	targetStat, err := te.fsEval.Lstatx(target)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			err = nil
+		}
+		return false, errors.Wrap(err, "lstat hardlink target")
+	}
+	return pathStat.Mode&unix.S_IFMT != unix.S_IFDIR &&
+		pathStat.Dev == targetStat.Dev && pathStat.Ino == targetStat.Ino, nil
+}
+
 func (te *TarExtractor) ociWhiteout(root string, dir string, file string) error {
 	isOpaque := file == whOpaque
 	file = strings.TrimPrefix(file, whPrefix)
@@ -320,6 +646,10 @@ func (te *TarExtractor) ociWhiteout(root string, dir string, file string) error
 	// we iterate over any children and try again. The only difference
 	// between opaque whiteouts and regular whiteouts is that we don't
 	// delete the directory itself with opaque whiteouts.
+	//
+	// Note that if path is a symlink, Walk only lstat(2)s it and RemoveAll
+	// unlinks it without following it -- a whiteout of a symlink must only
+	// remove the link, never the target it points to.
 	err := te.fsEval.Walk(path, func(subpath string, info os.FileInfo, err error) error {
 		// If we are passed an error, bail unless it's ENOENT.
 		if err != nil {
@@ -352,8 +682,11 @@ func (te *TarExtractor) ociWhiteout(root string, dir string, file string) error
 			// directory) since we just purged it -- and we don't want to
 			// hit ENOENT during iteration for no good reason.
 			err := errors.Wrap(te.fsEval.RemoveAll(subpath), "whiteout subpath")
-			if err == nil && info.IsDir() {
-				err = filepath.SkipDir
+			if err == nil {
+				te.forgetPath(upperPath)
+				if info.IsDir() {
+					err = filepath.SkipDir
+				}
 			}
 			return err
 		}
@@ -362,7 +695,46 @@ func (te *TarExtractor) ociWhiteout(root string, dir string, file string) error
 	return errors.Wrap(err, "whiteout remove")
 }
 
-func (te *TarExtractor) overlayFSWhiteout(dir string, file string) error {
+// overlayRedirectXattr is the xattr used by overlayfs (with redirect_dir
+// enabled) to mark a directory as having been renamed from another path. The
+// value is the path the directory was renamed from -- either absolute (from
+// the root of the overlay) or relative to the parent directory.
+const overlayRedirectXattr = "trusted.overlay.redirect"
+
+// overlayFSRedirect validates the overlayfs redirect xattr (if any) in the
+// given header, so that renamed directories in overlayfs layers are
+// preserved. The redirect is only meaningful in OverlayFSWhiteout mode, so in
+// all other modes it is stripped from the header.
+func (te *TarExtractor) overlayFSRedirect(hdr *tar.Header) error {
+	redirect, ok := hdr.Xattrs[overlayRedirectXattr]
+	if !ok {
+		return nil
+	}
+	if te.whiteoutMode != OverlayFSWhiteout {
+		log.Warnf("xattr{%s} ignoring overlayfs redirect outside of overlayfs whiteout mode: %q", hdr.Name, redirect)
+		delete(hdr.Xattrs, overlayRedirectXattr)
+		return nil
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		return errors.Errorf("overlayfs redirect set on non-directory: %s", hdr.Name)
+	}
+	if redirect == "" || strings.ContainsRune(redirect, 0) {
+		return errors.Errorf("invalid overlayfs redirect %q: %s", redirect, hdr.Name)
+	}
+	// Relative redirects are just the old name of the directory (in the same
+	// parent directory), while absolute redirects must not escape the root.
+	if !filepath.IsAbs(redirect) {
+		if strings.ContainsRune(redirect, os.PathSeparator) || redirect == "." || redirect == ".." {
+			return errors.Errorf("invalid relative overlayfs redirect %q: %s", redirect, hdr.Name)
+		}
+	} else if CleanPath(redirect) != redirect {
+		return errors.Errorf("invalid absolute overlayfs redirect %q: %s", redirect, hdr.Name)
+	}
+	log.Debugf("overlayfs redirect %s -> %s", hdr.Name, redirect)
+	return nil
+}
+
+func (te *TarExtractor) overlayFSWhiteout(root, dir, file string) error {
 	isOpaque := file == whOpaque
 
 	// if this is an opaque whiteout, whiteout the directory
@@ -373,19 +745,218 @@ func (te *TarExtractor) overlayFSWhiteout(dir string, file string) error {
 
 	// otherwise, white out the file itself.
 	p := filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
-	if err := os.RemoveAll(p); err != nil && !os.IsNotExist(err) {
+	if err := te.fsEval.RemoveAll(p); err != nil && !os.IsNotExist(err) {
 		return errors.Wrapf(err, "couldn't create overlayfs whiteout for %s", p)
 	}
+	if upperPath, err := filepath.Rel(root, p); err == nil {
+		te.forgetPath(upperPath)
+	}
 
 	err := te.fsEval.Mknod(p, unix.S_IFCHR|0666, unix.Mkdev(0, 0))
 	return errors.Wrapf(err, "couldn't create overlayfs whiteout for %s", p)
 }
 
+// markerWhiteout handles whiteouts with MarkerWhiteout, leaving the whited-out
+// path in place and appending the name of the whiteout entry to a marker file
+// next to it (or inside it, for opaque whiteouts).
+func (te *TarExtractor) markerWhiteout(dir, file, name string) error {
+	isOpaque := file == whOpaque
+
+	path := filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+	marker := path + WhiteoutMarkerSuffix
+	if isOpaque {
+		path = dir
+		marker = filepath.Join(dir, WhiteoutMarkerSuffix)
+	}
+
+	// As with ociWhiteout, there is nothing to mark if the path doesn't exist
+	// (nothing would have been deleted).
+	if _, err := te.fsEval.Lstat(path); err != nil {
+		// Need to use securejoin.IsNotExist to handle ENOTDIR.
+		if securejoin.IsNotExist(err) {
+			log.Debugf("whiteout marker: nothing to mark for %s", name)
+			err = nil
+		}
+		return errors.Wrap(err, "check whiteout target")
+	}
+
+	// Several layers may white out the same path, so keep the old entries.
+	// The marker path is controlled by the layers (a lower layer could have
+	// placed a symlink there), so we only ever read regular files and always
+	// replace the marker rather than writing through whatever is there.
+	var contents []byte
+	if fi, err := te.fsEval.Lstat(marker); err == nil {
+		if fi.Mode().IsRegular() {
+			fh, err := te.fsEval.Open(marker)
+			if err != nil {
+				return errors.Wrap(err, "open whiteout marker")
+			}
+			contents, err = ioutil.ReadAll(fh)
+			fh.Close()
+			if err != nil {
+				return errors.Wrap(err, "read whiteout marker")
+			}
+		} else {
+			log.Warnf("whiteout marker: replacing non-regular file %s", marker)
+		}
+		if err := te.fsEval.RemoveAll(marker); err != nil {
+			return errors.Wrap(err, "remove old whiteout marker")
+		}
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "stat whiteout marker")
+	}
+	contents = append(contents, name+"\n"...)
+
+	fh, err := te.fsEval.Create(marker)
+	if err != nil {
+		return errors.Wrap(err, "create whiteout marker")
+	}
+	defer fh.Close()
+	if _, err := fh.Write(contents); err != nil {
+		return errors.Wrap(err, "write whiteout marker")
+	}
+	return errors.Wrap(fh.Close(), "close whiteout marker")
+}
+
+// forgetUpperPaths removes all of the children of the given path from the set
+// of upper paths. This is necessary when a directory is clobbered by a later
+// entry for the same path, since any paths extracted inside the old directory
+// no longer exist.
+func (te *TarExtractor) forgetUpperPaths(root, path string) error {
+	upperPath, err := filepath.Rel(root, path)
+	if err != nil {
+		// Really shouldn't happen because of the guarantees of SecureJoinVFS.
+		return errors.Wrap(err, "find relative-to-root [should never happen]")
+	}
+	prefix := upperPath + string(filepath.Separator)
+	for pth := range te.upperPaths {
+		if strings.HasPrefix(pth, prefix) {
+			delete(te.upperPaths, pth)
+		}
+	}
+	return nil
+}
+
+// copyFile copies the contents of a regular file entry to the given file,
+// using the configured copy buffer (if there is one).
+func (te *TarExtractor) copyFile(fh *os.File, r io.Reader) (int64, error) {
+	if te.copyBuffer == nil {
+		return io.Copy(fh, r)
+	}
+	// Hide the io.ReaderFrom implementation of *os.File, otherwise
+	// io.CopyBuffer would ignore our buffer entirely.
+	return io.CopyBuffer(struct{ io.Writer }{fh}, r, te.copyBuffer)
+}
+
+// scanFile is like copyFile, except that the contents are passed to the
+// contentScan callback as they are copied. Any contents which the callback
+// doesn't read are copied after it returns.
+func (te *TarExtractor) scanFile(path string, fh *os.File, r io.Reader) (int64, error) {
+	if err := te.contentScan(path, io.TeeReader(r, fh)); err != nil {
+		return 0, errors.Wrapf(err, "content scan of %s", path)
+	}
+	scanned, err := fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, errors.Wrap(err, "get scanned size")
+	}
+	n, err := te.copyFile(fh, r)
+	return scanned + n, err
+}
+
+// forgetPath removes the given path (relative to the root) and all of its
+// children from the OwnershipReport, the recorded inode flags and the recorded
+// directory times (if they are being tracked).
+func (te *TarExtractor) forgetPath(upperPath string) {
+	if te.ownership != nil {
+		te.ownership.forget(upperPath)
+	}
+	if te.fileFlags != nil {
+		forgetFileFlags(te.fileFlags, upperPath)
+	}
+	for pth := range te.dirTimes {
+		if pth == upperPath || strings.HasPrefix(pth, upperPath+"/") {
+			delete(te.dirTimes, pth)
+		}
+	}
+}
+
+// isSocket returns whether the given entry is a socket (a regular file entry
+// with the S_IFSOCK file type bits set in its mode).
+func isSocket(hdr *tar.Header) bool {
+	return (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) && hdr.FileInfo().Mode()&os.ModeSocket != 0
+}
+
+// deviceNode returns the DeviceNode described by the given device, FIFO or
+// socket entry.
+func deviceNode(hdr *tar.Header) DeviceNode {
+	var nodeType string
+	switch {
+	case hdr.Typeflag == tar.TypeBlock:
+		nodeType = "block"
+	case hdr.Typeflag == tar.TypeFifo:
+		nodeType = "fifo"
+	case isSocket(hdr):
+		nodeType = "socket"
+	default:
+		nodeType = "char"
+	}
+	return DeviceNode{
+		Type:  nodeType,
+		Major: hdr.Devmajor,
+		Minor: hdr.Devminor,
+		Mode:  os.FileMode(hdr.Mode) & os.ModePerm,
+		UID:   hdr.Uid,
+		GID:   hdr.Gid,
+	}
+}
+
+// forgetSkippedDevices removes the skipped devices under the given path (and
+// the path itself if self is set) from te.skippedDevices.
+func (te *TarExtractor) forgetSkippedDevices(path string, self bool) {
+	if len(te.skippedDevices) == 0 {
+		return
+	}
+	path = filepath.Join("/", path)
+	if self {
+		delete(te.skippedDevices, path)
+	}
+	prefix := path + "/"
+	if path == "/" {
+		prefix = path
+	}
+	for devicePath := range te.skippedDevices {
+		if strings.HasPrefix(devicePath, prefix) {
+			delete(te.skippedDevices, devicePath)
+		}
+	}
+}
+
 // UnpackEntry extracts the given tar.Header to the provided root, ensuring
 // that the layer state is consistent with the layer state that produced the
 // tar archive being iterated over. This does handle whiteouts, so a tar.Header
 // that represents a whiteout will result in the path being removed.
 func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (Err error) {
+	// Reject (or sanitise) names with control characters. Hardlink targets
+	// are also paths inside the archive, so they get the same treatment.
+	name, err := checkEntryName(hdr.Name, te.unsafeNameMode)
+	if err != nil {
+		return err
+	}
+	if name, err = checkAbsoluteName(name, te.absolutePathMode); err != nil {
+		return err
+	}
+	hdr.Name = name
+	if hdr.Typeflag == tar.TypeLink {
+		linkname, err := checkEntryName(hdr.Linkname, te.unsafeNameMode)
+		if err != nil {
+			return errors.Wrap(err, "hardlink target")
+		}
+		if linkname, err = checkAbsoluteName(linkname, te.absolutePathMode); err != nil {
+			return errors.Wrap(err, "hardlink target")
+		}
+		hdr.Linkname = linkname
+	}
+
 	// Make the paths safe.
 	hdr.Name = CleanPath(hdr.Name)
 	root = filepath.Clean(root)
@@ -405,6 +976,44 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		// If we got an entry for the root, then unsafeDir is the full path.
 		unsafeDir, file = hdr.Name, "."
 	}
+
+	// Skip any entries which are not in the set of included paths. For
+	// whiteouts we need to check the path being whited-out, not the path of
+	// the whiteout itself.
+	includeName := hdr.Name
+	if file == whOpaque {
+		includeName = unsafeDir
+	} else if strings.HasPrefix(file, whPrefix) {
+		includeName = filepath.Join(unsafeDir, strings.TrimPrefix(file, whPrefix))
+	}
+	if !matchIncludePath(te.includePaths, includeName) {
+		log.Debugf("skipping entry not in include paths: %s", hdr.Name)
+		return nil
+	}
+	if hdr.Typeflag == tar.TypeLink && !matchIncludePath(te.includePaths, hdr.Linkname) {
+		log.Warnf("skipping hardlink %s to path not in include paths: %s", hdr.Name, hdr.Linkname)
+		return nil
+	}
+	if err := te.handleUnknownPAX(hdr); err != nil {
+		return err
+	}
+	if skip, err := te.handleUnsupportedType(hdr); err != nil || skip {
+		return err
+	}
+	if err := te.rewriteXattrs(hdr); err != nil {
+		return err
+	}
+
+	// Any skipped devices which this entry replaces (or removes) are no
+	// longer part of the rootfs.
+	switch {
+	case file == whOpaque:
+		te.forgetSkippedDevices(includeName, false)
+	case strings.HasPrefix(file, whPrefix):
+		te.forgetSkippedDevices(includeName, true)
+	default:
+		te.forgetSkippedDevices(hdr.Name, hdr.Typeflag != tar.TypeDir)
+	}
 	dir, err := securejoin.SecureJoinVFS(root, unsafeDir, te.fsEval)
 	if err != nil {
 		return errors.Wrap(err, "sanitise symlinks in root")
@@ -483,12 +1092,20 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		case OCIStandardWhiteout:
 			return te.ociWhiteout(root, dir, file)
 		case OverlayFSWhiteout:
-			return te.overlayFSWhiteout(dir, file)
+			return te.overlayFSWhiteout(root, dir, file)
+		case MarkerWhiteout:
+			return te.markerWhiteout(dir, file, hdr.Name)
 		default:
 			return errors.Errorf("unknown whiteout mode %d", te.whiteoutMode)
 		}
 	}
 
+	// Renamed directories in overlayfs layers are marked with an xattr, which
+	// we only keep if we're producing an overlayfs-compatible rootfs.
+	if err := te.overlayFSRedirect(hdr); err != nil {
+		return errors.Wrap(err, "check overlayfs redirect")
+	}
+
 	// Get information about the path. This has to be done after we've dealt
 	// with whiteouts because it turns out that lstat(2) will return EPERM if
 	// you try to stat a whiteout on AUFS.
@@ -505,10 +1122,28 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// FIXME: We have to make this consistent, since if the tar archive doesn't
 	//        have entries for some of these components we won't be able to
 	//        verify that we have consistent results during unpacking.
-	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
+	if err := te.mkdirParents(dir); err != nil {
 		return errors.Wrap(err, "mkdir parent")
 	}
 
+	// If a hardlink entry refers to the inode which already exists at its path
+	// (such as when an archive links a path to itself, which GNU tar does for
+	// paths which were archived more than once, or repeats a hardlink entry),
+	// the link already exists. Clobbering the path would remove the target of
+	// the link in the former case, so we leave the path alone.
+	var linkTarget string
+	alreadyLinked := false
+	if hdr.Typeflag == tar.TypeLink {
+		linkTarget, err = te.hardlinkTarget(root, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		alreadyLinked, err = te.isHardlinked(path, linkTarget)
+		if err != nil {
+			return errors.Wrap(err, "check existing hardlink")
+		}
+	}
+
 	isDirlink := false
 	// We remove whatever existed at the old path to clobber it so that
 	// creating a new path will not break. The only exception is if the path is
@@ -522,7 +1157,12 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// TarLink that is present before the "upper" entry in the layer but the
 	// "lower" file still exists (so the hard-link would point to the old
 	// inode). It's not clear if such an archive is actually valid though.
-	if !fi.IsDir() || hdr.Typeflag != tar.TypeDir {
+	//
+	// This is also how we handle archives which contain the same path more
+	// than once (POSIX tar semantics say that the last entry wins). If a
+	// directory is replaced by a non-directory, the entire directory tree
+	// (including anything extracted earlier in this layer) is removed.
+	if !alreadyLinked && (!fi.IsDir() || hdr.Typeflag != tar.TypeDir) {
 		// If we are in --keep-dirlinks mode and the existing fs object is a
 		// symlink to a directory (with the pending object is a directory), we
 		// don't remove the symlink (and instead allow subsequent objects to be
@@ -550,6 +1190,14 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 			if err := te.fsEval.RemoveAll(path); err != nil {
 				return errors.Wrap(err, "clobber old path")
 			}
+			if upperPath, err := filepath.Rel(root, path); err == nil {
+				te.forgetPath(upperPath)
+			}
+			if fi.IsDir() {
+				if err := te.forgetUpperPaths(root, path); err != nil {
+					return errors.Wrap(err, "forget clobbered upper paths")
+				}
+			}
 		}
 	}
 
@@ -560,6 +1208,21 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	switch hdr.Typeflag {
 	// regular file
 	case tar.TypeReg, tar.TypeRegA:
+		if isSocket(hdr) {
+			switch te.socketMode {
+			case SkipSockets:
+				log.Warnf("unpack entry: skipping socket %s", hdr.Name)
+			case RecordSockets:
+				log.Debugf("unpack entry: recording skipped socket %s", hdr.Name)
+				if te.skippedDevices != nil {
+					te.skippedDevices[filepath.Join("/", hdr.Name)] = deviceNode(hdr)
+				}
+			default:
+				return errors.Errorf("[internal error] unknown socket mode %d", te.socketMode)
+			}
+			return nil
+		}
+
 		// Create a new file, then just copy the data.
 		fh, err := te.fsEval.Create(path)
 		if err != nil {
@@ -568,7 +1231,12 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		defer fh.Close()
 
 		// We need to make sure that we copy all of the bytes.
-		n, err := io.Copy(fh, r)
+		var n int64
+		if te.contentScan != nil {
+			n, err = te.scanFile(filepath.Join("/", hdr.Name), fh, r)
+		} else {
+			n, err = te.copyFile(fh, r)
+		}
 		if int64(n) != hdr.Size {
 			if err != nil {
 				err = errors.Wrapf(err, "short write")
@@ -600,6 +1268,10 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 
 	// hard link, symbolic link
 	case tar.TypeLink, tar.TypeSymlink:
+		if alreadyLinked {
+			log.Debugf("unpack entry: %s is already hardlinked to %s", hdr.Name, hdr.Linkname)
+			break
+		}
 		linkname := hdr.Linkname
 
 		// Hardlinks and symlinks act differently when it comes to the scoping.
@@ -609,17 +1281,13 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		switch hdr.Typeflag {
 		case tar.TypeLink:
 			linkFn = te.fsEval.Link
-			// Because hardlinks are inode-based we need to scope the link to
-			// the rootfs using SecureJoinVFS. As before, we need to be careful
-			// that we don't resolve the last part of the link path (in case
-			// the user actually wanted to hardlink to a symlink).
-			unsafeLinkDir, linkFile := filepath.Split(CleanPath(linkname))
-			linkDir, err := securejoin.SecureJoinVFS(root, unsafeLinkDir, te.fsEval)
-			if err != nil {
-				return errors.Wrap(err, "sanitise hardlink target in root")
-			}
-			linkname = filepath.Join(linkDir, linkFile)
+			// The target was scoped to the rootfs by hardlinkTarget.
+			linkname = linkTarget
 		case tar.TypeSymlink:
+			// Symlink targets are data, not paths we resolve or write to, so
+			// they are stored verbatim (relative or absolute, and without any
+			// cleaning). Only the location of the link itself (path) is scoped
+			// to the rootfs -- the target is resolved by whoever follows it.
 			linkFn = te.fsEval.Symlink
 		}
 
@@ -640,27 +1308,55 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		// doesn't work as an unprivileged user here.
 		//
 		// TODO: We need to add the concept of a fake block device in
-		//       "user.rootlesscontainers", because this workaround suffers
-		//       from the obvious issue that if the file is touched (even the
-		//       metadata) then it will be incorrectly copied into the layer.
-		//       This would break distribution images fairly badly.
+		//       "user.rootlesscontainers", because the empty file workaround
+		//       suffers from the obvious issue that if the file is touched
+		//       (even the metadata) then it will be incorrectly copied into
+		//       the layer. This would break distribution images fairly badly.
 		if te.partialRootless {
-			log.Warnf("rootless{%s} creating empty file in place of device %d:%d", hdr.Name, hdr.Devmajor, hdr.Devminor)
-			fh, err := te.fsEval.Create(path)
-			if err != nil {
-				return errors.Wrap(err, "create rootless block")
-			}
-			defer fh.Close()
-			if err := fh.Chmod(0); err != nil {
-				return errors.Wrap(err, "chmod 0 rootless block")
+			switch te.rootlessDeviceMode {
+			case SkipRootlessDevices:
+				log.Warnf("rootless{%s} skipping creation of device %d:%d", hdr.Name, hdr.Devmajor, hdr.Devminor)
+				if te.skippedDevices != nil {
+					te.skippedDevices[filepath.Join("/", hdr.Name)] = deviceNode(hdr)
+				}
+				return nil
+			case EmptyFileRootlessDevices:
+				log.Warnf("rootless{%s} creating empty file in place of device %d:%d", hdr.Name, hdr.Devmajor, hdr.Devminor)
+				fh, err := te.fsEval.Create(path)
+				if err != nil {
+					return errors.Wrap(err, "create rootless block")
+				}
+				defer fh.Close()
+				if err := fh.Chmod(0); err != nil {
+					return errors.Wrap(err, "chmod 0 rootless block")
+				}
+				goto out
+			case RejectRootlessDevices:
+				return errors.Errorf("rootless{%s} cannot create device %d:%d", hdr.Name, hdr.Devmajor, hdr.Devminor)
+			default:
+				return errors.Errorf("[internal error] unknown rootless device mode %d", te.rootlessDeviceMode)
 			}
-			goto out
 		}
 
 		// Otherwise the handling is the same as a FIFO.
 		fallthrough
 	// fifo node
 	case tar.TypeFifo:
+		if hdr.Typeflag == tar.TypeFifo {
+			switch te.fifoMode {
+			case CreateFifos:
+				// Created below.
+			case RecordFifos:
+				log.Debugf("unpack entry: recording skipped fifo %s", hdr.Name)
+				if te.skippedDevices != nil {
+					te.skippedDevices[filepath.Join("/", hdr.Name)] = deviceNode(hdr)
+				}
+				return nil
+			default:
+				return errors.Errorf("[internal error] unknown fifo mode %d", te.fifoMode)
+			}
+		}
+
 		// We have to remove and then create the device. In the FIFO case we
 		// could choose not to do so, but we do it anyway just to be on the
 		// safe side.
@@ -683,12 +1379,27 @@ out:
 	// Apply the metadata, which will apply any mappings necessary. We don't
 	// apply metadata for hardlinks, because hardlinks don't have any separate
 	// metadata from their link (and the tar headers might not be filled).
+	// The container owner has to be saved first, since applyMetadata maps
+	// the header in-place.
+	containerUID, containerGID := hdr.Uid, hdr.Gid
 	if hdr.Typeflag != tar.TypeLink {
 		if err := te.applyMetadata(path, hdr); err != nil {
 			return errors.Wrap(err, "apply hdr metadata")
 		}
 	}
 
+	if te.stats != nil {
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			te.stats.Directories++
+		case tar.TypeReg, tar.TypeRegA:
+			te.stats.Files++
+			te.stats.Bytes += hdr.Size
+		default:
+			te.stats.Files++
+		}
+	}
+
 	// Everything is done -- the path now exists. Add it (and all its
 	// ancestors) to the set of upper paths. We first have to figure out the
 	// proper path corresponding to hdr.Name though.
@@ -700,5 +1411,46 @@ out:
 	for pth := upperPath; pth != filepath.Dir(pth); pth = filepath.Dir(pth) {
 		te.upperPaths[pth] = struct{}{}
 	}
+
+	// Record who the path was meant to be owned by and who it is actually
+	// owned by. Hardlinks share the inode (and thus the owner) of their
+	// target, so they don't get an entry of their own.
+	if te.ownership != nil && hdr.Typeflag != tar.TypeLink {
+		st, err := te.fsEval.Lstatx(path)
+		if err != nil {
+			return errors.Wrap(err, "lstat for ownership report")
+		}
+		te.ownership.record(upperPath, Ownership{
+			ContainerUID: containerUID,
+			ContainerGID: containerGID,
+			HostUID:      int(st.Uid),
+			HostGID:      int(st.Gid),
+		})
+	}
+
+	// Record the times of directories, since extracting their contents will
+	// modify them (and in some cases, such as implicitly created parent
+	// directories, the modifications are not reverted).
+	if te.dirTimes != nil {
+		if hdr.Typeflag == tar.TypeDir {
+			atime, mtime := headerTimes(hdr)
+			te.dirTimes[upperPath] = [2]time.Time{atime, mtime}
+		} else {
+			delete(te.dirTimes, upperPath)
+		}
+	}
+
+	// Record the inode flags of the path. They are only applied once every
+	// layer has been extracted (see ApplyFileFlags), since an immutable path
+	// can't be modified by later entries. Hardlinks share the flags of their
+	// target.
+	if te.fileFlags != nil && hdr.Typeflag != tar.TypeLink {
+		key := filepath.Join("/", upperPath)
+		if flags := hdr.PAXRecords[paxFileFlags]; flags != "" {
+			te.fileFlags[key] = flags
+		} else {
+			delete(te.fileFlags, key)
+		}
+	}
 	return nil
 }
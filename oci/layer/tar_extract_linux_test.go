@@ -21,11 +21,15 @@ package layer
 
 import (
 	"archive/tar"
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sys/unix"
 )
 
@@ -114,3 +118,338 @@ func TestUnpackEntryOverlayFSWhiteout(t *testing.T) {
 		}
 	}
 }
+
+func TestUnpackEntryOverlayFSRedirect(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("trusted.* xattrs require root")
+	}
+
+	for _, test := range []struct {
+		name         string
+		whiteoutMode WhiteoutMode
+		redirect     string
+	}{
+		{"OverlayFS", OverlayFSWhiteout, "/olddir"},
+		{"OCIStandard", OCIStandardWhiteout, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryOverlayFSRedirect")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if test.whiteoutMode == OverlayFSWhiteout {
+				mknodOk, err := canMknod(dir)
+				if err != nil {
+					t.Fatalf("couldn't mknod in dir: %v", err)
+				}
+				if !mknodOk {
+					t.Skip("skipping overlayfs test on kernel < 5.8")
+				}
+			}
+
+			te := NewTarExtractor(UnpackOptions{WhiteoutMode: test.whiteoutMode})
+
+			// The lower layer contains "olddir", and the upper layer renames it
+			// to "newdir" (as produced by overlayfs with redirect_dir=on).
+			for _, ph := range []pseudoHdr{
+				{"olddir", "", tar.TypeDir, false},
+				{"olddir/file", "", tar.TypeReg, false},
+				{whPrefix + "olddir", "", tar.TypeReg, false},
+			} {
+				hdr, rdr := fromPseudoHdr(ph)
+				if err := te.UnpackEntry(dir, hdr, rdr); err != nil {
+					t.Fatalf("UnpackEntry %s failed: %v", hdr.Name, err)
+				}
+			}
+			hdr, rdr := fromPseudoHdr(pseudoHdr{"newdir", "", tar.TypeDir, false})
+			hdr.Xattrs = map[string]string{overlayRedirectXattr: "/olddir"}
+			if err := te.UnpackEntry(dir, hdr, rdr); err != nil {
+				t.Fatalf("UnpackEntry %s failed: %v", hdr.Name, err)
+			}
+			// Adding a child must not clear the redirect on the parent.
+			hdr, rdr = fromPseudoHdr(pseudoHdr{"newdir/newfile", "", tar.TypeReg, false})
+			if err := te.UnpackEntry(dir, hdr, rdr); err != nil {
+				t.Fatalf("UnpackEntry %s failed: %v", hdr.Name, err)
+			}
+
+			value := make([]byte, 256)
+			n, err := unix.Lgetxattr(filepath.Join(dir, "newdir"), overlayRedirectXattr, value)
+			if test.redirect == "" {
+				if err != unix.ENODATA {
+					t.Errorf("expected no redirect xattr outside overlayfs mode: got %q (err=%v)", string(value[:n]), err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get overlay redirect attr: %v", err)
+			}
+			if string(value[:n]) != test.redirect {
+				t.Errorf("bad redirect xattr: expected %q, got %q", test.redirect, string(value[:n]))
+			}
+		})
+	}
+}
+
+func TestUnpackEntryOverlayFSRedirectInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		typeflag byte
+		redirect string
+	}{
+		{"NonDirectory", tar.TypeReg, "/olddir"},
+		{"Empty", tar.TypeDir, ""},
+		{"EscapeAbsolute", tar.TypeDir, "/../../olddir"},
+		{"RelativeWithSlash", tar.TypeDir, "a/b"},
+		{"DotDot", tar.TypeDir, ".."},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			te := NewTarExtractor(UnpackOptions{WhiteoutMode: OverlayFSWhiteout})
+			hdr, _ := fromPseudoHdr(pseudoHdr{"newdir", "", test.typeflag, false})
+			hdr.Xattrs = map[string]string{overlayRedirectXattr: test.redirect}
+			if err := te.overlayFSRedirect(hdr); err == nil {
+				t.Errorf("expected error with redirect %q", test.redirect)
+			}
+		})
+	}
+}
+
+// Device nodes must have their ownership mapped in both directions, just like
+// any other inode (while their device numbers are left unchanged).
+func TestDeviceNodeIDMapping(t *testing.T) {
+	if os.Geteuid() != 0 || inUserNamespace {
+		t.Skip("mapping device node ownership requires root outside a user namespace")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestDeviceNodeIDMapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if ok, err := canMknod(dir); err != nil {
+		t.Fatalf("couldn't mknod in dir: %v", err)
+	} else if !ok {
+		t.Skip("test requires the ability to mknod")
+	}
+
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: 200000, ContainerID: 0, Size: 65536}},
+	}
+
+	for _, typeflag := range []byte{tar.TypeChar, tar.TypeBlock} {
+		name := "dev" + string(typeflag)
+		te := NewTarExtractor(UnpackOptions{MapOptions: mapOptions})
+		hdr := &tar.Header{
+			Name:     name,
+			Typeflag: typeflag,
+			Mode:     0600,
+			Uid:      1000,
+			Gid:      100,
+			Devmajor: 7,
+			Devminor: 42,
+		}
+		if err := te.UnpackEntry(dir, hdr, nil); err != nil {
+			t.Fatalf("unexpected UnpackEntry error: %+v", err)
+		}
+
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(dir, name), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Uid != 101000 || st.Gid != 200100 {
+			t.Errorf("device %c: unexpected host owner: %d:%d", typeflag, st.Uid, st.Gid)
+		}
+		if major, minor := unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)); major != 7 || minor != 42 {
+			t.Errorf("device %c: unexpected device number: %d:%d", typeflag, major, minor)
+		}
+
+		// Generate an entry from the device node with the same mapping.
+		reader, writer := io.Pipe()
+		tg := newTarGenerator(writer, mapOptions)
+		go func() {
+			if err := tg.AddFile(name, filepath.Join(dir, name)); err != nil {
+				t.Errorf("AddFile: unexpected error: %s", err)
+			}
+			if err := tg.tw.Close(); err != nil {
+				t.Errorf("tw.Close: unexpected error: %s", err)
+			}
+			// #nosec G104
+			_ = writer.Close()
+		}()
+
+		newHdr, err := tar.NewReader(reader).Next()
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		// #nosec G104
+		_, _ = io.Copy(ioutil.Discard, reader)
+		if newHdr.Typeflag != typeflag {
+			t.Errorf("device %c: unexpected generated typeflag: %c", typeflag, newHdr.Typeflag)
+		}
+		if newHdr.Uid != 1000 || newHdr.Gid != 100 {
+			t.Errorf("device %c: unexpected generated owner: %d:%d", typeflag, newHdr.Uid, newHdr.Gid)
+		}
+		if newHdr.Devmajor != 7 || newHdr.Devminor != 42 {
+			t.Errorf("device %c: unexpected generated device number: %d:%d", typeflag, newHdr.Devmajor, newHdr.Devminor)
+		}
+	}
+}
+
+// OwnerOverride must be able to change the owner of arbitrary entries after
+// the ID mappings have been applied.
+func TestUnpackOwnerOverride(t *testing.T) {
+	if os.Geteuid() != 0 || inUserNamespace {
+		t.Skip("chown to arbitrary owners requires root outside a user namespace")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackOwnerOverride")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "data/", Mode: 0755, Uid: 1000, Gid: 100},
+		{Typeflag: tar.TypeReg, Name: "data/file", Mode: 0644, Uid: 1000, Gid: 100},
+		{Typeflag: tar.TypeDir, Name: "data/sub/", Mode: 0755, Uid: 1000, Gid: 100},
+		{Typeflag: tar.TypeSymlink, Name: "data/sub/link", Linkname: "../file", Uid: 1000, Gid: 100},
+		{Typeflag: tar.TypeDir, Name: "database/", Mode: 0755, Uid: 1000, Gid: 100},
+		{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0644, Uid: 1000, Gid: 100},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: 200000, ContainerID: 0, Size: 65536}},
+		},
+		OwnerOverride: func(path string, hdr *tar.Header) (int, int, bool) {
+			seen = append(seen, path)
+			// The callback sees the mapped owner.
+			if hdr.Uid != 101000 || hdr.Gid != 200100 {
+				t.Errorf("OwnerOverride(%s) got unmapped owner %d:%d", path, hdr.Uid, hdr.Gid)
+			}
+			if path == "/data" || strings.HasPrefix(path, "/data/") {
+				return 5000, 6000, true
+			}
+			return -1, -1, false
+		},
+	}
+	if err := UnpackLayer(dir, &buf, unpackOptions); err != nil {
+		t.Fatalf("unexpected UnpackLayer error: %+v", err)
+	}
+
+	if len(seen) != 6 {
+		t.Errorf("expected OwnerOverride to be called for every entry: %v", seen)
+	}
+	for _, test := range []struct {
+		path     string
+		uid, gid uint32
+	}{
+		{"data", 5000, 6000},
+		{"data/file", 5000, 6000},
+		{"data/sub", 5000, 6000},
+		{"data/sub/link", 5000, 6000},
+		{"database", 101000, 200100},
+		{"etc/passwd", 101000, 200100},
+	} {
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(dir, test.path), &st); err != nil {
+			t.Errorf("unexpected lstat error: %s: %v", test.path, err)
+			continue
+		}
+		if st.Uid != test.uid || st.Gid != test.gid {
+			t.Errorf("unexpected owner of %s: expected %d:%d, got %d:%d", test.path, test.uid, test.gid, st.Uid, st.Gid)
+		}
+	}
+}
+
+func TestUnpackLayerLongPath(t *testing.T) {
+	// Build a path which is (much) longer than PATH_MAX.
+	var components []string
+	for len(filepath.Join(components...)) < 2*unix.PathMax {
+		components = append(components, strings.Repeat("d", 200))
+	}
+	longDir := filepath.Join(components...)
+
+	makeLayer := func(hdrs []*tar.Header, contents map[string]string) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			data := contents[hdr.Name]
+			hdr.Size = int64(len(data))
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(tw, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	lower := makeLayer([]*tar.Header{
+		// The parent directories are created implicitly.
+		{Name: longDir + "/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: longDir + "/file", Mode: 0644, Typeflag: tar.TypeReg},
+		{Name: longDir + "/link", Typeflag: tar.TypeLink, Linkname: longDir + "/file"},
+		{Name: longDir + "/symlink", Typeflag: tar.TypeSymlink, Linkname: "file"},
+		{Name: longDir + "/junk", Mode: 0644, Typeflag: tar.TypeReg},
+	}, map[string]string{
+		longDir + "/file": "long path contents",
+		longDir + "/junk": "junk",
+	})
+	upper := makeLayer([]*tar.Header{
+		{Name: longDir + "/.wh.junk", Mode: 0644, Typeflag: tar.TypeReg},
+	}, nil)
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerLongPath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, layer := range [][]byte{lower, upper} {
+		if err := UnpackLayer(dir, bytes.NewReader(layer), nil); err != nil {
+			t.Fatalf("unexpected UnpackLayer error: %+v", err)
+		}
+	}
+
+	fsEval := unpackFsEval(nil)
+	for _, name := range []string{"file", "link", "symlink"} {
+		fh, err := fsEval.Open(filepath.Join(dir, longDir, name))
+		if err != nil {
+			t.Errorf("unexpected error opening %s: %+v", name, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(fh)
+		fh.Close()
+		if err != nil {
+			t.Errorf("unexpected error reading %s: %+v", name, err)
+		} else if string(data) != "long path contents" {
+			t.Errorf("unexpected contents of %s: %q", name, data)
+		}
+	}
+	if fi, err := fsEval.Lstat(filepath.Join(dir, longDir, "symlink")); err != nil {
+		t.Errorf("unexpected error lstat symlink: %+v", err)
+	} else if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
+		t.Errorf("expected symlink to be a symlink, got mode %s", fi.Mode())
+	}
+	if _, err := fsEval.Lstat(filepath.Join(dir, longDir, "junk")); !os.IsNotExist(err) {
+		t.Errorf("expected whited-out path to be removed, got %v", err)
+	}
+}
@@ -21,10 +21,12 @@ import (
 	"archive/tar"
 	"bytes"
 	"crypto/rand"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
@@ -728,6 +730,99 @@ func TestUnpackHardlink(t *testing.T) {
 	}
 }
 
+// TestUnpackHardlinkGroup checks that every member of a hardlink group ends
+// up as the same inode with the metadata of the first member, even when the
+// members are linked to each other (rather than to the first member), live in
+// read-only directories, and the owner is mapped.
+func TestUnpackHardlinkGroup(t *testing.T) {
+	data := []byte("hardlink group contents")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "etc/a", Mode: 04750, Typeflag: tar.TypeReg, Uid: 1000, Gid: 100, Size: int64(len(data))},
+		// The metadata of hardlink entries must not be applied.
+		{Name: "etc/b", Typeflag: tar.TypeLink, Linkname: "etc/a", Mode: 0644, Uid: 1337, Gid: 1337},
+		{Name: "ro/", Mode: 0555, Typeflag: tar.TypeDir},
+		{Name: "ro/c", Typeflag: tar.TypeLink, Linkname: "/etc/b"},
+		// Linking a path to itself (as GNU tar does for paths archived more
+		// than once) or repeating a hardlink entry must be a no-op.
+		{Name: "etc/a", Typeflag: tar.TypeLink, Linkname: "./etc/a"},
+		{Name: "ro/c", Typeflag: tar.TypeLink, Linkname: "etc/a"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Map the owner of etc/a to a different host owner (or to ourselves in
+	// rootless mode).
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+	}
+	expectedUID, expectedGID := uint32(101000), uint32(100100)
+	if os.Geteuid() != 0 {
+		mapOptions = MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1}},
+			Rootless:    true,
+		}
+		expectedUID, expectedGID = uint32(os.Geteuid()), uint32(os.Getegid())
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackHardlinkGroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Extracting the layer twice must give the same result.
+	for i := 0; i < 2; i++ {
+		if err := UnpackLayer(dir, bytes.NewReader(buf.Bytes()), &UnpackOptions{MapOptions: mapOptions}); err != nil {
+			t.Fatalf("unexpected UnpackLayer error (pass %d): %+v", i, err)
+		}
+
+		var first unix.Stat_t
+		for idx, path := range []string{"etc/a", "etc/b", "ro/c"} {
+			var st unix.Stat_t
+			if err := unix.Lstat(filepath.Join(dir, path), &st); err != nil {
+				t.Fatalf("hardlink group member %s missing: %v", path, err)
+			}
+			if idx == 0 {
+				first = st
+			}
+			if st.Ino != first.Ino {
+				t.Errorf("pass %d: %s is not the same inode as etc/a: %d != %d", i, path, st.Ino, first.Ino)
+			}
+			if st.Nlink != 3 {
+				t.Errorf("pass %d: %s has unexpected link count %d", i, path, st.Nlink)
+			}
+			if st.Mode&07777 != 04750 {
+				t.Errorf("pass %d: %s has unexpected mode %o", i, path, st.Mode&07777)
+			}
+			if st.Uid != expectedUID || st.Gid != expectedGID {
+				t.Errorf("pass %d: %s has unexpected owner %d:%d", i, path, st.Uid, st.Gid)
+			}
+		}
+		got, err := ioutil.ReadFile(filepath.Join(dir, "ro/c"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("pass %d: unexpected hardlink contents: %q", i, got)
+		}
+	}
+}
+
 // TestUnpackEntryMap checks that the mapOptions handling works.
 func TestUnpackEntryMap(t *testing.T) {
 	if os.Geteuid() != 0 {
@@ -957,3 +1052,1371 @@ func TestIsDirlink(t *testing.T) {
 		t.Errorf("file dirlink test failed")
 	}
 }
+
+// TestUnpackEntryUnsafeName makes sure that entries with control characters in
+// their names are rejected (or sanitised if requested).
+func TestUnpackEntryUnsafeName(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		entryName string
+		sanitized string
+	}{
+		{"Newline", "etc/pass\nwd", "etc/pass_wd"},
+		{"Escape", "bin/\x1b[31mls", "bin/_[31mls"},
+		{"Delete", "file\x7f", "file_"},
+		{"NUL", "file\x00.txt", "file_.txt"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryUnsafeName")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			data := []byte("some content")
+			newHeader := func() *tar.Header {
+				return &tar.Header{
+					Name:     test.entryName,
+					Uid:      os.Getuid(),
+					Gid:      os.Getgid(),
+					Mode:     0644,
+					Size:     int64(len(data)),
+					Typeflag: tar.TypeReg,
+				}
+			}
+
+			// Rejected by default.
+			rootfs := filepath.Join(dir, "reject")
+			if err := os.MkdirAll(filepath.Join(rootfs, filepath.Dir(test.sanitized)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			te := NewTarExtractor(UnpackOptions{})
+			if err := te.UnpackEntry(rootfs, newHeader(), bytes.NewReader(data)); err == nil {
+				t.Errorf("expected UnpackEntry to reject unsafe name %q", test.entryName)
+			} else if !strings.Contains(err.Error(), "unsafe entry name") {
+				t.Errorf("unexpected UnpackEntry error: %v", err)
+			}
+			if infos, err := ioutil.ReadDir(filepath.Join(rootfs, filepath.Dir(test.sanitized))); err != nil || len(infos) != 0 {
+				t.Errorf("rejected entry was extracted: %v (%v)", infos, err)
+			}
+
+			// Sanitised if requested.
+			rootfs = filepath.Join(dir, "sanitize")
+			if err := os.MkdirAll(filepath.Join(rootfs, filepath.Dir(test.sanitized)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			te = NewTarExtractor(UnpackOptions{UnsafeNameMode: SanitizeUnsafeNames})
+			if err := te.UnpackEntry(rootfs, newHeader(), bytes.NewReader(data)); err != nil {
+				t.Fatalf("unexpected UnpackEntry error: %+v", err)
+			}
+			if got, err := ioutil.ReadFile(filepath.Join(rootfs, test.sanitized)); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("sanitised entry not extracted to %q: %q (%v)", test.sanitized, got, err)
+			}
+		})
+	}
+}
+
+// TestUnpackLayerUnsafeName makes sure that unsafe names in an actual tar
+// stream cause UnpackLayer to fail.
+func TestUnpackLayerUnsafeName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerUnsafeName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"safe", "unsafe\nname"} {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = UnpackLayer(dir, bytes.NewReader(buf.Bytes()), nil)
+	if err == nil {
+		t.Fatalf("expected UnpackLayer to fail with unsafe entry name")
+	}
+	if !strings.Contains(err.Error(), `unsafe entry name "unsafe\nname"`) {
+		t.Errorf("unexpected UnpackLayer error: %v", err)
+	}
+}
+
+// TestUnpackLayerAbsolutePath makes sure that absolute entry names (and
+// hardlink targets) are extracted relative to the rootfs by default, and are
+// rejected with RejectAbsolutePaths.
+func TestUnpackLayerAbsolutePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerAbsolutePath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("root:x:0:0:root:/root:/bin/sh\n")
+	makeLayer := func(hdrs ...*tar.Header) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			if hdr.Typeflag == tar.TypeReg {
+				hdr.Size = int64(len(data))
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := tw.Write(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	absLayer := makeLayer(
+		&tar.Header{Name: "/etc/", Mode: 0755, Typeflag: tar.TypeDir},
+		&tar.Header{Name: "/etc/passwd", Mode: 0644, Typeflag: tar.TypeReg},
+		&tar.Header{Name: "//etc/passwd-", Linkname: "/etc/passwd", Typeflag: tar.TypeLink},
+		&tar.Header{Name: "etc/group", Mode: 0644, Typeflag: tar.TypeReg},
+	)
+	absLinkLayer := makeLayer(
+		&tar.Header{Name: "etc/passwd", Mode: 0644, Typeflag: tar.TypeReg},
+		&tar.Header{Name: "etc/passwd-", Linkname: "/etc/passwd", Typeflag: tar.TypeLink},
+	)
+
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    os.Geteuid() != 0,
+	}
+
+	t.Run("Strip", func(t *testing.T) {
+		rootfs := filepath.Join(dir, "strip")
+		if err := UnpackLayer(rootfs, bytes.NewReader(absLayer), &UnpackOptions{MapOptions: mapOptions}); err != nil {
+			t.Fatalf("unexpected UnpackLayer error: %+v", err)
+		}
+		for _, path := range []string{"etc/passwd", "etc/passwd-", "etc/group"} {
+			if got, err := ioutil.ReadFile(filepath.Join(rootfs, path)); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("entry %s not extracted inside rootfs: %q (%v)", path, got, err)
+			}
+		}
+		fi1, err := os.Lstat(filepath.Join(rootfs, "etc/passwd"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi2, err := os.Lstat(filepath.Join(rootfs, "etc/passwd-"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(fi1, fi2) {
+			t.Errorf("hardlink with absolute target not linked to etc/passwd")
+		}
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		for name, layer := range map[string][]byte{
+			"Name":     absLayer,
+			"Linkname": absLinkLayer,
+		} {
+			rootfs := filepath.Join(dir, "reject-"+name)
+			err := UnpackLayer(rootfs, bytes.NewReader(layer), &UnpackOptions{
+				MapOptions:       mapOptions,
+				AbsolutePathMode: RejectAbsolutePaths,
+			})
+			if err == nil {
+				t.Errorf("expected UnpackLayer to reject absolute %s", name)
+			} else if !strings.Contains(err.Error(), `absolute entry name "/etc`) {
+				t.Errorf("unexpected UnpackLayer error for absolute %s: %v", name, err)
+			}
+		}
+	})
+}
+
+// TestSymlinkTargetRoundTrip makes sure that symlink targets are preserved
+// byte-for-byte when packing and unpacking, while the location of the link is
+// still scoped to the rootfs.
+func TestSymlinkTargetRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestSymlinkTargetRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, path := range []string{src, dst} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	targets := map[string]string{
+		"relative":        "../lib/libc.so.6",
+		"dot-relative":    "./sibling",
+		"unclean":         "a//b/./../c/",
+		"absolute":        "/etc/passwd",
+		"absolute-escape": "/../../../../etc/shadow",
+		"escape":          "../../../../../../etc/shadow",
+		"dangling":        "nonexistent",
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, MapOptions{})
+	for name, target := range targets {
+		path := filepath.Join(src, name)
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+		if err := tg.AddFile(name, path); err != nil {
+			t.Fatalf("AddFile %s: unexpected error: %+v", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	te := NewTarExtractor(UnpackOptions{})
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("reading tar archive: %+v", err)
+		}
+		if hdr.Linkname != targets[hdr.Name] {
+			t.Errorf("%s: packed symlink target changed: expected %q, got %q", hdr.Name, targets[hdr.Name], hdr.Linkname)
+		}
+		if err := te.UnpackEntry(dst, hdr, tr); err != nil {
+			t.Fatalf("UnpackEntry %s: unexpected error: %+v", hdr.Name, err)
+		}
+	}
+
+	for name, target := range targets {
+		got, err := os.Readlink(filepath.Join(dst, name))
+		if err != nil {
+			t.Errorf("%s: unexpected readlink error: %+v", name, err)
+			continue
+		}
+		if got != target {
+			t.Errorf("%s: unpacked symlink target changed: expected %q, got %q", name, target, got)
+		}
+	}
+
+	// The link's own path must still be scoped to the rootfs, even though
+	// its target is left untouched.
+	if err := te.UnpackEntry(dst, &tar.Header{
+		Name:     "../../outside",
+		Linkname: "../../outside-target",
+		Typeflag: tar.TypeSymlink,
+	}, nil); err != nil {
+		t.Fatalf("UnpackEntry: unexpected error: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "outside")); !os.IsNotExist(err) {
+		t.Errorf("symlink was created outside of the rootfs: %v", err)
+	}
+	if got, err := os.Readlink(filepath.Join(dst, "outside")); err != nil {
+		t.Errorf("unexpected readlink error: %+v", err)
+	} else if got != "../../outside-target" {
+		t.Errorf("scoped symlink target changed: expected %q, got %q", "../../outside-target", got)
+	}
+}
+
+func TestUnpackLayerAllowedIDRange(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("AllowedIDRange tests only work with root privileges")
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		// Container 1500 maps to host 101500, inside the allowed range.
+		{Name: "inrange", Mode: 0644, Typeflag: tar.TypeReg, Uid: 1500, Gid: 1500},
+		// Container root maps to host 100000, below the allowed range.
+		{Name: "root", Mode: 0644, Typeflag: tar.TypeReg, Uid: 0, Gid: 0},
+		// Container 5000 maps to host 105000, above the allowed range.
+		{Name: "high", Mode: 0644, Typeflag: tar.TypeReg, Uid: 5000, Gid: 1500},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+	}
+	allowed := &IDRange{Min: 101000, Max: 101999}
+
+	for _, test := range []struct {
+		name   string
+		mode   IDRangeMode
+		fail   bool
+		owners map[string][2]int
+	}{
+		{"Reject", RejectOutOfRangeIDs, true, nil},
+		{"Clamp", ClampOutOfRangeIDs, false, map[string][2]int{
+			"inrange": {101500, 101500},
+			"root":    {101000, 101000},
+			"high":    {101999, 101500},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerAllowedIDRange")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opt := UnpackOptions{
+				MapOptions:     mapOptions,
+				AllowedIDRange: allowed,
+				IDRangeMode:    test.mode,
+			}
+			err = UnpackLayer(dir, bytes.NewReader(buf.Bytes()), &opt)
+			if test.fail {
+				if !errors.Is(err, ErrOwnerOutOfRange) {
+					t.Fatalf("expected UnpackLayer to fail with ErrOwnerOutOfRange: %+v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected UnpackLayer error: %+v", err)
+			}
+			for name, owner := range test.owners {
+				var st unix.Stat_t
+				if err := unix.Lstat(filepath.Join(dir, name), &st); err != nil {
+					t.Fatalf("unexpected error lstat %s: %+v", name, err)
+				}
+				if got := [2]int{int(st.Uid), int(st.Gid)}; got != owner {
+					t.Errorf("unexpected owner of %s: expected %v got %v", name, owner, got)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackLayerUnsupportedType(t *testing.T) {
+	contents := []byte("contiguous contents")
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "plain", Mode: 0644, Typeflag: tar.TypeReg},
+		{Name: "contiguous", Mode: 0600, Typeflag: tar.TypeCont, Size: int64(len(contents))},
+		{Name: "later", Mode: 0644, Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeCont {
+			if _, err := tw.Write(contents); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		mode       UnsupportedTypeMode
+		fail       bool
+		contiguous bool
+	}{
+		{"Reject", RejectUnsupportedTypes, true, false},
+		{"Skip", SkipUnsupportedTypes, false, false},
+		{"Regular", RegularUnsupportedTypes, false, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerUnsupportedType")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opt := UnpackOptions{UnsupportedTypeMode: test.mode}
+			err = UnpackLayer(dir, bytes.NewReader(buf.Bytes()), &opt)
+			if test.fail {
+				if err == nil {
+					t.Fatalf("expected UnpackLayer to fail with unsupported typeflag")
+				}
+				if !strings.Contains(err.Error(), "unsupported typeflag") {
+					t.Errorf("unexpected UnpackLayer error: %v", err)
+				}
+				if _, err := os.Lstat(filepath.Join(dir, "contiguous")); !os.IsNotExist(err) {
+					t.Errorf("expected rejected entry to not be extracted: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected UnpackLayer error: %+v", err)
+			}
+			for _, name := range []string{"plain", "later"} {
+				if _, err := os.Lstat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("expected %s to be extracted: %v", name, err)
+				}
+			}
+
+			fi, err := os.Lstat(filepath.Join(dir, "contiguous"))
+			if !test.contiguous {
+				if !os.IsNotExist(err) {
+					t.Errorf("expected skipped entry to not be extracted: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected contiguous file to be extracted: %v", err)
+			}
+			if !fi.Mode().IsRegular() || fi.Mode().Perm() != 0600 {
+				t.Errorf("contiguous file not extracted as a regular file: %s", fi.Mode())
+			}
+			got, err := ioutil.ReadFile(filepath.Join(dir, "contiguous"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, contents) {
+				t.Errorf("unexpected contents of contiguous file: %q", got)
+			}
+		})
+	}
+}
+
+func TestUnpackLayerUnknownPAX(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "plain", Mode: 0644, Typeflag: tar.TypeReg},
+		{
+			Name:     "vendor",
+			Mode:     0644,
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatPAX,
+			PAXRecords: map[string]string{
+				"VENDOR.custom":           "value",
+				"SCHILY.xattr.user.known": "xattr",
+			},
+		},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		mode   UnknownPAXMode
+		fail   bool
+		record map[string]map[string]string
+	}{
+		{"Ignore", IgnoreUnknownPAX, false, nil},
+		{"Record", RecordUnknownPAX, false, map[string]map[string]string{
+			"/vendor": {"VENDOR.custom": "value"},
+		}},
+		{"Reject", RejectUnknownPAX, true, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerUnknownPAX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opt := UnpackOptions{UnknownPAXMode: test.mode}
+			if test.mode == RecordUnknownPAX {
+				opt.UnknownPAXRecords = map[string]map[string]string{}
+			}
+			err = UnpackLayer(dir, bytes.NewReader(buf.Bytes()), &opt)
+			if test.fail {
+				if err == nil {
+					t.Fatalf("expected UnpackLayer to fail with unknown pax record")
+				}
+				if !strings.Contains(err.Error(), "unknown pax records: VENDOR.custom") {
+					t.Errorf("unexpected UnpackLayer error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected UnpackLayer error: %+v", err)
+			}
+			for _, name := range []string{"plain", "vendor"} {
+				if _, err := os.Lstat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("expected %s to be extracted: %v", name, err)
+				}
+			}
+			if !reflect.DeepEqual(opt.UnknownPAXRecords, test.record) {
+				t.Errorf("unexpected recorded pax records: expected %v, got %v", test.record, opt.UnknownPAXRecords)
+			}
+		})
+	}
+}
+
+func TestUnpackLayerOwnershipReport(t *testing.T) {
+	makeLayer := func(hdrs []*tar.Header) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	lower := makeLayer([]*tar.Header{
+		{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "etc/passwd", Mode: 0644, Typeflag: tar.TypeReg},
+		{Name: "home/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "home/user/", Mode: 0755, Typeflag: tar.TypeDir, Uid: 1000, Gid: 100},
+		{Name: "home/user/a", Mode: 0644, Typeflag: tar.TypeReg, Uid: 1000, Gid: 100},
+		{Name: "home/user/b", Typeflag: tar.TypeSymlink, Linkname: "a", Uid: 1000, Gid: 100},
+		{Name: "home/user/link", Typeflag: tar.TypeLink, Linkname: "home/user/a"},
+		{Name: "home/user/junk/", Mode: 0755, Typeflag: tar.TypeDir, Uid: 0, Gid: 0},
+	})
+	upper := makeLayer([]*tar.Header{
+		{Name: "home/user/.wh.junk", Mode: 0644, Typeflag: tar.TypeReg},
+	})
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerOwnershipReport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var report OwnershipReport
+	opt := UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    true,
+		},
+		OwnershipReport: &report,
+	}
+	for _, layer := range [][]byte{lower, upper} {
+		if err := UnpackLayer(dir, bytes.NewReader(layer), &opt); err != nil {
+			t.Fatalf("unexpected UnpackLayer error: %+v", err)
+		}
+	}
+
+	// Everything is owned by us, even though the layer asked otherwise.
+	root := Ownership{HostUID: os.Geteuid(), HostGID: os.Getegid()}
+	user := root
+	user.ContainerUID, user.ContainerGID = 1000, 100
+	expected := []OwnershipReportEntry{
+		{Path: "/etc", Ownership: root, Recursive: true},
+		{Path: "/home", Ownership: root},
+		{Path: "/home/user", Ownership: user, Recursive: true},
+	}
+	if got := report.Entries(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected ownership report: expected %+v, got %+v", expected, got)
+	}
+}
+
+// largeFileLayer returns an uncompressed layer containing a single regular
+// file with size bytes of pseudo-random contents.
+func largeFileLayer(tb testing.TB, size int) ([]byte, []byte) {
+	contents := make([]byte, size)
+	if _, err := rand.Read(contents); err != nil {
+		tb.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "large", Mode: 0644, Typeflag: tar.TypeReg, Size: int64(size)}); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		tb.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes(), contents
+}
+
+func TestUnpackLayerCopyBufferSize(t *testing.T) {
+	layer, contents := largeFileLayer(t, 3<<20+17)
+
+	for _, size := range []int{0, 1, 4096, 1 << 20, 8 << 20} {
+		dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerCopyBufferSize")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		opt := UnpackOptions{CopyBufferSize: size}
+		if err := UnpackLayer(dir, bytes.NewReader(layer), &opt); err != nil {
+			t.Fatalf("CopyBufferSize=%d: unexpected UnpackLayer error: %+v", size, err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(dir, "large"))
+		if err != nil {
+			t.Fatalf("CopyBufferSize=%d: unexpected error reading file: %+v", size, err)
+		}
+		if !bytes.Equal(got, contents) {
+			t.Errorf("CopyBufferSize=%d: extracted contents do not match (got %d bytes, expected %d)", size, len(got), len(contents))
+		}
+	}
+}
+
+func BenchmarkUnpackLayerCopyBufferSize(b *testing.B) {
+	layer, _ := largeFileLayer(b, 64<<20)
+
+	for _, size := range []int{0, 4 << 10, 128 << 10, 1 << 20, 4 << 20} {
+		name := "Default"
+		if size > 0 {
+			name = fmt.Sprintf("%dKiB", size>>10)
+		}
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "umoci-BenchmarkUnpackLayerCopyBufferSize")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			b.SetBytes(int64(len(layer)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				opt := UnpackOptions{CopyBufferSize: size}
+				if err := UnpackLayer(dir, bytes.NewReader(layer), &opt); err != nil {
+					b.Fatalf("unexpected UnpackLayer error: %+v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackLayerDirectoryTimesLast(t *testing.T) {
+	dirMtime := testutils.Unix(123, 0)
+	fileMtime := testutils.Unix(987654321, 0)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "dir/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: dirMtime},
+		{Name: "dir/file", Mode: 0644, Typeflag: tar.TypeReg, ModTime: fileMtime},
+		// The parent directories of this entry are created implicitly.
+		{Name: "dir/implicit/sub/file", Mode: 0644, Typeflag: tar.TypeReg, ModTime: fileMtime},
+		{Name: "dir/nested/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: dirMtime},
+		{Name: "dir/nested/file", Mode: 0644, Typeflag: tar.TypeReg, ModTime: fileMtime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerDirectoryTimesLast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := UnpackOptions{DirectoryTimesLast: true}
+	if err := UnpackLayer(dir, bytes.NewReader(buf.Bytes()), &opt); err != nil {
+		t.Fatalf("unexpected UnpackLayer error: %+v", err)
+	}
+
+	for _, pth := range []string{"dir", "dir/nested"} {
+		fi, err := os.Lstat(filepath.Join(dir, pth))
+		if err != nil {
+			t.Fatalf("unexpected error lstat %s: %+v", pth, err)
+		}
+		if !fi.ModTime().Equal(dirMtime) {
+			t.Errorf("mtime of %s not restored: got %s expected %s", pth, fi.ModTime(), dirMtime)
+		}
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "dir/file"))
+	if err != nil {
+		t.Fatalf("unexpected error lstat dir/file: %+v", err)
+	}
+	if !fi.ModTime().Equal(fileMtime) {
+		t.Errorf("mtime of dir/file changed: got %s expected %s", fi.ModTime(), fileMtime)
+	}
+}
+
+func TestUnpackLayerImplicitDirectoryMode(t *testing.T) {
+	const implicitMode = 0710
+
+	for _, test := range []struct {
+		name    string
+		headers []*tar.Header
+		modes   map[string]os.FileMode
+	}{
+		{"Implicit", []*tar.Header{
+			{Name: "a/b/file", Mode: 0644, Typeflag: tar.TypeReg},
+		}, map[string]os.FileMode{
+			"a":   implicitMode,
+			"a/b": implicitMode,
+		}},
+		{"ExplicitLater", []*tar.Header{
+			{Name: "a/b/file", Mode: 0644, Typeflag: tar.TypeReg},
+			{Name: "a/", Mode: 0750, Typeflag: tar.TypeDir},
+		}, map[string]os.FileMode{
+			"a":   0750,
+			"a/b": implicitMode,
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range test.headers {
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerImplicitDirectoryMode")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opt := UnpackOptions{ImplicitDirectoryMode: implicitMode}
+			if err := UnpackLayer(dir, bytes.NewReader(buf.Bytes()), &opt); err != nil {
+				t.Fatalf("unexpected UnpackLayer error: %+v", err)
+			}
+
+			for pth, mode := range test.modes {
+				fi, err := os.Lstat(filepath.Join(dir, pth))
+				if err != nil {
+					t.Fatalf("unexpected error lstat %s: %+v", pth, err)
+				}
+				if !fi.IsDir() {
+					t.Errorf("%s is not a directory: %s", pth, fi.Mode())
+				}
+				if got := fi.Mode().Perm(); got != mode {
+					t.Errorf("unexpected mode of %s: got %o expected %o", pth, got, mode)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackLayerRootlessDevices(t *testing.T) {
+	makeLayer := func(hdrs []*tar.Header) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	lower := makeLayer([]*tar.Header{
+		{Name: "dev/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "dev/null", Mode: 0666, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3},
+		{Name: "dev/loop0", Mode: 0660, Typeflag: tar.TypeBlock, Devmajor: 7, Devminor: 0, Gid: 6},
+		{Name: "dev/zero", Mode: 0666, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 5},
+	})
+	// The upper layer removes /dev/zero, so it is no longer a skipped device.
+	upper := makeLayer([]*tar.Header{
+		{Name: "dev/.wh.zero", Mode: 0644, Typeflag: tar.TypeReg},
+	})
+
+	for _, test := range []struct {
+		name  string
+		mode  RootlessDeviceMode
+		fail  bool
+		empty bool
+	}{
+		{"Skip", SkipRootlessDevices, false, false},
+		{"EmptyFile", EmptyFileRootlessDevices, false, true},
+		{"Reject", RejectRootlessDevices, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerRootlessDevices")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			skipped := map[string]DeviceNode{}
+			opt := UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+					GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+					Rootless:    true,
+				},
+				RootlessDeviceMode: test.mode,
+				SkippedDevices:     skipped,
+			}
+			for _, layer := range [][]byte{lower, upper} {
+				err = UnpackLayer(dir, bytes.NewReader(layer), &opt)
+				if err != nil {
+					break
+				}
+			}
+			if test.fail {
+				if err == nil {
+					t.Fatalf("expected UnpackLayer to fail with a device entry")
+				}
+				if _, err := os.Lstat(filepath.Join(dir, "dev/null")); !os.IsNotExist(err) {
+					t.Errorf("expected rejected device to not be created: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected UnpackLayer error: %+v", err)
+			}
+
+			for _, name := range []string{"dev/null", "dev/loop0"} {
+				fi, err := os.Lstat(filepath.Join(dir, name))
+				if !test.empty {
+					if !os.IsNotExist(err) {
+						t.Errorf("expected skipped device %s to not be created: %v", name, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("expected empty file in place of device %s: %v", name, err)
+					continue
+				}
+				if !fi.Mode().IsRegular() || fi.Size() != 0 {
+					t.Errorf("expected empty file in place of device %s: mode=%s size=%d", name, fi.Mode(), fi.Size())
+				}
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "dev/zero")); !os.IsNotExist(err) {
+				t.Errorf("expected whited-out device to not exist: %v", err)
+			}
+
+			expected := map[string]DeviceNode{}
+			if !test.empty {
+				expected = map[string]DeviceNode{
+					"/dev/null":  {Type: "char", Major: 1, Minor: 3, Mode: 0666},
+					"/dev/loop0": {Type: "block", Major: 7, Minor: 0, Mode: 0660, GID: 6},
+				}
+			}
+			if !reflect.DeepEqual(skipped, expected) {
+				t.Errorf("unexpected skipped devices: expected %v got %v", expected, skipped)
+			}
+		})
+	}
+}
+
+func TestUnpackLayerFifosSockets(t *testing.T) {
+	makeLayer := func(hdrs []*tar.Header) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	// The lower layer has a regular file which the upper layer replaces with
+	// a socket, which must still be removed even though the socket is not
+	// created.
+	lower := makeLayer([]*tar.Header{
+		{Name: "run/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "run/app.sock", Mode: 0644, Typeflag: tar.TypeReg},
+	})
+	upper := makeLayer([]*tar.Header{
+		{Name: "run/fifo", Mode: 0620, Typeflag: tar.TypeFifo},
+		{Name: "run/app.sock", Mode: 0140755, Typeflag: tar.TypeReg},
+	})
+
+	for _, test := range []struct {
+		name       string
+		fifoMode   FifoMode
+		socketMode SocketMode
+		expected   map[string]DeviceNode
+	}{
+		{"Default", CreateFifos, SkipSockets, map[string]DeviceNode{}},
+		{"Record", RecordFifos, RecordSockets, map[string]DeviceNode{
+			"/run/fifo":     {Type: "fifo", Mode: 0620},
+			"/run/app.sock": {Type: "socket", Mode: 0755},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerFifosSockets")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			skipped := map[string]DeviceNode{}
+			opt := UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+					GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+					Rootless:    os.Geteuid() != 0,
+				},
+				FifoMode:       test.fifoMode,
+				SocketMode:     test.socketMode,
+				SkippedDevices: skipped,
+			}
+			for _, layer := range [][]byte{lower, upper} {
+				if err := UnpackLayer(dir, bytes.NewReader(layer), &opt); err != nil {
+					t.Fatalf("unexpected UnpackLayer error: %+v", err)
+				}
+			}
+
+			fi, err := os.Lstat(filepath.Join(dir, "run/fifo"))
+			if test.fifoMode == CreateFifos {
+				if err != nil {
+					t.Errorf("expected fifo to be created: %v", err)
+				} else if fi.Mode()&os.ModeNamedPipe == 0 {
+					t.Errorf("expected run/fifo to be a fifo, got mode %s", fi.Mode())
+				}
+			} else if !os.IsNotExist(err) {
+				t.Errorf("expected recorded fifo to not be created: %v", err)
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "run/app.sock")); !os.IsNotExist(err) {
+				t.Errorf("expected socket (and the file it replaced) to not exist: %v", err)
+			}
+
+			if !reflect.DeepEqual(skipped, test.expected) {
+				t.Errorf("unexpected skipped devices: expected %v got %v", test.expected, skipped)
+			}
+		})
+	}
+}
+
+// TestUnpackWhiteoutSymlink checks that whiting out a symlink (directly or
+// with an opaque whiteout of its parent) removes the symlink itself rather
+// than the path it points to.
+func TestUnpackWhiteoutSymlink(t *testing.T) {
+	makeLayer := func(hdrs []*tar.Header) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Size > 0 {
+				if _, err := tw.Write([]byte(strings.Repeat("x", int(hdr.Size)))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	lower := makeLayer([]*tar.Header{
+		{Name: "important/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "important/file", Mode: 0644, Typeflag: tar.TypeReg, Size: 4},
+		{Name: "link", Linkname: "/important", Typeflag: tar.TypeSymlink},
+		{Name: "rel", Linkname: "important", Typeflag: tar.TypeSymlink},
+		{Name: "filelink", Linkname: "/important/file", Typeflag: tar.TypeSymlink},
+		{Name: "opaque/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "opaque/link", Linkname: "/important", Typeflag: tar.TypeSymlink},
+	})
+	upper := makeLayer([]*tar.Header{
+		{Name: ".wh.link", Typeflag: tar.TypeReg},
+		{Name: ".wh.rel", Typeflag: tar.TypeReg},
+		{Name: ".wh.filelink", Typeflag: tar.TypeReg},
+		{Name: "opaque/.wh..wh..opq", Typeflag: tar.TypeReg},
+	})
+
+	for _, rootless := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Rootless=%v", rootless), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackWhiteoutSymlink")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opt := UnpackOptions{MapOptions: MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+				GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+				Rootless:    rootless || os.Geteuid() != 0,
+			}}
+			for _, layer := range [][]byte{lower, upper} {
+				if err := UnpackLayer(dir, bytes.NewReader(layer), &opt); err != nil {
+					t.Fatalf("unexpected UnpackLayer error: %+v", err)
+				}
+			}
+
+			for _, name := range []string{"link", "rel", "filelink", "opaque/link"} {
+				if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+					t.Errorf("expected whited-out symlink %s to be removed: %v", name, err)
+				}
+			}
+			if fi, err := os.Lstat(filepath.Join(dir, "opaque")); err != nil || !fi.IsDir() {
+				t.Errorf("expected opaque directory to be kept: %v", err)
+			}
+			if fi, err := os.Lstat(filepath.Join(dir, "important")); err != nil || !fi.IsDir() {
+				t.Errorf("symlink target directory was modified: %v", err)
+			}
+			if data, err := ioutil.ReadFile(filepath.Join(dir, "important/file")); err != nil || string(data) != "xxxx" {
+				t.Errorf("symlink target file was modified: %q %v", data, err)
+			}
+		})
+	}
+}
+
+func TestUnpackEntryMarkerWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryMarkerWhiteout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layers := [][]pseudoHdr{
+		{
+			{"file", "", tar.TypeReg, false},
+			{"dir", "", tar.TypeDir, false},
+			{"dir/a", "", tar.TypeReg, false},
+			{"dir/sub", "", tar.TypeDir, false},
+			{"dir/sub/b", "", tar.TypeReg, false},
+			{"keep", "", tar.TypeReg, false},
+		},
+		{
+			{whPrefix + "file", "", tar.TypeReg, false},
+			{"dir/" + whOpaque, "", tar.TypeReg, false},
+			{"dir/sub/" + whPrefix + "b", "", tar.TypeReg, false},
+			{whPrefix + "missing", "", tar.TypeReg, false},
+		},
+		{
+			{whPrefix + "file", "", tar.TypeReg, false},
+		},
+	}
+
+	unpackOptions := UnpackOptions{
+		MapOptions: MapOptions{
+			Rootless: os.Geteuid() != 0,
+		},
+		WhiteoutMode: MarkerWhiteout,
+	}
+	for idx, layer := range layers {
+		te := NewTarExtractor(unpackOptions)
+		for _, ph := range layer {
+			hdr, rdr := fromPseudoHdr(ph)
+			if err := te.UnpackEntry(dir, hdr, rdr); err != nil {
+				t.Fatalf("layer %d: UnpackEntry %s failed: %v", idx, hdr.Name, err)
+			}
+		}
+	}
+
+	// Nothing should have been removed.
+	for _, path := range []string{"file", "dir/a", "dir/sub/b", "keep"} {
+		if _, err := os.Lstat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("whited-out path %s was removed: %v", path, err)
+		}
+	}
+
+	// Markers must appear wherever a deletion would have occurred.
+	for path, expected := range map[string]string{
+		"file" + WhiteoutMarkerSuffix:      whPrefix + "file\n" + whPrefix + "file\n",
+		"dir/" + WhiteoutMarkerSuffix:      "dir/" + whOpaque + "\n",
+		"dir/sub/b" + WhiteoutMarkerSuffix: "dir/sub/" + whPrefix + "b\n",
+	} {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Errorf("missing whiteout marker %s: %v", path, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("unexpected contents of whiteout marker %s: expected %q got %q", path, expected, string(contents))
+		}
+	}
+
+	// No markers should be written for paths that don't exist, or for paths
+	// which were not whited-out.
+	for _, path := range []string{"missing" + WhiteoutMarkerSuffix, "keep" + WhiteoutMarkerSuffix} {
+		if _, err := os.Lstat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("unexpected whiteout marker %s: %v", path, err)
+		}
+	}
+}
+
+// TestUnpackEntryMarkerWhiteoutSymlink makes sure that a symlink placed at the
+// path of a whiteout marker by a lower layer is never followed.
+func TestUnpackEntryMarkerWhiteoutSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryMarkerWhiteoutSymlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	victim := filepath.Join(dir, "victim")
+	if err := ioutil.WriteFile(victim, []byte("host data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	victimDir := filepath.Join(dir, "victim-dir")
+	if err := os.Mkdir(victimDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	layers := [][]pseudoHdr{
+		{
+			{"foo", "", tar.TypeReg, false},
+			{"foo" + WhiteoutMarkerSuffix, victim, tar.TypeSymlink, false},
+			{"dir", "", tar.TypeDir, false},
+			{"dir/a", "", tar.TypeReg, false},
+			{"dir/" + WhiteoutMarkerSuffix, filepath.Join(victimDir, "new"), tar.TypeSymlink, false},
+		},
+		{
+			{whPrefix + "foo", "", tar.TypeReg, false},
+			{"dir/" + whOpaque, "", tar.TypeReg, false},
+		},
+	}
+
+	unpackOptions := UnpackOptions{
+		MapOptions: MapOptions{
+			Rootless: os.Geteuid() != 0,
+		},
+		WhiteoutMode: MarkerWhiteout,
+	}
+	for idx, layer := range layers {
+		te := NewTarExtractor(unpackOptions)
+		for _, ph := range layer {
+			hdr, rdr := fromPseudoHdr(ph)
+			if err := te.UnpackEntry(rootfs, hdr, rdr); err != nil {
+				t.Fatalf("layer %d: UnpackEntry %s failed: %v", idx, hdr.Name, err)
+			}
+		}
+	}
+
+	// The files outside the rootfs must not have been touched.
+	if contents, err := ioutil.ReadFile(victim); err != nil || string(contents) != "host data\n" {
+		t.Errorf("host file was modified through whiteout marker: %q %v", contents, err)
+	}
+	if _, err := os.Lstat(filepath.Join(victimDir, "new")); !os.IsNotExist(err) {
+		t.Errorf("host file was created through whiteout marker: %v", err)
+	}
+
+	// The symlinks must have been replaced with real markers.
+	for path, expected := range map[string]string{
+		"foo" + WhiteoutMarkerSuffix:  whPrefix + "foo\n",
+		"dir/" + WhiteoutMarkerSuffix: "dir/" + whOpaque + "\n",
+	} {
+		fi, err := os.Lstat(filepath.Join(rootfs, path))
+		if err != nil {
+			t.Errorf("missing whiteout marker %s: %v", path, err)
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			t.Errorf("whiteout marker %s is not a regular file: %s", path, fi.Mode())
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(rootfs, path))
+		if err != nil {
+			t.Errorf("read whiteout marker %s: %v", path, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("unexpected contents of whiteout marker %s: expected %q got %q", path, expected, string(contents))
+		}
+	}
+}
+
+func TestUnpackLayerContentScan(t *testing.T) {
+	errInfected := errors.New("sentinel found")
+	makeLayer := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, name := range []string{"a", "b", "c"} {
+			contents, ok := files[name]
+			if !ok {
+				continue
+			}
+			if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(contents)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	for _, test := range []struct {
+		name     string
+		files    map[string]string
+		infected bool
+	}{
+		{"Clean", map[string]string{"a": "hello", "b": strings.Repeat("clean ", 10000), "c": ""}, false},
+		{"Infected", map[string]string{"a": "hello", "b": strings.Repeat("x", 70000) + "EICAR", "c": "never extracted"}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerContentScan")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			scanned := map[string]string{}
+			opt := UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+					GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+					Rootless:    os.Geteuid() != 0,
+				},
+				ContentScan: func(path string, r io.Reader) error {
+					// Only read part of "a", to check that the rest is still
+					// extracted.
+					if path == "/a" {
+						buf := make([]byte, 2)
+						_, err := io.ReadFull(r, buf)
+						scanned[path] = string(buf)
+						return err
+					}
+					data, err := ioutil.ReadAll(r)
+					if err != nil {
+						return err
+					}
+					scanned[path] = string(data)
+					if strings.Contains(string(data), "EICAR") {
+						return errInfected
+					}
+					return nil
+				},
+			}
+			err = UnpackLayer(dir, bytes.NewReader(makeLayer(test.files)), &opt)
+			if test.infected {
+				if errors.Cause(err) != errInfected {
+					t.Fatalf("expected unpack to be aborted by content scan: %+v", err)
+				}
+				if _, ok := scanned["/c"]; ok {
+					t.Errorf("content scan continued after aborting")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected UnpackLayer error: %+v", err)
+			}
+
+			for name, contents := range test.files {
+				data, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Errorf("unexpected error reading %s: %v", name, err)
+				} else if string(data) != contents {
+					t.Errorf("unexpected contents of %s: expected %d bytes got %d", name, len(contents), len(data))
+				}
+				want := contents
+				if name == "a" {
+					want = contents[:2]
+				}
+				if got, ok := scanned["/"+name]; !ok || got != want {
+					t.Errorf("unexpected scanned contents of %s: %q", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackLayerXattrRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerXattrRewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Not all filesystems support user xattrs.
+	probe := filepath.Join(dir, "probe")
+	if err := ioutil.WriteFile(probe, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(probe, "user.probe", []byte("1"), 0); err != nil {
+		t.Skipf("user xattrs not supported: %v", err)
+	}
+	if err := os.Remove(probe); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "file",
+		Mode:     0644,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			"SCHILY.xattr.user.overlay.origin": "origin",
+			"SCHILY.xattr.user.drop":           "dropped",
+			"SCHILY.xattr.user.keep":           "kept",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    os.Geteuid() != 0,
+		},
+		XattrRewrite: func(key string, value []byte) (string, []byte, bool) {
+			switch {
+			case key == "user.drop":
+				return "", nil, false
+			case strings.HasPrefix(key, "user.overlay."):
+				return "user.remapped." + strings.TrimPrefix(key, "user.overlay."), append([]byte("new-"), value...), true
+			}
+			return key, value, true
+		},
+	}
+	if err := UnpackLayer(dir, bytes.NewReader(buf.Bytes()), &opt); err != nil {
+		t.Fatalf("unexpected UnpackLayer error: %+v", err)
+	}
+
+	path := filepath.Join(dir, "file")
+	for name, want := range map[string]string{
+		"user.remapped.origin": "new-origin",
+		"user.keep":            "kept",
+	} {
+		value := make([]byte, 64)
+		n, err := unix.Lgetxattr(path, name, value)
+		if err != nil {
+			t.Errorf("expected xattr %q to be set: %v", name, err)
+		} else if got := string(value[:n]); got != want {
+			t.Errorf("unexpected value of xattr %q: expected %q got %q", name, want, got)
+		}
+	}
+	for _, name := range []string{"user.overlay.origin", "user.drop"} {
+		if _, err := unix.Lgetxattr(path, name, nil); err != unix.ENODATA {
+			t.Errorf("expected xattr %q to not be set: %v", name, err)
+		}
+	}
+
+	// Rewriting two xattrs to the same name is an error.
+	opt.XattrRewrite = func(key string, value []byte) (string, []byte, bool) {
+		return "user.same", value, true
+	}
+	if err := UnpackLayer(filepath.Join(dir, "collision"), bytes.NewReader(buf.Bytes()), &opt); err == nil {
+		t.Errorf("expected error rewriting two xattrs to the same name")
+	}
+}
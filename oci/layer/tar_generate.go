@@ -23,11 +23,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/opencontainers/umoci/pkg/fseval"
 	"github.com/opencontainers/umoci/pkg/testutils"
 	"github.com/pkg/errors"
+	rootlesscontainers "github.com/rootless-containers/proto/go-proto"
 )
 
 // ignoreXattrs is a list of xattr names that should be ignored when
@@ -75,6 +77,18 @@ type tarGenerator struct {
 	// fsEval is an fseval.FsEval used for extraction.
 	fsEval fseval.FsEval
 
+	// timestamp, if non-nil, is used as the timestamp of every entry rather
+	// than the timestamps of the files being added.
+	timestamp *time.Time
+
+	// preserveBirthtime indicates whether the birth time of entries should be
+	// recorded (see RepackOptions.PreserveBirthtime).
+	preserveBirthtime bool
+
+	// noIDMapping causes the owner of each file to be stored verbatim, rather
+	// than being mapped with mapOptions.
+	noIDMapping bool
+
 	// XXX: Should we add a safety check to make sure we don't generate two of
 	//      the same path in a tar archive? This is not permitted by the spec.
 }
@@ -182,6 +196,15 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		return errors.Wrapf(err, "lstatx %q", path)
 	}
 	updateHeader(hdr, statx)
+	if tg.timestamp != nil {
+		hdr.ModTime = *tg.timestamp
+		if !hdr.AccessTime.IsZero() {
+			hdr.AccessTime = *tg.timestamp
+		}
+		if !hdr.ChangeTime.IsZero() {
+			hdr.ChangeTime = *tg.timestamp
+		}
+	}
 
 	// Set up xattrs externally to updateHeader because the function signature
 	// would look really dumb otherwise.
@@ -230,10 +253,41 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		hdr.Size = 0
 	} else {
 		tg.inodes[statx.Ino] = name
+
+		// Store the inode flags (such as immutable or append-only) which we
+		// understand. Hardlinks share the flags of their target.
+		flags, err := getFileFlags(tg.fsEval, path, fi)
+		if err != nil {
+			return errors.Wrap(err, "get inode flags")
+		}
+		if flags != "" {
+			hdr.PAXRecords = map[string]string{paxFileFlags: flags}
+		}
+
+		// Store the birth time if the filesystem records it.
+		if tg.preserveBirthtime {
+			btime, err := getBirthtime(tg.fsEval, path)
+			if err != nil {
+				return errors.Wrap(err, "get birthtime")
+			}
+			if btime != "" && tg.timestamp != nil {
+				btime = formatPAXTime(*tg.timestamp)
+			}
+			if btime != "" {
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = map[string]string{}
+				}
+				hdr.PAXRecords[paxBirthtime] = btime
+			}
+		}
 	}
 
 	// Apply any header mappings.
-	if err := mapHeader(hdr, tg.mapOptions); err != nil {
+	if tg.noIDMapping {
+		if _, ok := hdr.Xattrs[rootlesscontainers.Keyname]; ok {
+			log.Warnf("suspicious filesystem: saw special rootless xattr %s with no id mapping", rootlesscontainers.Keyname)
+		}
+	} else if err := mapHeader(hdr, tg.mapOptions); err != nil {
 		return errors.Wrap(err, "map header")
 	}
 	if err := tg.tw.WriteHeader(hdr); err != nil {
@@ -292,10 +346,14 @@ func (tg *tarGenerator) addWhiteout(name string, opaque bool) error {
 	}
 
 	// Add a dummy header for the whiteout file.
-	return errors.Wrap(tg.tw.WriteHeader(&tar.Header{
+	hdr := &tar.Header{
 		Name: whiteout,
 		Size: 0,
-	}), "write whiteout header")
+	}
+	if tg.timestamp != nil {
+		hdr.ModTime = *tg.timestamp
+	}
+	return errors.Wrap(tg.tw.WriteHeader(hdr), "write whiteout header")
 }
 
 // AddWhiteout creates a whiteout for the provided path.
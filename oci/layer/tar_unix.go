@@ -26,7 +26,9 @@ import (
 func updateHeader(hdr *tar.Header, s unix.Stat_t) {
 	// Currently the Go stdlib doesn't fill in the major/minor numbers of
 	// devices, so we have to do it manually.
-	if s.Mode&unix.S_IFBLK == unix.S_IFBLK || s.Mode&unix.S_IFCHR == unix.S_IFCHR {
+	// Only device nodes have meaningful device numbers (note that the S_IF*
+	// types are not independent bits, so we have to compare the whole type).
+	if typ := s.Mode & unix.S_IFMT; typ == unix.S_IFBLK || typ == unix.S_IFCHR {
 		hdr.Devmajor = int64(unix.Major(uint64(s.Rdev)))
 		hdr.Devminor = int64(unix.Minor(uint64(s.Rdev)))
 	}
@@ -1,7 +1,14 @@
 package layer
 
 import (
+	"io"
+	"os"
+
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"golang.org/x/net/context"
 )
 
 // WhiteoutMode indicates how this TarExtractor will create whiteouts on the
@@ -17,8 +24,317 @@ const (
 	// so it follows the overlayfs whiteout protocol:
 	//     .wh.foo => mknod c 0 0 foo
 	OverlayFSWhiteout
+
+	// MarkerWhiteout is a diagnostic mode which does not remove any paths.
+	// Instead, the whited-out path is left in place and a marker file is
+	// written next to it, so that it is possible to see what each layer
+	// intended to delete:
+	//     .wh.foo => foo.umoci-whiteout
+	//     .wh..wh..opq => .umoci-whiteout (inside the directory)
+	// Each marker contains the names of the whiteout entries which created it
+	// (one per line). The resulting rootfs is not the rootfs of the image,
+	// and should only be used for inspection.
+	MarkerWhiteout
+)
+
+// WhiteoutMarkerSuffix is the suffix of the marker files written for whited-out
+// paths with MarkerWhiteout. For opaque whiteouts, the marker is named
+// WhiteoutMarkerSuffix and placed inside the directory.
+const WhiteoutMarkerSuffix = ".umoci-whiteout"
+
+// UnsafeNameMode indicates how a TarExtractor handles entries whose names
+// contain NUL bytes, newlines or other control characters.
+type UnsafeNameMode int
+
+const (
+	// RejectUnsafeNames causes extraction to fail if an entry name contains
+	// a control character.
+	RejectUnsafeNames UnsafeNameMode = iota
+
+	// SanitizeUnsafeNames replaces every control character in an entry name
+	// with an underscore, and extracts the entry under the sanitised name.
+	SanitizeUnsafeNames
+)
+
+// AbsolutePathMode indicates how a TarExtractor handles entries whose names
+// (or hardlink targets) are absolute paths. Well-formed layers only contain
+// relative paths, but some producers emit paths with a leading "/". Entries
+// are always extracted inside the root filesystem regardless of their name.
+type AbsolutePathMode int
+
+const (
+	// StripAbsolutePaths removes the leading "/" from absolute entry names,
+	// treating them as relative to the root filesystem. This is the default.
+	StripAbsolutePaths AbsolutePathMode = iota
+
+	// RejectAbsolutePaths causes extraction to fail if an entry name (or
+	// hardlink target) is an absolute path.
+	RejectAbsolutePaths
+)
+
+// UnknownPAXMode indicates how a TarExtractor handles PAX extended header
+// records with keywords that umoci does not understand (such as
+// vendor-specific keywords). See isKnownPAXKeyword for the set of keywords
+// which are understood.
+type UnknownPAXMode int
+
+const (
+	// IgnoreUnknownPAX causes unknown PAX records to be ignored (they are
+	// only logged at debug level).
+	IgnoreUnknownPAX UnknownPAXMode = iota
+
+	// RecordUnknownPAX causes unknown PAX records to be recorded in
+	// UnpackOptions.UnknownPAXRecords, but otherwise ignored.
+	RecordUnknownPAX
+
+	// RejectUnknownPAX causes extraction to fail if an entry has any unknown
+	// PAX records.
+	RejectUnknownPAX
+)
+
+// UnsupportedTypeMode indicates how a TarExtractor handles entries with a
+// typeflag that umoci does not support (such as tar.TypeCont contiguous files
+// or vendor-specific types).
+type UnsupportedTypeMode int
+
+const (
+	// RejectUnsupportedTypes causes extraction to fail if an entry has an
+	// unsupported typeflag. Nothing is modified for such entries.
+	RejectUnsupportedTypes UnsupportedTypeMode = iota
+
+	// SkipUnsupportedTypes causes entries with an unsupported typeflag to be
+	// skipped (with a warning).
+	SkipUnsupportedTypes
+
+	// RegularUnsupportedTypes causes entries with an unsupported typeflag to
+	// be extracted as regular files (with the contents of the entry).
+	RegularUnsupportedTypes
+)
+
+// RootlessDeviceMode indicates how a TarExtractor handles character and block
+// device entries when it is unable to create device nodes (in rootless mode
+// or when running inside a user namespace).
+type RootlessDeviceMode int
+
+const (
+	// SkipRootlessDevices causes device entries to not be created (any
+	// existing path is still removed). The skipped devices are recorded in
+	// UnpackOptions.SkippedDevices if it is non-nil.
+	SkipRootlessDevices RootlessDeviceMode = iota
+
+	// EmptyFileRootlessDevices causes device entries to be replaced by empty
+	// regular files with mode 0. Note that if such a file is modified (even
+	// its metadata), it will be included in the layer generated by
+	// umoci.Repack as a regular file.
+	EmptyFileRootlessDevices
+
+	// RejectRootlessDevices causes extraction to fail if a layer contains
+	// a device entry.
+	RejectRootlessDevices
+)
+
+// FifoMode indicates how a TarExtractor handles FIFO entries.
+type FifoMode int
+
+const (
+	// CreateFifos causes FIFO entries to be created with mknod(2). This is
+	// the default, and also works in rootless mode.
+	CreateFifos FifoMode = iota
+
+	// RecordFifos causes FIFO entries to not be created (any existing path is
+	// still removed). The FIFOs are recorded in UnpackOptions.SkippedDevices
+	// if it is non-nil.
+	RecordFifos
 )
 
+// SocketMode indicates how a TarExtractor handles socket entries. Since tar
+// has no typeflag for sockets, these are regular file entries whose mode has
+// the S_IFSOCK file type bits set. Sockets are only meaningful while the
+// process that bound them is running, so they are never created.
+type SocketMode int
+
+const (
+	// SkipSockets causes socket entries to not be created (any existing path
+	// is still removed), and a warning to be logged. This is the default.
+	SkipSockets SocketMode = iota
+
+	// RecordSockets is like SkipSockets, except that the sockets are
+	// recorded in UnpackOptions.SkippedDevices (if it is non-nil) rather than
+	// logged as warnings.
+	RecordSockets
+)
+
+// DeviceNode describes a character or block device entry, or a FIFO or socket
+// entry.
+type DeviceNode struct {
+	// Type is one of "char", "block", "fifo" or "socket". For FIFOs and
+	// sockets, Major and Minor are always zero.
+	Type string `json:"type"`
+
+	// Major and Minor are the device numbers of the node.
+	Major int64 `json:"major"`
+	Minor int64 `json:"minor"`
+
+	// Mode is the permission bits of the node.
+	Mode os.FileMode `json:"mode"`
+
+	// UID and GID are the (container) owner of the node.
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// IDRange is an inclusive range of host user or group IDs.
+type IDRange struct {
+	// Min is the smallest ID in the range.
+	Min int `json:"min"`
+
+	// Max is the largest ID in the range.
+	Max int `json:"max"`
+}
+
+// Contains returns whether the given ID is in the range.
+func (r IDRange) Contains(id int) bool {
+	return id >= r.Min && id <= r.Max
+}
+
+// Clamp returns the closest ID in the range to the given ID.
+func (r IDRange) Clamp(id int) int {
+	switch {
+	case id < r.Min:
+		return r.Min
+	case id > r.Max:
+		return r.Max
+	}
+	return id
+}
+
+// IDRangeMode indicates how a TarExtractor handles entries whose host owner
+// is outside of UnpackOptions.AllowedIDRange.
+type IDRangeMode int
+
+const (
+	// RejectOutOfRangeIDs causes extraction to fail with ErrOwnerOutOfRange
+	// if the host owner of an entry is outside of the allowed range.
+	RejectOutOfRangeIDs IDRangeMode = iota
+
+	// ClampOutOfRangeIDs causes the host owner of entries to be replaced by
+	// the closest ID in the allowed range.
+	ClampOutOfRangeIDs
+)
+
+// Compression indicates how umoci.Repack compresses the layers it generates.
+type Compression int
+
+const (
+	// GzipCompression compresses layers with gzip. This is the default, and
+	// is supported by every consumer of OCI images.
+	GzipCompression Compression = iota
+
+	// NoCompression produces uncompressed tar layers, whose digest is the
+	// same as their DiffID. This avoids the CPU cost of compression, which
+	// is useful for local caches or images that are re-extracted often.
+	NoCompression
+
+	// ZstdCompression compresses layers with zstd.
+	ZstdCompression
+)
+
+// EntryOrdering indicates the order in which GenerateLayer emits the entries
+// of the layers it generates.
+type EntryOrdering int
+
+const (
+	// LexicalOrdering emits every entry in lexicographic path order, with
+	// each directory immediately followed by its contents. This is the
+	// default.
+	LexicalOrdering EntryOrdering = iota
+
+	// ExtensionOrdering emits all directories and whiteouts first (in
+	// lexicographic order, so directories still come before their contents),
+	// followed by all other entries grouped by file extension. Placing
+	// similar files next to each other can improve the compression ratio of
+	// the layer, since compressors can only find matches within a limited
+	// window.
+	ExtensionOrdering
+)
+
+// ChangeDetection indicates which properties of a file are compared by
+// umoci.Repack to decide whether the file has been modified (and thus must be
+// included in the new layer). Added and removed files are always detected.
+type ChangeDetection int
+
+const (
+	// DigestChangeDetection compares both the metadata of each file
+	// (modification time, mode, ownership and xattrs) and the digest of its
+	// contents. This is the default.
+	DigestChangeDetection ChangeDetection = iota
+
+	// MetadataChangeDetection compares the metadata and size of each file,
+	// but not the digest of its contents. This is faster since the contents
+	// of files are not read, but a change to the contents of a file which
+	// preserves its size and modification time is not detected.
+	MetadataChangeDetection
+
+	// ContentChangeDetection only compares the type, size and contents (or
+	// symlink target) of each file. Changes to only the metadata of a file
+	// (such as updating its modification time) are ignored.
+	ContentChangeDetection
+)
+
+// RuntimeProfile indicates which OCI runtime the bundle generated by
+// UnpackManifest is intended to be used with, so that the generated
+// config.json can be tailored to the conventions of that runtime. The layout
+// of the bundle (config.json and the rootfs at RootfsName) is the same for
+// every profile, since umoci.Repack depends on it.
+type RuntimeProfile int
+
+const (
+	// RuncRuntimeProfile generates a config.json for runc. This is the
+	// default.
+	RuncRuntimeProfile RuntimeProfile = iota
+
+	// CrunRuntimeProfile generates a config.json for crun. crun accepts the
+	// same configuration as runc (including for rootless containers), so this
+	// is currently identical to RuncRuntimeProfile.
+	CrunRuntimeProfile
+
+	// KataRuntimeProfile generates a config.json for Kata Containers. Since
+	// Kata runs each container inside a virtual machine, the container must
+	// have its own network namespace (which Kata uses to configure the
+	// virtual machine's network interfaces) and cannot use a user namespace.
+	// As a result, rootless bundles and ID mappings are rejected.
+	KataRuntimeProfile
+)
+
+// Compressor is an interface which users can use to implement different
+// compression types. Layers compressed by a custom Compressor can be unpacked
+// by registering a corresponding decompressor with RegisterDecompressor.
+type Compressor interface {
+	// Compress sets up the streaming compressor for this compression type.
+	Compress(io.Reader) (io.ReadCloser, error)
+
+	// MediaTypeSuffix returns the suffix to be added to the layer to
+	// indicate what compression type is used, e.g. "gzip", or "" for no
+	// compression.
+	MediaTypeSuffix() string
+}
+
+// UnpackStats are statistics about the entries extracted while unpacking
+// layers. Entries are counted as they are extracted, so a path which is
+// present in more than one layer is counted once for each layer. Whiteouts and
+// entries excluded by IncludePaths are not counted.
+type UnpackStats struct {
+	// Files is the number of non-directory entries (regular files, symlinks,
+	// hardlinks and device or fifo nodes) extracted.
+	Files int64 `json:"files"`
+
+	// Directories is the number of directory entries extracted.
+	Directories int64 `json:"directories"`
+
+	// Bytes is the total size of the contents of all regular files extracted.
+	Bytes int64 `json:"bytes"`
+}
+
 // UnpackOptions describes the behavior of the various unpack operations.
 type UnpackOptions struct {
 	// MapOptions are the UID and GID mappings used when unpacking an image
@@ -31,6 +347,21 @@ type UnpackOptions struct {
 	// symlink.
 	KeepDirlinks bool
 
+	// DirectoryTimesLast causes the access and modification times of every
+	// directory in a layer to be restored in a final pass, after all of the
+	// entries in the layer have been extracted. Otherwise the times of a
+	// directory are only restored after each entry directly inside it is
+	// extracted, which misses modifications made while creating missing
+	// parent directories of deeper entries.
+	DirectoryTimesLast bool
+
+	// ImplicitDirectoryMode, if non-zero, is the mode given to directories
+	// which are created implicitly because they are missing parents of an
+	// entry in a layer. By default they are created with mode 0777 (modified
+	// by the umask). If an entry for the directory appears later in the
+	// layer, its mode is replaced by the mode of that entry as usual.
+	ImplicitDirectoryMode os.FileMode
+
 	// AfterLayerUnpack is a function that's called after every layer is
 	// unpacked.
 	AfterLayerUnpack AfterLayerUnpackCallback
@@ -38,10 +369,225 @@ type UnpackOptions struct {
 	// StartFrom is the descriptor in the manifest to start from
 	StartFrom ispec.Descriptor
 
+	// OnlyDiffIDs, if non-empty, restricts UnpackRootfs to the layers with
+	// the given DiffIDs (which must all be layers of the image). Only the
+	// changes made by those layers are extracted (in manifest order) onto the
+	// otherwise-empty rootfs, so whiteouts in the selected layers only affect
+	// paths from other selected layers. This is useful for inspecting what a
+	// particular layer changed. It cannot be combined with StartFrom.
+	OnlyDiffIDs []digest.Digest
+
 	// WhiteoutMode is the type of whiteout to write to the filesystem.
 	WhiteoutMode WhiteoutMode
+
+	// UnsafeNameMode is how entries with names containing control
+	// characters (such as NUL or newline) are handled. By default such
+	// entries are rejected.
+	UnsafeNameMode UnsafeNameMode
+
+	// AbsolutePathMode is how entries with absolute names (or hardlink
+	// targets) are handled. By default the leading "/" is stripped.
+	AbsolutePathMode AbsolutePathMode
+
+	// UnknownPAXMode is how PAX records with unknown keywords are handled.
+	// By default they are ignored.
+	UnknownPAXMode UnknownPAXMode
+
+	// UnsupportedTypeMode is how entries with an unsupported typeflag are
+	// handled. By default such entries are rejected.
+	UnsupportedTypeMode UnsupportedTypeMode
+
+	// RootlessDeviceMode is how character and block device entries are
+	// handled when device nodes cannot be created (in rootless mode or
+	// inside a user namespace). By default such entries are skipped.
+	RootlessDeviceMode RootlessDeviceMode
+
+	// FifoMode is how FIFO entries are handled. By default they are created.
+	FifoMode FifoMode
+
+	// SocketMode is how socket entries are handled. By default they are
+	// skipped with a warning.
+	SocketMode SocketMode
+
+	// SkippedDevices, if non-nil, is filled with every device entry which
+	// was skipped because of SkipRootlessDevices, as well as every FIFO and
+	// socket entry skipped because of RecordFifos or RecordSockets. The key
+	// is the absolute path of the entry within the rootfs. Devices which are
+	// replaced or removed by a later entry (or layer) are removed from the
+	// map. The LayerCache is not used when recording.
+	SkippedDevices map[string]DeviceNode
+
+	// UnknownPAXRecords is filled with the unknown PAX records of every
+	// extracted entry if UnknownPAXMode is RecordUnknownPAX (in which case
+	// it must be non-nil). The key is the absolute path of the entry within
+	// the rootfs, and the value is the set of unknown records. If a path
+	// occurs in more than one layer, the records of the last entry are kept.
+	// The LayerCache is not used when recording.
+	UnknownPAXRecords map[string]map[string]string
+
+	// IncludePaths, if non-empty, restricts extraction to the paths (and
+	// their children) matching at least one of the given patterns. Patterns
+	// are matched one path component at a time using filepath.Match syntax
+	// (so "/etc" or "/usr/lib/*.so" are both valid). Ancestor directories of
+	// included paths are also extracted, and whiteouts are still applied
+	// within the included set. Since all layers are filtered in the same way,
+	// the result is the included subset of the final merged rootfs.
+	IncludePaths []string
+
+	// MemoryBudgetBytes, if non-zero, is the approximate maximum amount of
+	// memory used for in-flight decompression buffers while unpacking. The
+	// parallel decompression of each layer is throttled to stay within this
+	// budget (layers are extracted one at a time, so the budget applies to
+	// the largest working set of any single layer).
+	MemoryBudgetBytes int64
+
+	// CopyBufferSize, if non-zero, is the size of the buffer used to copy the
+	// contents of regular files from the layer to the rootfs. Larger buffers
+	// reduce the number of read(2) and write(2) calls when extracting very
+	// large files. By default the io.Copy buffer size (32KiB) is used.
+	CopyBufferSize int
+
+	// ZstdDictionaries are the zstd dictionaries which can be used to
+	// decompress zstd layers that were compressed with a dictionary. The
+	// dictionary for each layer is selected using the digest recorded in the
+	// ZstdDictionaryAnnotation annotation of the layer descriptor.
+	ZstdDictionaries [][]byte
+
+	// FsEval, if non-nil, is the fseval.FsEval used to modify the rootfs
+	// while unpacking (overriding the default choice based on
+	// MapOptions.Rootless). This allows unpacking into a virtual filesystem
+	// such as fseval.NewMemory. Note that the bundle itself (and its
+	// config.json) are still written to the host by UnpackManifest.
+	FsEval fseval.FsEval
+
+	// LayerCache, if non-nil, is used to share extracted layers between
+	// unpack operations. UnpackRootfs restores the longest chain of
+	// (DiffID-verified) layers present in the cache instead of extracting
+	// them, and adds a snapshot of the rootfs to the cache after each layer
+	// it extracts. AfterLayerUnpack is not called for layers restored from
+	// the cache. The cache is not used if StartFrom, OnlyDiffIDs,
+	// OwnerOverride, OwnershipReport, ContentScan or XattrRewrite is set, if
+	// UnknownPAXMode is RecordUnknownPAX, or if SkippedDevices is non-nil.
+	LayerCache *LayerCache
+
+	// Stats, if non-nil, is filled with statistics about the entries
+	// extracted by UnpackRootfs (or UnpackLayer, in which case the statistics
+	// are added to the existing values). If StartFrom or OnlyDiffIDs is set,
+	// only the layers which were extracted are counted.
+	Stats *UnpackStats
+
+	// OwnerOverride, if non-nil, is consulted for every extracted entry after
+	// the ID mappings have been applied, allowing the host owner of
+	// individual paths to be overridden. It is not used in rootless mode
+	// (where every file is owned by the current user).
+	OwnerOverride OwnerOverrideCallback
+
+	// ContentScan, if non-nil, is called with the contents of every regular
+	// file as it is extracted (see ContentScanCallback), allowing the contents
+	// to be scanned (for malware or secrets, for instance) without a separate
+	// pass over the rootfs. Every version of a file is scanned, including
+	// versions which are replaced or removed by later layers. Returning an
+	// error aborts the unpack.
+	ContentScan ContentScanCallback
+
+	// XattrRewrite, if non-nil, is used to rename, modify or drop the xattrs
+	// of every extracted entry (see XattrRewriteCallback), such as remapping
+	// "trusted.overlay.*" xattrs or dropping "security.selinux" on hosts
+	// without SELinux. It is an error for two xattrs of an entry to be
+	// rewritten to the same name. xattrs which umoci never sets (such as
+	// "security.selinux") are still ignored after being rewritten.
+	XattrRewrite XattrRewriteCallback
+
+	// AllowedIDRange, if non-nil, is the range of host UIDs and GIDs which
+	// extracted entries may be owned by (after the ID mappings and
+	// OwnerOverride have been applied). This protects against untrusted
+	// images creating files owned by host IDs outside of the range allocated
+	// to the container (such as host root). Entries owned by IDs outside of
+	// the range are handled according to IDRangeMode. It is not used in
+	// rootless mode (where every file is owned by the current user).
+	AllowedIDRange *IDRange
+
+	// IDRangeMode is how entries owned by IDs outside of AllowedIDRange are
+	// handled. By default such entries are rejected.
+	IDRangeMode IDRangeMode
+
+	// OwnershipReport, if non-nil, is filled with the container (layer) and
+	// host owner of every extracted path. This is most useful for rootless
+	// unpacks, where the host owner is always the unpacking user. The
+	// LayerCache is not used when an OwnershipReport is requested.
+	OwnershipReport *OwnershipReport
+
+	// FileFlags, if non-nil, is filled with the inode flags (such as "schg"
+	// for immutable and "sappnd" for append-only paths) of every extracted
+	// path which has any, keyed by the absolute path inside the rootfs. The
+	// value is a comma-separated list of flag names. UnpackRootfs applies the
+	// flags once every layer has been extracted, except in rootless mode
+	// (where setting them is not permitted, so this is the only record of
+	// them) or if NoApplyFileFlags is set. UnpackLayer never applies the
+	// flags -- callers must use ApplyFileFlags once they have finished
+	// extracting layers.
+	FileFlags map[string]string
+
+	// NoApplyFileFlags stops UnpackRootfs and UnpackManifest from applying
+	// the inode flags of the extracted paths (they are still recorded in
+	// FileFlags). This should be set when unpacking a temporary rootfs, since
+	// immutable paths cannot be removed afterwards.
+	NoApplyFileFlags bool
+
+	// ExpectedStats, if non-nil, causes UnpackRootfs to fail if the
+	// statistics of the extracted layers do not match exactly. This can be
+	// used to detect truncated layers in deterministic pipelines.
+	ExpectedStats *UnpackStats
+
+	// CheckFreeSpace causes UnpackRootfs to check (using statfs(2)) that the
+	// filesystem containing the rootfs has enough space available before any
+	// layers are extracted, failing with ErrInsufficientSpace otherwise.
+	// Since images do not record the uncompressed size of their layers, the
+	// required space is estimated as the total size of the layer blobs being
+	// extracted -- so the check only catches filesystems which are certain to
+	// be too small. It is ignored if FsEval is set.
+	CheckFreeSpace bool
+
+	// CheckHistory causes UnpackRootfs to fail (with ErrHistoryMismatch) if
+	// the number of non-empty history entries in the image configuration does
+	// not match the number of layers, which usually indicates a broken or
+	// hand-edited image. Images without any history are accepted. Note that
+	// images modified with umoci's --no-history options can legitimately fail
+	// this check.
+	CheckHistory bool
+
+	// NoRuntimeConfig causes UnpackManifest to only extract the rootfs,
+	// without generating a config.json. umoci.Unpack will also not write any
+	// of its bundle metadata (umoci.json and the mtree manifest), so the
+	// resulting bundle cannot be used with umoci.Repack.
+	NoRuntimeConfig bool
+
+	// NetworkPlaceholders causes UnpackManifest to create empty
+	// /etc/resolv.conf and /etc/hosts files (see NetworkPlaceholderPaths) in
+	// the rootfs if they don't already exist, so that container runtimes can
+	// bind-mount the host's versions over them. Existing paths (including
+	// dangling symlinks) are never modified. Since umoci.Unpack generates the
+	// mtree manifest of the bundle after the placeholders are created, they
+	// are not included in the layer generated by umoci.Repack.
+	NetworkPlaceholders bool
+
+	// RuntimeProfile is the runtime that the config.json generated by
+	// UnpackManifest is tailored to. The default is RuncRuntimeProfile.
+	RuntimeProfile RuntimeProfile
 }
 
+// AfterManifestCommitCallback is called with the descriptor of the final
+// manifest once it has been written to the image (but before any tag has been
+// updated to reference it). The engine can be used to store additional blobs
+// which refer to the manifest, such as signatures or attestations. If an
+// error is returned, the operation is aborted.
+type AfterManifestCommitCallback func(ctx context.Context, engine casext.Engine, manifest ispec.Descriptor) error
+
+// ConfigMutatorCallback is called with the image configuration that is about
+// to be written, and may modify it in-place. If an error is returned, the
+// operation is aborted and none of the modifications are saved.
+type ConfigMutatorCallback func(config *ispec.Image) error
+
 // RepackOptions describes the behavior of the various GenerateLayer operations.
 type RepackOptions struct {
 	// MapOptions are the UID and GID mappings used when unpacking an image
@@ -51,4 +597,137 @@ type RepackOptions struct {
 	// .wh.foo style whiteouts when generating tarballs. Without this,
 	// whiteouts are untouched.
 	TranslateOverlayWhiteouts bool
+
+	// NoIDMapping causes the numeric owner of each file on the filesystem to
+	// be stored verbatim in the generated layer, with no translation of any
+	// kind. In particular, files are not made root-owned in rootless mode and
+	// "user.rootlesscontainers" xattrs are not applied. It is an error to set
+	// NoIDMapping together with UID or GID mappings in MapOptions.
+	NoIDMapping bool
+
+	// LayerAnnotations are annotations that are attached to the descriptor of
+	// the generated layer in the image manifest (such as a build ID or the
+	// source commit). They do not modify the layer blob itself.
+	LayerAnnotations map[string]string
+
+	// MemoryBudgetBytes, if non-zero, is the approximate maximum amount of
+	// memory used for in-flight compression buffers while repacking. The
+	// parallel compression of the new layer is throttled to stay within this
+	// budget.
+	MemoryBudgetBytes int64
+
+	// FixedChunkBytes, if non-zero, causes umoci.Repack to store the
+	// compressed layer as a sequence of blobs of FixedChunkBytes bytes each
+	// (the last chunk may be smaller) rather than as a single blob, so that
+	// CDNs can cache uniformly-sized blobs. The chunks are referenced by a
+	// ChunkedLayer blob (see MediaTypeChunkedLayer), and are reassembled when
+	// the layer is unpacked. Note that other tools will not understand such
+	// layers.
+	FixedChunkBytes int64
+
+	// ConfigMutator is a function that's called just before the new image
+	// configuration is written, after the diff_ids and history have been
+	// updated for the new layer. This allows the configuration (environment,
+	// labels and so on) to be changed as part of the repack.
+	ConfigMutator ConfigMutatorCallback
+
+	// AfterManifestCommit is a function that's called after the new manifest
+	// has been committed to the image, before the tag is updated.
+	AfterManifestCommit AfterManifestCommitCallback
+
+	// HistoryCreatedBy and HistoryComment, if non-empty, override the
+	// created_by and comment fields of the history entry added for the new
+	// layer by umoci.Repack. They have no effect if no history entry is being
+	// added.
+	HistoryCreatedBy string
+	HistoryComment   string
+
+	// MetadataOnly restricts the generated layer to entries whose metadata
+	// (mode, ownership, xattrs or timestamps) has changed but whose contents
+	// have not. Each such entry is still stored with its (unchanged)
+	// contents, since tar requires it. If any path was added, removed or had
+	// its contents changed, layer generation fails.
+	MetadataOnly bool
+
+	// BaseImageName, if non-empty, causes umoci.Repack to record the image
+	// that was unpacked to create the bundle as the base image of the new
+	// manifest (using the org.opencontainers.image.base.name and
+	// org.opencontainers.image.base.digest annotations). BaseImageName is
+	// used as the name of the base image, and the digest is the digest of the
+	// manifest the bundle was unpacked from.
+	BaseImageName string
+
+	// FailOnNoChange causes umoci.Repack to fail with ErrNoChanges (rather
+	// than committing a new manifest without a new layer) if the bundle has
+	// no changes relative to the image it was unpacked from. No changes are
+	// made to the image in that case.
+	FailOnNoChange bool
+
+	// Excludes is a list of .dockerignore-style patterns (see
+	// mtreefilter.ExcludeFilter) of paths to omit from the generated layer.
+	// For GenerateLayer the patterns are relative to the root filesystem,
+	// while for GenerateInsertLayer they are relative to the directory being
+	// inserted.
+	Excludes []string
+
+	// ExtraWhiteouts is a list of paths (relative to the root filesystem)
+	// which GenerateLayer will add whiteouts for, regardless of whether the
+	// diff detected their deletion. This is an escape hatch for callers which
+	// know what they deleted, in case the recorded state of the bundle is
+	// missing or stale. None of the paths may exist in the root filesystem.
+	// Note that the generated layer always uses OCI (AUFS-style) whiteouts,
+	// which are converted when unpacking with OverlayFSWhiteout.
+	ExtraWhiteouts []string
+
+	// TimestampReference, if non-empty, is the path of a file whose
+	// modification time is used as the timestamp of every entry in the
+	// generated layer (including whiteouts). This is useful for reproducible
+	// builds which track a canonical timestamp file.
+	TimestampReference string
+
+	// PreserveBirthtime causes the birth (creation) time of each entry to be
+	// recorded in the generated layer (using the LIBARCHIVE.creationtime PAX
+	// record), if the filesystem records birth times. If TimestampReference is
+	// set, it is used as the birth time instead. The birth time is only
+	// recorded -- it is never restored when unpacking, since Linux does not
+	// permit changing the birth time of a path.
+	PreserveBirthtime bool
+
+	// Compression is the compression used for the layer generated by
+	// umoci.Repack. By default layers are compressed with gzip.
+	Compression Compression
+
+	// Compressor, if non-nil, is used by umoci.Repack to compress the new
+	// layer instead of the compressor selected by Compression. The media-type
+	// of the layer is the uncompressed layer media-type with the
+	// MediaTypeSuffix of the Compressor appended. It cannot be combined with
+	// ZstdDictionary.
+	Compressor Compressor
+
+	// ZstdDictionary, if non-nil, causes umoci.Repack to compress the new
+	// layer using zstd with the given dictionary (in the format produced by
+	// "zstd --train"), so Compression must be left as the default or set to
+	// ZstdCompression. The digest of the dictionary is recorded in the
+	// ZstdDictionaryAnnotation annotation of the layer descriptor, and the
+	// same dictionary must be included in UnpackOptions.ZstdDictionaries in
+	// order to unpack the layer.
+	ZstdDictionary []byte
+
+	// ChangeDetection controls which changes to a file cause umoci.Repack to
+	// include it in the new layer. By default (DigestChangeDetection) any
+	// change to either the metadata or contents of a file is detected.
+	ChangeDetection ChangeDetection
+
+	// MaxLayers, if non-zero, is the maximum number of layers of the image
+	// produced by umoci.Repack. If adding the new layer results in more than
+	// MaxLayers layers, the oldest layers are squashed into a single layer
+	// (see mutate.Mutator.LimitLayers) to keep the image within the limit.
+	MaxLayers int
+
+	// CompressionOrdering is the order in which GenerateLayer emits entries.
+	// Any ordering other than LexicalOrdering (the default) replaces the
+	// lexicographic entry order, so the layer will differ from one generated
+	// with the default ordering (though it is still reproducible). It has no
+	// effect on GenerateInsertLayer.
+	CompressionOrdering EntryOrdering
 }
@@ -30,6 +30,7 @@ import (
 	"time"
 
 	"github.com/apex/log"
+	"github.com/cyphar/filepath-securejoin"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -39,7 +40,7 @@ import (
 	iconv "github.com/opencontainers/umoci/oci/config/convert"
 	"github.com/opencontainers/umoci/pkg/fseval"
 	"github.com/opencontainers/umoci/pkg/idtools"
-	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/opencontainers/umoci/pkg/membudget"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -47,6 +48,41 @@ import (
 // AfterLayerUnpackCallback is called after each layer is unpacked.
 type AfterLayerUnpackCallback func(manifest ispec.Manifest, desc ispec.Descriptor) error
 
+// OwnerOverrideCallback is called for every extracted entry (other than
+// hardlinks and whiteouts) with its absolute path inside the rootfs and its
+// header, after the ID mappings have been applied (so hdr.Uid and hdr.Gid are
+// the host owner). If ok is true, the entry is owned by the returned host uid
+// and gid instead.
+type OwnerOverrideCallback func(path string, hdr *tar.Header) (uid, gid int, ok bool)
+
+// ContentScanCallback is called for every regular file extracted, with its
+// absolute path inside the rootfs and a reader for its (decompressed)
+// contents. The contents are written to the rootfs as they are read from r,
+// and any contents not read by the callback are written once it returns. If
+// an error is returned, the unpack is aborted.
+type ContentScanCallback func(path string, r io.Reader) error
+
+// XattrRewriteCallback is called for every xattr of every extracted entry,
+// with the name and value of the xattr from the archive. The xattr is set
+// with the returned name and value instead, unless keep is false (in which
+// case it is not set at all).
+type XattrRewriteCallback func(key string, value []byte) (newKey string, newValue []byte, keep bool)
+
+// unpackFsEval returns the fseval.FsEval which should be used to modify the
+// rootfs when unpacking with the given options. Layers may contain paths longer
+// than PATH_MAX, so the built-in FsEvals are wrapped with fseval.LongPath.
+func unpackFsEval(opt *UnpackOptions) fseval.FsEval {
+	switch {
+	case opt == nil:
+		return fseval.LongPath(fseval.Default)
+	case opt.FsEval != nil:
+		return opt.FsEval
+	case opt.MapOptions.Rootless:
+		return fseval.LongPath(fseval.Rootless)
+	}
+	return fseval.LongPath(fseval.Default)
+}
+
 // UnpackLayer unpacks the tar stream representing an OCI layer at the given
 // root. It ensures that the state of the root is as close as possible to the
 // state used to create the layer. If an error is returned, the state of root
@@ -56,6 +92,9 @@ func UnpackLayer(root string, layer io.Reader, opt *UnpackOptions) error {
 	if opt != nil {
 		unpackOptions = *opt
 	}
+	if err := validateIncludePaths(unpackOptions.IncludePaths); err != nil {
+		return err
+	}
 	te := NewTarExtractor(unpackOptions)
 	tr := tar.NewReader(layer)
 	for {
@@ -70,7 +109,7 @@ func UnpackLayer(root string, layer io.Reader, opt *UnpackOptions) error {
 			return errors.Wrapf(err, "unpack entry: %s", hdr.Name)
 		}
 	}
-	return nil
+	return te.RestoreDirectoryTimes(root)
 }
 
 // RootfsName is the name of the rootfs directory inside the bundle path when
@@ -81,19 +120,98 @@ const RootfsName = "rootfs"
 // layer blob. This includes both distributable and non-distributable images.
 func isLayerType(mediaType string) bool {
 	return mediaType == ispec.MediaTypeImageLayer || mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
+		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
+		needsZstd(mediaType)
 }
 
+// gzipDecompressBlocks is the maximum number of blocks that the parallel gzip
+// reader will decompress ahead of the consumer (this matches the pgzip
+// default).
+const gzipDecompressBlocks = 4
+
+// gzipDecompressCost is the approximate memory usage of a parallel gzip reader.
+// Each read-ahead block is a single buffer, and there is a single flate
+// decompressor (with a 32KiB window plus its own buffers).
+var gzipDecompressCost = membudget.Cost{Overhead: 64 << 10, BuffersPerBlock: 1}
+
 func needsGunzip(mediaType string) bool {
 	return mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
 }
 
+// decompressLayer returns a reader for the uncompressed contents of the given
+// layer blob, using the registered decompressor for the media-type of desc (or
+// the built-in gzip and zstd support). The returned reader must be closed by
+// the caller, though closing it does not close blob.
+func decompressLayer(blob io.Reader, desc ispec.Descriptor, opt *UnpackOptions) (io.ReadCloser, error) {
+	decompress := GetDecompressor(desc.MediaType)
+	if !isLayerType(desc.MediaType) && decompress == nil {
+		return nil, errors.Wrapf(ErrUnsupportedMediaType, "layer %s: blob is not correct mediatype: %s", desc.Digest, desc.MediaType)
+	}
+
+	switch {
+	case decompress != nil:
+		// A custom decompressor was registered for this media-type. As with
+		// gzip, the DiffID is checked against the output.
+		decompressed, err := decompress(blob)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decompress %s layer", desc.MediaType)
+		}
+		return decompressed, nil
+	case needsGunzip(desc.MediaType):
+		var budget int64
+		if opt != nil {
+			budget = opt.MemoryBudgetBytes
+		}
+		blockSize, blocks := membudget.Split(budget, gzipDecompressCost, gzipDecompressBlocks)
+		decompressed, err := gzip.NewReaderN(blob, blockSize, blocks)
+		if err != nil {
+			return nil, errors.Wrap(err, "create gzip reader")
+		}
+		return decompressed, nil
+	case needsZstd(desc.MediaType):
+		var dicts [][]byte
+		if opt != nil {
+			dicts = opt.ZstdDictionaries
+		}
+		return zstdReader(blob, desc, dicts)
+	}
+	return ioutil.NopCloser(blob), nil
+}
+
+// IsLayerMediaType returns whether the given media-type is the media-type of
+// an image layer blob which can be decompressed by DecompressLayer, either
+// because it is natively supported or because a decompressor has been
+// registered for it.
+func IsLayerMediaType(mediaType string) bool {
+	return isLayerType(mediaType) || GetDecompressor(mediaType) != nil
+}
+
+// DecompressLayer returns a reader for the uncompressed (tar) contents of the
+// given layer blob, based on the media-type of desc. The returned reader must
+// be closed by the caller, though closing it does not close blob.
+func DecompressLayer(blob io.Reader, desc ispec.Descriptor) (io.ReadCloser, error) {
+	return decompressLayer(blob, desc, nil)
+}
+
 // UnpackManifest extracts all of the layers in the given manifest, as well as
 // generating a runtime bundle and configuration. The rootfs is extracted to
 // <bundle>/<layer.RootfsName>.
 //
 // FIXME: This interface is ugly.
 func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *UnpackOptions) (err error) {
+	// Whether the runtime profile can be used only depends on the MapOptions
+	// (not the image configuration), so make sure it can be applied before
+	// extracting anything.
+	if !opt.NoRuntimeConfig {
+		spec, err := toRuntimeSpec("", ispec.Image{OS: "linux"}, &opt.MapOptions)
+		if err != nil {
+			return errors.Wrap(err, "check runtime profile")
+		}
+		if err := applyRuntimeProfile(&spec, opt.RuntimeProfile); err != nil {
+			return errors.Wrap(err, "check runtime profile")
+		}
+	}
+
 	// Create the bundle directory. We only error out if config.json or rootfs/
 	// already exists, because we cannot be sure that the user intended us to
 	// extract over an existing bundle.
@@ -118,15 +236,19 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 		return errors.Wrap(err, "problem accessing bundle config")
 	}
 
+	// The inode flags are only applied once we are done modifying the rootfs,
+	// so UnpackRootfs must not apply them itself.
+	fileFlags := opt.FileFlags
+	if fileFlags == nil {
+		fileFlags = map[string]string{}
+	}
+	rootfsOpt := *opt
+	rootfsOpt.FileFlags = fileFlags
+	rootfsOpt.NoApplyFileFlags = true
+
 	defer func() {
 		if err != nil {
-			fsEval := fseval.Default
-			if opt != nil && opt.MapOptions.Rootless {
-				fsEval = fseval.Rootless
-			}
-			// It's too late to care about errors.
-			// #nosec G104
-			_ = fsEval.RemoveAll(rootfsPath)
+			removeRootfs(rootfsPath, fileFlags, opt)
 		}
 	}()
 
@@ -138,10 +260,25 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	}
 
 	log.Infof("unpack rootfs: %s", rootfsPath)
-	if err := UnpackRootfs(ctx, engine, rootfsPath, manifest, opt); err != nil {
+	if err := UnpackRootfs(ctx, engine, rootfsPath, manifest, &rootfsOpt); err != nil {
 		return errors.Wrap(err, "unpack rootfs")
 	}
 
+	if opt.NetworkPlaceholders {
+		if err := createNetworkPlaceholders(rootfsPath, opt); err != nil {
+			return errors.Wrap(err, "create network placeholders")
+		}
+	}
+
+	if err := applyRootfsFileFlags(rootfsPath, fileFlags, opt); err != nil {
+		return errors.Wrap(err, "unpack rootfs")
+	}
+
+	if opt.NoRuntimeConfig {
+		log.Debugf("skipping config.json generation")
+		return nil
+	}
+
 	// Generate a runtime configuration file from ispec.Image.
 	configFile, err := os.Create(configPath)
 	if err != nil {
@@ -149,33 +286,90 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	}
 	defer configFile.Close()
 
-	if err := UnpackRuntimeJSON(ctx, engine, configFile, rootfsPath, manifest, &opt.MapOptions); err != nil {
+	if err := unpackRuntimeJSON(ctx, engine, configFile, rootfsPath, manifest, &opt.MapOptions, opt.RuntimeProfile); err != nil {
 		return errors.Wrap(err, "unpack config.json")
 	}
 	return nil
 }
 
+// NetworkPlaceholderPaths are the paths (within the rootfs) of the
+// placeholder files created if UnpackOptions.NetworkPlaceholders is set.
+var NetworkPlaceholderPaths = []string{"/etc/resolv.conf", "/etc/hosts"}
+
+// createNetworkPlaceholders creates an empty file (owned by the container's
+// root user) for each of NetworkPlaceholderPaths which doesn't exist in the
+// rootfs. Symlinks in the rootfs are resolved scoped to the rootfs.
+func createNetworkPlaceholders(rootfsPath string, opt *UnpackOptions) error {
+	fsEval := unpackFsEval(opt)
+	for _, unsafePath := range NetworkPlaceholderPaths {
+		unsafeDir, file := filepath.Split(unsafePath)
+		dir, err := securejoin.SecureJoinVFS(rootfsPath, unsafeDir, fsEval)
+		if err != nil {
+			return errors.Wrap(err, "sanitise symlinks in rootfs")
+		}
+		path := filepath.Join(dir, file)
+
+		if _, err := fsEval.Lstat(path); err == nil {
+			log.Debugf("not creating placeholder %s: path already exists", unsafePath)
+			continue
+		} else if !os.IsNotExist(errors.Cause(err)) {
+			return errors.Wrapf(err, "check %s", unsafePath)
+		}
+
+		if err := fsEval.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "mkdir parent of %s", unsafePath)
+		}
+		fh, err := fsEval.Create(path)
+		if err != nil {
+			return errors.Wrapf(err, "create %s", unsafePath)
+		}
+		fh.Close()
+		if err := fsEval.Chmod(path, 0644); err != nil {
+			return errors.Wrapf(err, "chmod %s", unsafePath)
+		}
+		if !opt.MapOptions.Rootless {
+			uid, err := idtools.ToHost(0, opt.MapOptions.UIDMappings)
+			if err != nil {
+				return errors.Wrap(err, "map root uid")
+			}
+			gid, err := idtools.ToHost(0, opt.MapOptions.GIDMappings)
+			if err != nil {
+				return errors.Wrap(err, "map root gid")
+			}
+			if err := fsEval.Lchown(path, uid, gid); err != nil {
+				return errors.Wrapf(err, "chown %s", unsafePath)
+			}
+		}
+		log.Debugf("created placeholder %s", unsafePath)
+	}
+	return nil
+}
+
 // UnpackRootfs extracts all of the layers in the given manifest.
-// Some verification is done during image extraction.
+// Some verification is done during image extraction. In particular, the
+// uncompressed contents of every layer are always hashed as they are extracted
+// and compared against the corresponding DiffID in the image configuration
+// (in addition to the verification of the compressed blob digest), and an
+// error wrapping ErrDiffIDMismatch is returned if they do not match.
 func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *UnpackOptions) (err error) {
 	engineExt := casext.NewEngine(engine)
+	fsEval := unpackFsEval(opt)
 
-	if err := os.Mkdir(rootfsPath, 0755); err != nil && !os.IsExist(err) {
+	if err := fsEval.MkdirAll(rootfsPath, 0755); err != nil {
 		return errors.Wrap(err, "mkdir rootfs")
 	}
 
+	fileFlags := opt.FileFlags
+	if fileFlags == nil {
+		fileFlags = map[string]string{}
+	}
+
 	// In order to avoid having a broken rootfs in the case of an error, we
 	// remove the rootfs. In the case of rootless this is particularly
 	// important (`rm -rf` won't work on most distro rootfs's).
 	defer func() {
 		if err != nil {
-			fsEval := fseval.Default
-			if opt != nil && opt.MapOptions.Rootless {
-				fsEval = fseval.Rootless
-			}
-			// It's too late to care about errors.
-			// #nosec G104
-			_ = fsEval.RemoveAll(rootfsPath)
+			removeRootfs(rootfsPath, fileFlags, opt)
 		}
 	}()
 
@@ -188,7 +382,7 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 	if err != nil {
 		return errors.Wrap(err, "ensure rootgid has mapping")
 	}
-	if err := os.Lchown(rootfsPath, rootUID, rootGID); err != nil {
+	if err := fsEval.Lchown(rootfsPath, rootUID, rootGID); err != nil {
 		return errors.Wrap(err, "chown rootfs")
 	}
 
@@ -198,7 +392,7 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 	// this, we first set the mtime of the root directory to the Unix epoch
 	// (which is as good of an arbitrary choice as any).
 	epoch := time.Unix(0, 0)
-	if err := system.Lutimes(rootfsPath, epoch, epoch); err != nil {
+	if err := fsEval.Lutimes(rootfsPath, epoch, epoch); err != nil {
 		return errors.Wrap(err, "set initial root time")
 	}
 
@@ -211,7 +405,7 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 	}
 	defer configBlob.Close()
 	if configBlob.Descriptor.MediaType != ispec.MediaTypeImageConfig {
-		return errors.Errorf("unpack rootfs: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
+		return errors.Wrapf(ErrUnsupportedMediaType, "unpack rootfs: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
 	}
 	config, ok := configBlob.Data.(ispec.Image)
 	if !ok {
@@ -224,46 +418,118 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 		return errors.Errorf("unpack rootfs: config: unsupported rootfs.type: %s", config.RootFS.Type)
 	}
 
+	// Every layer is verified against its DiffID as it is extracted, so the
+	// config must have exactly one DiffID for each layer.
+	if err := CheckDiffIDs(manifest, config); err != nil {
+		return errors.Wrap(err, "unpack rootfs")
+	}
+	if opt.CheckHistory {
+		if err := CheckHistory(manifest, config); err != nil {
+			return errors.Wrap(err, "unpack rootfs")
+		}
+	}
+
+	// Figure out which layers were selected (if only some were requested).
+	var onlyDiffIDs map[digest.Digest]struct{}
+	if len(opt.OnlyDiffIDs) > 0 {
+		if opt.StartFrom.MediaType != "" {
+			return errors.Errorf("unpack rootfs: cannot select layers by diff_id when starting from a layer")
+		}
+		layerDiffIDs := map[digest.Digest]struct{}{}
+		for _, diffID := range config.RootFS.DiffIDs {
+			layerDiffIDs[diffID] = struct{}{}
+		}
+		onlyDiffIDs = map[digest.Digest]struct{}{}
+		for _, diffID := range opt.OnlyDiffIDs {
+			if _, ok := layerDiffIDs[diffID]; !ok {
+				return errors.Errorf("unpack rootfs: image has no layer with diff_id %s", diffID)
+			}
+			onlyDiffIDs[diffID] = struct{}{}
+		}
+	}
+
+	// Fail early if the layers obviously won't fit, rather than leaving the
+	// filesystem full after extracting most of the image.
+	if opt.CheckFreeSpace && opt.FsEval == nil {
+		required, err := requiredSpace(ctx, engineExt, manifest, config.RootFS.DiffIDs, opt.StartFrom, onlyDiffIDs)
+		if err != nil {
+			return errors.Wrap(err, "unpack rootfs")
+		}
+		if err := checkFreeSpace(rootfsPath, required); err != nil {
+			return errors.Wrap(err, "unpack rootfs")
+		}
+	}
+
+	// Statistics are always collected, since they are stored in the layer
+	// cache. Each layer is extracted with its own UnpackOptions so that the
+	// caller's options are not modified.
+	stats := opt.Stats
+	if stats == nil {
+		stats = new(UnpackStats)
+	}
+	*stats = UnpackStats{}
+	layerOpt := *opt
+	layerOpt.Stats = stats
+	layerOpt.FileFlags = fileFlags
+
+	// Restore the longest chain of layers we already have in the layer cache.
+	var cacheKeys []layerCacheEntryKey
+	cached := 0
+	if opt.LayerCache != nil && opt.StartFrom.MediaType == "" && onlyDiffIDs == nil && opt.OwnerOverride == nil && opt.OwnershipReport == nil && opt.ContentScan == nil && opt.XattrRewrite == nil && opt.UnknownPAXMode != RecordUnknownPAX && opt.SkippedDevices == nil {
+		cacheKeys = layerCacheKeys(config.RootFS.DiffIDs, opt)
+		for idx := len(cacheKeys) - 1; idx >= 0; idx-- {
+			ok, err := opt.LayerCache.restore(cacheKeys[idx], rootfsPath, fsEval, stats, fileFlags)
+			if err != nil {
+				return errors.Wrap(err, "unpack rootfs")
+			}
+			if ok {
+				cached = idx + 1
+				break
+			}
+		}
+	}
+
 	// Layer extraction.
 	found := false
 	for idx, layerDescriptor := range manifest.Layers {
+		if idx < cached {
+			log.Infof("unpack layer: %s (cached)", layerDescriptor.Digest)
+			continue
+		}
 		if !found && opt.StartFrom.MediaType != "" && layerDescriptor.Digest.String() != opt.StartFrom.Digest.String() {
 			continue
 		}
 		found = true
 
 		layerDiffID := config.RootFS.DiffIDs[idx]
+		if onlyDiffIDs != nil {
+			if _, ok := onlyDiffIDs[layerDiffID]; !ok {
+				log.Debugf("unpack layer: %s (not selected)", layerDescriptor.Digest)
+				continue
+			}
+		}
 		log.Infof("unpack layer: %s", layerDescriptor.Digest)
 
-		layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
+		// Chunked layers are reassembled here, so layerBlobDescriptor is the
+		// descriptor of the actual (compressed) layer blob.
+		layerData, layerBlobDescriptor, err := OpenLayer(ctx, engineExt, layerDescriptor)
 		if err != nil {
-			return errors.Wrap(err, "get layer blob")
-		}
-		defer layerBlob.Close()
-		if !isLayerType(layerBlob.Descriptor.MediaType) {
-			return errors.Errorf("unpack rootfs: layer %s: blob is not correct mediatype: %s", layerBlob.Descriptor.Digest, layerBlob.Descriptor.MediaType)
-		}
-		layerData, ok := layerBlob.Data.(io.ReadCloser)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+			return errors.Wrap(err, "unpack rootfs")
 		}
+		defer layerData.Close()
 
-		layerRaw := layerData
-		if needsGunzip(layerBlob.Descriptor.MediaType) {
-			// We have to extract a gzip'd version of the above layer. Also note
-			// that we have to check the DiffID we're extracting (which is the
-			// sha256 sum of the *uncompressed* layer).
-			layerRaw, err = gzip.NewReader(layerData)
-			if err != nil {
-				return errors.Wrap(err, "create gzip reader")
-			}
+		// Note that we have to check the DiffID of the layer we're extracting
+		// (which is the sha256 sum of the *uncompressed* layer).
+		layerRaw, err := decompressLayer(layerData, layerBlobDescriptor, opt)
+		if err != nil {
+			return errors.Wrap(err, "unpack rootfs")
 		}
+		defer layerRaw.Close()
 
 		layerDigester := digest.SHA256.Digester()
 		layer := io.TeeReader(layerRaw, layerDigester.Hash())
 
-		if err := UnpackLayer(rootfsPath, layer, opt); err != nil {
+		if err := UnpackLayer(rootfsPath, layer, &layerOpt); err != nil {
 			return errors.Wrap(err, "unpack layer")
 		}
 		// Different tar implementations can have different levels of redundant
@@ -282,7 +548,15 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 
 		layerDigest := layerDigester.Digest()
 		if layerDigest != layerDiffID {
-			return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
+			return errors.Wrapf(ErrDiffIDMismatch, "unpack manifest: layer %d (%s): got %s expected %s", idx, layerDescriptor.Digest, layerDigest, layerDiffID)
+		}
+
+		// The layer cache is only an optimisation, so failing to populate
+		// it should not cause the unpack to fail.
+		if cacheKeys != nil {
+			if err := opt.LayerCache.store(cacheKeys[idx], rootfsPath, fsEval, *stats, fileFlags); err != nil {
+				log.Warnf("unpack rootfs: failed to add layer %s to layer cache: %v", layerDescriptor.Digest, err)
+			}
 		}
 
 		if opt.AfterLayerUnpack != nil {
@@ -292,9 +566,43 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 		}
 	}
 
+	if opt.ExpectedStats != nil && *stats != *opt.ExpectedStats {
+		return errors.Errorf("unpack rootfs: extracted entries do not match expected statistics: got %+v expected %+v", *stats, *opt.ExpectedStats)
+	}
+
+	// Inode flags can only be applied once nothing else will be extracted.
+	if err := applyRootfsFileFlags(rootfsPath, fileFlags, opt); err != nil {
+		return errors.Wrap(err, "unpack rootfs")
+	}
 	return nil
 }
 
+// applyRootfsFileFlags applies the inode flags recorded while extracting the
+// rootfs, unless this was disabled with UnpackOptions.NoApplyFileFlags. We are
+// not permitted to set them in rootless mode.
+func applyRootfsFileFlags(rootfsPath string, fileFlags map[string]string, opt *UnpackOptions) error {
+	if len(fileFlags) == 0 || opt.NoApplyFileFlags {
+		return nil
+	}
+	if opt.MapOptions.Rootless {
+		log.Warnf("unpack rootfs: rootless mode cannot restore inode flags of %d paths", len(fileFlags))
+		return nil
+	}
+	return ApplyFileFlags(rootfsPath, fileFlags)
+}
+
+// removeRootfs removes a rootfs which failed to unpack. Immutable paths cannot
+// be removed, so any inode flags which may have been applied are cleared first.
+func removeRootfs(rootfsPath string, fileFlags map[string]string, opt *UnpackOptions) {
+	if len(fileFlags) > 0 && !opt.MapOptions.Rootless && !opt.NoApplyFileFlags {
+		// #nosec G104
+		_ = ClearFileFlags(rootfsPath, fileFlags)
+	}
+	// It's too late to care about errors.
+	// #nosec G104
+	_ = unpackFsEval(opt).RemoveAll(rootfsPath)
+}
+
 // UnpackRuntimeJSON converts a given manifest's configuration to a runtime
 // configuration and writes it to the given writer. If rootfs is specified, it
 // is sourced during the configuration generation (for conversion of
@@ -305,12 +613,13 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 //
 // XXX: I don't like this API. It has way too many arguments.
 func UnpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Writer, rootfs string, manifest ispec.Manifest, opt *MapOptions) error {
-	engineExt := casext.NewEngine(engine)
+	return unpackRuntimeJSON(ctx, engine, configFile, rootfs, manifest, opt, RuncRuntimeProfile)
+}
 
-	var mapOptions MapOptions
-	if opt != nil {
-		mapOptions = *opt
-	}
+// unpackRuntimeJSON is UnpackRuntimeJSON, with the generated configuration
+// tailored to the given runtime profile.
+func unpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Writer, rootfs string, manifest ispec.Manifest, opt *MapOptions, profile RuntimeProfile) error {
+	engineExt := casext.NewEngine(engine)
 
 	// In order to verify the DiffIDs as we extract layers, we have to get the
 	// .Config blob first. But we can't extract it (generate the runtime
@@ -321,17 +630,81 @@ func UnpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Wri
 	}
 	defer configBlob.Close()
 	if configBlob.Descriptor.MediaType != ispec.MediaTypeImageConfig {
-		return errors.Errorf("unpack manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
+		return errors.Wrapf(ErrUnsupportedMediaType, "unpack manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
 	}
 	config, ok := configBlob.Data.(ispec.Image)
 	if !ok {
 		// Should _never_ be reached.
 		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
 	}
+	spec, err := toRuntimeSpec(rootfs, config, opt)
+	if err != nil {
+		return err
+	}
+	if err := applyRuntimeProfile(&spec, profile); err != nil {
+		return err
+	}
+	return writeRuntimeJSON(configFile, spec)
+}
+
+// applyRuntimeProfile tailors the given runtime configuration to the
+// conventions of the runtime described by profile.
+func applyRuntimeProfile(spec *rspec.Spec, profile RuntimeProfile) error {
+	switch profile {
+	case RuncRuntimeProfile, CrunRuntimeProfile:
+		// The generated configuration is already suitable.
+	case KataRuntimeProfile:
+		hasNetNS := false
+		for _, ns := range spec.Linux.Namespaces {
+			switch ns.Type {
+			case rspec.UserNamespace:
+				return errors.Errorf("kata runtime profile does not support user namespaces (rootless or id-mapped bundles)")
+			case rspec.NetworkNamespace:
+				hasNetNS = true
+			}
+		}
+		if !hasNetNS {
+			spec.Linux.Namespaces = append(spec.Linux.Namespaces, rspec.LinuxNamespace{
+				Type: rspec.NetworkNamespace,
+			})
+		}
+	default:
+		return errors.Errorf("unknown runtime profile: %d", profile)
+	}
+	return nil
+}
+
+// PreviewRuntimeJSON converts the given image configuration to the runtime
+// configuration that UnpackManifest would generate for it (with the given
+// MapOptions and runtime profile), and writes it to the given writer. This
+// allows the runtime configuration of an image to be checked without
+// unpacking it. Since the rootfs is not available, the user in the image
+// configuration can only be resolved if it is numeric (as with
+// UnpackRuntimeJSON without a rootfs).
+func PreviewRuntimeJSON(configFile io.Writer, config ispec.Image, opt *MapOptions, profile RuntimeProfile) error {
+	spec, err := toRuntimeSpec("", config, opt)
+	if err != nil {
+		return err
+	}
+	if err := applyRuntimeProfile(&spec, profile); err != nil {
+		return err
+	}
+	spec.Root.Path = RootfsName
+	return writeRuntimeJSON(configFile, spec)
+}
+
+// toRuntimeSpec converts the given image configuration to a runtime
+// configuration, using the given rootfs (which may be empty) to resolve the
+// user and applying the ID mappings in opt.
+func toRuntimeSpec(rootfs string, config ispec.Image, opt *MapOptions) (rspec.Spec, error) {
+	var mapOptions MapOptions
+	if opt != nil {
+		mapOptions = *opt
+	}
 
 	spec, err := iconv.ToRuntimeSpec(rootfs, config)
 	if err != nil {
-		return errors.Wrap(err, "generate config.json")
+		return rspec.Spec{}, errors.Wrap(err, "generate config.json")
 	}
 
 	// Add UIDMapping / GIDMapping options.
@@ -351,11 +724,14 @@ func UnpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Wri
 	spec.Linux.GIDMappings = mapOptions.GIDMappings
 	if mapOptions.Rootless {
 		if err := iconv.ToRootless(&spec); err != nil {
-			return errors.Wrap(err, "convert spec to rootless")
+			return rspec.Spec{}, errors.Wrap(err, "convert spec to rootless")
 		}
 	}
+	return spec, nil
+}
 
-	// Save the config.json.
+// writeRuntimeJSON writes the given runtime configuration as a config.json.
+func writeRuntimeJSON(configFile io.Writer, spec rspec.Spec) error {
 	enc := json.NewEncoder(configFile)
 	enc.SetIndent("", "\t")
 	return errors.Wrap(enc.Encode(spec), "write config.json")
@@ -18,21 +18,28 @@
 package layer
 
 import (
+	"archive/tar"
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 )
 
 func mustDecodeString(s string) []byte {
@@ -185,6 +192,135 @@ func TestUnpackManifestCustomLayer(t *testing.T) {
 	}
 }
 
+func TestUnpackManifestRuntimeProfile(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}
+
+	unpack := func(t *testing.T, opt *UnpackOptions) (rspec.Spec, error) {
+		bundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestRuntimeProfile_bundle")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(bundle)
+
+		var spec rspec.Spec
+		if err := UnpackManifest(ctx, engineExt, bundle, manifest, opt); err != nil {
+			return spec, err
+		}
+		data, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &spec); err != nil {
+			t.Fatalf("parse config.json: %v", err)
+		}
+		return spec, nil
+	}
+
+	namespaces := func(spec rspec.Spec) map[rspec.LinuxNamespaceType]bool {
+		set := map[rspec.LinuxNamespaceType]bool{}
+		for _, ns := range spec.Linux.Namespaces {
+			set[ns.Type] = true
+		}
+		return set
+	}
+
+	for _, profile := range []RuntimeProfile{RuncRuntimeProfile, CrunRuntimeProfile} {
+		spec, err := unpack(t, &UnpackOptions{MapOptions: mapOptions, RuntimeProfile: profile})
+		if err != nil {
+			t.Fatalf("unexpected UnpackManifest error with profile %d: %+v", profile, err)
+		}
+		if !namespaces(spec)[rspec.UserNamespace] {
+			t.Errorf("expected user namespace with profile %d: got %v", profile, spec.Linux.Namespaces)
+		}
+		if spec.Root.Path != RootfsName {
+			t.Errorf("unexpected root path with profile %d: expected %q got %q", profile, RootfsName, spec.Root.Path)
+		}
+	}
+
+	// Kata doesn't support user namespaces, which must be detected before
+	// any layers are extracted.
+	extracted := false
+	if _, err := unpack(t, &UnpackOptions{
+		MapOptions:     mapOptions,
+		RuntimeProfile: KataRuntimeProfile,
+		AfterLayerUnpack: func(ispec.Manifest, ispec.Descriptor) error {
+			extracted = true
+			return nil
+		},
+	}); err == nil {
+		t.Errorf("expected UnpackManifest to fail with kata profile and id mappings")
+	}
+	if extracted {
+		t.Errorf("layers were extracted before the kata profile was rejected")
+	}
+
+	if _, err := unpack(t, &UnpackOptions{RuntimeProfile: RuntimeProfile(-1)}); err == nil {
+		t.Errorf("expected UnpackManifest to fail with unknown profile")
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("unpacking without id mappings requires root")
+	}
+	spec, err := unpack(t, &UnpackOptions{RuntimeProfile: KataRuntimeProfile})
+	if err != nil {
+		t.Fatalf("unexpected UnpackManifest error with kata profile: %+v", err)
+	}
+	if ns := namespaces(spec); ns[rspec.UserNamespace] || !ns[rspec.NetworkNamespace] {
+		t.Errorf("expected network namespace and no user namespace with kata profile: got %v", spec.Linux.Namespaces)
+	}
+	if spec.Root.Path != RootfsName {
+		t.Errorf("unexpected root path with kata profile: expected %q got %q", RootfsName, spec.Root.Path)
+	}
+}
+
+// Make sure that even a (very) small memory budget still allows us to make
+// progress unpacking an image.
+func TestUnpackManifestMemoryBudget(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	bundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestMemoryBudget_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+				{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+				{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+		MemoryBudgetBytes: 1,
+	}
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err != nil {
+		t.Errorf("unexpected UnpackManifest error: %+v\n", err)
+	}
+}
+
 func TestUnpackStartFromDescriptor(t *testing.T) {
 	ctx := context.Background()
 
@@ -219,3 +355,548 @@ func TestUnpackStartFromDescriptor(t *testing.T) {
 		t.Errorf("test file present? %+v\n", err)
 	}
 }
+
+// TestUnpackLayerDuplicateEntries ensures that if a single layer contains the
+// same path more than once (which some malformed archives do), the last entry
+// always wins -- even if the type of the entry changes.
+func TestUnpackLayerDuplicateEntries(t *testing.T) {
+	type tarEntry struct {
+		name     string
+		typeflag byte
+		linkname string
+		contents string
+	}
+
+	for _, test := range []struct {
+		name     string
+		entries  []tarEntry
+		path     string
+		mode     os.FileMode
+		contents string
+		missing  []string
+	}{
+		{"DirThenFile", []tarEntry{
+			{"dup", tar.TypeDir, "", ""},
+			{"dup/child", tar.TypeReg, "", "child"},
+			{"dup/subdir", tar.TypeDir, "", ""},
+			{"dup/subdir/grandchild", tar.TypeReg, "", "grandchild"},
+			{"dup", tar.TypeReg, "", "final"},
+		}, "dup", 0, "final", nil},
+		{"FileThenDir", []tarEntry{
+			{"dup", tar.TypeReg, "", "first"},
+			{"dup", tar.TypeDir, "", ""},
+			{"dup/child", tar.TypeReg, "", "child"},
+		}, "dup", os.ModeDir, "", nil},
+		{"FileThenFile", []tarEntry{
+			{"dup", tar.TypeReg, "", "first"},
+			{"dup", tar.TypeReg, "", "final"},
+		}, "dup", 0, "final", nil},
+		{"DirThenSymlink", []tarEntry{
+			{"dup", tar.TypeDir, "", ""},
+			{"dup/child", tar.TypeReg, "", "child"},
+			{"dup", tar.TypeSymlink, "target", ""},
+		}, "dup", os.ModeSymlink, "", nil},
+		{"DirThenDirOpaque", []tarEntry{
+			{"dup", tar.TypeDir, "", ""},
+			{"dup/child", tar.TypeReg, "", "child"},
+			{"dup", tar.TypeReg, "", "file"},
+			{"dup", tar.TypeDir, "", ""},
+			{"dup/" + whOpaque, tar.TypeReg, "", ""},
+		}, "dup", os.ModeDir, "", []string{"dup/child"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "umoci-TestUnpackLayerDuplicateEntries")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			var buffer bytes.Buffer
+			tw := tar.NewWriter(&buffer)
+			for _, entry := range test.entries {
+				hdr := &tar.Header{
+					Name:     entry.name,
+					Typeflag: entry.typeflag,
+					Linkname: entry.linkname,
+					Mode:     0755,
+					Size:     int64(len(entry.contents)),
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatalf("write header %s: %v", entry.name, err)
+				}
+				if _, err := io.WriteString(tw, entry.contents); err != nil {
+					t.Fatalf("write contents %s: %v", entry.name, err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			unpackOptions := &UnpackOptions{MapOptions: MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+				GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+				Rootless:    os.Geteuid() != 0,
+			}}
+			if err := UnpackLayer(root, &buffer, unpackOptions); err != nil {
+				t.Fatalf("unexpected UnpackLayer error: %+v", err)
+			}
+
+			fi, err := os.Lstat(filepath.Join(root, test.path))
+			if err != nil {
+				t.Fatalf("unexpected lstat error: %v", err)
+			}
+			if fi.Mode()&os.ModeType != test.mode {
+				t.Errorf("final inode has wrong type: expected %v, got %v", test.mode, fi.Mode()&os.ModeType)
+			}
+			if test.mode == 0 {
+				contents, err := ioutil.ReadFile(filepath.Join(root, test.path))
+				if err != nil {
+					t.Fatalf("unexpected readfile error: %v", err)
+				}
+				if string(contents) != test.contents {
+					t.Errorf("final file has wrong contents: expected %q, got %q", test.contents, string(contents))
+				}
+			}
+			for _, path := range test.missing {
+				if _, err := os.Lstat(filepath.Join(root, path)); !os.IsNotExist(err) {
+					t.Errorf("expected %s to have been removed: %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackLayerIncludePaths(t *testing.T) {
+	type tarEntry struct {
+		name     string
+		typeflag byte
+	}
+
+	layers := [][]tarEntry{
+		{
+			{"etc", tar.TypeDir},
+			{"etc/passwd", tar.TypeReg},
+			{"etc/group", tar.TypeReg},
+			{"etc/sub", tar.TypeDir},
+			{"etc/sub/file", tar.TypeReg},
+			{"etcetera", tar.TypeReg},
+			{"usr", tar.TypeDir},
+			{"usr/bin", tar.TypeDir},
+			{"usr/bin/sh", tar.TypeReg},
+			{"usr/bin/bash", tar.TypeReg},
+			{"usr/lib", tar.TypeDir},
+			{"usr/lib/libc.so", tar.TypeReg},
+		},
+		{
+			{"etc/" + whPrefix + "passwd", tar.TypeReg},
+			{"etc/sub/" + whOpaque, tar.TypeReg},
+			{"etc/sub/new", tar.TypeReg},
+			{"usr/bin/" + whPrefix + "bash", tar.TypeReg},
+		},
+	}
+
+	for _, test := range []struct {
+		name         string
+		includePaths []string
+		present      []string
+		absent       []string
+	}{
+		{"Subtree", []string{"/etc"},
+			[]string{"etc", "etc/group", "etc/sub", "etc/sub/new"},
+			[]string{"etc/passwd", "etc/sub/file", "etcetera", "usr"}},
+		{"Glob", []string{"/usr/bin/*sh"},
+			[]string{"usr", "usr/bin", "usr/bin/sh"},
+			[]string{"usr/bin/bash", "usr/lib", "etc", "etcetera"}},
+		{"Multiple", []string{"etc/group", "usr/lib"},
+			[]string{"etc", "etc/group", "usr", "usr/lib", "usr/lib/libc.so"},
+			[]string{"etc/passwd", "etc/sub", "usr/bin", "etcetera"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "umoci-TestUnpackLayerIncludePaths")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			unpackOptions := &UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+					GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+					Rootless:    os.Geteuid() != 0,
+				},
+				IncludePaths: test.includePaths,
+			}
+
+			for _, entries := range layers {
+				var buffer bytes.Buffer
+				tw := tar.NewWriter(&buffer)
+				for _, entry := range entries {
+					if err := tw.WriteHeader(&tar.Header{
+						Name:     entry.name,
+						Typeflag: entry.typeflag,
+						Mode:     0755,
+					}); err != nil {
+						t.Fatalf("write header %s: %v", entry.name, err)
+					}
+				}
+				if err := tw.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if err := UnpackLayer(root, &buffer, unpackOptions); err != nil {
+					t.Fatalf("unexpected UnpackLayer error: %+v", err)
+				}
+			}
+
+			for _, path := range test.present {
+				if _, err := os.Lstat(filepath.Join(root, path)); err != nil {
+					t.Errorf("expected included path %s to exist: %v", path, err)
+				}
+			}
+			for _, path := range test.absent {
+				if _, err := os.Lstat(filepath.Join(root, path)); !os.IsNotExist(err) {
+					t.Errorf("expected path %s to be absent: %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackLayerIncludePathsInvalid(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackLayerIncludePathsInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var buffer bytes.Buffer
+	if err := tar.NewWriter(&buffer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer(root, &buffer, &UnpackOptions{IncludePaths: []string{"/etc/[a-"}}); err == nil {
+		t.Errorf("expected error with invalid include path pattern")
+	}
+}
+
+func TestUnpackRootfsMemory(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	// The rootfs path only exists inside the in-memory filesystem.
+	rootfs := filepath.Join(root, "memory", RootfsName)
+	fsEval := fseval.NewMemory()
+	if err := UnpackRootfs(ctx, engineExt, rootfs, manifest, &UnpackOptions{FsEval: fsEval}); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Dir(rootfs)); !os.IsNotExist(err) {
+		t.Errorf("unpacking to in-memory filesystem touched the host: %v", err)
+	}
+
+	for _, test := range []struct {
+		path     string
+		mode     os.FileMode
+		contents string
+	}{
+		{"test_file", 0644, "Who controls the past controls the future. Who controls the present controls the past.\n"},
+		{"test_script.sh", os.ModeSetuid | 0755, "#!/bin/sh\n\necho \"It was a bright cold day in April, and the clocks were striking thirteen.\"\n"},
+		{"test_dir", os.ModeDir | 0707, ""},
+	} {
+		path := filepath.Join(rootfs, test.path)
+		st, err := fsEval.Lstatx(path)
+		if err != nil {
+			t.Errorf("unexpected lstat error: %s: %+v", test.path, err)
+			continue
+		}
+		if st.Uid != 1000 || st.Gid != 100 {
+			t.Errorf("unexpected owner of %s: %d:%d", test.path, st.Uid, st.Gid)
+		}
+		fi, _ := fsEval.Lstat(path)
+		if fi.Mode() != test.mode {
+			t.Errorf("unexpected mode of %s: expected %v, got %v", test.path, test.mode, fi.Mode())
+		}
+		if fi.IsDir() {
+			continue
+		}
+		fh, err := fsEval.Open(path)
+		if err != nil {
+			t.Errorf("unexpected open error: %s: %+v", test.path, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(fh)
+		fh.Close()
+		if err != nil {
+			t.Errorf("unexpected read error: %s: %+v", test.path, err)
+		} else if string(data) != test.contents {
+			t.Errorf("unexpected contents of %s: %q", test.path, string(data))
+		}
+	}
+}
+
+func TestUnpackLayerMemory(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, Xattrs: map[string]string{"user.comment": "test"}},
+		{Name: "etc/alias", Typeflag: tar.TypeSymlink, Linkname: "hostname"},
+		{Name: "etc/hardlink", Typeflag: tar.TypeLink, Linkname: "etc/hostname"},
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("umoci")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fsEval := fseval.NewMemory()
+	if err := UnpackLayer("/", &buf, &UnpackOptions{FsEval: fsEval}); err != nil {
+		t.Fatalf("unexpected UnpackLayer error: %+v", err)
+	}
+
+	for _, path := range []string{"/etc/hostname", "/etc/alias", "/etc/hardlink"} {
+		fh, err := fsEval.Open(path)
+		if err != nil {
+			t.Errorf("unexpected open error: %s: %+v", path, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(fh)
+		fh.Close()
+		if err != nil || string(data) != "umoci" {
+			t.Errorf("unexpected contents of %s: %q (%v)", path, string(data), err)
+		}
+	}
+	if target, err := fsEval.Readlink("/etc/alias"); err != nil || target != "hostname" {
+		t.Errorf("unexpected symlink target: %q (%v)", target, err)
+	}
+	if value, err := fsEval.Lgetxattr("/etc/hostname", "user.comment"); err != nil || string(value) != "test" {
+		t.Errorf("unexpected xattr value: %q (%v)", value, err)
+	}
+
+	// Devices are replaced with empty files when running in a user namespace.
+	if !inUserNamespace {
+		st, err := fsEval.Lstatx("/dev/null")
+		if err != nil {
+			t.Fatalf("unexpected lstat error: %+v", err)
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFCHR || unix.Major(uint64(st.Rdev)) != 1 || unix.Minor(uint64(st.Rdev)) != 3 {
+			t.Errorf("unexpected device node: mode=%o rdev=%d:%d", st.Mode, unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)))
+		}
+	}
+}
+
+func TestUnpackRootfsStats(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	// Both layers have an entry for the root directory, in addition to
+	// test_file and test_dir (layer 1) and test_script.sh (layer 2).
+	expected := UnpackStats{
+		Files:       2,
+		Directories: 3,
+		Bytes:       int64(len("Who controls the past controls the future. Who controls the present controls the past.\n") + len("#!/bin/sh\n\necho \"It was a bright cold day in April, and the clocks were striking thirteen.\"\n")),
+	}
+
+	cache, err := NewLayerCache(filepath.Join(root, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The statistics must be the same whether or not the layers are
+	// restored from the layer cache.
+	for idx, name := range []string{"rootfs", "rootfs-cached"} {
+		var stats UnpackStats
+		opt := &UnpackOptions{
+			FsEval:        fseval.NewMemory(),
+			Stats:         &stats,
+			ExpectedStats: &expected,
+		}
+		if idx > 0 {
+			opt.FsEval = nil
+			opt.MapOptions = testCacheUnpackOptions(nil).MapOptions
+			opt.LayerCache = cache
+		}
+		if err := UnpackRootfs(ctx, engineExt, filepath.Join(root, name), manifest, opt); err != nil {
+			t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+		}
+		if stats != expected {
+			t.Errorf("unexpected unpack stats: expected %+v, got %+v", expected, stats)
+		}
+	}
+
+	wrong := expected
+	wrong.Files++
+	err = UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs-wrong"), manifest, &UnpackOptions{
+		FsEval:        fseval.NewMemory(),
+		ExpectedStats: &wrong,
+	})
+	if err == nil {
+		t.Fatalf("expected UnpackRootfs to fail with mismatched expected stats")
+	}
+	if !strings.Contains(err.Error(), "do not match expected statistics") {
+		t.Errorf("unexpected UnpackRootfs error: %v", err)
+	}
+}
+
+func TestUnpackRootfsErrors(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	// putConfig stores a copy of the image config modified by fn, and returns
+	// a copy of the manifest using it.
+	putConfig := func(manifest ispec.Manifest, fn func(*ispec.Image)) ispec.Manifest {
+		configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer configBlob.Close()
+		config := configBlob.Data.(ispec.Image)
+		config.RootFS.DiffIDs = append([]digest.Digest{}, config.RootFS.DiffIDs...)
+		fn(&config)
+		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Config.Digest = configDigest
+		manifest.Config.Size = configSize
+		return manifest
+	}
+
+	badDiffID := putConfig(manifest, func(config *ispec.Image) {
+		config.RootFS.DiffIDs[1] = digest.FromString("not the diffid")
+	})
+
+	badLayerType := manifest
+	badLayerType.Layers = append([]ispec.Descriptor{}, manifest.Layers...)
+	badLayerType.Layers[1].MediaType = "application/vnd.example.unknown.layer"
+
+	missingLayer := manifest
+	missingLayer.Layers = append([]ispec.Descriptor{}, manifest.Layers...)
+	missingLayer.Layers[1].Digest = digest.FromString("missing layer")
+
+	for _, test := range []struct {
+		name     string
+		manifest ispec.Manifest
+		expected error
+	}{
+		{"DiffIDMismatch", badDiffID, ErrDiffIDMismatch},
+		{"UnsupportedMediaType", badLayerType, ErrUnsupportedMediaType},
+		{"MissingLayer", missingLayer, cas.ErrBlobNotExist},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rootfs := filepath.Join(root, "rootfs-"+test.name)
+			err := UnpackRootfs(ctx, engineExt, rootfs, test.manifest, &UnpackOptions{FsEval: fseval.NewMemory()})
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected UnpackRootfs error to match %v: %+v", test.expected, err)
+			}
+		})
+	}
+}
+
+// Layers whose contents do not match the DiffIDs in the config must always be
+// rejected, with an error that identifies the offending layer.
+func TestUnpackRootfsDiffIDMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer configBlob.Close()
+	config := configBlob.Data.(ispec.Image)
+	origDiffIDs := config.RootFS.DiffIDs
+
+	for _, test := range []struct {
+		name     string
+		diffIDs  []digest.Digest
+		contains string
+	}{
+		{"WrongDiffID", []digest.Digest{origDiffIDs[0], digest.FromString("wrong")}, "layer 1 (" + manifest.Layers[1].Digest.String() + ")"},
+		{"MissingDiffID", origDiffIDs[:1], "config has 1 diff_ids but manifest has 2 layers"},
+		{"ExtraDiffID", append(append([]digest.Digest{}, origDiffIDs...), digest.FromString("extra")), "config has 3 diff_ids but manifest has 2 layers"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config.RootFS.DiffIDs = test.diffIDs
+			configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			badManifest := manifest
+			badManifest.Config.Digest = configDigest
+			badManifest.Config.Size = configSize
+
+			err = UnpackRootfs(ctx, engineExt, filepath.Join(root, test.name), badManifest, &UnpackOptions{FsEval: fseval.NewMemory()})
+			if !errors.Is(err, ErrDiffIDMismatch) {
+				t.Fatalf("expected UnpackRootfs to fail with ErrDiffIDMismatch: %+v", err)
+			}
+			if !strings.Contains(err.Error(), test.contains) {
+				t.Errorf("UnpackRootfs error does not identify the problem (%q): %v", test.contains, err)
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsOnlyDiffIDs(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer configBlob.Close()
+	diffIDs := configBlob.Data.(ispec.Image).RootFS.DiffIDs
+
+	// Only the top layer is selected, so only test_script.sh (and the root
+	// directory) should be extracted.
+	rootfs := filepath.Join(root, "rootfs")
+	fsEval := fseval.NewMemory()
+	var stats UnpackStats
+	if err := UnpackRootfs(ctx, engineExt, rootfs, manifest, &UnpackOptions{
+		FsEval:      fsEval,
+		Stats:       &stats,
+		OnlyDiffIDs: []digest.Digest{diffIDs[1]},
+	}); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+	if _, err := fsEval.Lstat(filepath.Join(rootfs, "test_script.sh")); err != nil {
+		t.Errorf("expected path added by selected layer to be extracted: %v", err)
+	}
+	for _, path := range []string{"test_file", "test_dir"} {
+		if _, err := fsEval.Lstat(filepath.Join(rootfs, path)); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("expected path %s from unselected layer to not be extracted: %v", path, err)
+		}
+	}
+	if stats.Files != 1 || stats.Directories != 1 {
+		t.Errorf("unexpected unpack stats for selected layer: %+v", stats)
+	}
+
+	// Selecting a layer which is not in the image is an error.
+	err = UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs-missing"), manifest, &UnpackOptions{
+		FsEval:      fseval.NewMemory(),
+		OnlyDiffIDs: []digest.Digest{diffIDs[1], digest.FromString("missing")},
+	})
+	if err == nil {
+		t.Fatalf("expected UnpackRootfs to fail with a DiffID not in the image")
+	}
+	if !strings.Contains(err.Error(), "no layer with diff_id") {
+		t.Errorf("unexpected UnpackRootfs error: %v", err)
+	}
+}
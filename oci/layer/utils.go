@@ -21,7 +21,10 @@ import (
 	"archive/tar"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/apex/log"
 	"github.com/golang/protobuf/proto"
@@ -211,6 +214,86 @@ func CleanPath(path string) string {
 	return filepath.Clean(path)
 }
 
+// checkEntryName validates that the given tar entry name does not contain any
+// control characters (including NUL and newline), which could confuse other
+// tools operating on the extracted filesystem. Depending on mode, either an
+// error is returned or a sanitised name (with every control character replaced
+// with an underscore) is returned.
+func checkEntryName(name string, mode UnsafeNameMode) (string, error) {
+	idx := strings.IndexFunc(name, unicode.IsControl)
+	if idx < 0 {
+		return name, nil
+	}
+	switch mode {
+	case RejectUnsafeNames:
+		r, _ := utf8.DecodeRuneInString(name[idx:])
+		return "", errors.Errorf("unsafe entry name %q: contains control character %U", name, r)
+	case SanitizeUnsafeNames:
+		sanitized := strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return '_'
+			}
+			return r
+		}, name)
+		log.Warnf("sanitizing unsafe entry name %q to %q", name, sanitized)
+		return sanitized, nil
+	}
+	return "", errors.Errorf("[internal error] unknown unsafe name mode %d", mode)
+}
+
+// checkAbsoluteName handles tar entry names which are absolute paths.
+// Depending on mode, either an error is returned or the name is returned with
+// its leading "/" removed (so that it is relative to the root filesystem).
+func checkAbsoluteName(name string, mode AbsolutePathMode) (string, error) {
+	if !strings.HasPrefix(name, "/") {
+		return name, nil
+	}
+	switch mode {
+	case RejectAbsolutePaths:
+		return "", errors.Errorf("absolute entry name %q", name)
+	case StripAbsolutePaths:
+		stripped := strings.TrimLeft(name, "/")
+		if stripped == "" {
+			stripped = "."
+		}
+		log.Debugf("stripping leading / from absolute entry name %q", name)
+		return stripped, nil
+	}
+	return "", errors.Errorf("[internal error] unknown absolute path mode %d", mode)
+}
+
+// knownPAXKeywords are the PAX record keywords which are interpreted by
+// archive/tar (and thus by umoci). See pax(1) for the POSIX keywords.
+var knownPAXKeywords = map[string]struct{}{
+	"atime":      {},
+	"charset":    {},
+	"comment":    {},
+	"ctime":      {},
+	"gid":        {},
+	"gname":      {},
+	"hdrcharset": {},
+	"linkpath":   {},
+	"mtime":      {},
+	"path":       {},
+	"size":       {},
+	"uid":        {},
+	"uname":      {},
+
+	// Interpreted by umoci itself.
+	paxFileFlags: {},
+	paxBirthtime: {},
+}
+
+// isKnownPAXKeyword returns whether the given PAX record keyword is one that
+// umoci understands. In addition to knownPAXKeywords, extended attributes
+// (SCHILY.xattr.*) and GNU sparse file records (GNU.sparse.*) are understood.
+func isKnownPAXKeyword(keyword string) bool {
+	if _, ok := knownPAXKeywords[keyword]; ok {
+		return true
+	}
+	return strings.HasPrefix(keyword, "SCHILY.xattr.") || strings.HasPrefix(keyword, "GNU.sparse.")
+}
+
 // InnerErrno returns the "real" system error from an error that originally
 // came from the "os" package. The returned error can be compared directly with
 // unix.* (or syscall.*) errno values. If the type could not be detected we just return
@@ -246,3 +329,72 @@ func isOverlayWhiteout(info os.FileInfo) (bool, error) {
 	return major == 0 && minor == 0 &&
 		info.Mode()&os.ModeCharDevice != 0, nil
 }
+
+// splitIncludePath cleans the given path (relative to the root of the rootfs)
+// and splits it into its components. The root itself has no components.
+func splitIncludePath(path string) []string {
+	path = CleanPath(string(os.PathSeparator) + path)
+	path = strings.TrimPrefix(path, string(os.PathSeparator))
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, string(os.PathSeparator))
+}
+
+// pathLess returns whether the path a (relative to the root of the rootfs)
+// should come before the path b in a generated layer. Paths are compared one
+// component at a time, so that every directory comes before its contents
+// (which immediately follow it) and siblings are in lexicographic order. The
+// plain string ordering does not guarantee this, since it would sort "a-b"
+// between "a" and "a/b" (and "-b" before ".").
+func pathLess(a, b string) bool {
+	aParts, bParts := splitIncludePath(a), splitIncludePath(b)
+	for idx := 0; idx < len(aParts) && idx < len(bParts); idx++ {
+		if aParts[idx] != bParts[idx] {
+			return aParts[idx] < bParts[idx]
+		}
+	}
+	return len(aParts) < len(bParts)
+}
+
+// validateIncludePaths checks that all of the given IncludePaths patterns are
+// valid filepath.Match patterns.
+func validateIncludePaths(patterns []string) error {
+	for _, pattern := range patterns {
+		for _, component := range splitIncludePath(pattern) {
+			if _, err := filepath.Match(component, ""); err != nil {
+				return errors.Wrapf(err, "invalid include path %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// matchIncludePath returns whether the given path (relative to the root of the
+// rootfs) should be extracted given the set of IncludePaths patterns. A path
+// is included if it (or one of its ancestors) matches a pattern, or if it is
+// an ancestor of a path which could match a pattern (so that the metadata of
+// parent directories is still extracted). Patterns are matched one path
+// component at a time with filepath.Match. An empty set of patterns includes
+// every path.
+func matchIncludePath(patterns []string, path string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	pathComponents := splitIncludePath(path)
+	for _, pattern := range patterns {
+		patternComponents := splitIncludePath(pattern)
+		matched := true
+		for idx := 0; idx < len(pathComponents) && idx < len(patternComponents); idx++ {
+			// The pattern has already been validated, so errors are impossible.
+			if ok, _ := filepath.Match(patternComponents[idx], pathComponents[idx]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,302 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinkDepth is the maximum number of symlinks which will be followed
+// when resolving a path in an ImageView (matching MAXSYMLINKS on Linux).
+const maxSymlinkDepth = 40
+
+// ImageView is a read-only view of the merged contents of the layers of an
+// image (with whiteouts and overwritten paths resolved as they would be when
+// extracting the image), allowing individual files to be read without
+// extracting the whole image. The index of the merged view is built from the
+// headers of every layer when it is first needed, and each Open only reads
+// the layer containing the requested file.
+//
+// Note that since the layers are not read to EOF when opening a file, the
+// layer blobs are not fully verified against their digests.
+type ImageView struct {
+	engine  casext.Engine
+	layers  []ispec.Descriptor
+	entries map[string]viewEntry
+}
+
+// viewEntry is an entry in the merged view of an ImageView.
+type viewEntry struct {
+	// Header is the tar header of the entry. For hardlinks, this is the
+	// header of the link target (with the name of the hardlink).
+	Header *tar.Header
+
+	// Layer is the index of the layer which contains the contents of the
+	// entry, and Index is the position of the entry in that layer (or -1 for
+	// implicitly-created parent directories).
+	Layer, Index int
+}
+
+// NewImageView creates a new ImageView for the layers of the given manifest.
+func NewImageView(engine casext.Engine, manifest ispec.Manifest) *ImageView {
+	return &ImageView{
+		engine: engine,
+		layers: manifest.Layers,
+	}
+}
+
+// openLayer returns a tar reader for the uncompressed contents of the layer
+// with the given index. The returned closer must be closed by the caller.
+func (v *ImageView) openLayer(ctx context.Context, idx int) (*tar.Reader, *viewCloser, error) {
+	blob, desc, err := OpenLayer(ctx, v.engine, v.layers[idx])
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "open layer %d", idx)
+	}
+	decompressed, err := DecompressLayer(blob, desc)
+	if err != nil {
+		blob.Close()
+		return nil, nil, errors.Wrapf(err, "decompress layer %d", idx)
+	}
+	return tar.NewReader(decompressed), &viewCloser{decompressed: decompressed, blob: blob}, nil
+}
+
+// viewCloser closes both the decompressor and the underlying layer blob.
+type viewCloser struct {
+	decompressed io.Closer
+	blob         io.ReadCloser
+
+	// drain causes the rest of the layer blob to be read before it is
+	// closed, since the digest of the blob can only be verified once the
+	// whole blob has been read.
+	drain bool
+}
+
+func (c *viewCloser) Close() error {
+	if c.drain {
+		if _, err := io.Copy(ioutil.Discard, c.blob); err != nil {
+			c.decompressed.Close()
+			c.blob.Close()
+			return errors.Wrap(err, "verify layer")
+		}
+	}
+	err := c.decompressed.Close()
+	if blobErr := c.blob.Close(); err == nil {
+		err = blobErr
+	}
+	return err
+}
+
+// removeChildren removes every entry inside dir (but not dir itself) which
+// comes from a layer below maxLayer.
+func removeChildren(entries map[string]viewEntry, dir string, maxLayer int) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for name, entry := range entries {
+		if strings.HasPrefix(name, prefix) && entry.Layer < maxLayer {
+			delete(entries, name)
+		}
+	}
+}
+
+// addParents adds implicit directory entries for any parents of name which
+// are not already present, as happens when extracting a layer.
+func addParents(entries map[string]viewEntry, name string, layer int) {
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		if _, ok := entries[dir]; ok {
+			break
+		}
+		entries[dir] = viewEntry{
+			Header: &tar.Header{
+				Name:     dir,
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+			},
+			Layer: layer,
+			Index: -1,
+		}
+	}
+}
+
+// load builds the index of the merged view, if it has not already been built.
+func (v *ImageView) load(ctx context.Context) error {
+	if v.entries != nil {
+		return nil
+	}
+
+	entries := map[string]viewEntry{}
+	for idx := range v.layers {
+		tr, closer, err := v.openLayer(ctx, idx)
+		if err != nil {
+			return err
+		}
+		for pos := 0; ; pos++ {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				closer.Close()
+				return errors.Wrapf(err, "read layer %d", idx)
+			}
+
+			name := path.Clean("/" + hdr.Name)
+			dir, file := path.Split(name)
+			switch {
+			case file == whOpaque:
+				// Whiteouts only apply to the contents of lower layers.
+				removeChildren(entries, path.Clean(dir), idx)
+			case strings.HasPrefix(file, whPrefix):
+				target := path.Join(dir, strings.TrimPrefix(file, whPrefix))
+				if entry, ok := entries[target]; ok && entry.Layer < idx {
+					delete(entries, target)
+				}
+				removeChildren(entries, target, idx)
+			default:
+				entry := viewEntry{Header: hdr, Layer: idx, Index: pos}
+				if hdr.Typeflag == tar.TypeLink {
+					target, ok := entries[path.Clean("/"+hdr.Linkname)]
+					if !ok {
+						closer.Close()
+						return errors.Errorf("layer %d: hardlink %s has non-existent target %s", idx, name, hdr.Linkname)
+					}
+					linkHdr := *target.Header
+					linkHdr.Name = hdr.Name
+					entry = viewEntry{Header: &linkHdr, Layer: target.Layer, Index: target.Index}
+				}
+				// Replacing a directory with a non-directory removes its
+				// contents.
+				if old, ok := entries[name]; ok && old.Header.Typeflag == tar.TypeDir && entry.Header.Typeflag != tar.TypeDir {
+					removeChildren(entries, name, idx+1)
+				}
+				addParents(entries, name, idx)
+				entries[name] = entry
+			}
+		}
+		if err := closer.Close(); err != nil {
+			return errors.Wrapf(err, "close layer %d", idx)
+		}
+	}
+	v.entries = entries
+	return nil
+}
+
+// resolve returns the entry for the given path in the merged view. Symlinks
+// are resolved (scoped to the root of the image), though a symlink in the
+// final component is only followed if followFinal is set.
+func (v *ImageView) resolve(ctx context.Context, op, unsafePath string, followFinal bool) (viewEntry, error) {
+	if err := v.load(ctx); err != nil {
+		return viewEntry{}, err
+	}
+
+	current := "/"
+	components := strings.Split(unsafePath, "/")
+	for links := 0; len(components) > 0; {
+		part := components[0]
+		components = components[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = path.Dir(current)
+			continue
+		}
+
+		next := path.Join(current, part)
+		entry, ok := v.entries[next]
+		if !ok {
+			return viewEntry{}, &os.PathError{Op: op, Path: unsafePath, Err: os.ErrNotExist}
+		}
+		if entry.Header.Typeflag == tar.TypeSymlink && (len(components) > 0 || followFinal) {
+			links++
+			if links > maxSymlinkDepth {
+				return viewEntry{}, &os.PathError{Op: op, Path: unsafePath, Err: unix.ELOOP}
+			}
+			if path.IsAbs(entry.Header.Linkname) {
+				current = "/"
+			}
+			components = append(strings.Split(entry.Header.Linkname, "/"), components...)
+			continue
+		}
+		if len(components) > 0 && entry.Header.Typeflag != tar.TypeDir {
+			return viewEntry{}, &os.PathError{Op: op, Path: unsafePath, Err: unix.ENOTDIR}
+		}
+		current = next
+	}
+
+	entry, ok := v.entries[current]
+	if !ok && current == "/" {
+		// The root directory is usually not included in layers.
+		entry = viewEntry{
+			Header: &tar.Header{Name: "/", Typeflag: tar.TypeDir, Mode: 0755},
+			Index:  -1,
+		}
+	}
+	return entry, nil
+}
+
+// Lstat returns the tar header of the given path in the merged view. If the
+// path is a symlink, the header of the symlink itself is returned. The
+// returned error is an *os.PathError if the path does not exist.
+func (v *ImageView) Lstat(ctx context.Context, path string) (*tar.Header, error) {
+	entry, err := v.resolve(ctx, "lstat", path, false)
+	if err != nil {
+		return nil, err
+	}
+	hdr := *entry.Header
+	return &hdr, nil
+}
+
+// Open returns a reader for the contents of the given regular file in the
+// merged view (following any symlinks). Only the layer containing the file
+// is read. The returned reader must be closed by the caller. Closing the
+// reader reads the remainder of the layer, so that the layer's digest can be
+// verified (an error is returned if it does not match).
+func (v *ImageView) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	entry, err := v.resolve(ctx, "open", path, true)
+	if err != nil {
+		return nil, err
+	}
+	if typ := entry.Header.Typeflag; typ != tar.TypeReg && typ != tar.TypeRegA {
+		return nil, errors.Errorf("open %s: not a regular file", path)
+	}
+
+	tr, closer, err := v.openLayer(ctx, entry.Layer)
+	if err != nil {
+		return nil, err
+	}
+	for pos := 0; pos <= entry.Index; pos++ {
+		if _, err := tr.Next(); err != nil {
+			closer.Close()
+			return nil, errors.Wrapf(err, "find %s in layer %d", path, entry.Layer)
+		}
+	}
+	closer.drain = true
+	return struct {
+		io.Reader
+		io.Closer
+	}{tr, closer}, nil
+}
@@ -0,0 +1,230 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// viewEntrySpec describes a tar entry for TestImageView. Regular files have
+// the given contents.
+type viewEntrySpec struct {
+	name, linkname, contents string
+	typeflag                 byte
+}
+
+func makeViewLayer(t *testing.T, engineExt casext.Engine, entries []viewEntrySpec) ispec.Descriptor {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Linkname: entry.linkname,
+			Typeflag: entry.typeflag,
+			Mode:     0644,
+			Size:     int64(len(entry.contents)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layerDigest, layerSize, err := engineExt.PutBlob(context.Background(), &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+}
+
+func TestImageView(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestImageView")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{
+			makeViewLayer(t, engineExt, []viewEntrySpec{
+				{name: "etc/", typeflag: tar.TypeDir},
+				{name: "etc/file", contents: "lower", typeflag: tar.TypeReg},
+				{name: "etc/gone", contents: "gone", typeflag: tar.TypeReg},
+				{name: "lib", linkname: "/etc", typeflag: tar.TypeSymlink},
+				{name: "opaque/old", contents: "old", typeflag: tar.TypeReg},
+				{name: "implicit/dir/file", contents: "implicit", typeflag: tar.TypeReg},
+			}),
+			makeViewLayer(t, engineExt, []viewEntrySpec{
+				{name: "etc/file", contents: "upper", typeflag: tar.TypeReg},
+				{name: "etc/.wh.gone", typeflag: tar.TypeReg},
+				{name: "etc/link", linkname: "etc/file", typeflag: tar.TypeLink},
+				{name: "opaque/.wh..wh..opq", typeflag: tar.TypeReg},
+				{name: "opaque/new", contents: "new", typeflag: tar.TypeReg},
+			}),
+		},
+	}
+	view := NewImageView(engineExt, manifest)
+
+	for _, test := range []struct {
+		path, contents string
+	}{
+		// The higher layer wins.
+		{"/etc/file", "upper"},
+		{"etc/../etc/./file", "upper"},
+		// Symlinks are resolved inside the image.
+		{"/lib/file", "upper"},
+		{"/lib/../lib/file", "upper"},
+		// Hardlinks refer to the contents at the time of the link.
+		{"/etc/link", "upper"},
+		{"/opaque/new", "new"},
+		{"/implicit/dir/file", "implicit"},
+	} {
+		rc, err := view.Open(ctx, test.path)
+		if err != nil {
+			t.Errorf("unexpected error opening %s: %+v", test.path, err)
+			continue
+		}
+		contents, err := ioutil.ReadAll(rc)
+		if closeErr := rc.Close(); closeErr != nil {
+			t.Errorf("unexpected error closing %s: %+v", test.path, closeErr)
+		}
+		if err != nil {
+			t.Errorf("unexpected error reading %s: %+v", test.path, err)
+		} else if string(contents) != test.contents {
+			t.Errorf("unexpected contents of %s: expected %q, got %q", test.path, test.contents, contents)
+		}
+	}
+
+	// Whited-out paths must not exist.
+	for _, path := range []string{"/etc/gone", "/lib/gone", "/opaque/old", "/nonexistent"} {
+		if _, err := view.Open(ctx, path); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("expected %s to not exist, got %v", path, err)
+		}
+	}
+
+	if hdr, err := view.Lstat(ctx, "/lib"); err != nil {
+		t.Errorf("unexpected error in lstat: %+v", err)
+	} else if hdr.Typeflag != tar.TypeSymlink {
+		t.Errorf("expected /lib to be a symlink, got type %c", hdr.Typeflag)
+	}
+	for _, path := range []string{"/", "/implicit", "/lib/"} {
+		hdr, err := view.Lstat(ctx, path)
+		if err != nil {
+			t.Errorf("unexpected error in lstat of %s: %+v", path, err)
+		} else if hdr.Typeflag != tar.TypeDir {
+			t.Errorf("expected %s to be a directory, got type %c", path, hdr.Typeflag)
+		}
+	}
+	if _, err := view.Open(ctx, "/etc"); err == nil {
+		t.Errorf("expected error opening a directory")
+	}
+}
+
+// TestImageViewOpenClose makes sure that closing a file opened from the view
+// verifies the layer, even if the file is not at the end of the layer.
+func TestImageViewOpenClose(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestImageViewOpenClose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	layer := makeViewLayer(t, engineExt, []viewEntrySpec{
+		{name: "a", contents: "small", typeflag: tar.TypeReg},
+		{name: "b", contents: strings.Repeat("x", 4<<20), typeflag: tar.TypeReg},
+	})
+	view := NewImageView(engineExt, ispec.Manifest{Layers: []ispec.Descriptor{layer}})
+
+	open := func(path string) ([]byte, error) {
+		rc, err := view.Open(ctx, path)
+		if err != nil {
+			t.Fatalf("unexpected error opening %s: %+v", path, err)
+		}
+		contents, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %+v", path, err)
+		}
+		return contents, rc.Close()
+	}
+
+	if contents, err := open("/a"); err != nil {
+		t.Errorf("unexpected error closing /a: %+v", err)
+	} else if string(contents) != "small" {
+		t.Errorf("unexpected contents of /a: expected %q, got %q", "small", contents)
+	}
+
+	// Corrupt the end of the layer (the tar padding), which is after /a.
+	blobPath := filepath.Join(image, "blobs", layer.Digest.Algorithm().String(), layer.Digest.Hex())
+	data, err := ioutil.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(blobPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open("/a"); err == nil {
+		t.Errorf("expected error closing /a from corrupted layer")
+	}
+}
@@ -39,6 +39,9 @@ type FsEval interface {
 	// Lstatx is equivalent to unix.Lstat.
 	Lstatx(path string) (unix.Stat_t, error)
 
+	// Lbirthtime is equivalent to system.Lbirthtime.
+	Lbirthtime(path string) (time.Time, error)
+
 	// Readlink is equivalent to os.Readlink.
 	Readlink(path string) (string, error)
 
@@ -51,6 +54,9 @@ type FsEval interface {
 	// Chmod is equivalent to os.Chmod.
 	Chmod(path string, mode os.FileMode) error
 
+	// Lchown is equivalent to os.Lchown.
+	Lchown(path string, uid, gid int) error
+
 	// Lutimes is equivalent to os.Lutimes.
 	Lutimes(path string, atime, mtime time.Time) error
 
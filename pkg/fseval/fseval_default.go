@@ -68,6 +68,11 @@ func (fs osFsEval) Lstatx(path string) (unix.Stat_t, error) {
 	return s, err
 }
 
+// Lbirthtime is equivalent to system.Lbirthtime.
+func (fs osFsEval) Lbirthtime(path string) (time.Time, error) {
+	return system.Lbirthtime(path)
+}
+
 // Readlink is equivalent to os.Readlink.
 func (fs osFsEval) Readlink(path string) (string, error) {
 	return os.Readlink(path)
@@ -93,6 +98,11 @@ func (fs osFsEval) Chmod(path string, mode os.FileMode) error {
 	return os.Chmod(path, mode)
 }
 
+// Lchown is equivalent to os.Lchown.
+func (fs osFsEval) Lchown(path string, uid, gid int) error {
+	return os.Lchown(path, uid, gid)
+}
+
 // Lutimes is equivalent to os.Lutimes.
 func (fs osFsEval) Lutimes(path string, atime, mtime time.Time) error {
 	return system.Lutimes(path, atime, mtime)
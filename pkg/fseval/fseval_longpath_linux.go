@@ -0,0 +1,290 @@
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fseval
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
+)
+
+// procFdPrefixLen is an upper bound on the length of the "/proc/self/fd/<fd>"
+// prefix used by shortenPath.
+const procFdPrefixLen = 32
+
+// LongPath returns an FsEval which wraps fs, allowing it to operate on paths
+// longer than PATH_MAX (which would otherwise fail with ENAMETOOLONG). For such
+// paths, the leading directories are opened one component at a time (so the
+// kernel never has to resolve more than PATH_MAX bytes at once) and the
+// operation is done on the remainder of the path relative to that directory
+// (using its /proc/self/fd magic-link). Shorter paths are passed to fs as-is.
+func LongPath(fs FsEval) FsEval {
+	return longPathFsEval{fs: fs}
+}
+
+// longPathFsEval is the FsEval returned by LongPath.
+type longPathFsEval struct {
+	fs FsEval
+}
+
+// shortenPath calls fn with a path equivalent to path that is shorter than
+// PATH_MAX.
+func shortenPath(path string, fn func(string) error) error {
+	if len(path) < unix.PathMax {
+		return fn(path)
+	}
+
+	// Open the leading components of the path until the remainder (with the
+	// /proc/self/fd prefix) is short enough.
+	dirfd := unix.AT_FDCWD
+	rest := filepath.Clean(path)
+	if filepath.IsAbs(rest) {
+		rest = strings.TrimPrefix(rest, "/")
+		fd, err := unix.Open("/", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: "/", Err: err}
+		}
+		dirfd = fd
+	}
+	defer func() {
+		if dirfd != unix.AT_FDCWD {
+			// #nosec G104
+			_ = unix.Close(dirfd)
+		}
+	}()
+	for len(rest)+procFdPrefixLen >= unix.PathMax {
+		idx := strings.IndexByte(rest, '/')
+		if idx < 0 {
+			break
+		}
+		fd, err := unix.Openat(dirfd, rest[:idx], unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "openat", Path: path, Err: err}
+		}
+		if dirfd != unix.AT_FDCWD {
+			// #nosec G104
+			_ = unix.Close(dirfd)
+		}
+		dirfd = fd
+		rest = rest[idx+1:]
+	}
+	if dirfd == unix.AT_FDCWD {
+		return fn(rest)
+	}
+	return fn("/proc/self/fd/" + strconv.Itoa(dirfd) + "/" + rest)
+}
+
+// Open is equivalent to os.Open.
+func (fs longPathFsEval) Open(path string) (fh *os.File, err error) {
+	err = shortenPath(path, func(path string) error {
+		fh, err = fs.fs.Open(path)
+		return err
+	})
+	return
+}
+
+// Create is equivalent to os.Create.
+func (fs longPathFsEval) Create(path string) (fh *os.File, err error) {
+	err = shortenPath(path, func(path string) error {
+		fh, err = fs.fs.Create(path)
+		return err
+	})
+	return
+}
+
+// Readdir is equivalent to os.Readdir.
+func (fs longPathFsEval) Readdir(path string) (fis []os.FileInfo, err error) {
+	err = shortenPath(path, func(path string) error {
+		fis, err = fs.fs.Readdir(path)
+		return err
+	})
+	return
+}
+
+// Lstat is equivalent to os.Lstat.
+func (fs longPathFsEval) Lstat(path string) (fi os.FileInfo, err error) {
+	err = shortenPath(path, func(path string) error {
+		fi, err = fs.fs.Lstat(path)
+		return err
+	})
+	return
+}
+
+// Lstatx is equivalent to unix.Lstat.
+func (fs longPathFsEval) Lstatx(path string) (s unix.Stat_t, err error) {
+	err = shortenPath(path, func(path string) error {
+		s, err = fs.fs.Lstatx(path)
+		return err
+	})
+	return
+}
+
+// Lbirthtime is equivalent to system.Lbirthtime.
+func (fs longPathFsEval) Lbirthtime(path string) (btime time.Time, err error) {
+	err = shortenPath(path, func(path string) error {
+		btime, err = fs.fs.Lbirthtime(path)
+		return err
+	})
+	return
+}
+
+// Readlink is equivalent to os.Readlink.
+func (fs longPathFsEval) Readlink(path string) (target string, err error) {
+	err = shortenPath(path, func(path string) error {
+		target, err = fs.fs.Readlink(path)
+		return err
+	})
+	return
+}
+
+// Symlink is equivalent to os.Symlink.
+func (fs longPathFsEval) Symlink(target, linkname string) error {
+	return shortenPath(linkname, func(linkname string) error {
+		return fs.fs.Symlink(target, linkname)
+	})
+}
+
+// Link is equivalent to os.Link.
+func (fs longPathFsEval) Link(target, linkname string) error {
+	return shortenPath(target, func(target string) error {
+		return shortenPath(linkname, func(linkname string) error {
+			return fs.fs.Link(target, linkname)
+		})
+	})
+}
+
+// Chmod is equivalent to os.Chmod.
+func (fs longPathFsEval) Chmod(path string, mode os.FileMode) error {
+	return shortenPath(path, func(path string) error {
+		return fs.fs.Chmod(path, mode)
+	})
+}
+
+// Lchown is equivalent to os.Lchown.
+func (fs longPathFsEval) Lchown(path string, uid, gid int) error {
+	return shortenPath(path, func(path string) error {
+		return fs.fs.Lchown(path, uid, gid)
+	})
+}
+
+// Lutimes is equivalent to os.Lutimes.
+func (fs longPathFsEval) Lutimes(path string, atime, mtime time.Time) error {
+	return shortenPath(path, func(path string) error {
+		return fs.fs.Lutimes(path, atime, mtime)
+	})
+}
+
+// RemoveAll is equivalent to os.RemoveAll.
+func (fs longPathFsEval) RemoveAll(path string) error {
+	return shortenPath(path, func(path string) error {
+		return fs.fs.RemoveAll(path)
+	})
+}
+
+// Mknod is equivalent to unix.Mknod.
+func (fs longPathFsEval) Mknod(path string, mode os.FileMode, dev uint64) error {
+	return shortenPath(path, func(path string) error {
+		return fs.fs.Mknod(path, mode, dev)
+	})
+}
+
+// MkdirAll is equivalent to os.MkdirAll.
+func (fs longPathFsEval) MkdirAll(path string, perm os.FileMode) error {
+	// shortenPath requires the leading directories to exist, so create the
+	// parent directories first.
+	if len(path) >= unix.PathMax {
+		if fi, err := fs.Lstat(path); err == nil && fi.IsDir() {
+			return nil
+		}
+		if err := fs.MkdirAll(filepath.Dir(path), perm); err != nil {
+			return err
+		}
+	}
+	return shortenPath(path, func(path string) error {
+		return fs.fs.MkdirAll(path, perm)
+	})
+}
+
+// Llistxattr is equivalent to system.Llistxattr
+func (fs longPathFsEval) Llistxattr(path string) (names []string, err error) {
+	err = shortenPath(path, func(path string) error {
+		names, err = fs.fs.Llistxattr(path)
+		return err
+	})
+	return
+}
+
+// Lremovexattr is equivalent to system.Lremovexattr
+func (fs longPathFsEval) Lremovexattr(path, name string) error {
+	return shortenPath(path, func(path string) error {
+		return fs.fs.Lremovexattr(path, name)
+	})
+}
+
+// Lsetxattr is equivalent to system.Lsetxattr
+func (fs longPathFsEval) Lsetxattr(path, name string, value []byte, flags int) error {
+	return shortenPath(path, func(path string) error {
+		return fs.fs.Lsetxattr(path, name, value, flags)
+	})
+}
+
+// Lgetxattr is equivalent to system.Lgetxattr
+func (fs longPathFsEval) Lgetxattr(path string, name string) (value []byte, err error) {
+	err = shortenPath(path, func(path string) error {
+		value, err = fs.fs.Lgetxattr(path, name)
+		return err
+	})
+	return
+}
+
+// Lclearxattrs is equivalent to system.Lclearxattrs
+func (fs longPathFsEval) Lclearxattrs(path string, except map[string]struct{}) error {
+	return shortenPath(path, func(path string) error {
+		return fs.fs.Lclearxattrs(path, except)
+	})
+}
+
+// KeywordFunc returns a wrapper around the given mtree.KeywordFunc.
+func (fs longPathFsEval) KeywordFunc(fn mtree.KeywordFunc) mtree.KeywordFunc {
+	fn = fs.fs.KeywordFunc(fn)
+	return func(path string, info os.FileInfo, r io.Reader) (kvs []mtree.KeyVal, err error) {
+		err = shortenPath(path, func(path string) error {
+			kvs, err = fn(path, info, r)
+			return err
+		})
+		return
+	}
+}
+
+// Walk is equivalent to filepath.Walk. The paths passed to walkFn are always
+// relative to the original root, even if it was shortened.
+func (fs longPathFsEval) Walk(root string, walkFn filepath.WalkFunc) error {
+	return shortenPath(root, func(shortRoot string) error {
+		return fs.fs.Walk(shortRoot, func(path string, info os.FileInfo, err error) error {
+			return walkFn(root+strings.TrimPrefix(path, shortRoot), info, err)
+		})
+	})
+}
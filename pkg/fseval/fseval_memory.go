@@ -0,0 +1,829 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fseval
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinkDepth is the maximum number of symlinks that will be followed
+// while resolving a single path in a memory FsEval (matching Linux's
+// MAXSYMLINKS).
+const maxSymlinkDepth = 40
+
+// memNode is a single inode in a memory FsEval. Hardlinks are represented by
+// the same memNode being present in more than one directory.
+type memNode struct {
+	ino   uint64
+	mode  os.FileMode
+	uid   int
+	gid   int
+	rdev  uint64
+	nlink int
+	atime time.Time
+	mtime time.Time
+
+	// xattrs are the (simulated) extended attributes of the inode.
+	xattrs map[string][]byte
+
+	// children is the set of directory entries, if the inode is a directory.
+	children map[string]*memNode
+
+	// target is the symlink target, if the inode is a symlink.
+	target string
+
+	// data contains the contents of the inode, if it is a regular file. In
+	// order to be able to return an *os.File from Create and Open, this is an
+	// anonymous memfd(2) and thus never touches any filesystem.
+	data *os.File
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+func (n *memNode) isSymlink() bool {
+	return n.mode&os.ModeSymlink == os.ModeSymlink
+}
+
+// size returns the st_size of the inode.
+func (n *memNode) size() int64 {
+	switch {
+	case n.data != nil:
+		if fi, err := n.data.Stat(); err == nil {
+			return fi.Size()
+		}
+	case n.isSymlink():
+		return int64(len(n.target))
+	}
+	return 0
+}
+
+// unlink drops a reference to the inode (and all of its children if it is a
+// directory), freeing its contents once it is no longer referenced.
+func (n *memNode) unlink() {
+	n.nlink--
+	if n.nlink > 0 {
+		return
+	}
+	for _, child := range n.children {
+		child.unlink()
+	}
+	n.children = nil
+	if n.data != nil {
+		// #nosec G104
+		_ = n.data.Close()
+		n.data = nil
+	}
+}
+
+// unixMode converts the mode of the inode into a stat(2)-style mode.
+func (n *memNode) unixMode() uint32 {
+	var mode uint32
+	switch {
+	case n.isDir():
+		mode = unix.S_IFDIR
+	case n.isSymlink():
+		mode = unix.S_IFLNK
+	case n.mode&os.ModeCharDevice == os.ModeCharDevice:
+		mode = unix.S_IFCHR
+	case n.mode&os.ModeDevice == os.ModeDevice:
+		mode = unix.S_IFBLK
+	case n.mode&os.ModeNamedPipe == os.ModeNamedPipe:
+		mode = unix.S_IFIFO
+	case n.mode&os.ModeSocket == os.ModeSocket:
+		mode = unix.S_IFSOCK
+	default:
+		mode = unix.S_IFREG
+	}
+	mode |= uint32(n.mode.Perm())
+	if n.mode&os.ModeSetuid != 0 {
+		mode |= unix.S_ISUID
+	}
+	if n.mode&os.ModeSetgid != 0 {
+		mode |= unix.S_ISGID
+	}
+	if n.mode&os.ModeSticky != 0 {
+		mode |= unix.S_ISVTX
+	}
+	return mode
+}
+
+// setUint sets an integer field of unix.Stat_t, whose types differ between
+// architectures.
+func setUint(field interface{}, value uint64) {
+	reflect.ValueOf(field).Elem().SetUint(value)
+}
+
+// stat returns the simulated stat(2) information of the inode.
+func (n *memNode) stat() unix.Stat_t {
+	var st unix.Stat_t
+	st.Ino = n.ino
+	st.Mode = n.unixMode()
+	st.Uid = uint32(n.uid)
+	st.Gid = uint32(n.gid)
+	st.Size = n.size()
+	st.Atim = unix.NsecToTimespec(n.atime.UnixNano())
+	st.Mtim = unix.NsecToTimespec(n.mtime.UnixNano())
+	st.Ctim = st.Mtim
+	setUint(&st.Nlink, uint64(n.nlink))
+	setUint(&st.Rdev, n.rdev)
+	return st
+}
+
+// memFileInfo is the os.FileInfo of an inode in a memory FsEval.
+type memFileInfo struct {
+	name string
+	stat unix.Stat_t
+	mode os.FileMode
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.stat.Size }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi memFileInfo) ModTime() time.Time { return time.Unix(fi.stat.Mtim.Unix()) }
+func (fi memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi memFileInfo) Sys() interface{}   { return &fi.stat }
+
+// memFsEval is an FsEval implementation which operates entirely on an
+// in-memory filesystem tree.
+type memFsEval struct {
+	lock    sync.Mutex
+	root    *memNode
+	nextIno uint64
+}
+
+// NewMemory returns a new FsEval backed by an empty in-memory filesystem (with
+// only a root directory). Paths are interpreted relative to the root of the
+// in-memory filesystem, so no disk I/O is done when operating on it.
+// Ownership, device nodes and extended attributes are simulated, so all
+// operations can be done without any privileges. The contents of regular
+// files are stored in anonymous memfd(2) files, which are released once they
+// are removed from the tree.
+//
+// Each call returns a separate filesystem, which is safe for concurrent use.
+func NewMemory() FsEval {
+	fs := &memFsEval{}
+	fs.root = fs.newNode(os.ModeDir | 0755)
+	return fs
+}
+
+func (fs *memFsEval) newNode(mode os.FileMode) *memNode {
+	fs.nextIno++
+	now := time.Now()
+	return &memNode{
+		ino:   fs.nextIno,
+		mode:  mode,
+		nlink: 1,
+		atime: now,
+		mtime: now,
+	}
+}
+
+// splitPath splits a path into its components, dropping any empty or "."
+// components.
+func splitPath(path string) []string {
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// memLookup is the result of resolving a path in a memory FsEval.
+type memLookup struct {
+	// parent is the directory containing the final component. It is nil if
+	// the path resolved to the root.
+	parent *memNode
+	// name is the final component of the path.
+	name string
+	// node is the inode of the final component, or nil if it doesn't exist
+	// (but the parent does).
+	node *memNode
+}
+
+// resolve looks up the given path, following symlinks in all but the final
+// component (and the final component too, if follow is set). If the final
+// component doesn't exist, the returned memLookup has a nil node. The lock
+// must be held by the caller.
+func (fs *memFsEval) resolve(op, path string, follow bool) (memLookup, error) {
+	stack := []*memNode{fs.root}
+	names := []string{""}
+	remaining := splitPath(path)
+	links := 0
+	for len(remaining) > 0 {
+		name := remaining[0]
+		remaining = remaining[1:]
+
+		if name == ".." {
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+				names = names[:len(names)-1]
+			}
+			continue
+		}
+
+		current := stack[len(stack)-1]
+		if !current.isDir() {
+			return memLookup{}, &os.PathError{Op: op, Path: path, Err: unix.ENOTDIR}
+		}
+		child, ok := current.children[name]
+		if !ok {
+			if len(remaining) == 0 {
+				return memLookup{parent: current, name: name}, nil
+			}
+			return memLookup{}, &os.PathError{Op: op, Path: path, Err: unix.ENOENT}
+		}
+		if child.isSymlink() && (follow || len(remaining) > 0) {
+			links++
+			if links > maxSymlinkDepth {
+				return memLookup{}, &os.PathError{Op: op, Path: path, Err: unix.ELOOP}
+			}
+			if filepath.IsAbs(child.target) {
+				stack = stack[:1]
+				names = names[:1]
+			}
+			remaining = append(splitPath(child.target), remaining...)
+			continue
+		}
+		stack = append(stack, child)
+		names = append(names, name)
+	}
+
+	lookup := memLookup{
+		name: names[len(names)-1],
+		node: stack[len(stack)-1],
+	}
+	if len(stack) > 1 {
+		lookup.parent = stack[len(stack)-2]
+	}
+	return lookup, nil
+}
+
+// get is a wrapper around resolve which returns ENOENT if the final
+// component doesn't exist.
+func (fs *memFsEval) get(op, path string, follow bool) (memLookup, error) {
+	lookup, err := fs.resolve(op, path, follow)
+	if err == nil && lookup.node == nil {
+		err = &os.PathError{Op: op, Path: path, Err: unix.ENOENT}
+	}
+	return lookup, err
+}
+
+// create adds a new inode at the given path (without following a symlink in
+// the final component), failing with EEXIST if the path already exists.
+func (fs *memFsEval) create(op, path string, mode os.FileMode) (*memNode, error) {
+	lookup, err := fs.resolve(op, path, false)
+	if err != nil {
+		return nil, err
+	}
+	if lookup.node != nil {
+		return nil, &os.PathError{Op: op, Path: path, Err: unix.EEXIST}
+	}
+	return fs.insert(lookup.parent, lookup.name, mode), nil
+}
+
+// insert adds a new inode to the given directory.
+func (fs *memFsEval) insert(dir *memNode, name string, mode os.FileMode) *memNode {
+	node := fs.newNode(mode)
+	if node.isDir() {
+		node.children = make(map[string]*memNode)
+	}
+	if dir.children == nil {
+		dir.children = make(map[string]*memNode)
+	}
+	dir.children[name] = node
+	dir.mtime = node.mtime
+	return node
+}
+
+// newMemfd creates a new anonymous memfd(2).
+func newMemfd(name string) (*os.File, error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, &os.PathError{Op: "memfd_create", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// Open is equivalent to os.Open. Only regular files can be opened, and the
+// returned file is a read-only snapshot of the file's contents.
+func (fs *memFsEval) Open(path string) (*os.File, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("open", path, true)
+	if err != nil {
+		return nil, err
+	}
+	node := lookup.node
+	if node.isDir() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: unix.EISDIR}
+	}
+	if node.data == nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: unix.ENXIO}
+	}
+
+	fh, err := newMemfd(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(fh, io.NewSectionReader(node.data, 0, node.size())); err != nil {
+		fh.Close()
+		return nil, errors.Wrapf(err, "copy contents: %s", path)
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		fh.Close()
+		return nil, errors.Wrapf(err, "seek contents: %s", path)
+	}
+	node.atime = time.Now()
+	return fh, nil
+}
+
+// Create is equivalent to os.Create. Writes to the returned file modify the
+// contents of the file in the in-memory filesystem.
+func (fs *memFsEval) Create(path string) (*os.File, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.resolve("open", path, true)
+	if err != nil {
+		return nil, err
+	}
+	node := lookup.node
+	switch {
+	case node == nil:
+		data, err := newMemfd(path)
+		if err != nil {
+			return nil, err
+		}
+		node = fs.insert(lookup.parent, lookup.name, 0666)
+		node.data = data
+	case node.isDir():
+		return nil, &os.PathError{Op: "open", Path: path, Err: unix.EISDIR}
+	case node.data == nil:
+		return nil, &os.PathError{Op: "open", Path: path, Err: unix.ENXIO}
+	default:
+		if err := node.data.Truncate(0); err != nil {
+			return nil, errors.Wrapf(err, "truncate: %s", path)
+		}
+		node.mtime = time.Now()
+	}
+
+	// The returned file shares its offset with node.data, which is fine
+	// because we only ever access node.data using positional I/O.
+	fd, err := unix.FcntlInt(node.data.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "dup", Path: path, Err: err}
+	}
+	fh := os.NewFile(uintptr(fd), path)
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		fh.Close()
+		return nil, errors.Wrapf(err, "seek contents: %s", path)
+	}
+	return fh, nil
+}
+
+// Readdir is equivalent to os.Readdir. The entries are sorted by name.
+func (fs *memFsEval) Readdir(path string) ([]os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("readdirent", path, true)
+	if err != nil {
+		return nil, err
+	}
+	if !lookup.node.isDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: path, Err: unix.ENOTDIR}
+	}
+
+	var names []string
+	for name := range lookup.node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var infos []os.FileInfo
+	for _, name := range names {
+		infos = append(infos, fileInfo(name, lookup.node.children[name]))
+	}
+	return infos, nil
+}
+
+func fileInfo(name string, node *memNode) os.FileInfo {
+	if name == "" {
+		name = "/"
+	}
+	return memFileInfo{name: name, stat: node.stat(), mode: node.mode}
+}
+
+// Lstat is equivalent to os.Lstat.
+func (fs *memFsEval) Lstat(path string) (os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("lstat", path, false)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo(lookup.name, lookup.node), nil
+}
+
+// Lstatx is equivalent to unix.Lstat.
+func (fs *memFsEval) Lstatx(path string) (unix.Stat_t, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("lstat", path, false)
+	if err != nil {
+		return unix.Stat_t{}, err
+	}
+	return lookup.node.stat(), nil
+}
+
+// Lbirthtime always returns an error wrapping unix.ENOTSUP, since birth
+// times are not recorded in memory.
+func (fs *memFsEval) Lbirthtime(path string) (time.Time, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if _, err := fs.get("lstat", path, false); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, &os.PathError{Op: "get birthtime", Path: path, Err: unix.ENOTSUP}
+}
+
+// Readlink is equivalent to os.Readlink.
+func (fs *memFsEval) Readlink(path string) (string, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("readlink", path, false)
+	if err != nil {
+		return "", err
+	}
+	if !lookup.node.isSymlink() {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: unix.EINVAL}
+	}
+	return lookup.node.target, nil
+}
+
+// Symlink is equivalent to os.Symlink.
+func (fs *memFsEval) Symlink(target, linkname string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	node, err := fs.create("symlink", linkname, os.ModeSymlink|0777)
+	if err != nil {
+		return err
+	}
+	node.target = target
+	return nil
+}
+
+// Link is equivalent to unix.Link(..., ~AT_SYMLINK_FOLLOW).
+func (fs *memFsEval) Link(target, linkname string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("link", target, false)
+	if err != nil {
+		return err
+	}
+	if lookup.node.isDir() {
+		return &os.PathError{Op: "link", Path: target, Err: unix.EPERM}
+	}
+	dst, err := fs.resolve("link", linkname, false)
+	if err != nil {
+		return err
+	}
+	if dst.node != nil {
+		return &os.PathError{Op: "link", Path: linkname, Err: unix.EEXIST}
+	}
+	dst.parent.children[dst.name] = lookup.node
+	lookup.node.nlink++
+	return nil
+}
+
+// Chmod is equivalent to os.Chmod.
+func (fs *memFsEval) Chmod(path string, mode os.FileMode) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("chmod", path, true)
+	if err != nil {
+		return err
+	}
+	const chmodBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	lookup.node.mode = (lookup.node.mode &^ chmodBits) | (mode & chmodBits)
+	return nil
+}
+
+// Lchown is equivalent to os.Lchown.
+func (fs *memFsEval) Lchown(path string, uid, gid int) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("lchown", path, false)
+	if err != nil {
+		return err
+	}
+	if uid != -1 {
+		lookup.node.uid = uid
+	}
+	if gid != -1 {
+		lookup.node.gid = gid
+	}
+	return nil
+}
+
+// Lutimes is equivalent to os.Lutimes.
+func (fs *memFsEval) Lutimes(path string, atime, mtime time.Time) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("lutimes", path, false)
+	if err != nil {
+		return err
+	}
+	lookup.node.atime = atime
+	lookup.node.mtime = mtime
+	return nil
+}
+
+// RemoveAll is equivalent to os.RemoveAll. Removing the root of the
+// in-memory filesystem removes all of its contents, but (as with the root of
+// a real filesystem) the root itself cannot be removed.
+func (fs *memFsEval) RemoveAll(path string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.resolve("unlinkat", path, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if lookup.node == nil {
+		return nil
+	}
+	if lookup.parent == nil {
+		for name, child := range lookup.node.children {
+			child.unlink()
+			delete(lookup.node.children, name)
+		}
+		return &os.PathError{Op: "unlinkat", Path: path, Err: unix.EBUSY}
+	}
+	delete(lookup.parent.children, lookup.name)
+	lookup.parent.mtime = time.Now()
+	lookup.node.unlink()
+	return nil
+}
+
+// MkdirAll is equivalent to os.MkdirAll.
+func (fs *memFsEval) MkdirAll(path string, perm os.FileMode) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	parts := splitPath(path)
+	prefix := "/"
+	for _, part := range parts {
+		prefix = filepath.Join(prefix, part)
+		lookup, err := fs.resolve("mkdir", prefix, true)
+		if err != nil {
+			return err
+		}
+		switch {
+		case lookup.node == nil:
+			fs.insert(lookup.parent, lookup.name, os.ModeDir|perm.Perm())
+		case !lookup.node.isDir():
+			return &os.PathError{Op: "mkdir", Path: prefix, Err: unix.ENOTDIR}
+		}
+	}
+	return nil
+}
+
+// Mknod is equivalent to unix.Mknod. Device nodes, fifos and sockets are
+// only simulated, and cannot be opened.
+func (fs *memFsEval) Mknod(path string, mode os.FileMode, dev uint64) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	// Like unix.Mknod, mode contains the raw S_IF* file type bits.
+	rawMode := uint32(mode)
+	var fileMode os.FileMode
+	switch rawMode & unix.S_IFMT {
+	case 0, unix.S_IFREG:
+		// Regular files.
+	case unix.S_IFCHR:
+		fileMode = os.ModeDevice | os.ModeCharDevice
+	case unix.S_IFBLK:
+		fileMode = os.ModeDevice
+	case unix.S_IFIFO:
+		fileMode = os.ModeNamedPipe
+	case unix.S_IFSOCK:
+		fileMode = os.ModeSocket
+	default:
+		return &os.PathError{Op: "mknod", Path: path, Err: unix.EINVAL}
+	}
+	fileMode |= os.FileMode(rawMode).Perm()
+	if rawMode&unix.S_ISUID != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if rawMode&unix.S_ISGID != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if rawMode&unix.S_ISVTX != 0 {
+		fileMode |= os.ModeSticky
+	}
+
+	var data *os.File
+	if fileMode.IsRegular() {
+		var err error
+		if data, err = newMemfd(path); err != nil {
+			return err
+		}
+	}
+	node, err := fs.create("mknod", path, fileMode)
+	if err != nil {
+		if data != nil {
+			data.Close()
+		}
+		return err
+	}
+	node.data = data
+	if fileMode&os.ModeDevice == os.ModeDevice {
+		node.rdev = dev
+	}
+	return nil
+}
+
+// Llistxattr is equivalent to system.Llistxattr. The names are sorted.
+func (fs *memFsEval) Llistxattr(path string) ([]string, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("llistxattr", path, false)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range lookup.node.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Lremovexattr is equivalent to system.Lremovexattr.
+func (fs *memFsEval) Lremovexattr(path, name string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("lremovexattr", path, false)
+	if err != nil {
+		return err
+	}
+	if _, ok := lookup.node.xattrs[name]; !ok {
+		return &os.PathError{Op: "lremovexattr", Path: path, Err: unix.ENODATA}
+	}
+	delete(lookup.node.xattrs, name)
+	return nil
+}
+
+// Lsetxattr is equivalent to system.Lsetxattr.
+func (fs *memFsEval) Lsetxattr(path, name string, value []byte, flags int) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("lsetxattr", path, false)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return &os.PathError{Op: "lsetxattr", Path: path, Err: unix.ERANGE}
+	}
+	_, exists := lookup.node.xattrs[name]
+	if flags&unix.XATTR_CREATE == unix.XATTR_CREATE && exists {
+		return &os.PathError{Op: "lsetxattr", Path: path, Err: unix.EEXIST}
+	}
+	if flags&unix.XATTR_REPLACE == unix.XATTR_REPLACE && !exists {
+		return &os.PathError{Op: "lsetxattr", Path: path, Err: unix.ENODATA}
+	}
+	if lookup.node.xattrs == nil {
+		lookup.node.xattrs = make(map[string][]byte)
+	}
+	lookup.node.xattrs[name] = append([]byte(nil), value...)
+	return nil
+}
+
+// Lgetxattr is equivalent to system.Lgetxattr.
+func (fs *memFsEval) Lgetxattr(path string, name string) ([]byte, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("lgetxattr", path, false)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := lookup.node.xattrs[name]
+	if !ok {
+		return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: unix.ENODATA}
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// Lclearxattrs is equivalent to system.Lclearxattrs.
+func (fs *memFsEval) Lclearxattrs(path string, except map[string]struct{}) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lookup, err := fs.get("lclearxattrs", path, false)
+	if err != nil {
+		return err
+	}
+	for name := range lookup.node.xattrs {
+		if _, skip := except[name]; !skip {
+			delete(lookup.node.xattrs, name)
+		}
+	}
+	return nil
+}
+
+// KeywordFunc returns a wrapper around the given mtree.KeywordFunc.
+func (fs *memFsEval) KeywordFunc(fn mtree.KeywordFunc) mtree.KeywordFunc {
+	return fn
+}
+
+// Walk is equivalent to filepath.Walk.
+func (fs *memFsEval) Walk(root string, fn filepath.WalkFunc) error {
+	info, err := fs.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = fs.walk(root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walk is equivalent to filepath.walk, and recursively descends path.
+func (fs *memFsEval) walk(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	infos, err := fs.Readdir(path)
+	err1 := fn(path, info, err)
+	// If err != nil, walk can't walk into this directory. err1 != nil means
+	// fn wants walk to skip this directory or stop walking. Therefore, if one
+	// of err and err1 isn't nil, walk will return.
+	if err != nil || err1 != nil {
+		// The caller's behavior is controlled by the return value, which is
+		// decided by fn. fn may ignore err and return nil. If fn returns
+		// SkipDir, it will be handled by the caller. So walk should return
+		// whatever fn returns.
+		return err1
+	}
+
+	for _, info := range infos {
+		subpath := filepath.Join(path, info.Name())
+		if err := fs.walk(subpath, info, fn); err != nil {
+			if !info.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
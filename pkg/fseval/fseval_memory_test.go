@@ -0,0 +1,235 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fseval
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMemoryFiles(t *testing.T) {
+	fs := NewMemory()
+
+	if err := fs.MkdirAll("/a/b/c", 0755); err != nil {
+		t.Fatalf("unexpected mkdirall error: %+v", err)
+	}
+	fh, err := fs.Create("/a/b/file")
+	if err != nil {
+		t.Fatalf("unexpected create error: %+v", err)
+	}
+	if _, err := fh.Write([]byte("hello world")); err != nil {
+		t.Fatalf("unexpected write error: %+v", err)
+	}
+	fh.Close()
+
+	if err := fs.Symlink("b/file", "/a/c"); err != nil {
+		t.Fatalf("unexpected symlink error: %+v", err)
+	}
+	if err := fs.Symlink("/a/b", "/link"); err != nil {
+		t.Fatalf("unexpected symlink error: %+v", err)
+	}
+	if err := fs.Link("/a/b/file", "/a/hardlink"); err != nil {
+		t.Fatalf("unexpected link error: %+v", err)
+	}
+
+	// The same contents must be visible through every name.
+	for _, path := range []string{"/a/b/file", "/a/c", "/link/file", "/a/hardlink", "a/b/../b/file"} {
+		fh, err := fs.Open(path)
+		if err != nil {
+			t.Errorf("unexpected open error: %s: %+v", path, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(fh)
+		fh.Close()
+		if err != nil {
+			t.Errorf("unexpected read error: %s: %+v", path, err)
+		} else if string(data) != "hello world" {
+			t.Errorf("unexpected contents of %s: %q", path, string(data))
+		}
+	}
+
+	if target, err := fs.Readlink("/link"); err != nil || target != "/a/b" {
+		t.Errorf("unexpected readlink: got %q (%v)", target, err)
+	}
+	if fi, err := fs.Lstat("/link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat followed symlink: %v (%v)", fi, err)
+	}
+	if st, err := fs.Lstatx("/a/hardlink"); err != nil || st.Nlink != 2 || st.Size != 11 {
+		t.Errorf("unexpected hardlink stat: %+v (%v)", st, err)
+	}
+
+	// Create must truncate the existing file.
+	if fh, err := fs.Create("/a/hardlink"); err != nil {
+		t.Errorf("unexpected create error: %+v", err)
+	} else {
+		fh.Close()
+	}
+	if fi, err := fs.Lstat("/a/b/file"); err != nil || fi.Size() != 0 {
+		t.Errorf("create did not truncate file: %v (%v)", fi, err)
+	}
+
+	infos, err := fs.Readdir("/a")
+	if err != nil {
+		t.Fatalf("unexpected readdir error: %+v", err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if expected := []string{"b", "c", "hardlink"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected readdir entries: expected %v, got %v", expected, names)
+	}
+
+	if err := fs.RemoveAll("/a/b"); err != nil {
+		t.Fatalf("unexpected removeall error: %+v", err)
+	}
+	if _, err := fs.Lstat("/a/b/c"); !os.IsNotExist(err) {
+		t.Errorf("expected removed path to not exist: %v", err)
+	}
+	if _, err := fs.Open("/link/file"); !os.IsNotExist(err) {
+		t.Errorf("expected dangling symlink to not resolve: %v", err)
+	}
+	if st, err := fs.Lstatx("/a/hardlink"); err != nil || st.Nlink != 1 {
+		t.Errorf("unexpected hardlink stat after removeall: %+v (%v)", st, err)
+	}
+}
+
+func TestMemoryMetadata(t *testing.T) {
+	fs := NewMemory()
+
+	if err := fs.Mknod("/null", unix.S_IFCHR|0666, unix.Mkdev(1, 3)); err != nil {
+		t.Fatalf("unexpected mknod error: %+v", err)
+	}
+	if err := fs.Mknod("/fifo", unix.S_IFIFO|0600, 0); err != nil {
+		t.Fatalf("unexpected mknod error: %+v", err)
+	}
+	if err := fs.Mknod("/null", unix.S_IFCHR|0666, 0); !os.IsExist(err) {
+		t.Errorf("expected mknod of existing path to fail with EEXIST: %v", err)
+	}
+
+	fi, err := fs.Lstat("/null")
+	if err != nil {
+		t.Fatalf("unexpected lstat error: %+v", err)
+	}
+	if fi.Mode() != os.ModeDevice|os.ModeCharDevice|0666 {
+		t.Errorf("unexpected device mode: %v", fi.Mode())
+	}
+	st := fi.Sys().(*unix.Stat_t)
+	if unix.Major(uint64(st.Rdev)) != 1 || unix.Minor(uint64(st.Rdev)) != 3 {
+		t.Errorf("unexpected device number: %d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)))
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR {
+		t.Errorf("unexpected stat mode: %o", st.Mode)
+	}
+	if fi, err := fs.Lstat("/fifo"); err != nil || fi.Mode() != os.ModeNamedPipe|0600 {
+		t.Errorf("unexpected fifo mode: %v (%v)", fi, err)
+	}
+	if _, err := fs.Open("/null"); err == nil {
+		t.Errorf("expected open of simulated device to fail")
+	}
+
+	// Ownership and modes can be changed without privileges.
+	if err := fs.Lchown("/null", 1000, 100); err != nil {
+		t.Fatalf("unexpected lchown error: %+v", err)
+	}
+	if err := fs.Chmod("/null", os.ModeSetuid|0600); err != nil {
+		t.Fatalf("unexpected chmod error: %+v", err)
+	}
+	mtime := time.Unix(1234, 5678)
+	if err := fs.Lutimes("/null", mtime, mtime); err != nil {
+		t.Fatalf("unexpected lutimes error: %+v", err)
+	}
+	if st, err := fs.Lstatx("/null"); err != nil {
+		t.Fatalf("unexpected lstatx error: %+v", err)
+	} else if st.Uid != 1000 || st.Gid != 100 || st.Mode != unix.S_IFCHR|unix.S_ISUID|0600 {
+		t.Errorf("unexpected metadata: uid=%d gid=%d mode=%o", st.Uid, st.Gid, st.Mode)
+	} else if !time.Unix(st.Mtim.Unix()).Equal(mtime) {
+		t.Errorf("unexpected mtime: %v", time.Unix(st.Mtim.Unix()))
+	}
+
+	// Extended attributes.
+	if err := fs.Lsetxattr("/null", "user.a", []byte("1"), 0); err != nil {
+		t.Fatalf("unexpected lsetxattr error: %+v", err)
+	}
+	if err := fs.Lsetxattr("/null", "trusted.b", []byte("2"), unix.XATTR_CREATE); err != nil {
+		t.Fatalf("unexpected lsetxattr error: %+v", err)
+	}
+	if err := fs.Lsetxattr("/null", "trusted.b", []byte("3"), unix.XATTR_CREATE); errorsCause(err) != unix.EEXIST {
+		t.Errorf("expected XATTR_CREATE of existing xattr to fail with EEXIST: %v", err)
+	}
+	if names, err := fs.Llistxattr("/null"); err != nil || !reflect.DeepEqual(names, []string{"trusted.b", "user.a"}) {
+		t.Errorf("unexpected llistxattr: %v (%v)", names, err)
+	}
+	if value, err := fs.Lgetxattr("/null", "user.a"); err != nil || string(value) != "1" {
+		t.Errorf("unexpected lgetxattr: %q (%v)", value, err)
+	}
+	if err := fs.Lclearxattrs("/null", map[string]struct{}{"trusted.b": {}}); err != nil {
+		t.Fatalf("unexpected lclearxattrs error: %+v", err)
+	}
+	if _, err := fs.Lgetxattr("/null", "user.a"); errorsCause(err) != unix.ENODATA {
+		t.Errorf("expected cleared xattr to be missing: %v", err)
+	}
+	if err := fs.Lremovexattr("/null", "trusted.b"); err != nil {
+		t.Errorf("unexpected lremovexattr error: %+v", err)
+	}
+}
+
+func TestMemoryWalk(t *testing.T) {
+	fs := NewMemory()
+
+	for _, dir := range []string{"/root/a/b", "/root/c"} {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("unexpected mkdirall error: %+v", err)
+		}
+	}
+	if err := fs.Symlink("/nonexistent", "/root/a/link"); err != nil {
+		t.Fatalf("unexpected symlink error: %+v", err)
+	}
+
+	var paths []string
+	if err := fs.Walk("/root", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		if info.Name() == "c" {
+			return filepath.SkipDir
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected walk error: %+v", err)
+	}
+	expected := []string{"/root", "/root/a", "/root/a/b", "/root/a/link", "/root/c"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected walk: expected %v, got %v", expected, paths)
+	}
+}
+
+// errorsCause returns the underlying errno of an *os.PathError.
+func errorsCause(err error) error {
+	if perr, ok := err.(*os.PathError); ok {
+		return perr.Err
+	}
+	return err
+}
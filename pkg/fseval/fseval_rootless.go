@@ -62,6 +62,11 @@ func (fs unprivFsEval) Lstatx(path string) (unix.Stat_t, error) {
 	return unpriv.Lstatx(path)
 }
 
+// Lbirthtime is equivalent to unpriv.Lbirthtime.
+func (fs unprivFsEval) Lbirthtime(path string) (time.Time, error) {
+	return unpriv.Lbirthtime(path)
+}
+
 // Readlink is equivalent to unpriv.Readlink.
 func (fs unprivFsEval) Readlink(path string) (string, error) {
 	return unpriv.Readlink(path)
@@ -82,6 +87,11 @@ func (fs unprivFsEval) Chmod(path string, mode os.FileMode) error {
 	return unpriv.Chmod(path, mode)
 }
 
+// Lchown is equivalent to unpriv.Lchown.
+func (fs unprivFsEval) Lchown(path string, uid, gid int) error {
+	return unpriv.Lchown(path, uid, gid)
+}
+
 // Lutimes is equivalent to unpriv.Lutimes.
 func (fs unprivFsEval) Lutimes(path string, atime, mtime time.Time) error {
 	return unpriv.Lutimes(path, atime, mtime)
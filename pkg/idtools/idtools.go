@@ -18,6 +18,7 @@
 package idtools
 
 import (
+	"sort"
 	"strconv"
 	"strings"
 
@@ -60,6 +61,56 @@ func ToContainer(hostID int, idMap []rspec.LinuxIDMapping) (int, error) {
 	return -1, errors.Errorf("host id %d cannot be mapped to a container id", hostID)
 }
 
+// ComposeMappings returns the ID mapping which is equivalent to first applying
+// the inner mapping and then the outer mapping. This is necessary when running
+// inside a user namespace which is itself nested inside another user
+// namespace: inner maps IDs in the nested namespace to IDs in the
+// intermediate namespace, and outer maps IDs in the intermediate namespace to
+// IDs in the host namespace. IDs which are mapped by inner but not by outer
+// cannot be mapped to the host, and so are not included in the result. A nil
+// mapping is treated as the identity mapping (as with ToHost).
+func ComposeMappings(outer, inner []rspec.LinuxIDMapping) []rspec.LinuxIDMapping {
+	if outer == nil {
+		return inner
+	}
+	if inner == nil {
+		return outer
+	}
+
+	composed := []rspec.LinuxIDMapping{}
+	for _, in := range inner {
+		// The range of intermediate IDs mapped by this inner mapping. We use
+		// uint64 to avoid overflows at the end of the ID space.
+		inStart := uint64(in.HostID)
+		inEnd := inStart + uint64(in.Size)
+		for _, out := range outer {
+			outStart := uint64(out.ContainerID)
+			outEnd := outStart + uint64(out.Size)
+
+			// Find the overlap between the two ranges of intermediate IDs.
+			start, end := inStart, inEnd
+			if outStart > start {
+				start = outStart
+			}
+			if outEnd < end {
+				end = outEnd
+			}
+			if start >= end {
+				continue
+			}
+			composed = append(composed, rspec.LinuxIDMapping{
+				ContainerID: uint32(uint64(in.ContainerID) + (start - inStart)),
+				HostID:      uint32(uint64(out.HostID) + (start - outStart)),
+				Size:        uint32(end - start),
+			})
+		}
+	}
+	sort.Slice(composed, func(i, j int) bool {
+		return composed[i].ContainerID < composed[j].ContainerID
+	})
+	return composed
+}
+
 // ParseMapping takes a mapping string of the form "container:host[:size]" and
 // returns the corresponding rspec.LinuxIDMapping. An error is returned if not
 // enough fields are provided or are otherwise invalid. The default size is 1.
@@ -18,6 +18,7 @@
 package idtools
 
 import (
+	"reflect"
 	"testing"
 
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
@@ -289,6 +290,94 @@ func TestToContainerMultiple(t *testing.T) {
 	}
 }
 
+func TestComposeMappings(t *testing.T) {
+	// The intermediate namespace maps 0-65535 to host IDs 100000-165535.
+	outer := []rspec.LinuxIDMapping{
+		{HostID: 100000, ContainerID: 0, Size: 65536},
+	}
+	// The nested namespace maps root to 1000, and 1-999 to 10001-10999.
+	inner := []rspec.LinuxIDMapping{
+		{HostID: 1000, ContainerID: 0, Size: 1},
+		{HostID: 10001, ContainerID: 1, Size: 999},
+	}
+
+	composed := ComposeMappings(outer, inner)
+	expected := []rspec.LinuxIDMapping{
+		{HostID: 101000, ContainerID: 0, Size: 1},
+		{HostID: 110001, ContainerID: 1, Size: 999},
+	}
+	if !reflect.DeepEqual(composed, expected) {
+		t.Errorf("unexpected composed mapping: expected %v, got %v", expected, composed)
+	}
+
+	for _, test := range []struct {
+		container, host int
+		failure         bool
+	}{
+		{container: 0, host: 101000},
+		{container: 1, host: 110001},
+		{container: 500, host: 110500},
+		{container: 999, host: 110999},
+		{container: 1000, failure: true},
+	} {
+		// Composing the mappings must be equivalent to applying them in turn.
+		id, err := ToHost(test.container, composed)
+		if test.failure {
+			if err == nil {
+				t.Errorf("expected an error with container=%d", test.container)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %+v", err)
+		} else if id != test.host {
+			t.Errorf("expected container=%d to map to %d, got %d", test.container, test.host, id)
+		}
+		intermediate, err := ToHost(test.container, inner)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if id2, err := ToHost(intermediate, outer); err != nil || id2 != id {
+			t.Errorf("composed mapping disagrees with applying mappings in turn: %d != %d (%v)", id, id2, err)
+		}
+	}
+}
+
+func TestComposeMappingsPartial(t *testing.T) {
+	// The outer mapping is split, and only covers part of the inner mapping.
+	outer := []rspec.LinuxIDMapping{
+		{HostID: 5000, ContainerID: 0, Size: 10},
+		{HostID: 9000, ContainerID: 20, Size: 10},
+	}
+	inner := []rspec.LinuxIDMapping{
+		{HostID: 5, ContainerID: 100, Size: 20},
+	}
+
+	composed := ComposeMappings(outer, inner)
+	expected := []rspec.LinuxIDMapping{
+		// Inner 100-104 -> intermediate 5-9 -> host 5005-5009.
+		{HostID: 5005, ContainerID: 100, Size: 5},
+		// Inner 115-119 -> intermediate 20-24 -> host 9000-9004.
+		{HostID: 9000, ContainerID: 115, Size: 5},
+	}
+	if !reflect.DeepEqual(composed, expected) {
+		t.Errorf("unexpected composed mapping: expected %v, got %v", expected, composed)
+	}
+
+	// Intermediate IDs 10-19 are not mapped by outer.
+	if id, err := ToHost(110, composed); err == nil {
+		t.Errorf("expected an error mapping unmapped id, got %d", id)
+	}
+
+	// A nil mapping is the identity.
+	if got := ComposeMappings(nil, inner); !reflect.DeepEqual(got, inner) {
+		t.Errorf("unexpected composition with nil outer mapping: %v", got)
+	}
+	if got := ComposeMappings(outer, nil); !reflect.DeepEqual(got, outer) {
+		t.Errorf("unexpected composition with nil inner mapping: %v", got)
+	}
+}
+
 func TestParseIDMapping(t *testing.T) {
 
 	for _, test := range []struct {
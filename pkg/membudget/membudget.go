@@ -0,0 +1,93 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package membudget provides helpers for splitting a memory budget between
+// the in-flight buffers of umoci's parallel (de)compression pipelines.
+package membudget
+
+const (
+	// MinBlockSize is the smallest block size that will be returned by Split.
+	// It must be larger than pgzip's internal tail size (16KiB).
+	MinBlockSize = 64 << 10
+
+	// DefaultBlockSize is the block size used when the budget is large
+	// enough (it matches pgzip's default block size).
+	DefaultBlockSize = 1 << 20
+)
+
+// Cost describes the memory used by a parallel (de)compressor.
+type Cost struct {
+	// Overhead is the fixed memory used regardless of the number of blocks.
+	Overhead int64
+
+	// PerBlockOverhead is the memory used for each in-flight block in
+	// addition to its buffers (such as per-block compressor state).
+	PerBlockOverhead int64
+
+	// BuffersPerBlock is the number of block-sized buffers used for each
+	// in-flight block.
+	BuffersPerBlock int
+}
+
+// Usage returns the memory used with the given block size and number of
+// blocks.
+func (c Cost) Usage(blockSize, blocks int) int64 {
+	perBlock := c.PerBlockOverhead + int64(c.buffersPerBlock())*int64(blockSize)
+	return c.Overhead + int64(blocks)*perBlock
+}
+
+func (c Cost) buffersPerBlock() int {
+	if c.BuffersPerBlock < 1 {
+		return 1
+	}
+	return c.BuffersPerBlock
+}
+
+// Split computes the block size and number of blocks for a parallel
+// (de)compressor with the given Cost, such that cost.Usage(blockSize, blocks)
+// does not exceed budget, with the block count capped to maxBlocks. If the budget
+// is not large enough for even a single block of MinBlockSize, a single block
+// of MinBlockSize is returned so that progress can still be made.
+//
+// A budget of zero (or less) means there is no limit, in which case
+// DefaultBlockSize and maxBlocks are returned.
+func Split(budget int64, cost Cost, maxBlocks int) (blockSize, blocks int) {
+	if maxBlocks < 1 {
+		maxBlocks = 1
+	}
+	if budget <= 0 {
+		return DefaultBlockSize, maxBlocks
+	}
+
+	blockSize = DefaultBlockSize
+	for blockSize > MinBlockSize && cost.Usage(blockSize, 1) > budget {
+		blockSize /= 2
+	}
+	if blockSize < MinBlockSize {
+		blockSize = MinBlockSize
+	}
+
+	perBlock := cost.Usage(blockSize, 1) - cost.Overhead
+	blocks = int((budget - cost.Overhead) / perBlock)
+	if blocks < 1 {
+		blocks = 1
+	}
+	if blocks > maxBlocks {
+		blocks = maxBlocks
+	}
+	return blockSize, blocks
+}
@@ -0,0 +1,72 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package membudget
+
+import (
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	for _, budget := range []int64{
+		1<<20 + 2*MinBlockSize,
+		1<<20 + 3*MinBlockSize,
+		2 << 20,
+		4 << 20,
+		5<<20 + 12345,
+		64 << 20,
+		1 << 30,
+	} {
+		for _, cost := range []Cost{
+			{Overhead: 1 << 20, BuffersPerBlock: 1},
+			{Overhead: 1 << 20, BuffersPerBlock: 2},
+			{Overhead: 32 << 10, PerBlockOverhead: 700 << 10, BuffersPerBlock: 2},
+		} {
+			blockSize, blocks := Split(budget, cost, 16)
+			if blocks < 1 {
+				t.Errorf("Split(%d, %+v): got no blocks -- no progress can be made", budget, cost)
+			}
+			if blocks > 16 {
+				t.Errorf("Split(%d, %+v): got more than maxBlocks: %d", budget, cost, blocks)
+			}
+			if blockSize < MinBlockSize || blockSize > DefaultBlockSize {
+				t.Errorf("Split(%d, %+v): block size %d out of range", budget, cost, blockSize)
+			}
+			// If a single minimum-sized block fits, we must be within budget.
+			if cost.Usage(MinBlockSize, 1) <= budget {
+				if usage := cost.Usage(blockSize, blocks); usage > budget {
+					t.Errorf("Split(%d, %+v): usage %d exceeds budget (blockSize=%d blocks=%d)", budget, cost, usage, blockSize, blocks)
+				}
+			}
+		}
+	}
+}
+
+func TestSplitTinyBudget(t *testing.T) {
+	// Budgets that are too small still have to make progress.
+	blockSize, blocks := Split(1, Cost{Overhead: 1 << 20, BuffersPerBlock: 2}, 8)
+	if blockSize != MinBlockSize || blocks != 1 {
+		t.Errorf("expected a single minimum-sized block, got blockSize=%d blocks=%d", blockSize, blocks)
+	}
+}
+
+func TestSplitUnlimited(t *testing.T) {
+	blockSize, blocks := Split(0, Cost{Overhead: 1 << 20, BuffersPerBlock: 2}, 8)
+	if blockSize != DefaultBlockSize || blocks != 8 {
+		t.Errorf("expected defaults with no budget, got blockSize=%d blocks=%d", blockSize, blocks)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// excludePattern is a single compiled .dockerignore-style pattern.
+type excludePattern struct {
+	// exception is set if the pattern was negated with a leading '!', and
+	// thus re-includes paths excluded by earlier patterns.
+	exception bool
+
+	regexp *regexp.Regexp
+}
+
+// compileExcludePattern converts a .dockerignore-style glob into a regular
+// expression. '*' and '?' never match a '/', while '**' matches any number of
+// path components (including none).
+func compileExcludePattern(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch ch {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" also matches zero directories.
+					i++
+					expr.WriteString("(.*/)?")
+				} else {
+					expr.WriteString(".*")
+				}
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				return nil, errors.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 == len(pattern) {
+				return nil, errors.Errorf("trailing escape character")
+			}
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// ExcludeFilter is a factory for FilterFuncs that will filter out all paths
+// matching the given .dockerignore-style patterns. All paths (and patterns)
+// are considered to be relative to '/'. The semantics match those of
+// .dockerignore files:
+//
+//   - Patterns are matched with filepath.Match-style globbing, with '**'
+//     additionally matching any number of directories.
+//   - A pattern which matches a directory also matches everything inside it.
+//   - A pattern starting with '!' is an exception, which re-includes paths
+//     matched by earlier patterns. The last matching pattern wins.
+//
+// The root directory itself is never filtered out.
+func ExcludeFilter(patterns []string) (FilterFunc, error) {
+	var compiled []excludePattern
+	for _, pattern := range patterns {
+		var exception bool
+		pattern = strings.TrimSpace(pattern)
+		if strings.HasPrefix(pattern, "!") {
+			exception = true
+			pattern = strings.TrimSpace(pattern[1:])
+		}
+		pattern = strings.TrimPrefix(makeRoot(pattern), "/")
+		if pattern == "" {
+			continue
+		}
+
+		re, err := compileExcludePattern(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid exclude pattern %q", pattern)
+		}
+		compiled = append(compiled, excludePattern{
+			exception: exception,
+			regexp:    re,
+		})
+	}
+
+	return func(path string) bool {
+		path = strings.TrimPrefix(makeRoot(path), "/")
+		if path == "" {
+			return true
+		}
+		components := strings.Split(path, "/")
+
+		var excluded bool
+		for _, pattern := range compiled {
+			// Only patterns which could change the result need checking.
+			if pattern.exception != excluded {
+				continue
+			}
+			match := pattern.regexp.MatchString(path)
+			// Directory matches also apply to their contents.
+			for depth := 1; !match && depth < len(components); depth++ {
+				match = pattern.regexp.MatchString(strings.Join(components[:depth], "/"))
+			}
+			if match {
+				excluded = !pattern.exception
+			}
+		}
+		if excluded {
+			log.Debugf("excludefilter: ignoring excluded path %q", path)
+		}
+		return !excluded
+	}, nil
+}
+
+// ParseExcludeFile reads a list of .dockerignore-style patterns from the given
+// reader. Blank lines and lines starting with '#' are ignored.
+func ParseExcludeFile(r io.Reader) ([]string, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read exclude file")
+	}
+	return patterns, nil
+}
@@ -0,0 +1,106 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExcludeFilter(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		patterns []string
+		included []string
+		excluded []string
+	}{
+		{
+			name:     "Literal",
+			patterns: []string{"secret.txt", "/build"},
+			included: []string{"/", "secret.txt.bak", "dir/secret.txt", "builder"},
+			excluded: []string{"secret.txt", "/secret.txt", "build", "build/output/a.o"},
+		},
+		{
+			name:     "Glob",
+			patterns: []string{"*.o", "dir/?.tmp", "[ab]*.log"},
+			included: []string{"dir/a.o", "dir/ab.tmp", "c.log", "dir/a.log"},
+			excluded: []string{"main.o", "dir/a.tmp", "a.log", "b1.log"},
+		},
+		{
+			name:     "DoubleStar",
+			patterns: []string{"**/*.pyc", "cache/**/data"},
+			included: []string{"a.py", "cache/data2"},
+			excluded: []string{"a.pyc", "src/pkg/mod.pyc", "cache/data", "cache/x/y/data", "cache/x/data/inner"},
+		},
+		{
+			name:     "Exception",
+			patterns: []string{"*.md", "!README.md", "logs", "!logs/keep"},
+			included: []string{"README.md", "logs/keep", "logs/keep/inner", "src/CHANGES.md"},
+			excluded: []string{"CHANGES.md", "logs", "logs/other"},
+		},
+		{
+			name:     "LastMatchWins",
+			patterns: []string{"!important", "*"},
+			included: []string{"/"},
+			excluded: []string{"important", "anything", "dir/file"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := ExcludeFilter(test.patterns)
+			if err != nil {
+				t.Fatalf("unexpected error compiling %v: %+v", test.patterns, err)
+			}
+			for _, path := range test.included {
+				if !filter(path) {
+					t.Errorf("expected %q to be included by %v", path, test.patterns)
+				}
+			}
+			for _, path := range test.excluded {
+				if filter(path) {
+					t.Errorf("expected %q to be excluded by %v", path, test.patterns)
+				}
+			}
+		})
+	}
+}
+
+func TestExcludeFilterInvalid(t *testing.T) {
+	for _, pattern := range []string{"[abc", `trailing\`} {
+		if _, err := ExcludeFilter([]string{pattern}); err == nil {
+			t.Errorf("expected error compiling invalid pattern %q", pattern)
+		}
+	}
+}
+
+func TestParseExcludeFile(t *testing.T) {
+	file := `# build output
+build/
+
+  *.o
+!keep.o
+`
+	patterns, err := ParseExcludeFile(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("unexpected error parsing exclude file: %+v", err)
+	}
+	expected := []string{"build/", "*.o", "!keep.o"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("unexpected patterns: expected %v, got %v", expected, patterns)
+	}
+}
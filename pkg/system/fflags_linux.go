@@ -0,0 +1,62 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsIocSetflags is FS_IOC_SETFLAGS, which is not provided by x/sys. It is
+// derived from FS_IOC_GETFLAGS: both have the same size and type, but the
+// read and write direction bits are swapped and the command number is one
+// higher. This holds for both the generic and the powerpc/mips/sparc ioctl
+// encodings.
+const fsIocSetflags = (unix.FS_IOC_GETFLAGS ^ 0xc0000000) + 1
+
+// Inode flags, as used with FS_IOC_GETFLAGS and FS_IOC_SETFLAGS. These values
+// are the same on every architecture.
+const (
+	// InodeImmutable is FS_IMMUTABLE_FL.
+	InodeImmutable uint32 = 0x00000010
+
+	// InodeAppend is FS_APPEND_FL.
+	InodeAppend uint32 = 0x00000020
+)
+
+// GetInodeFlags returns the inode flags (such as InodeImmutable) of the given
+// open file, using the FS_IOC_GETFLAGS ioctl(2).
+func GetInodeFlags(fh *os.File) (uint32, error) {
+	flags, err := unix.IoctlGetUint32(int(fh.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return 0, &os.PathError{Op: "get inode flags", Path: fh.Name(), Err: err}
+	}
+	return flags, nil
+}
+
+// SetInodeFlags sets the inode flags (such as InodeImmutable) of the given
+// open file, using the FS_IOC_SETFLAGS ioctl(2). Note that flags which are not
+// set are cleared, and that changing InodeImmutable or InodeAppend requires
+// CAP_LINUX_IMMUTABLE.
+func SetInodeFlags(fh *os.File, flags uint32) error {
+	if err := unix.IoctlSetPointerInt(int(fh.Fd()), fsIocSetflags, int(flags)); err != nil {
+		return &os.PathError{Op: "set inode flags", Path: fh.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// +build !linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Inode flags, as used with FS_IOC_GETFLAGS and FS_IOC_SETFLAGS. These values
+// are the same on every architecture.
+const (
+	// InodeImmutable is FS_IMMUTABLE_FL.
+	InodeImmutable uint32 = 0x00000010
+
+	// InodeAppend is FS_APPEND_FL.
+	InodeAppend uint32 = 0x00000020
+)
+
+// GetInodeFlags is not supported on this platform.
+func GetInodeFlags(fh *os.File) (uint32, error) {
+	return 0, &os.PathError{Op: "get inode flags", Path: fh.Name(), Err: unix.ENOTSUP}
+}
+
+// SetInodeFlags is not supported on this platform.
+func SetInodeFlags(fh *os.File, flags uint32) error {
+	return &os.PathError{Op: "set inode flags", Path: fh.Name(), Err: unix.ENOTSUP}
+}
@@ -217,6 +217,20 @@ func Lstatx(path string) (unix.Stat_t, error) {
 	return s, errors.Wrap(err, "unpriv.lstatx")
 }
 
+// Lbirthtime is a wrapper around system.Lbirthtime which has been wrapped
+// with unpriv.Wrap to make it possible to get the birth time of a path even
+// if you do not currently have the required mode bits set to resolve the
+// path.
+func Lbirthtime(path string) (time.Time, error) {
+	var btime time.Time
+	err := Wrap(path, func(path string) error {
+		var err error
+		btime, err = system.Lbirthtime(path)
+		return err
+	})
+	return btime, errors.Wrap(err, "unpriv.lbirthtime")
+}
+
 // Readlink is a wrapper around os.Readlink which has been wrapped with
 // unpriv.Wrap to make it possible to get the target of a symlink even if you
 // do not currently have the required mode bits set to resolve the path. Note
@@ -274,6 +288,16 @@ func Chmod(path string, mode os.FileMode) error {
 	}), "unpriv.chmod")
 }
 
+// Lchown is a wrapper around os.Lchown which has been wrapped with unpriv.Wrap
+// to make it possible to change the owner of a path even if you do not
+// currently have the required access bits to access the path. Note that this
+// does not give you any additional privileges to change the owner.
+func Lchown(path string, uid, gid int) error {
+	return errors.Wrap(Wrap(path, func(path string) error {
+		return os.Lchown(path, uid, gid)
+	}), "unpriv.lchown")
+}
+
 // Chtimes is a wrapper around os.Chtimes which has been wrapped with
 // unpriv.Wrap to make it possible to change the modified times of a path even
 // if you do not currently have the required access bits to access the path.
@@ -23,6 +23,7 @@ import (
 	"strings"
 
 	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/mutate"
 	"github.com/opencontainers/umoci/oci/casext"
@@ -34,9 +35,108 @@ import (
 	"golang.org/x/net/context"
 )
 
+const (
+	// AnnotationBaseImageName is the annotation used to record the name of
+	// the image an image was based on.
+	AnnotationBaseImageName = "org.opencontainers.image.base.name"
+
+	// AnnotationBaseImageDigest is the annotation used to record the digest
+	// of the manifest of the image an image was based on.
+	AnnotationBaseImageDigest = "org.opencontainers.image.base.digest"
+)
+
+// layerCompressor returns the compressor for the layer generated with the
+// given options, as well as the annotations for its descriptor.
+func layerCompressor(opt layer.RepackOptions) (mutate.Compressor, map[string]string, error) {
+	if opt.Compressor != nil {
+		if opt.ZstdDictionary != nil {
+			return nil, nil, errors.Errorf("zstd dictionary cannot be used with a custom compressor")
+		}
+		return opt.Compressor, opt.LayerAnnotations, nil
+	}
+	if opt.ZstdDictionary != nil {
+		if opt.Compression != layer.GzipCompression && opt.Compression != layer.ZstdCompression {
+			return nil, nil, errors.Errorf("zstd dictionary cannot be used without zstd compression")
+		}
+		// Don't modify the caller's annotations.
+		annotations := map[string]string{}
+		for k, v := range opt.LayerAnnotations {
+			annotations[k] = v
+		}
+		annotations[layer.ZstdDictionaryAnnotation] = digest.FromBytes(opt.ZstdDictionary).String()
+		return mutate.ZstdCompressorWithDict(opt.ZstdDictionary), annotations, nil
+	}
+
+	switch opt.Compression {
+	case layer.GzipCompression:
+		return mutate.GzipCompressorWithBudget(opt.MemoryBudgetBytes), opt.LayerAnnotations, nil
+	case layer.NoCompression:
+		return mutate.NoopCompressor, opt.LayerAnnotations, nil
+	case layer.ZstdCompression:
+		return mutate.ZstdCompressor, opt.LayerAnnotations, nil
+	}
+	return nil, nil, errors.Errorf("unknown layer compression %d", opt.Compression)
+}
+
+// changeDetectionKeywords returns the subset of MtreeKeywords which are
+// compared for the given layer.ChangeDetection mode.
+func changeDetectionKeywords(mode layer.ChangeDetection) ([]mtree.Keyword, error) {
+	var keywords []mtree.Keyword
+	for _, keyword := range MtreeKeywords {
+		switch mode {
+		case layer.DigestChangeDetection:
+		case layer.MetadataChangeDetection:
+			if keyword == "sha256digest" {
+				continue
+			}
+		case layer.ContentChangeDetection:
+			if keyword != "size" && keyword != "type" && keyword != "link" && keyword != "sha256digest" {
+				continue
+			}
+		default:
+			return nil, errors.Errorf("unknown change detection mode %d", mode)
+		}
+		keywords = append(keywords, keyword)
+	}
+	return keywords, nil
+}
+
 // Repack repacks a bundle into an image adding a new layer for the changed
-// data in the bundle.
-func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Meta, history *ispec.History, filters []mtreefilter.FilterFunc, refreshBundle bool, mutator *mutate.Mutator) error {
+// data in the bundle. The MapOptions and TranslateOverlayWhiteouts fields of
+// opt are always filled from meta, the remaining fields are used as-is (opt
+// may be nil). The HistoryCreatedBy and HistoryComment fields of opt override
+// the corresponding fields of history. The new layer is generated and
+// streamed into the image without using any temporary files (other than the
+// engine's own in-progress copy of the blob).
+func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Meta, history *ispec.History, filters []mtreefilter.FilterFunc, refreshBundle bool, mutator *mutate.Mutator, opt *layer.RepackOptions) error {
+	if meta.WhiteoutMode == layer.MarkerWhiteout {
+		return errors.Errorf("refusing to repack bundle unpacked with whiteout markers")
+	}
+
+	var packOptions layer.RepackOptions
+	if opt != nil {
+		packOptions = *opt
+	}
+	packOptions.MapOptions = meta.MapOptions
+	packOptions.TranslateOverlayWhiteouts = meta.WhiteoutMode == layer.OverlayFSWhiteout
+
+	if history != nil && (packOptions.HistoryCreatedBy != "" || packOptions.HistoryComment != "") {
+		// Don't modify the caller's history entry.
+		newHistory := *history
+		if packOptions.HistoryCreatedBy != "" {
+			newHistory.CreatedBy = packOptions.HistoryCreatedBy
+		}
+		if packOptions.HistoryComment != "" {
+			newHistory.Comment = packOptions.HistoryComment
+		}
+		history = &newHistory
+	}
+
+	keywords, err := changeDetectionKeywords(packOptions.ChangeDetection)
+	if err != nil {
+		return err
+	}
+
 	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
 	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
@@ -59,7 +159,7 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 	}
 
 	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
+		"keywords": keywords,
 	}).Debugf("umoci: parsed mtree spec")
 
 	fsEval := fseval.Default
@@ -68,7 +168,7 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 	}
 
 	log.Info("computing filesystem diff ...")
-	diffs, err := mtree.Check(fullRootfsPath, spec, MtreeKeywords, fsEval)
+	diffs, err := mtree.Check(fullRootfsPath, spec, keywords, fsEval)
 	if err != nil {
 		return errors.Wrap(err, "check mtree")
 	}
@@ -81,7 +181,11 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 	allFilters := append(filters, mtreefilter.SimplifyFilter(diffs))
 	diffs = mtreefilter.FilterDeltas(diffs, allFilters...)
 
-	if len(diffs) == 0 {
+	if len(diffs) == 0 && len(packOptions.ExtraWhiteouts) == 0 {
+		if packOptions.FailOnNoChange {
+			return errors.Wrapf(layer.ErrNoChanges, "repack %s", bundlePath)
+		}
+
 		config, err := mutator.Config(context.Background())
 		if err != nil {
 			return err
@@ -102,10 +206,11 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 			return err
 		}
 	} else {
-		packOptions := layer.RepackOptions{MapOptions: meta.MapOptions}
-		if meta.WhiteoutMode == layer.OverlayFSWhiteout {
-			packOptions.TranslateOverlayWhiteouts = true
+		compressor, layerAnnotations, err := layerCompressor(packOptions)
+		if err != nil {
+			return err
 		}
+
 		reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &packOptions)
 		if err != nil {
 			return errors.Wrap(err, "generate diff layer")
@@ -114,9 +219,44 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 
 		// TODO: We should add a flag to allow for a new layer to be made
 		//       non-distributable.
-		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, reader, history, mutate.GzipCompressor); err != nil {
+		if packOptions.FixedChunkBytes < 0 {
+			return errors.Errorf("invalid layer chunk size %d", packOptions.FixedChunkBytes)
+		}
+		if packOptions.FixedChunkBytes > 0 {
+			_, err = mutator.AddChunked(context.Background(), ispec.MediaTypeImageLayer, reader, history, compressor, layerAnnotations, packOptions.FixedChunkBytes)
+		} else {
+			_, err = mutator.Add(context.Background(), ispec.MediaTypeImageLayer, reader, history, compressor, layerAnnotations)
+		}
+		if err != nil {
 			return errors.Wrap(err, "add diff layer")
 		}
+
+		if packOptions.MaxLayers < 0 {
+			return errors.Errorf("invalid maximum layer count %d", packOptions.MaxLayers)
+		}
+		if packOptions.MaxLayers > 0 {
+			if err := mutator.LimitLayers(context.Background(), packOptions.MaxLayers, compressor); err != nil {
+				return errors.Wrap(err, "limit layers")
+			}
+		}
+	}
+
+	if packOptions.BaseImageName != "" {
+		annotations, err := mutator.Annotations(context.Background())
+		if err != nil {
+			return err
+		}
+		annotations[AnnotationBaseImageName] = packOptions.BaseImageName
+		annotations[AnnotationBaseImageDigest] = meta.From.Descriptor().Digest.String()
+		if err := mutator.SetAnnotations(context.Background(), annotations); err != nil {
+			return errors.Wrap(err, "set base image annotations")
+		}
+	}
+
+	if packOptions.ConfigMutator != nil {
+		if err := mutator.MutateImage(context.Background(), packOptions.ConfigMutator); err != nil {
+			return errors.Wrap(err, "config mutator callback")
+		}
 	}
 
 	newDescriptorPath, err := mutator.Commit(context.Background())
@@ -126,6 +266,12 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 
 	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
 
+	if packOptions.AfterManifestCommit != nil {
+		if err := packOptions.AfterManifestCommit(context.Background(), engineExt, newDescriptorPath.Descriptor()); err != nil {
+			return errors.Wrap(err, "after manifest commit callback")
+		}
+	}
+
 	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
 		return errors.Wrap(err, "add new tag")
 	}
@@ -0,0 +1,1112 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	zstd "github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// testMapOptions returns the set of MapOptions which are usable by the
+// current user (mirroring what --rootless does for unprivileged users).
+func testMapOptions() layer.MapOptions {
+	if os.Geteuid() == 0 {
+		return layer.MapOptions{}
+	}
+	return layer.MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    true,
+	}
+}
+
+// setupBundle creates a new image layout with a single empty image (tagged
+// "latest") inside the given directory, and unpacks it to a bundle. The
+// returned values are the engine and bundle path.
+func setupBundle(t *testing.T, dir string) (casext.Engine, string) {
+	image := filepath.Join(dir, "image")
+	bundle := filepath.Join(dir, "bundle")
+
+	engineExt, err := CreateLayout(image)
+	if err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	return engineExt, bundle
+}
+
+// repackBundle is a wrapper around Repack that handles all of the setup
+// required to repack the bundle to the given tag.
+func repackBundle(t *testing.T, engineExt casext.Engine, tagName, bundle string, opt *layer.RepackOptions) error {
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatalf("unexpected error reading bundle metadata: %+v", err)
+	}
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatalf("unexpected error creating mutator: %+v", err)
+	}
+	history := &ispec.History{CreatedBy: "repack_test"}
+	return Repack(engineExt, tagName, bundle, meta, history, nil, false, mutator, opt)
+}
+
+// getManifest resolves the given tag and returns its manifest.
+func getManifest(t *testing.T, engineExt casext.Engine, tagName string) ispec.Manifest {
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		t.Fatalf("unexpected error resolving %s: %+v", tagName, err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for %s: %d", tagName, len(descriptorPaths))
+	}
+	blob, err := engineExt.FromDescriptor(context.Background(), descriptorPaths[0].Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	defer blob.Close()
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		t.Fatalf("unexpected manifest blob type: %T", blob.Data)
+	}
+	return manifest
+}
+
+func TestRepackLayerAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackLayerAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	annotations := map[string]string{
+		"com.example.build.id":   "1234",
+		"com.example.git.commit": "deadbeef",
+	}
+	if err := repackBundle(t, engineExt, "new", bundle, &layer.RepackOptions{
+		LayerAnnotations: annotations,
+	}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	manifest := getManifest(t, engineExt, "new")
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("expected one layer in repacked image, got %d", len(manifest.Layers))
+	}
+	if got := manifest.Layers[0].Annotations; !reflect.DeepEqual(got, annotations) {
+		t.Errorf("layer descriptor has wrong annotations: expected %v, got %v", annotations, got)
+	}
+}
+
+func TestRepackAfterManifestCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackAfterManifestCommit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		called  int
+		gotDesc ispec.Descriptor
+	)
+	if err := repackBundle(t, engineExt, "new", bundle, &layer.RepackOptions{
+		AfterManifestCommit: func(ctx context.Context, engine casext.Engine, desc ispec.Descriptor) error {
+			called++
+			gotDesc = desc
+			// The manifest must already be readable from the engine.
+			blob, err := engine.FromDescriptor(ctx, desc)
+			if err != nil {
+				return err
+			}
+			return blob.Close()
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	if called != 1 {
+		t.Fatalf("expected callback to be called once, got %d calls", called)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), "new")
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected error resolving new tag: %+v", err)
+	}
+	if expected := descriptorPaths[0].Descriptor(); gotDesc.Digest != expected.Digest || gotDesc.Size != expected.Size {
+		t.Errorf("callback got wrong manifest descriptor: expected %s (%d bytes), got %s (%d bytes)", expected.Digest, expected.Size, gotDesc.Digest, gotDesc.Size)
+	}
+	if gotDesc.MediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("callback got unexpected media type: %s", gotDesc.MediaType)
+	}
+}
+
+func TestRepackAfterManifestCommitError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackAfterManifestCommitError")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	if err := repackBundle(t, engineExt, "new", bundle, &layer.RepackOptions{
+		AfterManifestCommit: func(ctx context.Context, engine casext.Engine, desc ispec.Descriptor) error {
+			return fmt.Errorf("signing failed")
+		},
+	}); err == nil {
+		t.Fatalf("expected repack to fail if the callback fails")
+	}
+
+	// The tag must not have been created.
+	if descriptorPaths, err := engineExt.ResolveReference(context.Background(), "new"); err != nil {
+		t.Fatalf("unexpected error resolving new tag: %+v", err)
+	} else if len(descriptorPaths) != 0 {
+		t.Errorf("tag was created despite callback failure: %v", descriptorPaths)
+	}
+}
+
+func TestRepackConfigMutator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackConfigMutator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var seenDiffIDs int
+	if err := repackBundle(t, engineExt, "new", bundle, &layer.RepackOptions{
+		ConfigMutator: func(config *ispec.Image) error {
+			seenDiffIDs = len(config.RootFS.DiffIDs)
+			if config.Config.Labels == nil {
+				config.Config.Labels = map[string]string{}
+			}
+			config.Config.Labels["org.opencontainers.umoci.test"] = "repack"
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	manifest := getManifest(t, engineExt, "new")
+	if seenDiffIDs != len(manifest.Layers) {
+		t.Errorf("mutator saw %d diff_ids but the image has %d layers", seenDiffIDs, len(manifest.Layers))
+	}
+	blob, err := engineExt.FromDescriptor(context.Background(), manifest.Config)
+	if err != nil {
+		t.Fatalf("unexpected error getting config: %+v", err)
+	}
+	defer blob.Close()
+	config, ok := blob.Data.(ispec.Image)
+	if !ok {
+		t.Fatalf("unexpected config blob type: %T", blob.Data)
+	}
+	if got := config.Config.Labels["org.opencontainers.umoci.test"]; got != "repack" {
+		t.Errorf("saved config is missing label: got %q", got)
+	}
+
+	// A failing mutator must abort the repack.
+	if err := repackBundle(t, engineExt, "bad", bundle, &layer.RepackOptions{
+		ConfigMutator: func(config *ispec.Image) error {
+			return fmt.Errorf("mutator failed")
+		},
+	}); err == nil {
+		t.Fatalf("expected repack to fail if the mutator fails")
+	}
+	if descriptorPaths, err := engineExt.ResolveReference(context.Background(), "bad"); err != nil {
+		t.Fatalf("unexpected error resolving bad tag: %+v", err)
+	} else if len(descriptorPaths) != 0 {
+		t.Errorf("tag was created despite mutator failure: %v", descriptorPaths)
+	}
+}
+
+func TestRepackHistoryOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackHistoryOverride")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		createdBy = "make -C /src install"
+		comment   = "built from commit deadbeef"
+	)
+	if err := repackBundle(t, engineExt, "new", bundle, &layer.RepackOptions{
+		HistoryCreatedBy: createdBy,
+		HistoryComment:   comment,
+	}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	manifest := getManifest(t, engineExt, "new")
+	blob, err := engineExt.FromDescriptor(context.Background(), manifest.Config)
+	if err != nil {
+		t.Fatalf("unexpected error getting config: %+v", err)
+	}
+	defer blob.Close()
+	config, ok := blob.Data.(ispec.Image)
+	if !ok {
+		t.Fatalf("unexpected config blob type: %T", blob.Data)
+	}
+	if len(config.History) == 0 {
+		t.Fatalf("repacked image has no history")
+	}
+	last := config.History[len(config.History)-1]
+	if last.CreatedBy != createdBy {
+		t.Errorf("history entry has wrong created_by: expected %q, got %q", createdBy, last.CreatedBy)
+	}
+	if last.Comment != comment {
+		t.Errorf("history entry has wrong comment: expected %q, got %q", comment, last.Comment)
+	}
+	if last.EmptyLayer {
+		t.Errorf("history entry unexpectedly marked as empty_layer")
+	}
+}
+
+func TestRepackEmptyDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackEmptyDirectories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+
+	// A directory which is emptied between layers.
+	if err := os.MkdirAll(filepath.Join(rootfs, "emptied"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "emptied", "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackBundle(t, engineExt, "v1", bundle, nil); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	// Unpack the new image, and then create some new empty directories as
+	// well as removing the contents of an existing one.
+	bundle = filepath.Join(dir, "bundle-v1")
+	rootfs = filepath.Join(bundle, layer.RootfsName)
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	if err := Unpack(engineExt, "v1", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	emptyDirs := []string{"empty", "nested/empty/dirs", "emptied"}
+	for _, path := range emptyDirs {
+		if err := os.MkdirAll(filepath.Join(rootfs, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(rootfs, "emptied", "file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackBundle(t, engineExt, "v2", bundle, nil); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	// All of the empty directories must still exist.
+	bundle = filepath.Join(dir, "bundle-v2")
+	rootfs = filepath.Join(bundle, layer.RootfsName)
+	if err := Unpack(engineExt, "v2", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	for _, path := range append(emptyDirs, "nested", "nested/empty") {
+		fi, err := os.Lstat(filepath.Join(rootfs, path))
+		if err != nil {
+			t.Errorf("directory %s missing after repack: %v", path, err)
+			continue
+		}
+		if !fi.IsDir() {
+			t.Errorf("%s is no longer a directory: %v", path, fi.Mode())
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "emptied", "file")); !os.IsNotExist(err) {
+		t.Errorf("removed file still present after repack: %v", err)
+	}
+}
+
+func TestRepackBaseImageAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackBaseImageAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatalf("unexpected error reading bundle metadata: %+v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const baseName = "registry.example.com/base:latest"
+	if err := repackBundle(t, engineExt, "new", bundle, &layer.RepackOptions{
+		BaseImageName: baseName,
+	}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	manifest := getManifest(t, engineExt, "new")
+	if got := manifest.Annotations[AnnotationBaseImageName]; got != baseName {
+		t.Errorf("unexpected base image name: expected %q, got %q", baseName, got)
+	}
+	if got, expected := manifest.Annotations[AnnotationBaseImageDigest], meta.From.Descriptor().Digest.String(); got != expected {
+		t.Errorf("unexpected base image digest: expected %q, got %q", expected, got)
+	}
+
+	// Without BaseImageName no annotations are added.
+	if err := repackBundle(t, engineExt, "plain", bundle, nil); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+	manifest = getManifest(t, engineExt, "plain")
+	for _, key := range []string{AnnotationBaseImageName, AnnotationBaseImageDigest} {
+		if val, ok := manifest.Annotations[key]; ok {
+			t.Errorf("unexpected %s annotation: %q", key, val)
+		}
+	}
+}
+
+// TestRepackStreaming makes sure that the new layer is streamed directly into
+// the image, rather than being buffered into a temporary file first.
+func TestRepackStreaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackStreaming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	// Incompressible data, so that buffering would be noticeable.
+	data := make([]byte, 4<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "large"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Redirect the system temporary directory, and watch it while repacking.
+	tmpDir := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldTmpDir, hadTmpDir := os.LookupEnv("TMPDIR")
+	os.Setenv("TMPDIR", tmpDir)
+	defer func() {
+		if hadTmpDir {
+			os.Setenv("TMPDIR", oldTmpDir)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+	}()
+
+	done := make(chan struct{})
+	tmpUsed := make(chan int64)
+	go func() {
+		var maxSize int64
+		for {
+			var size int64
+			_ = filepath.Walk(tmpDir, func(_ string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					size += info.Size() + 1
+				}
+				return nil
+			})
+			if size > maxSize {
+				maxSize = size
+			}
+			select {
+			case <-done:
+				tmpUsed <- maxSize
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	err = repackBundle(t, engineExt, "new", bundle, nil)
+	close(done)
+	if err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+	if size := <-tmpUsed; size != 0 {
+		t.Errorf("repack used temporary files (up to %d bytes) outside of the image", size)
+	}
+
+	// The only copy of the layer in the image must be the blob itself.
+	manifest := getManifest(t, engineExt, "new")
+	newLayer := manifest.Layers[len(manifest.Layers)-1]
+	blobs, err := engineExt.ListBlobs(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error listing blobs: %+v", err)
+	}
+	found := false
+	for _, blob := range blobs {
+		if blob == newLayer.Digest {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("new layer %s not stored in image", newLayer.Digest)
+	}
+	if err := filepath.Walk(filepath.Join(dir, "image"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".umoci-") && info.IsDir() {
+			entries, err := ioutil.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				t.Errorf("temporary files left in image: %s: %d entries", path, len(entries))
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// And the layer must be valid (the DiffID is verified while unpacking).
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	if err := Unpack(engineExt, "new", filepath.Join(dir, "bundle-new"), unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking repacked image: %+v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "bundle-new", layer.RootfsName, "large"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("repacked layer has wrong contents (%v)", err)
+	}
+}
+
+func TestRepackExtraWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackExtraWhiteouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "deleted"), []byte("deleted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "kept"), []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackBundle(t, engineExt, "base", bundle, nil); err != nil {
+		t.Fatalf("unexpected error repacking base: %+v", err)
+	}
+
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	baseBundle := filepath.Join(dir, "bundle-base")
+	if err := Unpack(engineExt, "base", baseBundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking base: %+v", err)
+	}
+
+	// Delete the file, but regenerate the recorded state so the deletion
+	// can't be detected by the diff.
+	if err := os.Remove(filepath.Join(baseBundle, layer.RootfsName, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := ReadBundleMeta(baseBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	if err := os.Remove(filepath.Join(baseBundle, mtreeName+".mtree")); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateBundleManifest(mtreeName, baseBundle, nil); err != nil {
+		t.Fatalf("unexpected error regenerating mtree: %+v", err)
+	}
+
+	// A path which still exists can't be whited out.
+	if err := repackBundle(t, engineExt, "bad", baseBundle, &layer.RepackOptions{
+		ExtraWhiteouts: []string{"/kept"},
+	}); err == nil {
+		t.Errorf("expected error forcing whiteout of existing path")
+	}
+
+	if err := repackBundle(t, engineExt, "new", baseBundle, &layer.RepackOptions{
+		ExtraWhiteouts: []string{"/deleted", "deleted"},
+	}); err != nil {
+		t.Fatalf("unexpected error repacking with extra whiteouts: %+v", err)
+	}
+	if manifest := getManifest(t, engineExt, "new"); len(manifest.Layers) != 2 {
+		t.Errorf("expected a new layer to be added for the whiteout, got %d layers", len(manifest.Layers))
+	}
+
+	newBundle := filepath.Join(dir, "bundle-new")
+	if err := Unpack(engineExt, "new", newBundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking new: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(newBundle, layer.RootfsName, "deleted")); !os.IsNotExist(err) {
+		t.Errorf("expected whited out file to be deleted: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(newBundle, layer.RootfsName, "kept")); err != nil {
+		t.Errorf("unexpected error checking kept file: %+v", err)
+	}
+}
+
+func TestRepackZstdDictionary(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestRepackZstdDictionary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Train a dictionary on files similar to the ones in the layer.
+	sampleContents := func(name string, idx int) []byte {
+		return []byte(fmt.Sprintf(`{"name": %q, "version": "1.%d.0", "description": "a package installed in the image", "license": "Apache-2.0", "dependencies": ["libc", "libz"]}`+"\n", name, idx))
+	}
+	samples := filepath.Join(dir, "samples")
+	if err := os.Mkdir(samples, 0755); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-q", "--train", "--maxdict=4096", "-o", filepath.Join(dir, "dict")}
+	for idx := 0; idx < 200; idx++ {
+		path := filepath.Join(samples, fmt.Sprintf("sample%d", idx))
+		if err := ioutil.WriteFile(path, sampleContents(fmt.Sprintf("sample%d", idx), idx), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, path)
+	}
+	if out, err := exec.Command("zstd", args...).CombinedOutput(); err != nil {
+		t.Fatalf("zstd --train failed: %v: %s", err, out)
+	}
+	dict, err := ioutil.ReadFile(filepath.Join(dir, "dict"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	for idx := 0; idx < 4; idx++ {
+		name := fmt.Sprintf("pkg%d", idx)
+		if err := ioutil.WriteFile(filepath.Join(rootfs, name), sampleContents(name, 100+idx), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repackBundle(t, engineExt, "new", bundle, &layer.RepackOptions{
+		ZstdDictionary: dict,
+	}); err != nil {
+		t.Fatalf("unexpected error repacking with zstd dictionary: %+v", err)
+	}
+
+	manifest := getManifest(t, engineExt, "new")
+	layerDesc := manifest.Layers[len(manifest.Layers)-1]
+	if layerDesc.MediaType != ispec.MediaTypeImageLayer+"+zstd" {
+		t.Errorf("unexpected layer media type: %s", layerDesc.MediaType)
+	}
+	if got, want := layerDesc.Annotations[layer.ZstdDictionaryAnnotation], digest.FromBytes(dict).String(); got != want {
+		t.Errorf("unexpected dictionary annotation: expected %q got %q", want, got)
+	}
+
+	// Compare against the same layer compressed without a dictionary.
+	layerBlob, err := engineExt.GetBlob(context.Background(), layerDesc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := zstd.NewReader(layerBlob, zstd.WithDecoderDicts(dict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerTar, err := ioutil.ReadAll(dec)
+	dec.Close()
+	layerBlob.Close()
+	if err != nil {
+		t.Fatalf("unexpected error decompressing layer: %+v", err)
+	}
+	plain, err := mutate.ZstdCompressor.Compress(bytes.NewReader(layerTar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainLayer, err := ioutil.ReadAll(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layerDesc.Size >= int64(len(plainLayer)) {
+		t.Errorf("expected dictionary-compressed layer (%d bytes) to be smaller than plain zstd layer (%d bytes)", layerDesc.Size, len(plainLayer))
+	}
+
+	// The layer can only be unpacked with the dictionary.
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	if err := Unpack(engineExt, "new", filepath.Join(dir, "bundle-nodict"), unpackOptions); !errors.Is(err, layer.ErrMissingZstdDictionary) {
+		t.Errorf("expected ErrMissingZstdDictionary unpacking without dictionary, got %+v", err)
+	}
+	unpackOptions.ZstdDictionaries = [][]byte{[]byte("unrelated"), dict}
+	newBundle := filepath.Join(dir, "bundle-new")
+	if err := Unpack(engineExt, "new", newBundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking with dictionary: %+v", err)
+	}
+	for idx := 0; idx < 4; idx++ {
+		name := fmt.Sprintf("pkg%d", idx)
+		got, err := ioutil.ReadFile(filepath.Join(newBundle, layer.RootfsName, name))
+		if err != nil {
+			t.Errorf("unexpected error reading %s: %+v", name, err)
+			continue
+		}
+		if want := sampleContents(name, 100+idx); !bytes.Equal(got, want) {
+			t.Errorf("unexpected contents of %s: expected %q got %q", name, want, got)
+		}
+	}
+}
+
+func TestRepackNoCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackNoCompression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "file"), []byte("uncompressed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackBundle(t, engineExt, "new", bundle, &layer.RepackOptions{
+		Compression: layer.NoCompression,
+	}); err != nil {
+		t.Fatalf("unexpected error repacking without compression: %+v", err)
+	}
+
+	manifest := getManifest(t, engineExt, "new")
+	layerDesc := manifest.Layers[len(manifest.Layers)-1]
+	if layerDesc.MediaType != ispec.MediaTypeImageLayer {
+		t.Errorf("unexpected layer media type: expected %s got %s", ispec.MediaTypeImageLayer, layerDesc.MediaType)
+	}
+	configBlob, err := engineExt.FromDescriptor(context.Background(), manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer configBlob.Close()
+	config := configBlob.Data.(ispec.Image)
+	if diffID := config.RootFS.DiffIDs[len(config.RootFS.DiffIDs)-1]; layerDesc.Digest != diffID {
+		t.Errorf("uncompressed layer digest %s does not match diffid %s", layerDesc.Digest, diffID)
+	}
+
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	newBundle := filepath.Join(dir, "bundle-new")
+	if err := Unpack(engineExt, "new", newBundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking uncompressed layer: %+v", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(newBundle, layer.RootfsName, "file")); err != nil {
+		t.Errorf("unexpected error reading file: %+v", err)
+	} else if string(got) != "uncompressed" {
+		t.Errorf("unexpected file contents: %q", got)
+	}
+
+	// A zstd dictionary can only be used with zstd compression.
+	if err := repackBundle(t, engineExt, "bad", bundle, &layer.RepackOptions{
+		Compression:    layer.NoCompression,
+		ZstdDictionary: []byte("dictionary"),
+	}); err == nil {
+		t.Errorf("expected an error repacking with a zstd dictionary and no compression")
+	}
+}
+
+// testMediaTypeLayerBase64 is the media-type of layers produced by
+// base64Compressor.
+const testMediaTypeLayerBase64 = ispec.MediaTypeImageLayer + "+base64"
+
+// base64Compressor is a trivial custom layer.Compressor, which "compresses"
+// layers by base64-encoding them.
+type base64Compressor struct{}
+
+func (base64Compressor) Compress(r io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		enc := base64.NewEncoder(base64.StdEncoding, pipeWriter)
+		_, err := io.Copy(enc, r)
+		if err == nil {
+			err = enc.Close()
+		}
+		// #nosec G104
+		_ = pipeWriter.CloseWithError(err)
+	}()
+	return pipeReader, nil
+}
+
+func (base64Compressor) MediaTypeSuffix() string {
+	return "base64"
+}
+
+func init() {
+	layer.RegisterDecompressor(testMediaTypeLayerBase64, func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(base64.NewDecoder(base64.StdEncoding, r)), nil
+	})
+}
+
+func TestRepackCustomCompressor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackCustomCompressor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "file"), []byte("custom compression"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackBundle(t, engineExt, "new", bundle, &layer.RepackOptions{
+		Compressor: base64Compressor{},
+	}); err != nil {
+		t.Fatalf("unexpected error repacking with custom compressor: %+v", err)
+	}
+
+	manifest := getManifest(t, engineExt, "new")
+	layerDesc := manifest.Layers[len(manifest.Layers)-1]
+	if layerDesc.MediaType != testMediaTypeLayerBase64 {
+		t.Errorf("unexpected layer media type: expected %s got %s", testMediaTypeLayerBase64, layerDesc.MediaType)
+	}
+
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	newBundle := filepath.Join(dir, "bundle-new")
+	if err := Unpack(engineExt, "new", newBundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking custom compressed layer: %+v", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(newBundle, layer.RootfsName, "file")); err != nil {
+		t.Errorf("unexpected error reading file: %+v", err)
+	} else if string(got) != "custom compression" {
+		t.Errorf("unexpected file contents: %q", got)
+	}
+
+	// A zstd dictionary cannot be used with a custom compressor.
+	if err := repackBundle(t, engineExt, "bad", bundle, &layer.RepackOptions{
+		Compressor:     base64Compressor{},
+		ZstdDictionary: []byte("dictionary"),
+	}); err == nil {
+		t.Errorf("expected an error repacking with a zstd dictionary and a custom compressor")
+	}
+}
+
+func TestRepackFailOnNoChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackFailOnNoChange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	opt := &layer.RepackOptions{FailOnNoChange: true}
+	err = repackBundle(t, engineExt, "new", bundle, opt)
+	if !errors.Is(err, layer.ErrNoChanges) {
+		t.Fatalf("expected repack of unmodified bundle to fail with ErrNoChanges: %+v", err)
+	}
+	names, err := engineExt.ListReferences(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error listing references: %+v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"latest"}) {
+		t.Errorf("failed repack modified the image references: %v", names)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackBundle(t, engineExt, "new", bundle, opt); err != nil {
+		t.Fatalf("unexpected error repacking modified bundle: %+v", err)
+	}
+	if manifest := getManifest(t, engineExt, "new"); len(manifest.Layers) != 1 {
+		t.Errorf("expected one layer in repacked image, got %d", len(manifest.Layers))
+	}
+}
+
+func TestRepackFixedChunkBytes(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestRepackFixedChunkBytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	// Random data doesn't compress, so the layer is spread over many chunks.
+	data := make([]byte, 16*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Repack the bundle both normally and chunked, so that the reassembled
+	// layer can be compared to the original one.
+	if err := repackBundle(t, engineExt, "plain", bundle, nil); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+	const chunkSize = 1024
+	if err := repackBundle(t, engineExt, "chunked", bundle, &layer.RepackOptions{
+		FixedChunkBytes: chunkSize,
+	}); err != nil {
+		t.Fatalf("unexpected error repacking with chunks: %+v", err)
+	}
+	if err := repackBundle(t, engineExt, "bad", bundle, &layer.RepackOptions{
+		FixedChunkBytes: -1,
+	}); err == nil {
+		t.Errorf("expected an error repacking with a negative chunk size")
+	}
+
+	plainManifest := getManifest(t, engineExt, "plain")
+	plainLayer := plainManifest.Layers[len(plainManifest.Layers)-1]
+	manifest := getManifest(t, engineExt, "chunked")
+	layerDesc := manifest.Layers[len(manifest.Layers)-1]
+	if layerDesc.MediaType != layer.MediaTypeChunkedLayer {
+		t.Fatalf("unexpected layer media type: expected %s got %s", layer.MediaTypeChunkedLayer, layerDesc.MediaType)
+	}
+
+	// The layers must only be referenced by the manifests, so that the chunks
+	// are only kept by the garbage collector if they are found by walking the
+	// chunked layer.
+	if err := engineExt.DeleteReference(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("unexpected error during gc: %+v", err)
+	}
+
+	blob, err := engineExt.FromDescriptor(ctx, layerDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunked, ok := blob.Data.(layer.ChunkedLayer)
+	blob.Close()
+	if !ok {
+		t.Fatalf("unexpected chunked layer blob type: %T", blob.Data)
+	}
+	if chunked.MediaType != plainLayer.MediaType || chunked.Digest != plainLayer.Digest || chunked.Size != plainLayer.Size {
+		t.Errorf("chunked layer %s (%d bytes) does not match original layer %s (%d bytes)", chunked.Digest, chunked.Size, plainLayer.Digest, plainLayer.Size)
+	}
+	if expected := int((plainLayer.Size + chunkSize - 1) / chunkSize); len(chunked.Chunks) != expected {
+		t.Errorf("unexpected number of chunks: expected %d got %d", expected, len(chunked.Chunks))
+	}
+	for idx, chunk := range chunked.Chunks {
+		if idx < len(chunked.Chunks)-1 && chunk.Size != chunkSize {
+			t.Errorf("chunk %d has unexpected size %d", idx, chunk.Size)
+		}
+	}
+
+	// Reassembling the chunks must give the original layer blob.
+	reader, reassembledDesc, err := layer.OpenLayer(ctx, engineExt, layerDesc)
+	if err != nil {
+		t.Fatalf("unexpected error opening chunked layer: %+v", err)
+	}
+	reassembled, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error reassembling chunked layer: %+v", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Errorf("unexpected error closing chunked layer: %+v", err)
+	}
+	if got := digest.FromBytes(reassembled); got != plainLayer.Digest || reassembledDesc.Digest != plainLayer.Digest {
+		t.Errorf("reassembled layer has digest %s (descriptor %s), expected %s", got, reassembledDesc.Digest, plainLayer.Digest)
+	}
+
+	// ... as must exporting it ...
+	var exported bytes.Buffer
+	exportedDesc, err := ExportLayer(engineExt, "chunked", nil, len(manifest.Layers)-1, false, &exported)
+	if err != nil {
+		t.Fatalf("unexpected error exporting chunked layer: %+v", err)
+	}
+	if got := digest.FromBytes(exported.Bytes()); got != plainLayer.Digest || exportedDesc.Digest != plainLayer.Digest {
+		t.Errorf("exported layer has digest %s (descriptor %s), expected %s", got, exportedDesc.Digest, plainLayer.Digest)
+	}
+
+	// ... and the chunked layer must unpack.
+	newBundle := filepath.Join(dir, "bundle-chunked")
+	if err := Unpack(engineExt, "chunked", newBundle, layer.UnpackOptions{MapOptions: testMapOptions()}); err != nil {
+		t.Fatalf("unexpected error unpacking chunked layer: %+v", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(newBundle, layer.RootfsName, "file")); err != nil {
+		t.Errorf("unexpected error reading file: %+v", err)
+	} else if !bytes.Equal(got, data) {
+		t.Errorf("unpacked file from chunked layer has unexpected contents")
+	}
+}
+
+func TestRepackChangeDetection(t *testing.T) {
+	for _, test := range []struct {
+		name                    string
+		mode                    layer.ChangeDetection
+		touched, sameSizeChange bool
+	}{
+		{"Digest", layer.DigestChangeDetection, true, true},
+		{"Metadata", layer.MetadataChangeDetection, true, false},
+		{"Content", layer.ContentChangeDetection, false, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestRepackChangeDetection")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			engineExt, bundle := setupBundle(t, dir)
+			defer engineExt.Close()
+
+			path := filepath.Join(bundle, layer.RootfsName, "file")
+			mtime := time.Unix(1500000000, 0)
+			if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			// repack repacks the bundle (refreshing it) and returns whether
+			// a new layer was added.
+			repack := func() bool {
+				meta, err := ReadBundleMeta(bundle)
+				if err != nil {
+					t.Fatalf("unexpected error reading bundle metadata: %+v", err)
+				}
+				mutator, err := mutate.New(engineExt, meta.From)
+				if err != nil {
+					t.Fatalf("unexpected error creating mutator: %+v", err)
+				}
+				opt := &layer.RepackOptions{ChangeDetection: test.mode, FailOnNoChange: true}
+				err = Repack(engineExt, "latest", bundle, meta, &ispec.History{CreatedBy: "repack_test"}, nil, true, mutator, opt)
+				if errors.Cause(err) == layer.ErrNoChanges {
+					return false
+				}
+				if err != nil {
+					t.Fatalf("unexpected error repacking: %+v", err)
+				}
+				return true
+			}
+
+			if !repack() {
+				t.Fatalf("new file was not included in the new layer")
+			}
+
+			// Only change the modification time.
+			touched := mtime.Add(time.Hour)
+			if err := os.Chtimes(path, touched, touched); err != nil {
+				t.Fatal(err)
+			}
+			if got := repack(); got != test.touched {
+				t.Errorf("unexpected decision for touched file: expected included=%v got %v", test.touched, got)
+			}
+
+			// Change the contents, but keep the size and modification time.
+			if err := ioutil.WriteFile(path, []byte("CONTENTS"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, touched, touched); err != nil {
+				t.Fatal(err)
+			}
+			if got := repack(); got != test.sameSizeChange {
+				t.Errorf("unexpected decision for same-size change: expected included=%v got %v", test.sameSizeChange, got)
+			}
+		})
+	}
+}
+
+func TestRepackChangeDetectionInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackChangeDetectionInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+
+	if err := repackBundle(t, engineExt, "latest", bundle, &layer.RepackOptions{ChangeDetection: layer.ChangeDetection(1337)}); err == nil {
+		t.Errorf("expected error with unknown change detection mode")
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package umoci
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// tempReferenceName returns a new (randomly-named) reference name based on
+// tagName, for use as a temporary tag.
+func tempReferenceName(tagName string) (string, error) {
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", errors.Wrap(err, "generate temporary tag name")
+	}
+	return tagName + ".umoci-tmp-" + hex.EncodeToString(suffix[:]), nil
+}
+
+// ReplaceReference atomically replaces the image referenced by tagName with
+// the result of build. build is called with the name of a temporary tag which
+// initially references the same image as tagName (if tagName exists), and
+// should apply all of its modifications to that temporary tag. If build
+// succeeds, tagName is swapped to point to the new image with a single update
+// of the index. Otherwise the temporary tag is removed and tagName is left
+// untouched -- any blobs created by build can be cleaned up with GC.
+func ReplaceReference(engineExt casext.Engine, tagName string, build func(tmpName string) error) (Err error) {
+	ctx := context.Background()
+
+	if !casext.IsValidReferenceName(tagName) {
+		return errors.Errorf("invalid tag name %q", tagName)
+	}
+	tmpName, err := tempReferenceName(tagName)
+	if err != nil {
+		return err
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, tagName)
+	if err != nil {
+		return errors.Wrapf(err, "resolve %s", tagName)
+	}
+	if len(descriptorPaths) > 0 {
+		root := descriptorPaths[0].Root()
+		for _, descriptorPath := range descriptorPaths[1:] {
+			if descriptorPath.Root().Digest != root.Digest {
+				return errors.Errorf("tag is ambiguous: %s", tagName)
+			}
+		}
+		if err := engineExt.UpdateReference(ctx, tmpName, root); err != nil {
+			return errors.Wrap(err, "create temporary tag")
+		}
+	}
+
+	defer func() {
+		if Err != nil {
+			if err := engineExt.DeleteReference(ctx, tmpName); err != nil {
+				log.Warnf("failed to remove temporary tag %s: %v", tmpName, err)
+			}
+		}
+	}()
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+		"tmp": tmpName,
+	}).Debugf("umoci: building replacement image")
+
+	if err := build(tmpName); err != nil {
+		return errors.Wrap(err, "build replacement image")
+	}
+	if err := engineExt.RenameReference(ctx, tmpName, tagName); err != nil {
+		return errors.Wrapf(err, "swap %s", tagName)
+	}
+	return nil
+}
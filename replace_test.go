@@ -0,0 +1,100 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package umoci
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"golang.org/x/net/context"
+)
+
+func getManifestDescriptor(t *testing.T, engineExt casext.Engine, tagName string) ispec.Descriptor {
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected error resolving %s: %+v", tagName, err)
+	}
+	return descriptorPaths[0].Descriptor()
+}
+
+func TestReplaceReference(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestReplaceReference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+	defer engineExt.Close()
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	original := getManifestDescriptor(t, engineExt, "latest")
+
+	// A build which fails half-way must leave the original tag untouched.
+	if err := ReplaceReference(engineExt, "latest", func(tmpName string) error {
+		if !strings.HasPrefix(tmpName, "latest.") {
+			t.Errorf("unexpected temporary tag name %q", tmpName)
+		}
+		tagged := addMarkerLayer(t, engineExt, tmpName, "first")
+		if err := engineExt.UpdateReference(context.Background(), tmpName, tagged); err != nil {
+			return err
+		}
+		return fmt.Errorf("build failed")
+	}); err == nil {
+		t.Fatalf("expected error from failed build")
+	}
+	if got := getManifestDescriptor(t, engineExt, "latest"); got.Digest != original.Digest {
+		t.Errorf("original tag modified by failed build: expected %s, got %s", original.Digest, got.Digest)
+	}
+	if refs, err := engineExt.ListReferences(context.Background()); err != nil {
+		t.Fatalf("unexpected error listing references: %+v", err)
+	} else if len(refs) != 1 || refs[0] != "latest" {
+		t.Errorf("temporary tag left behind after failed build: %v", refs)
+	}
+
+	// A successful build replaces the tag.
+	var built string
+	if err := ReplaceReference(engineExt, "latest", func(tmpName string) error {
+		// The temporary tag must start out as a copy of the original.
+		if got := getManifestDescriptor(t, engineExt, tmpName); got.Digest != original.Digest {
+			t.Errorf("temporary tag doesn't reference original image: expected %s, got %s", original.Digest, got.Digest)
+		}
+		tagged := addMarkerLayer(t, engineExt, tmpName, "second")
+		built = tagged.Digest.String()
+		return engineExt.UpdateReference(context.Background(), tmpName, tagged)
+	}); err != nil {
+		t.Fatalf("unexpected error replacing image: %+v", err)
+	}
+	if got := getManifestDescriptor(t, engineExt, "latest"); got.Digest.String() != built {
+		t.Errorf("tag not replaced: expected %s, got %s", built, got.Digest)
+	}
+	if refs, err := engineExt.ListReferences(context.Background()); err != nil {
+		t.Fatalf("unexpected error listing references: %+v", err)
+	} else if len(refs) != 1 || refs[0] != "latest" {
+		t.Errorf("unexpected references after replacement: %v", refs)
+	}
+}
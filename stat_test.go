@@ -0,0 +1,146 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package umoci
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas/httpdir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"golang.org/x/net/context"
+)
+
+func TestStatRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestStatRemote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "image")
+	engineExt, err := CreateLayout(image)
+	if err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	descriptor := addMarkerLayer(t, engineExt, "latest", "remote")
+
+	// Set some configuration to check for.
+	mutator, err := mutate.New(engineExt, casext.DescriptorPath{Walk: []ispec.Descriptor{descriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Env = append(config.Env, "REMOTE=1")
+	config.Labels = map[string]string{"org.example.remote": "yes"}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), config, meta, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(context.Background(), "latest", newPath.Root()); err != nil {
+		t.Fatalf("unexpected error tagging image: %+v", err)
+	}
+	engineExt.Close()
+
+	// Record every request made to the server.
+	var (
+		lock     sync.Mutex
+		requests []string
+	)
+	fileServer := http.FileServer(http.Dir(image))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r.URL.Path)
+		lock.Unlock()
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	engine, err := httpdir.Open(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error opening http layout: %+v", err)
+	}
+	remoteExt := casext.NewEngine(engine)
+	defer remoteExt.Close()
+
+	descriptorPaths, err := remoteExt.ResolveReference(context.Background(), "latest")
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected error resolving latest: %+v", err)
+	}
+	ms, err := Stat(context.Background(), remoteExt, descriptorPaths[0].Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error in stat: %+v", err)
+	}
+
+	if len(ms.Config.Env) == 0 || ms.Config.Env[len(ms.Config.Env)-1] != "REMOTE=1" {
+		t.Errorf("unexpected stat config env: %v", ms.Config.Env)
+	}
+	if ms.Config.Labels["org.example.remote"] != "yes" {
+		t.Errorf("unexpected stat config labels: %v", ms.Config.Labels)
+	}
+	var wantSize int64
+	for _, desc := range manifest.Layers {
+		wantSize += desc.Size
+	}
+	if ms.Size != wantSize || wantSize == 0 {
+		t.Errorf("unexpected stat size: expected %d got %d", wantSize, ms.Size)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, desc := range manifest.Layers {
+		for _, path := range requests {
+			if strings.HasSuffix(path, desc.Digest.Hex()) {
+				t.Errorf("stat fetched layer blob %s", desc.Digest)
+			}
+		}
+	}
+	for _, desc := range []ispec.Descriptor{newPath.Descriptor(), manifest.Config} {
+		found := false
+		for _, path := range requests {
+			found = found || strings.HasSuffix(path, desc.Digest.Hex())
+		}
+		if !found {
+			t.Errorf("expected stat to fetch blob %s", desc.Digest)
+		}
+	}
+}
@@ -59,10 +59,15 @@ function teardown() {
 	umoci stat --image "${IMAGE}:${TAG}" --json
 	[ "$status" -eq 0 ]
 	numLinesA="$(echo "$output" | jq -SM '.history | length')"
+	layersA="$(echo "$output" | jq -SMc '[.history[].layer | select(. != null)]')"
 
 	umoci stat --image "${IMAGE}:${TAG}-new" --json
 	[ "$status" -eq 0 ]
 	numLinesB="$(echo "$output" | jq -SM '.history | length')"
+	layersB="$(echo "$output" | jq -SMc '[.history[].layer | select(. != null)]')"
+
+	# The layer blobs must be reused verbatim.
+	[[ "$layersA" == "$layersB" ]]
 
 	# Number of lines should be greater.
 	[ "$numLinesB" -gt "$numLinesA" ]
@@ -819,3 +824,176 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci config --config-json" {
+	echo '{"WorkingDir": "/from/json", "Env": ["VARIABLE1=json", "VARIABLE2=json"]}' >"$UMOCI_TMPDIR/config.json"
+
+	# Merge the partial config, with a --config.* override.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config-json "$UMOCI_TMPDIR/config.json" --config.env "VARIABLE2=flag"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run jq -SM '.process.cwd' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[ "$output" = '"/from/json"' ]
+
+	sane_run jq -SMr '.process.env[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	export "${lines[@]}"
+	[[ "$VARIABLE1" == "json" ]]
+	[[ "$VARIABLE2" == "flag" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --config-json [invalid]" {
+	# Wrong type for a field.
+	echo '{"WorkingDir": ["/not/a/string"]}' >"$UMOCI_TMPDIR/config.json"
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config-json "$UMOCI_TMPDIR/config.json"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"config.WorkingDir"* ]]
+	image-verify "${IMAGE}"
+
+	# Unknown field.
+	echo '{"Bogus": "field"}' >"$UMOCI_TMPDIR/config.json"
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config-json "$UMOCI_TMPDIR/config.json"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"config.Bogus"* ]]
+	image-verify "${IMAGE}"
+
+	# Not JSON at all.
+	echo 'this is not json' >"$UMOCI_TMPDIR/config.json"
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config-json "$UMOCI_TMPDIR/config.json"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# The tag must not have been created.
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --runtime-preview" {
+	# Rootless unpacks generate a different (rootless) config.json.
+	requires root
+
+	# Set some config values which affect the runtime config.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.user="1337:8888" --config.workingdir="/srv" \
+		--config.env="VARIABLE=preview" --config.cmd="/bin/preview" \
+		--config.volume="/volume"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	statBefore="$output"
+
+	# Preview the runtime config.
+	umoci config --image "${IMAGE}:${TAG}-new" --runtime-preview
+	[ "$status" -eq 0 ]
+	echo "$output" | jq -SM '.' >"$UMOCI_TMPDIR/preview-config.json"
+
+	# The preview must not have modified the image.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$statBefore" ]]
+
+	# Compare against the config generated by an actual unpack.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	jq -SM '.' "$BUNDLE/config.json" >"$UMOCI_TMPDIR/unpack-config.json"
+	sane_run diff -u "$UMOCI_TMPDIR/unpack-config.json" "$UMOCI_TMPDIR/preview-config.json"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --print-labels" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-labels" \
+		--clear=config.labels \
+		--config.label="org.opencontainers.image.version=1.2.3" \
+		--config.label="maintainer=Jane Doe <jane@example.com>"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-labels" --json
+	[ "$status" -eq 0 ]
+	statBefore="$output"
+
+	# Print the labels as name=value pairs.
+	umoci config --image "${IMAGE}:${TAG}-labels" --print-labels
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "${lines[0]}" == "maintainer=Jane Doe <jane@example.com>" ]]
+	[[ "${lines[1]}" == "org.opencontainers.image.version=1.2.3" ]]
+
+	# ... and as JSON.
+	umoci config --image "${IMAGE}:${TAG}-labels" --print-labels --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '."org.opencontainers.image.version"')" == "1.2.3" ]]
+	[[ "$(echo "$output" | jq -r '.maintainer')" == "Jane Doe <jane@example.com>" ]]
+	[[ "$(echo "$output" | jq -r 'length')" == "2" ]]
+
+	# Printing the labels must not have modified the image.
+	umoci stat --image "${IMAGE}:${TAG}-labels" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$statBefore" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --runtime-preview [mapping options]" {
+	# Set some config values which affect the runtime config.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.user="1337:8888" --config.workingdir="/srv" \
+		--config.env="VARIABLE=preview" --config.cmd="/bin/preview"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The mapping options are passed exactly as they are to umoci-unpack(1),
+	# which is always rootless if we are.
+	mapArgs=("--uid-map=0:$(id -u):1" "--gid-map=0:$(id -g):1")
+	previewArgs=("${mapArgs[@]}")
+	if [[ "$IS_ROOTLESS" != 0 ]]; then
+		previewArgs+=("--rootless")
+	fi
+
+	umoci config --image "${IMAGE}:${TAG}-new" --runtime-preview --runtime-profile=crun "${previewArgs[@]}"
+	[ "$status" -eq 0 ]
+	echo "$output" | jq -SM '.' >"$UMOCI_TMPDIR/preview-config.json"
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" --runtime-profile=crun "${mapArgs[@]}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	jq -SM '.' "$BUNDLE/config.json" >"$UMOCI_TMPDIR/unpack-config.json"
+	sane_run diff -u "$UMOCI_TMPDIR/unpack-config.json" "$UMOCI_TMPDIR/preview-config.json"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# The kata profile cannot be used with user namespaces, in the preview as
+	# much as when unpacking.
+	umoci config --image "${IMAGE}:${TAG}-new" --runtime-preview --runtime-profile=kata "${previewArgs[@]}"
+	[ "$status" -ne 0 ]
+
+	# The mapping options are meaningless without --runtime-preview.
+	umoci config --image "${IMAGE}:${TAG}-new" --tag "${TAG}-bad" "${previewArgs[@]}"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}-new" --tag "${TAG}-bad" --runtime-profile=crun
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -277,9 +277,9 @@ function teardown() {
 	# Verify that the hashes of the blobs and index match (blobs are
 	# content-addressable so using hashes is a bit silly, but whatever).
 	known_hashes=(
-		"4e15e3699a98dddc67cb2e9aa5a6135cdf8ffcbdc7963daf959395f73dd52849  $IMAGE/index.json"
-		"54d5cbf998d9b1185628128d83af76ca18425f037ef9f79e6900f7e26985c169  $IMAGE/blobs/sha256/54d5cbf998d9b1185628128d83af76ca18425f037ef9f79e6900f7e26985c169"
-		"e7013826daf8b5d68f82c5b790ca5e9de222a834f2cb3fe3532030161bd72083  $IMAGE/blobs/sha256/e7013826daf8b5d68f82c5b790ca5e9de222a834f2cb3fe3532030161bd72083"
+		"3082dba9cdbd85531771e3543c2cb1e18d96b4785f540f154eae1eb7d49e36d7  $IMAGE/index.json"
+		"be9e61e1bf4b22e8157231248c3fc5becacaf689cb977fd4a000efb2dd965057  $IMAGE/blobs/sha256/be9e61e1bf4b22e8157231248c3fc5becacaf689cb977fd4a000efb2dd965057"
+		"c9d94ba5b381ae0a6de394a1a7c383a95b4ae8c57a9a1d13ef4b9eb9a6cc017b  $IMAGE/blobs/sha256/c9d94ba5b381ae0a6de394a1a7c383a95b4ae8c57a9a1d13ef4b9eb9a6cc017b"
 		"f4a39a97d97aa834da7ad2d92940f9636a57e3d9b3cc7c53242451b02a6cea89  $IMAGE/blobs/sha256/f4a39a97d97aa834da7ad2d92940f9636a57e3d9b3cc7c53242451b02a6cea89"
 	)
 	sha256sum -c <(printf '%s\n' "${known_hashes[@]}")
@@ -0,0 +1,79 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci diff --json" {
+	# Unpack the image, modify a file and repack it under a new tag.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "diff test file" > "$ROOTFS/etc/passwd"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci diff --image "${IMAGE}:${TAG}" --image "${IMAGE}:${TAG}-new" --files --json
+	[ "$status" -eq 0 ]
+
+	diffFile="$(setup_tmpdir)/diff"
+	echo "$output" > "$diffFile"
+
+	# There should be exactly one new layer, and no removed ones.
+	sane_run jq -SMr '.added_layers | length' "$diffFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 1 ]
+	sane_run jq -SMr '.removed_layers | length' "$diffFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+
+	# The changed file must be listed as modified.
+	sane_run jq -SMr '.files[] | select(.path == "/etc/passwd") | .type' "$diffFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "modified" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci diff [invalid arguments]" {
+	# Missing --image arguments.
+	umoci diff
+	[ "$status" -ne 0 ]
+	umoci diff --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Too many --image arguments.
+	umoci diff --image "${IMAGE}:${TAG}" --image "${IMAGE}:${TAG}" --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Invalid tag.
+	umoci diff --image "${IMAGE}:${TAG}" --image "${IMAGE}:${INVALID_TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,71 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci fsck [missing arguments]" {
+	# Missing --layout argument.
+	umoci fsck
+	[ "$status" -ne 0 ]
+
+	# Layout path contains a ":".
+	umoci fsck --layout "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Too many positional arguments.
+	umoci fsck --layout "${IMAGE}" this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci fsck" {
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	umoci fsck --quick --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# Corrupt the largest blob (a layer) in the image.
+	sane_run sh -c "find '$IMAGE/blobs' -type f -printf '%s %p\n' | sort -n | tail -n1 | cut -d' ' -f2-"
+	[ "$status" -eq 0 ]
+	blob="$output"
+	chmod +w "$blob"
+	echo "corruption" >>"$blob"
+
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"corrupt blob: sha256:$(basename "$blob")"* ]]
+
+	# --quick doesn't read layers, so doesn't notice the corruption.
+	umoci fsck --quick --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# Remove the blob entirely.
+	rm -f "$blob"
+
+	umoci fsck --quick --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"missing blob: sha256:$(basename "$blob")"* ]]
+}
@@ -145,6 +145,14 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
 
+	umoci fsck --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci fsck"+ ]]
+
+	umoci fsck -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci fsck"+ ]]
+
 	umoci init --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci init"+ ]]
@@ -0,0 +1,68 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci raw layer" {
+	LAYER="$(setup_tmpdir)"
+	echo "hello" > "$LAYER/hello"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	umoci new --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci raw add-layer --image "${IMAGE}:${TAG}" "$UMOCI_TMPDIR/layer.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Find the layer descriptor in the manifest.
+	sane_run jq -r --arg tag "$TAG" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$(echo "$output" | cut -d: -f2)"
+	sane_run jq -r '.layers[0].digest' "${IMAGE}/blobs/sha256/$manifest"
+	[ "$status" -eq 0 ]
+	layerDigest="$output"
+
+	# The exported blob matches the descriptor.
+	umoci raw layer --image "${IMAGE}:${TAG}" --index 0 --out "$UMOCI_TMPDIR/layer.tar.gz"
+	[ "$status" -eq 0 ]
+	sane_run sha256sum "$UMOCI_TMPDIR/layer.tar.gz"
+	[ "$status" -eq 0 ]
+	[[ "sha256:$(echo "$output" | awk '{ print $1 }')" == "$layerDigest" ]]
+
+	# The decompressed layer contains the file.
+	umoci raw layer --image "${IMAGE}:${TAG}" --index 0 --decompress --out "$UMOCI_TMPDIR/layer-out.tar"
+	[ "$status" -eq 0 ]
+	sane_run tar xOf "$UMOCI_TMPDIR/layer-out.tar" ./hello
+	[ "$status" -eq 0 ]
+	[[ "$output" == "hello" ]]
+
+	# Out-of-range and missing indices are rejected.
+	umoci raw layer --image "${IMAGE}:${TAG}" --index 1 --out "$UMOCI_TMPDIR/bad"
+	[ "$status" -ne 0 ]
+	umoci raw layer --image "${IMAGE}:${TAG}" --out "$UMOCI_TMPDIR/bad"
+	[ "$status" -ne 0 ]
+}
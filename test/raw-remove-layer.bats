@@ -0,0 +1,103 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci raw remove-layer" {
+	# Create three independent layers.
+	for layer in layer1 layer2 layer3; do
+		LAYER="$(setup_tmpdir)"
+		mkdir "$LAYER/$layer"
+		echo "$layer" > "$LAYER/$layer/file"
+		sane_run tar cvfC "$UMOCI_TMPDIR/$layer.tar" "$LAYER" .
+		[ "$status" -eq 0 ]
+	done
+
+	umoci new --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	for layer in layer1 layer2 layer3; do
+		umoci raw add-layer --image "${IMAGE}:${TAG}" "$UMOCI_TMPDIR/$layer.tar"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+
+	# Remove the middle layer.
+	umoci raw remove-layer --image "${IMAGE}:${TAG}" 1
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Only the history entries of the remaining layers are left.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+	sane_run jq -SMr '[.history[] | select(.empty_layer == null)] | length' "$statFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 2 ]
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[ -f "$ROOTFS/layer1/file" ]
+	! [ -e "$ROOTFS/layer2" ]
+	[ -f "$ROOTFS/layer3/file" ]
+
+	# Out-of-range indices are rejected.
+	umoci raw remove-layer --image "${IMAGE}:${TAG}" 2
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci raw remove-layer [dependent layer]" {
+	LAYER="$(setup_tmpdir)"
+	echo "layer1" > "$LAYER/file"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer1.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	# The second layer deletes the file from the first.
+	LAYER="$(setup_tmpdir)"
+	touch "$LAYER/.wh.file"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer2.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	umoci new --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	for layer in layer1 layer2; do
+		umoci raw add-layer --image "${IMAGE}:${TAG}" "$UMOCI_TMPDIR/$layer.tar"
+		[ "$status" -eq 0 ]
+	done
+
+	umoci raw remove-layer --image "${IMAGE}:${TAG}" 0
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	umoci raw remove-layer --image "${IMAGE}:${TAG}" --force 0
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
@@ -878,3 +878,32 @@ function teardown() {
 	layers1=$(cat "${IMAGE}/oci/blobs/sha256/$manifest1" | jq -r .layers)
 	[ "$layers0" == "$layers1" ]
 }
+
+@test "umoci repack --metadata-only" {
+	# Unpack the original image
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Only change the metadata of a file.
+	chmod 0600 "$ROOTFS/etc/passwd"
+
+	umoci repack --metadata-only --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the new image and make sure the change is present.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(stat -c '%a' "$ROOTFS/etc/passwd")" == "600" ]]
+
+	# Content changes must be rejected.
+	echo "new content" >> "$ROOTFS/etc/passwd"
+	umoci repack --metadata-only --image "${IMAGE}:${TAG}-new2" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
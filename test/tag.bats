@@ -50,6 +50,33 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci list --json" {
+	umoci list --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	listFile="$(setup_tmpdir)/list"
+	echo "$output" > "$listFile"
+
+	# The tag we use must be listed, resolving to a single manifest.
+	sane_run jq -SMr --arg tag "$TAG" '.[] | select(.name == $tag) | .manifests | length' "$listFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 1 ]
+	sane_run jq -SMr --arg tag "$TAG" '.[] | select(.name == $tag) | .manifests[0].mediaType' "$listFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.oci.image.manifest.v1+json" ]]
+
+	# The number of entries must match the number of tagged index entries.
+	sane_run jq -SMr 'length' "$listFile"
+	[ "$status" -eq 0 ]
+	nrefs="$output"
+	sane_run jq -SMr '[.manifests[] | .annotations["org.opencontainers.image.ref.name"] | strings] | length' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq "$nrefs" ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci list [invalid arguments]" {
 	umoci list
 	[ "$status" -ne 0 ]
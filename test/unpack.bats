@@ -279,14 +279,37 @@ function teardown() {
 	[ "$status" -eq 0 ]
 	bundle-verify "$BUNDLE"
 
-	# At the least, check that the files exist.
-	[ -e "$ROOTFS/block1" ]
-	[ -e "$ROOTFS/block2" ]
-	[ -e "$ROOTFS/char1" ]
-	[ -e "$ROOTFS/char2" ]
+	# By default devices are skipped, but recorded in umoci.json.
+	! [ -e "$ROOTFS/block1" ]
+	! [ -e "$ROOTFS/block2" ]
+	! [ -e "$ROOTFS/char1" ]
+	! [ -e "$ROOTFS/char2" ]
+	sane_run jq -r '.skipped_devices | keys | join(" ")' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "/block1 /block2 /char1 /char2" ]]
+	sane_run jq -r '.skipped_devices["/char1"] | "\(.type) \(.major):\(.minor)"' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "char 133:37" ]]
 	# But the FIFOs should be preserved.
 	[ -p "$ROOTFS/fifo" ]
 
+	# With --rootless-no-devices=empty, devices are replaced with empty files.
+	new_bundle_rootfs
+	umoci unpack --rootless --rootless-no-devices=empty --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[ -f "$ROOTFS/block1" ]
+	[ -f "$ROOTFS/block2" ]
+	[ -f "$ROOTFS/char1" ]
+	[ -f "$ROOTFS/char2" ]
+	[ -p "$ROOTFS/fifo" ]
+
+	# With --rootless-no-devices=error, the unpack fails.
+	new_bundle_rootfs
+	umoci unpack --rootless --rootless-no-devices=error --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
 	image-verify "${IMAGE}"
 }
 
@@ -31,25 +31,61 @@ import (
 	"golang.org/x/net/context"
 )
 
-// Unpack unpacks an image to the specified bundle path.
+// Unpack unpacks an image to the specified bundle path. If fromName refers to
+// a multi-platform image index, the manifest for the host platform is
+// unpacked.
 func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackOptions layer.UnpackOptions) error {
-	var meta Meta
-	meta.Version = MetaVersion
-	meta.MapOptions = unpackOptions.MapOptions
-	meta.WhiteoutMode = unpackOptions.WhiteoutMode
+	return UnpackPlatform(engineExt, fromName, nil, bundlePath, unpackOptions)
+}
 
+// resolvePlatform resolves fromName to a single manifest. If platform is
+// non-nil, only manifests for that platform are considered. Otherwise, if the
+// reference is ambiguous (such as with a multi-platform image index) the
+// manifest for the host platform is selected.
+func resolvePlatform(engineExt casext.Engine, fromName string, platform *ispec.Platform) (casext.DescriptorPath, error) {
 	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
 	if err != nil {
-		return errors.Wrap(err, "get descriptor")
+		return casext.DescriptorPath{}, errors.Wrap(err, "get descriptor")
 	}
 	if len(fromDescriptorPaths) == 0 {
-		return errors.Errorf("tag is not found: %s", fromName)
+		return casext.DescriptorPath{}, errors.Errorf("tag is not found: %s", fromName)
+	}
+	if platform == nil && len(fromDescriptorPaths) > 1 {
+		hostPlatform := casext.HostPlatform()
+		platform = &hostPlatform
+	}
+	if platform != nil {
+		var available []string
+		for _, descriptorPath := range fromDescriptorPaths {
+			if p := descriptorPath.Platform(); p != nil {
+				available = append(available, casext.PlatformString(*p))
+			}
+		}
+		fromDescriptorPaths = casext.FilterPlatform(fromDescriptorPaths, *platform)
+		if len(fromDescriptorPaths) == 0 {
+			return casext.DescriptorPath{}, errors.Errorf("tag %s has no manifest for platform %s (available platforms: %s)", fromName, casext.PlatformString(*platform), strings.Join(available, ", "))
+		}
 	}
 	if len(fromDescriptorPaths) != 1 {
 		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
+		return casext.DescriptorPath{}, errors.Errorf("tag is ambiguous: %s", fromName)
 	}
-	meta.From = fromDescriptorPaths[0]
+	return fromDescriptorPaths[0], nil
+}
+
+// UnpackPlatform unpacks the manifest for the given platform from an image to
+// the specified bundle path. If platform is nil, this is equivalent to Unpack.
+func UnpackPlatform(engineExt casext.Engine, fromName string, platform *ispec.Platform, bundlePath string, unpackOptions layer.UnpackOptions) error {
+	var meta Meta
+	meta.Version = MetaVersion
+	meta.MapOptions = unpackOptions.MapOptions
+	meta.WhiteoutMode = unpackOptions.WhiteoutMode
+
+	fromDescriptorPath, err := resolvePlatform(engineExt, fromName, platform)
+	if err != nil {
+		return err
+	}
+	meta.From = fromDescriptorPath
 
 	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From.Descriptor())
 	if err != nil {
@@ -81,16 +117,34 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackO
 	}
 	// XXX: We should probably defer os.RemoveAll(bundlePath).
 
+	// Record any devices which cannot be created in rootless mode, as well as
+	// any FIFOs and sockets which the caller asked to record.
+	recordDevices := meta.MapOptions.Rootless && unpackOptions.RootlessDeviceMode == layer.SkipRootlessDevices
+	if unpackOptions.FifoMode == layer.RecordFifos || unpackOptions.SocketMode == layer.RecordSockets {
+		recordDevices = true
+	}
+	if recordDevices && unpackOptions.SkippedDevices == nil {
+		unpackOptions.SkippedDevices = map[string]layer.DeviceNode{}
+	}
+
 	log.Info("unpacking bundle ...")
 	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &unpackOptions); err != nil {
 		return errors.Wrap(err, "create runtime bundle")
 	}
 	log.Info("... done")
+	meta.SkippedDevices = unpackOptions.SkippedDevices
+
+	if unpackOptions.NoRuntimeConfig {
+		log.Infof("unpacked rootfs without bundle metadata: %s", bundlePath)
+		return nil
+	}
 
 	fsEval := fseval.Default
 	if meta.MapOptions.Rootless {
 		fsEval = fseval.Rootless
 	}
+	// The rootfs may contain paths longer than PATH_MAX.
+	fsEval = fseval.LongPath(fsEval)
 
 	if err := GenerateBundleManifest(mtreeName, bundlePath, fsEval); err != nil {
 		return errors.Wrap(err, "write mtree")
@@ -0,0 +1,501 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas/httpdir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// addMarkerLayer adds a layer containing a single file called "marker" with
+// the given contents to the image referenced by tagName, and returns the
+// descriptor of the new manifest.
+func addMarkerLayer(t *testing.T, engineExt casext.Engine, tagName, marker string) ispec.Descriptor {
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected error resolving %s: %+v", tagName, err)
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatalf("unexpected error creating mutator: %+v", err)
+	}
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "marker",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(marker)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(marker)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, &buffer, nil, mutate.GzipCompressor, nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing layer: %+v", err)
+	}
+	return newDescriptorPath.Descriptor()
+}
+
+// setupMultiPlatformImage creates a new image layout inside the given
+// directory with a tag "multi" referencing an image index with one manifest
+// for each of the given platforms. Each manifest has a single layer containing
+// a "marker" file whose contents are the platform string.
+func setupMultiPlatformImage(t *testing.T, dir string, platforms ...string) casext.Engine {
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+
+	index := ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+	}
+	for _, platformStr := range platforms {
+		platform, err := casext.ParsePlatform(platformStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewImage(engineExt, "tmp"); err != nil {
+			t.Fatalf("unexpected error creating image: %+v", err)
+		}
+		descriptor := addMarkerLayer(t, engineExt, "tmp", platformStr)
+		descriptor.Platform = &platform
+		index.Manifests = append(index.Manifests, descriptor)
+	}
+	if err := engineExt.DeleteReference(context.Background(), "tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(context.Background(), index)
+	if err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+	if err := engineExt.UpdateReference(context.Background(), "multi", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}); err != nil {
+		t.Fatalf("unexpected error tagging index: %+v", err)
+	}
+	return engineExt
+}
+
+func TestUnpackPlatform(t *testing.T) {
+	host := casext.PlatformString(casext.HostPlatform())
+	// Make sure that neither of the platforms is the host platform by
+	// accident, so that the default selection is tested properly.
+	other := "linux/umoci-test-arch"
+
+	for _, test := range []struct {
+		name     string
+		platform string
+		marker   string
+	}{
+		{"Host", "", host},
+		{"Explicit", other, other},
+		{"ExplicitHost", host, host},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackPlatform")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			engineExt := setupMultiPlatformImage(t, dir, other, host)
+			defer engineExt.Close()
+
+			var platform *ispec.Platform
+			if test.platform != "" {
+				p, err := casext.ParsePlatform(test.platform)
+				if err != nil {
+					t.Fatal(err)
+				}
+				platform = &p
+			}
+
+			bundle := filepath.Join(dir, "bundle")
+			unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+			if err := UnpackPlatform(engineExt, "multi", platform, bundle, unpackOptions); err != nil {
+				t.Fatalf("unexpected error unpacking: %+v", err)
+			}
+
+			marker, err := ioutil.ReadFile(filepath.Join(bundle, layer.RootfsName, "marker"))
+			if err != nil {
+				t.Fatalf("unexpected error reading marker: %+v", err)
+			}
+			if string(marker) != test.marker {
+				t.Errorf("wrong manifest unpacked: expected marker %q, got %q", test.marker, string(marker))
+			}
+		})
+	}
+}
+
+func TestUnpackPlatformNoMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackPlatformNoMatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Neither platform matches the host, so the default selection must fail.
+	engineExt := setupMultiPlatformImage(t, dir, "linux/umoci-test-a", "linux/umoci-test-b")
+	defer engineExt.Close()
+
+	bundle := filepath.Join(dir, "bundle")
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	if err := Unpack(engineExt, "multi", bundle, unpackOptions); err == nil {
+		t.Errorf("expected error unpacking index without host platform")
+	}
+
+	platform := ispec.Platform{OS: "linux", Architecture: "umoci-test-c"}
+	if err := UnpackPlatform(engineExt, "multi", &platform, bundle, unpackOptions); err == nil {
+		t.Errorf("expected error unpacking index without requested platform")
+	}
+}
+
+func TestUnpackDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackDigest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+	defer engineExt.Close()
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	tagged := addMarkerLayer(t, engineExt, "latest", "tagged")
+	if err := engineExt.UpdateReference(context.Background(), "latest", tagged); err != nil {
+		t.Fatalf("unexpected error tagging image: %+v", err)
+	}
+	// The returned manifest is not referenced by any tag.
+	untagged := addMarkerLayer(t, engineExt, "latest", "untagged")
+
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	unpack := func(name, ref string) string {
+		bundle := filepath.Join(dir, name)
+		if err := Unpack(engineExt, ref, bundle, unpackOptions); err != nil {
+			t.Fatalf("unexpected error unpacking %s: %+v", ref, err)
+		}
+		marker, err := ioutil.ReadFile(filepath.Join(bundle, layer.RootfsName, "marker"))
+		if err != nil {
+			t.Fatalf("unexpected error reading marker: %+v", err)
+		}
+		return string(marker)
+	}
+
+	byTag := unpack("bundle-tag", "latest")
+	byDigest := unpack("bundle-digest", casext.DigestReference(tagged.Digest))
+	if byTag != byDigest {
+		t.Errorf("unpacking by digest differs from unpacking by tag: %q != %q", byDigest, byTag)
+	}
+	tagConfig, err := ioutil.ReadFile(filepath.Join(dir, "bundle-tag", "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digestConfig, err := ioutil.ReadFile(filepath.Join(dir, "bundle-digest", "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tagConfig, digestConfig) {
+		t.Errorf("runtime config differs between unpacking by digest and by tag")
+	}
+
+	if marker := unpack("bundle-untagged", casext.DigestReference(untagged.Digest)); marker != "untagged" {
+		t.Errorf("wrong manifest unpacked: expected marker %q, got %q", "untagged", marker)
+	}
+
+	// Layer blobs are not manifests, and unknown digests must be rejected.
+	manifest := getManifest(t, engineExt, casext.DigestReference(untagged.Digest))
+	for _, ref := range []string{
+		casext.DigestReference(manifest.Layers[0].Digest),
+		casext.DigestReference(digest.FromString("does not exist")),
+		"@sha256:invalid",
+	} {
+		if err := Unpack(engineExt, ref, filepath.Join(dir, "bundle-bad"), unpackOptions); err == nil {
+			t.Errorf("expected error unpacking %s", ref)
+		}
+		os.RemoveAll(filepath.Join(dir, "bundle-bad"))
+	}
+}
+
+func TestUnpackNoRuntimeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackNoRuntimeConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+	defer engineExt.Close()
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	tagged := addMarkerLayer(t, engineExt, "latest", "marker")
+	if err := engineExt.UpdateReference(context.Background(), "latest", tagged); err != nil {
+		t.Fatalf("unexpected error tagging image: %+v", err)
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.UnpackOptions{
+		MapOptions:      testMapOptions(),
+		NoRuntimeConfig: true,
+	}); err != nil {
+		t.Fatalf("unexpected error unpacking: %+v", err)
+	}
+
+	// Only the rootfs should have been created.
+	fis, err := ioutil.ReadDir(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if len(names) != 1 || names[0] != layer.RootfsName {
+		t.Errorf("unexpected bundle contents: expected only %s, got %v", layer.RootfsName, names)
+	}
+	if marker, err := ioutil.ReadFile(filepath.Join(bundle, layer.RootfsName, "marker")); err != nil {
+		t.Errorf("unexpected error reading marker: %+v", err)
+	} else if string(marker) != "marker" {
+		t.Errorf("unexpected marker contents: %q", marker)
+	}
+}
+
+func TestUnpackHTTPLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackHTTPLayout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "image")
+	engineExt, err := CreateLayout(image)
+	if err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	descriptor := addMarkerLayer(t, engineExt, "latest", "served over http")
+	if err := engineExt.UpdateReference(context.Background(), "latest", descriptor); err != nil {
+		t.Fatalf("unexpected error tagging image: %+v", err)
+	}
+	engineExt.Close()
+
+	server := httptest.NewServer(http.FileServer(http.Dir(image)))
+	defer server.Close()
+
+	engine, err := httpdir.Open(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error opening http layout: %+v", err)
+	}
+	defer engine.Close()
+
+	bundle := filepath.Join(dir, "bundle")
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions()}
+	if err := Unpack(casext.NewEngine(engine), "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking from http layout: %+v", err)
+	}
+
+	marker, err := ioutil.ReadFile(filepath.Join(bundle, layer.RootfsName, "marker"))
+	if err != nil {
+		t.Fatalf("unexpected error reading marker: %+v", err)
+	}
+	if string(marker) != "served over http" {
+		t.Errorf("unexpected marker contents: %q", string(marker))
+	}
+}
+
+func TestUnpackRuntimePreview(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackRuntimePreview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+	defer engineExt.Close()
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	// Set up a config which affects most of the runtime config.
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), "latest")
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected error resolving latest: %+v", err)
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.User = "1337:8888"
+	config.WorkingDir = "/srv"
+	config.Env = []string{"PATH=/bin", "VARIABLE=preview"}
+	config.Entrypoint = []string{"/bin/sh", "-c"}
+	config.Cmd = []string{"echo preview"}
+	config.Volumes = map[string]struct{}{"/volume": {}}
+	config.Labels = map[string]string{"label": "value"}
+	if err := mutator.Set(context.Background(), config, meta, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.CommitReference(context.Background(), "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	mapOptions := testMapOptions()
+	bundle := filepath.Join(dir, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.UnpackOptions{MapOptions: mapOptions}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	unpacked, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var preview bytes.Buffer
+	image := ispec.Image{
+		Config:       config,
+		Created:      &meta.Created,
+		Author:       meta.Author,
+		Architecture: meta.Architecture,
+		OS:           meta.OS,
+	}
+	if err := layer.PreviewRuntimeJSON(&preview, image, &mapOptions, layer.RuncRuntimeProfile); err != nil {
+		t.Fatalf("unexpected error previewing runtime config: %+v", err)
+	}
+	if !bytes.Equal(preview.Bytes(), unpacked) {
+		t.Errorf("preview does not match unpacked config.json:\npreview:\n%s\nunpacked:\n%s", preview.Bytes(), unpacked)
+	}
+}
+
+func TestUnpackNetworkPlaceholders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackNetworkPlaceholders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The bundle from setupBundle was unpacked without placeholders.
+	engineExt, bundle := setupBundle(t, dir)
+	defer engineExt.Close()
+	for _, name := range []string{"etc/resolv.conf", "etc/hosts"} {
+		if _, err := os.Lstat(filepath.Join(bundle, layer.RootfsName, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to not exist without placeholders: %v", name, err)
+		}
+	}
+
+	unpackOptions := layer.UnpackOptions{MapOptions: testMapOptions(), NetworkPlaceholders: true}
+	emptyBundle := filepath.Join(dir, "bundle-empty")
+	if err := Unpack(engineExt, "latest", emptyBundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking: %+v", err)
+	}
+	for _, name := range []string{"etc/resolv.conf", "etc/hosts"} {
+		fi, err := os.Lstat(filepath.Join(emptyBundle, layer.RootfsName, name))
+		if err != nil {
+			t.Errorf("expected placeholder %s to exist: %v", name, err)
+		} else if !fi.Mode().IsRegular() || fi.Size() != 0 {
+			t.Errorf("expected placeholder %s to be an empty file: mode=%v size=%d", name, fi.Mode(), fi.Size())
+		}
+	}
+
+	// Placeholders must not replace existing paths in the image, including
+	// dangling symlinks.
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc/hosts"), []byte("127.0.0.1 image\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../run/resolv.conf", filepath.Join(rootfs, "etc/resolv.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackBundle(t, engineExt, "latest", bundle, nil); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	fullBundle := filepath.Join(dir, "bundle-full")
+	if err := Unpack(engineExt, "latest", fullBundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking: %+v", err)
+	}
+	if hosts, err := ioutil.ReadFile(filepath.Join(fullBundle, layer.RootfsName, "etc/hosts")); err != nil || string(hosts) != "127.0.0.1 image\n" {
+		t.Errorf("existing /etc/hosts was modified: %q (%v)", hosts, err)
+	}
+	if target, err := os.Readlink(filepath.Join(fullBundle, layer.RootfsName, "etc/resolv.conf")); err != nil || target != "../run/resolv.conf" {
+		t.Errorf("existing /etc/resolv.conf symlink was modified: %q (%v)", target, err)
+	}
+	if _, err := os.Lstat(filepath.Join(fullBundle, layer.RootfsName, "run/resolv.conf")); !os.IsNotExist(err) {
+		t.Errorf("placeholder was created through symlink: %v", err)
+	}
+
+	// The placeholders are part of the bundle's mtree manifest, so they are
+	// not included in a repacked layer.
+	err = repackBundle(t, engineExt, "latest", emptyBundle, &layer.RepackOptions{FailOnNoChange: true})
+	if errors.Cause(err) != layer.ErrNoChanges {
+		t.Errorf("expected placeholders to not be repacked: %+v", err)
+	}
+}
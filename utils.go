@@ -93,6 +93,15 @@ type Meta struct {
 	// WhiteoutMode indicates what style of whiteout was written to disk
 	// when this filesystem was extracted.
 	WhiteoutMode layer.WhiteoutMode `json:"whiteout_mode"`
+
+	// SkippedDevices are the device nodes in the image which were not
+	// created in the rootfs, because device nodes cannot be created in
+	// rootless mode (see layer.SkipRootlessDevices), as well as any FIFOs
+	// and sockets which were recorded rather than created (see
+	// layer.RecordFifos and layer.RecordSockets). Since they are also missing
+	// from the mtree manifest of the bundle, umoci-repack(1) does not remove
+	// them from the image.
+	SkippedDevices map[string]layer.DeviceNode `json:"skipped_devices,omitempty"`
 }
 
 // WriteTo writes a JSON-serialised version of Meta to the given io.Writer.
@@ -143,6 +152,14 @@ type ManifestStat struct {
 
 	// History stores the history information for the manifest.
 	History []historyStat `json:"history"`
+
+	// Config is the runtime configuration (environment, entrypoint, labels
+	// and so on) of the image.
+	Config ispec.ImageConfig `json:"config"`
+
+	// Size is the total (compressed) size of the layers of the image, as
+	// recorded in the manifest.
+	Size int64 `json:"size"`
 }
 
 // Format formats a ManifestStat using the default formatting, and writes the
@@ -225,6 +242,20 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 
 	// TODO: This should probably be moved into separate functions.
 
+	// Only the manifest and config are needed, so stat never reads any layer
+	// blobs (the sizes come from the layer descriptors). This keeps stat cheap
+	// for remote images.
+	stat.Config = config.Config
+	for _, desc := range manifest.Layers {
+		stat.Size += desc.Size
+	}
+
+	// Make sure the history can be matched up with the layers, so that broken
+	// images result in a descriptive error.
+	if err := layer.CheckDiffIDs(manifest, config); err != nil {
+		return stat, errors.Wrap(err, "stat")
+	}
+
 	// Generate the history of the image. Because the config.History entries
 	// are in the same order as the manifest.Layer entries this is fairly
 	// simple. However, we only increment the layer index if a layer was
@@ -240,6 +271,9 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		// Only fill the other information and increment layerIdx if it's a
 		// non-empty layer.
 		if !histEntry.EmptyLayer {
+			if layerIdx >= len(manifest.Layers) {
+				return stat, errors.Wrapf(layer.ErrHistoryMismatch, "stat: config has more non-empty history entries than the %d layers in the manifest", len(manifest.Layers))
+			}
 			info.DiffID = config.RootFS.DiffIDs[layerIdx].String()
 			info.Layer = &manifest.Layers[layerIdx]
 			layerIdx++
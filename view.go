@@ -0,0 +1,41 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package umoci
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"golang.org/x/net/context"
+)
+
+// OpenImageView returns a read-only view of the merged contents of the image
+// referenced by fromName, which can be used to read individual files without
+// unpacking the image. If fromName refers to a multi-platform image index,
+// the manifest for the given platform (or the host platform if platform is
+// nil) is used.
+func OpenImageView(engineExt casext.Engine, fromName string, platform *ispec.Platform) (*layer.ImageView, error) {
+	fromDescriptorPath, err := resolvePlatform(engineExt, fromName, platform)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readManifest(context.Background(), engineExt, fromDescriptorPath.Descriptor())
+	if err != nil {
+		return nil, err
+	}
+	return layer.NewImageView(engineExt, manifest), nil
+}
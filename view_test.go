@@ -0,0 +1,72 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package umoci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestOpenImageView(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestOpenImageView")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatalf("unexpected error creating layout: %+v", err)
+	}
+	defer engineExt.Close()
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	// The marker is overwritten by the second layer.
+	for _, marker := range []string{"lower", "upper"} {
+		tagged := addMarkerLayer(t, engineExt, "latest", marker)
+		if err := engineExt.UpdateReference(context.Background(), "latest", tagged); err != nil {
+			t.Fatalf("unexpected error tagging image: %+v", err)
+		}
+	}
+
+	view, err := OpenImageView(engineExt, "latest", nil)
+	if err != nil {
+		t.Fatalf("unexpected error opening image view: %+v", err)
+	}
+	rc, err := view.Open(context.Background(), "/marker")
+	if err != nil {
+		t.Fatalf("unexpected error opening marker: %+v", err)
+	}
+	defer rc.Close()
+	marker, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("unexpected error reading marker: %+v", err)
+	}
+	if string(marker) != "upper" {
+		t.Errorf("expected higher layer to win: expected %q, got %q", "upper", marker)
+	}
+
+	if _, err := OpenImageView(engineExt, "nonexistent", nil); err == nil {
+		t.Errorf("expected error opening view of non-existent tag")
+	}
+}